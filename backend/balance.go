@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Balance entry kinds
+const (
+	BalanceKindGiftCertificate = "gift_certificate"
+	BalanceKindReferral        = "referral"
+	BalanceKindSession         = "session"        // spent on a booking
+	BalanceKindSessionReturn   = "session_return" // returned on cancellation
+)
+
+// Gift certificate statuses
+const (
+	GiftCertificateStatusPending   = "pending" // waiting for payment
+	GiftCertificateStatusActive    = "active"
+	GiftCertificateStatusRedeemed  = "redeemed"
+	GiftCertificateStatusCancelled = "cancelled"
+)
+
+const giftCertificateValidity = 365 * 24 * time.Hour
+
+// BalanceEntry changes the prepaid balance of a client. The balance is the
+// sum of the entries; Reference keeps each credit or spend unique.
+type BalanceEntry struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	UserID      uint      `json:"user_id" gorm:"not null;index"`
+	Amount      int       `json:"amount"` // in kopecks, negative when spent
+	Kind        string    `json:"kind"`
+	Reference   string    `json:"-" gorm:"uniqueIndex;not null"`
+	SessionID   *uint     `json:"session_id,omitempty" gorm:"index"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type GiftCertificate struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	Code           string     `json:"code,omitempty" gorm:"uniqueIndex;not null"`
+	Amount         int        `json:"amount"` // in kopecks
+	PurchaserID    uint       `json:"purchaser_id" gorm:"not null;index"`
+	PaymentID      *uint      `json:"payment_id,omitempty"`
+	RecipientName  string     `json:"recipient_name,omitempty"`
+	RecipientEmail string     `json:"recipient_email,omitempty"`
+	Message        string     `json:"message,omitempty"`
+	Status         string     `json:"status" gorm:"default:pending;index"`
+	RedeemedBy     *uint      `json:"redeemed_by,omitempty"`
+	RedeemedAt     *time.Time `json:"redeemed_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+type GiftCertificateRequest struct {
+	Amount         int    `json:"amount" binding:"required,min=50000,max=10000000"` // in kopecks
+	RecipientName  string `json:"recipient_name"`
+	RecipientEmail string `json:"recipient_email" binding:"omitempty,email"`
+	Message        string `json:"message" binding:"max=500"`
+	Provider       string `json:"provider"`
+	ReturnURL      string `json:"return_url"`
+}
+
+type GiftCertificatePurchaseResponse struct {
+	GiftCertificate GiftCertificate `json:"gift_certificate"`
+	Payment         Payment         `json:"payment"`
+}
+
+type RedeemRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type BalanceResponse struct {
+	Balance int `json:"balance"` // in kopecks
+}
+
+var errGiftCertificateInvalid = errors.New("gift certificate cannot be redeemed")
+
+// userBalance sums the entries of the user
+func userBalance(tx *gorm.DB, userID uint) (int, error) {
+	var balance int
+	err := tx.Model(&BalanceEntry{}).Where("user_id = ?", userID).
+		Select("COALESCE(SUM(amount), 0)").Scan(&balance).Error
+	return balance, err
+}
+
+// creditBalance adds money to the balance, once per reference
+func creditBalance(tx *gorm.DB, userID uint, amount int, kind, reference, description string) error {
+	entry := BalanceEntry{UserID: userID, Amount: amount, Kind: kind, Reference: reference, Description: description}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry).Error
+}
+
+// spendBalance pays up to the session price from the client balance. The
+// user row is locked, so concurrent bookings cannot spend the balance twice.
+func spendBalance(tx *gorm.DB, session *Session) error {
+	var user User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, session.ClientID).Error; err != nil {
+		return err
+	}
+	balance, err := userBalance(tx, session.ClientID)
+	if err != nil {
+		return err
+	}
+	amount := balance
+	if amount > session.Price {
+		amount = session.Price
+	}
+	if amount <= 0 {
+		return nil
+	}
+
+	entry := BalanceEntry{
+		UserID:      session.ClientID,
+		Amount:      -amount,
+		Kind:        BalanceKindSession,
+		Reference:   fmt.Sprintf("session:%d", session.ID),
+		SessionID:   &session.ID,
+		Description: fmt.Sprintf("Оплата сессии №%d", session.ID),
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return err
+	}
+
+	session.BalanceUsed = amount
+	if err := tx.Save(session).Error; err != nil {
+		return err
+	}
+	return postPrepaymentUsage(tx, fmt.Sprintf("balance:%d", entry.ID), session.TherapistID, &session.ID, amount, entry.Description)
+}
+
+// returnBalance gives back percent of the balance spent on a cancelled session
+func returnBalance(tx *gorm.DB, session *Session, percent int) error {
+	amount := session.BalanceUsed * percent / 100
+	if amount <= 0 {
+		return nil
+	}
+
+	entry := BalanceEntry{
+		UserID:      session.ClientID,
+		Amount:      amount,
+		Kind:        BalanceKindSessionReturn,
+		Reference:   fmt.Sprintf("session-return:%d", session.ID),
+		SessionID:   &session.ID,
+		Description: fmt.Sprintf("Возврат за сессию №%d", session.ID),
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return postPrepaymentUsage(tx, fmt.Sprintf("balance-return:%d", entry.ID), session.TherapistID, &session.ID, -amount, entry.Description)
+}
+
+// releaseSessionDiscounts undoes the promo code and returns percent of the
+// balance when a session is cancelled
+func releaseSessionDiscounts(tx *gorm.DB, session *Session, percent int) error {
+	if err := releasePromoCode(tx, session.ID); err != nil {
+		return err
+	}
+	return returnBalance(tx, session, percent)
+}
+
+// randomCode makes n random characters without look-alikes such as 0 and O
+func randomCode(n int) (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	for i, b := range raw {
+		raw[i] = alphabet[int(b)%len(alphabet)]
+	}
+	return string(raw), nil
+}
+
+// newGiftCode makes a code like GIFT-7KQ2-M9XD
+func newGiftCode() (string, error) {
+	code, err := randomCode(8)
+	if err != nil {
+		return "", err
+	}
+	return "GIFT-" + code[:4] + "-" + code[4:], nil
+}
+
+// activateGiftCertificate makes a paid certificate redeemable for a year
+func activateGiftCertificate(tx *gorm.DB, certificateID uint) error {
+	expires := time.Now().Add(giftCertificateValidity)
+	return tx.Model(&GiftCertificate{}).
+		Where("id = ? AND status = ?", certificateID, GiftCertificateStatusPending).
+		Updates(map[string]interface{}{"status": GiftCertificateStatusActive, "expires_at": expires}).Error
+}
+
+// redeemGiftCertificate moves the certificate amount to the user balance. The
+// money stays a client prepayment, it only changes hands.
+func redeemGiftCertificate(userID uint, code string) (*GiftCertificate, error) {
+	var certificate GiftCertificate
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).First(&certificate).Error; err != nil {
+			return errGiftCertificateInvalid
+		}
+		if certificate.Status != GiftCertificateStatusActive ||
+			(certificate.ExpiresAt != nil && time.Now().After(*certificate.ExpiresAt)) {
+			return errGiftCertificateInvalid
+		}
+
+		now := time.Now()
+		certificate.Status = GiftCertificateStatusRedeemed
+		certificate.RedeemedBy = &userID
+		certificate.RedeemedAt = &now
+		if err := tx.Save(&certificate).Error; err != nil {
+			return err
+		}
+		return creditBalance(tx, userID, certificate.Amount, BalanceKindGiftCertificate,
+			fmt.Sprintf("gift:%d", certificate.ID), "Подарочный сертификат "+certificate.Code)
+	})
+	return &certificate, err
+}
+
+// Handlers
+func getBalance(c *gin.Context) {
+	balance, err := userBalance(db, c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке баланса",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    BalanceResponse{Balance: balance},
+	})
+}
+
+func getBalanceEntries(c *gin.Context) {
+	limit := cursorLimit(c, 20, 100)
+	query, err := paginateByID(db.Model(&BalanceEntry{}).Where("user_id = ?", c.GetUint("user_id")), c, "balance_entries", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var entries []BalanceEntry
+	if err := query.Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке операций",
+		})
+		return
+	}
+
+	entries, meta := pageByID(entries, limit, func(e BalanceEntry) uint { return e.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    entries,
+		Meta:    meta,
+	})
+}
+
+func purchaseGiftCertificate(c *gin.Context) {
+	var req GiftCertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+	if _, ok := paymentProvider(req.Provider); !ok {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неизвестный платёжный провайдер",
+		})
+		return
+	}
+
+	code, err := newGiftCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при генерации кода",
+		})
+		return
+	}
+
+	userID := c.GetUint("user_id")
+	certificate := GiftCertificate{
+		Code:           code,
+		Amount:         req.Amount,
+		PurchaserID:    userID,
+		RecipientName:  req.RecipientName,
+		RecipientEmail: req.RecipientEmail,
+		Message:        req.Message,
+		Status:         GiftCertificateStatusPending,
+	}
+	var payment Payment
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&certificate).Error; err != nil {
+			return err
+		}
+		payment = Payment{
+			GiftCertificateID: &certificate.ID,
+			UserID:            userID,
+			Amount:            certificate.Amount,
+			Currency:          settlementCurrency,
+			Status:            PaymentStatusPending,
+			Provider:          req.Provider,
+			Description:       "Подарочный сертификат на " + formatRoubles(certificate.Amount) + " ₽",
+		}
+		if payment.Provider == "" {
+			payment.Provider = defaultPaymentProvider
+		}
+		if err := tx.Create(&payment).Error; err != nil {
+			return err
+		}
+		certificate.PaymentID = &payment.ID
+		return tx.Save(&certificate).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при покупке сертификата",
+		})
+		return
+	}
+
+	returnURL := req.ReturnURL
+	if returnURL == "" {
+		returnURL = fmt.Sprintf("%s/gift-certificates/%d", getEnv("FRONTEND_URL", "http://localhost:3000"), certificate.ID)
+	}
+	if err := startPayment(c.Request.Context(), &payment, returnURL); err != nil {
+		log.Printf("Failed to start payment %d: %v", payment.ID, err)
+		c.JSON(http.StatusBadGateway, ApiResponse{
+			Success: false,
+			Error:   "Платёжная система недоступна, попробуйте позже",
+		})
+		return
+	}
+
+	db.First(&certificate, certificate.ID)
+	// The code is shown once the certificate is paid
+	if certificate.Status == GiftCertificateStatusPending {
+		certificate.Code = ""
+	}
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data: GiftCertificatePurchaseResponse{
+			GiftCertificate: certificate,
+			Payment:         payment,
+		},
+	})
+}
+
+func getGiftCertificates(c *gin.Context) {
+	var certificates []GiftCertificate
+	if err := db.Where("purchaser_id = ?", c.GetUint("user_id")).Order("id DESC").Find(&certificates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке сертификатов",
+		})
+		return
+	}
+	for i := range certificates {
+		if certificates[i].Status == GiftCertificateStatusPending || certificates[i].Status == GiftCertificateStatusCancelled {
+			certificates[i].Code = ""
+		}
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    certificates,
+	})
+}
+
+func redeemGiftCertificateHandler(c *gin.Context) {
+	var req RedeemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	userID := c.GetUint("user_id")
+	certificate, err := redeemGiftCertificate(userID, req.Code)
+	if errors.Is(err, errGiftCertificateInvalid) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Сертификат не найден, уже использован или истёк",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при активации сертификата",
+		})
+		return
+	}
+
+	balance, _ := userBalance(db, userID)
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data: gin.H{
+			"gift_certificate": certificate,
+			"balance":          balance,
+		},
+	})
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CancellationTier refunds RefundPercent when the client cancels at least
+// MinHoursBefore hours before the session starts
+type CancellationTier struct {
+	MinHoursBefore int `json:"min_hours_before" binding:"min=0"`
+	RefundPercent  int `json:"refund_percent" binding:"min=0,max=100"`
+}
+
+type CancellationPolicy struct {
+	ID                  uint               `json:"id" gorm:"primaryKey"`
+	TherapistID         uint               `json:"therapist_id" gorm:"uniqueIndex;not null"`
+	Tiers               []CancellationTier `json:"tiers" gorm:"serializer:json"`
+	NoShowRefundPercent int                `json:"no_show_refund_percent"`
+	// How many times a session may be moved and how many hours ahead of
+	// both the old and the new start time
+	RescheduleLimit       int       `json:"reschedule_limit" gorm:"default:2"`
+	RescheduleNoticeHours int       `json:"reschedule_notice_hours" gorm:"default:24"`
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+type CancellationPolicyRequest struct {
+	Tiers                 []CancellationTier `json:"tiers" binding:"required,dive"`
+	NoShowRefundPercent   int                `json:"no_show_refund_percent" binding:"min=0,max=100"`
+	RescheduleLimit       *int               `json:"reschedule_limit" binding:"omitempty,min=0"`
+	RescheduleNoticeHours *int               `json:"reschedule_notice_hours" binding:"omitempty,min=0"`
+}
+
+type CancelSessionRequest struct {
+	Reason string `json:"reason"`
+}
+
+type CancelSessionResponse struct {
+	Session       Session `json:"session"`
+	RefundPercent int     `json:"refund_percent"`
+	// Sessions paid with a package credit get the credit back instead of a refund
+	CreditReturned bool    `json:"credit_returned,omitempty"`
+	Refund         *Refund `json:"refund,omitempty"`
+	RefundError    string  `json:"refund_error,omitempty"`
+}
+
+// Who cancelled a session, as in the frontend Session type
+const (
+	CancelledByClient    = "client"
+	CancelledByTherapist = "therapist"
+	CancelledBySystem    = "system"
+)
+
+// defaultCancellationPolicy applies to therapists without their own policy:
+// full refund more than 24 hours ahead, half within 24 hours, none for no-show
+var defaultCancellationPolicy = CancellationPolicy{
+	Tiers: []CancellationTier{
+		{MinHoursBefore: 24, RefundPercent: 100},
+		{MinHoursBefore: 0, RefundPercent: 50},
+	},
+	NoShowRefundPercent:   0,
+	RescheduleLimit:       2,
+	RescheduleNoticeHours: 24,
+}
+
+var errSessionNotCancellable = errors.New("session cannot be cancelled")
+
+func therapistCancellationPolicy(tx *gorm.DB, therapistID uint) CancellationPolicy {
+	var policy CancellationPolicy
+	if err := tx.Where("therapist_id = ?", therapistID).First(&policy).Error; err != nil {
+		policy = defaultCancellationPolicy
+		policy.TherapistID = therapistID
+	}
+	return policy
+}
+
+// refundPercent picks the tier with the largest notice the client has given
+func (p CancellationPolicy) refundPercent(startTime, cancelledAt time.Time) int {
+	hoursBefore := startTime.Sub(cancelledAt).Hours()
+	tiers := append([]CancellationTier(nil), p.Tiers...)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinHoursBefore > tiers[j].MinHoursBefore })
+	for _, tier := range tiers {
+		if hoursBefore >= float64(tier.MinHoursBefore) {
+			return tier.RefundPercent
+		}
+	}
+	return 0
+}
+
+// sessionRole tells how the user takes part in the session: client, therapist or admin
+func sessionRole(c *gin.Context, session *Session) string {
+	if c.GetString("user_role") == "admin" {
+		return "admin"
+	}
+	userID := c.GetUint("user_id")
+	if session.ClientID == userID {
+		return "client"
+	}
+	var therapist Therapist
+	if db.Where("user_id = ?", userID).First(&therapist).Error == nil && therapist.ID == session.TherapistID {
+		return "therapist"
+	}
+	return ""
+}
+
+// cancelSessionWithRefund cancels the session and refunds its payment
+// according to the therapist policy. status is either cancelled or no_show.
+func cancelSessionWithRefund(c *gin.Context, sessionID uint, status, cancelledBy, reason string) (*CancelSessionResponse, error) {
+	var session Session
+	var percent int
+	var creditReturned bool
+	var unpaid []Payment
+	var refund *Refund
+	var paid *Payment
+	now := time.Now()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, sessionID).Error; err != nil {
+			return err
+		}
+		if session.Status != SessionStatusScheduled && session.Status != SessionStatusConfirmed {
+			return errSessionNotCancellable
+		}
+
+		policy := therapistCancellationPolicy(tx, session.TherapistID)
+		switch {
+		case status == SessionStatusNoShow:
+			percent = policy.NoShowRefundPercent
+		case cancelledBy == CancelledByClient:
+			percent = policy.refundPercent(session.StartTime, now)
+		default:
+			// Therapist and platform cancellations are always refunded in full
+			percent = 100
+		}
+
+		// A session paid with a package credit gets the credit back only
+		// when it would be refunded in full
+		if session.ClientPackageID != nil && percent == 100 {
+			returned, err := returnCredit(tx, &session)
+			if err != nil {
+				return err
+			}
+			creditReturned = returned
+		}
+
+		if err := releaseSessionDiscounts(tx, &session, percent); err != nil {
+			return err
+		}
+
+		if err := cancelSessionReminders(tx, session.ID); err != nil {
+			return err
+		}
+
+		session.Status = status
+		session.CancelledBy = cancelledBy
+		session.CancelledReason = reason
+		session.CancelledAt = &now
+		if err := tx.Save(&session).Error; err != nil {
+			return err
+		}
+		if err := recordSessionEvent(tx, EventSessionCancelled, &session); err != nil {
+			return err
+		}
+
+		// An unpaid booking just drops its pending payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("session_id = ? AND status IN ?", session.ID, []string{PaymentStatusPending, PaymentStatusProcessing}).
+			Find(&unpaid).Error; err != nil {
+			return err
+		}
+		for i := range unpaid {
+			if err := applyPaymentStatus(tx, &unpaid[i], PaymentStatusCancelled, "session_cancelled"); err != nil {
+				return err
+			}
+		}
+
+		// The refund is reserved with the cancellation, the provider is
+		// called once it commits
+		if percent == 0 || session.ClientPackageID != nil {
+			return nil
+		}
+		var payment Payment
+		err := tx.Where("session_id = ? AND status IN ?", session.ID,
+			[]string{PaymentStatusCompleted, PaymentStatusPartiallyRefunded}).First(&payment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// What earlier partial refunds left is the most that can be returned
+		amount := min(payment.Amount*percent/100, refundable(&payment))
+		if amount <= 0 {
+			return nil
+		}
+		refund, paid, err = reserveRefund(tx, payment.ID, amount, "session_"+status+": "+reason)
+		if errors.Is(err, errNothingToRefund) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cancelProviderPayments(c.Request.Context(), unpaid)
+
+	notifyOtherParties(db, &session, NotificationSessionCancelled, cancelledBy)
+
+	response := &CancelSessionResponse{Session: session, RefundPercent: percent, CreditReturned: creditReturned}
+	if refund != nil {
+		// A refund the provider could not be reached for stays pending and
+		// is retried; one it declined is kept as failed for the support team
+		response.Refund, err = submitRefund(c.Request.Context(), refund, paid)
+		if err != nil {
+			log.Printf("Refund for session %d failed: %v", session.ID, err)
+			response.RefundError = "Не удалось выполнить возврат, обратитесь в поддержку"
+		}
+	}
+	return response, nil
+}
+
+// Handlers
+func getCancellationPolicy(c *gin.Context) {
+	var therapist Therapist
+	if err := db.First(&therapist, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Therapist not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    therapistCancellationPolicy(db, therapist.ID),
+	})
+}
+
+func updateCancellationPolicy(c *gin.Context) {
+	var therapist Therapist
+	if err := db.First(&therapist, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Therapist not found",
+		})
+		return
+	}
+
+	if c.GetString("user_role") != "admin" && therapist.UserID != c.GetUint("user_id") {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Недостаточно прав",
+		})
+		return
+	}
+
+	var req CancellationPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var policy CancellationPolicy
+	db.Where("therapist_id = ?", therapist.ID).First(&policy)
+	policy.TherapistID = therapist.ID
+	policy.Tiers = req.Tiers
+	policy.NoShowRefundPercent = req.NoShowRefundPercent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Create the row first: gorm replaces zero values with column defaults
+		// on insert, and a zero reschedule limit is a valid setting
+		if policy.ID == 0 {
+			policy.RescheduleLimit = defaultCancellationPolicy.RescheduleLimit
+			policy.RescheduleNoticeHours = defaultCancellationPolicy.RescheduleNoticeHours
+			if err := tx.Create(&policy).Error; err != nil {
+				return err
+			}
+		}
+		if req.RescheduleLimit != nil {
+			policy.RescheduleLimit = *req.RescheduleLimit
+		}
+		if req.RescheduleNoticeHours != nil {
+			policy.RescheduleNoticeHours = *req.RescheduleNoticeHours
+		}
+		return tx.Save(&policy).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении правил отмены",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    policy,
+	})
+}
+
+func cancelSession(c *gin.Context) {
+	var req CancelSessionRequest
+	// The reason is optional, so is the body
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var session Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+
+	cancelledBy := CancelledBySystem
+	switch sessionRole(c, &session) {
+	case "client":
+		cancelledBy = CancelledByClient
+	case "therapist":
+		cancelledBy = CancelledByTherapist
+	case "admin":
+	default:
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+
+	respondCancellation(c, session.ID, SessionStatusCancelled, cancelledBy, req.Reason)
+}
+
+func markSessionNoShow(c *gin.Context) {
+	var session Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+
+	role := sessionRole(c, &session)
+	if role != "therapist" && role != "admin" {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Недостаточно прав",
+		})
+		return
+	}
+	if time.Now().Before(session.StartTime) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Сессия ещё не началась",
+		})
+		return
+	}
+
+	respondCancellation(c, session.ID, SessionStatusNoShow, CancelledBySystem, "client_no_show")
+}
+
+func respondCancellation(c *gin.Context, sessionID uint, status, cancelledBy, reason string) {
+	response, err := cancelSessionWithRefund(c, sessionID, status, cancelledBy, reason)
+	if errors.Is(err, errSessionNotCancellable) {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Сессию нельзя отменить в текущем статусе",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при отмене сессии",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    response,
+	})
+}
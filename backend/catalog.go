@@ -0,0 +1,254 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Catalog metadata types
+type PriceRange struct {
+	Min      int    `json:"min"` // in minor units of Currency
+	Max      int    `json:"max"`
+	Currency string `json:"currency"`
+}
+
+// Facets are only filled on the first page, cursor pages carry CursorMeta
+type TherapistListMeta struct {
+	Facets      map[string][]FacetCount `json:"facets,omitempty"`
+	PriceRange  *PriceRange             `json:"price_range,omitempty"`
+	OnlineCount int64                   `json:"online_count,omitempty"`
+	Sort        string                  `json:"sort"`
+	*CursorMeta
+}
+
+// catalogFilter is a filter scope tagged with the facet it belongs to, so a
+// facet can be counted with all the other filters but not its own
+type catalogFilter struct {
+	group string
+	scope func(*gorm.DB) *gorm.DB
+}
+
+type catalogFilters []catalogFilter
+
+// scopes returns the filter scopes except those of the given groups
+func (f catalogFilters) scopes(except ...string) []func(*gorm.DB) *gorm.DB {
+	var scopes []func(*gorm.DB) *gorm.DB
+next:
+	for _, filter := range f {
+		for _, group := range except {
+			if filter.group == group {
+				continue next
+			}
+		}
+		scopes = append(scopes, filter.scope)
+	}
+	return scopes
+}
+
+// therapistSort is a catalog ordering: keyset columns ending with the
+// primary key as a tiebreaker, and the cursor values of a row
+type therapistSort struct {
+	keys   []sortKey
+	values func(t Therapist) []interface{}
+}
+
+var therapistIDKey = sortKey{Column: "therapists.id"}
+
+var therapistSorts = map[string]therapistSort{
+	"rating": {
+		[]sortKey{{Column: "therapists.rating", Desc: true}, {Column: "therapists.review_count", Desc: true}, therapistIDKey},
+		func(t Therapist) []interface{} { return []interface{}{t.Rating, t.ReviewCount, t.ID} },
+	},
+	"price": {
+		[]sortKey{{Column: "therapists.price_per_hour_rub"}, therapistIDKey},
+		func(t Therapist) []interface{} { return []interface{}{t.PricePerHourRUB, t.ID} },
+	},
+	"price_desc": {
+		[]sortKey{{Column: "therapists.price_per_hour_rub", Desc: true}, therapistIDKey},
+		func(t Therapist) []interface{} { return []interface{}{t.PricePerHourRUB, t.ID} },
+	},
+	"experience": {
+		[]sortKey{{Column: "therapists.experience", Desc: true}, therapistIDKey},
+		func(t Therapist) []interface{} { return []interface{}{t.Experience, t.ID} },
+	},
+	"reviews": {
+		[]sortKey{{Column: "therapists.review_count", Desc: true}, therapistIDKey},
+		func(t Therapist) []interface{} { return []interface{}{t.ReviewCount, t.ID} },
+	},
+	"next_slot": {
+		[]sortKey{{Column: "therapists.next_slot", NullsLast: true}, therapistIDKey},
+		func(t Therapist) []interface{} {
+			var slot interface{}
+			if t.NextSlot != nil {
+				slot = *t.NextSlot
+			}
+			return []interface{}{slot, t.ID}
+		},
+	},
+}
+
+// parseCatalogDate accepts either a date (2006-01-02) or an RFC3339 timestamp
+func parseCatalogDate(value string) (time.Time, bool, bool) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, true
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, true
+	}
+	return time.Time{}, false, false
+}
+
+// therapistFilters builds catalog filter scopes from query parameters so the
+// same filters can be reused for the page, the total count and the facets
+func therapistFilters(c *gin.Context, viewer string) catalogFilters {
+	var filters catalogFilters
+	where := func(group, condition string, args ...interface{}) {
+		filters = append(filters, catalogFilter{group, func(query *gorm.DB) *gorm.DB {
+			return query.Where(condition, args...)
+		}})
+	}
+
+	if spec := c.Query("specialization"); spec != "" {
+		where("specialization", "specialization ILIKE ?", "%"+spec+"%")
+	}
+
+	if approach := c.Query("approach"); approach != "" {
+		where("approach", "approach ILIKE ?", "%"+approach+"%")
+	}
+
+	if minExp := c.Query("min_experience"); minExp != "" {
+		if exp, err := strconv.Atoi(minExp); err == nil {
+			where("experience", "experience >= ?", exp)
+		}
+	}
+
+	// Prices are given in whole units of the viewer currency and compared
+	// with the rouble prices
+	if minPrice := c.Query("min_price"); minPrice != "" {
+		if price, err := strconv.Atoi(minPrice); err == nil {
+			if amount, err := toSettlement(price*100, viewer); err == nil {
+				where("price", "price_per_hour_rub >= ?", amount)
+			}
+		}
+	}
+
+	if maxPrice := c.Query("max_price"); maxPrice != "" {
+		if price, err := strconv.Atoi(maxPrice); err == nil {
+			if amount, err := toSettlement(price*100, viewer); err == nil {
+				where("price", "price_per_hour_rub <= ?", amount)
+			}
+		}
+	}
+
+	// "rating" is what the frontend TherapistFilters sends
+	minRating := c.Query("min_rating")
+	if minRating == "" {
+		minRating = c.Query("rating")
+	}
+	if minRating != "" {
+		if rating, err := strconv.ParseFloat(minRating, 64); err == nil {
+			where("rating", "rating >= ?", rating)
+		}
+	}
+
+	if c.Query("online_only") == "true" || c.Query("is_online") == "true" {
+		where("online", "is_online = ?", true)
+	}
+
+	// Availability: the nearest free slot must fall into the requested window.
+	// A bare date as the upper bound includes the whole day.
+	if from := c.Query("available_from"); from != "" {
+		if t, _, ok := parseCatalogDate(from); ok {
+			where("availability", "next_slot >= ?", t)
+		}
+	}
+	if to := c.Query("available_to"); to != "" {
+		if t, dateOnly, ok := parseCatalogDate(to); ok {
+			if dateOnly {
+				t = t.AddDate(0, 0, 1)
+			}
+			where("availability", "next_slot < ?", t)
+		}
+	}
+
+	// Taxonomy filters: any of the values within a vocabulary, all vocabularies together
+	for _, vocabulary := range vocabularies {
+		param := vocabularyParams[vocabulary]
+		if values := queryList(c, param); len(values) > 0 {
+			filters = append(filters, catalogFilter{param, filterByTerms(vocabulary, values)})
+		}
+	}
+
+	if search := strings.TrimSpace(c.Query("search")); search != "" {
+		filters = append(filters, catalogFilter{"search", func(query *gorm.DB) *gorm.DB {
+			query, _ = applyTherapistSearch(query, search)
+			return query
+		}})
+	}
+
+	return filters
+}
+
+// applyTherapistSort orders the catalog query and returns the applied sort.
+// Search results default to relevance, everything else to rating.
+func applyTherapistSort(query *gorm.DB, c *gin.Context) (*gorm.DB, string, therapistSort) {
+	search := strings.TrimSpace(c.Query("search"))
+	searching := searchPrefixQuery(search) != ""
+
+	name := c.Query("sort")
+	sort, ok := therapistSorts[name]
+	if !ok {
+		name = "rating"
+		sort = therapistSorts[name]
+		if searching {
+			name = "relevance"
+		}
+	}
+
+	if searching {
+		query = selectSearchRank(query, search)
+		if name == "relevance" {
+			sort = therapistSort{
+				[]sortKey{searchRankKey(search), therapistIDKey},
+				func(t Therapist) []interface{} { return []interface{}{t.SearchRank, t.ID} },
+			}
+		}
+	}
+
+	return keysetOrder(query, sort.keys), name, sort
+}
+
+// therapistListMeta builds the catalog sidebar data. Every facet is counted
+// without its own filter so that selecting a value does not hide the others.
+func therapistListMeta(filters catalogFilters, sort, viewer string) TherapistListMeta {
+	meta := TherapistListMeta{
+		Facets:     map[string][]FacetCount{},
+		PriceRange: &PriceRange{},
+		Sort:       sort,
+	}
+
+	for _, vocabulary := range vocabularies {
+		param := vocabularyParams[vocabulary]
+		meta.Facets[param] = therapistFacetCounts(vocabulary,
+			db.Model(&Therapist{}).Scopes(filters.scopes(param)...))
+	}
+
+	db.Model(&Therapist{}).Scopes(filters.scopes("price")...).
+		Select("COALESCE(MIN(price_per_hour_rub), 0) AS min, COALESCE(MAX(price_per_hour_rub), 0) AS max").
+		Scan(meta.PriceRange)
+	meta.PriceRange.Currency = settlementCurrency
+	if low, err := convertAmount(meta.PriceRange.Min, settlementCurrency, viewer); err == nil {
+		high, _ := convertAmount(meta.PriceRange.Max, settlementCurrency, viewer)
+		meta.PriceRange.Min, meta.PriceRange.Max, meta.PriceRange.Currency = low, high, viewer
+	}
+
+	db.Model(&Therapist{}).Scopes(filters.scopes("online")...).
+		Where("is_online = ?", true).
+		Count(&meta.OnlineCount)
+
+	return meta
+}
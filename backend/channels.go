@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// EmailSender delivers email
+type EmailSender interface {
+	Name() string
+	SendEmail(ctx context.Context, msg EmailMessage) (string, error)
+}
+
+// SMSSender delivers text messages to phone numbers
+type SMSSender interface {
+	Name() string
+	SendSMS(ctx context.Context, phone, text string) (string, error)
+}
+
+// PushSender delivers a payload to one browser push subscription
+type PushSender interface {
+	Name() string
+	SendPush(ctx context.Context, sub *PushSubscription, payload []byte) error
+}
+
+type EmailMessage struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string // optional alternative part
+}
+
+// errPushSubscriptionGone means the browser dropped the subscription and it
+// must not be used again
+var errPushSubscriptionGone = errors.New("push subscription is gone")
+
+// errDestinationNotAllowed means a user-supplied URL resolved to our own
+// network
+var errDestinationNotAllowed = errors.New("destination is not allowed")
+
+// Hosts of the browser push services. Endpoints come from users, so pushes
+// go to these only.
+var pushServiceHosts = []string{
+	"fcm.googleapis.com",
+	"push.services.mozilla.com",
+	"push.apple.com",
+	"notify.windows.com",
+}
+
+// pushHTTPClient sends to push endpoints, which users supply. Unlike
+// providerHTTPClient it follows no redirects and connects to public
+// addresses only.
+var pushHTTPClient = &http.Client{
+	Timeout: 15 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: publicOnlyTransport(""),
+}
+
+// publicOnlyTransport refuses to connect to loopback, private and link-local
+// addresses unless the allowPrivateEnv variable is "true". The address is
+// checked when dialing, after DNS resolution, so a name pointing inside does
+// not pass; there is no proxy, since the check must see the real address.
+func publicOnlyTransport(allowPrivateEnv string) *http.Transport {
+	return &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				if allowPrivateEnv != "" && getEnv(allowPrivateEnv, "false") == "true" {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+					ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+					return fmt.Errorf("%w: %s", errDestinationNotAllowed, host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+}
+
+// validPushEndpoint accepts https endpoints of the known push services
+func validPushEndpoint(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User != nil || u.Port() != "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, service := range pushServiceHosts {
+		if host == service || strings.HasSuffix(host, "."+service) {
+			return true
+		}
+	}
+	return false
+}
+
+// SMTP adapter
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Name() string { return "smtp" }
+
+func (s *SMTPSender) SendEmail(ctx context.Context, msg EmailMessage) (string, error) {
+	messageID := fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), randomHex(8), s.Host)
+
+	var body bytes.Buffer
+	headers := textproto.MIMEHeader{}
+	headers.Set("From", s.From)
+	headers.Set("To", msg.To)
+	headers.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	headers.Set("Message-ID", messageID)
+	headers.Set("Date", time.Now().Format(time.RFC1123Z))
+	headers.Set("MIME-Version", "1.0")
+
+	if msg.HTML == "" {
+		headers.Set("Content-Type", "text/plain; charset=utf-8")
+		writeHeaders(&body, headers)
+		body.WriteString(msg.Text)
+	} else {
+		var content bytes.Buffer
+		parts := multipart.NewWriter(&content)
+		for _, part := range []struct{ contentType, text string }{
+			{"text/plain; charset=utf-8", msg.Text},
+			{"text/html; charset=utf-8", msg.HTML},
+		} {
+			w, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+			if err != nil {
+				return "", err
+			}
+			io.WriteString(w, part.text)
+		}
+		parts.Close()
+		headers.Set("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+		writeHeaders(&body, headers)
+		body.Write(content.Bytes())
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Host+":"+s.Port, auth, s.From, []string{msg.To}, body.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return messageID, err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func writeHeaders(w *bytes.Buffer, headers textproto.MIMEHeader) {
+	for key, values := range headers {
+		for _, v := range values {
+			fmt.Fprintf(w, "%s: %s\r\n", key, v)
+		}
+	}
+	w.WriteString("\r\n")
+}
+
+func randomHex(n int) string {
+	raw := make([]byte, n)
+	rand.Read(raw)
+	return fmt.Sprintf("%x", raw)
+}
+
+// SMS.ru adapter (https://sms.ru/api/send)
+type SMSRuSender struct {
+	APIID   string
+	From    string
+	BaseURL string
+}
+
+func (s *SMSRuSender) Name() string { return "smsru" }
+
+func (s *SMSRuSender) SendSMS(ctx context.Context, phone, text string) (string, error) {
+	form := url.Values{"api_id": {s.APIID}, "to": {phone}, "msg": {text}, "json": {"1"}}
+	if s.From != "" {
+		form.Set("from", s.From)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.BaseURL+"/sms/send", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status     string `json:"status"`
+		StatusText string `json:"status_text"`
+		SMS        map[string]struct {
+			Status     string `json:"status"`
+			StatusText string `json:"status_text"`
+			SMSID      string `json:"sms_id"`
+		} `json:"sms"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("smsru: %w", err)
+	}
+	if body.Status != "OK" {
+		return "", fmt.Errorf("smsru: %s", body.StatusText)
+	}
+	for _, sms := range body.SMS {
+		if sms.Status != "OK" {
+			return "", fmt.Errorf("smsru: %s", sms.StatusText)
+		}
+		return sms.SMSID, nil
+	}
+	return "", errors.New("smsru: empty response")
+}
+
+// WebPushSender sends Web Push messages encrypted as in RFC 8291 and
+// authorized with VAPID (RFC 8292)
+type WebPushSender struct {
+	PublicKey  string // base64url uncompressed P-256 point
+	PrivateKey string // base64url 32-byte scalar
+	Subject    string // mailto: or https: contact of the sender
+	TTL        int    // seconds the push service keeps an undelivered message
+}
+
+func (s *WebPushSender) Name() string { return "webpush" }
+
+func (s *WebPushSender) SendPush(ctx context.Context, sub *PushSubscription, payload []byte) error {
+	if !validPushEndpoint(sub.Endpoint) {
+		return errPushSubscriptionGone
+	}
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := s.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(s.TTL))
+	req.Header.Set("Authorization", authorization)
+	resp, err := pushHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The body is not kept: the endpoint is the user's, what it says is not
+	// ours to store
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("webpush: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// vapidAuthorization signs a token for the origin of the push service
+func (s *WebPushSender) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	key, err := s.signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": s.Subject,
+	})
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + signed + ", k=" + s.PublicKey, nil
+}
+
+func (s *WebPushSender) signingKey() (*ecdsa.PrivateKey, error) {
+	public, errPublic := base64.RawURLEncoding.DecodeString(s.PublicKey)
+	private, errPrivate := base64.RawURLEncoding.DecodeString(s.PrivateKey)
+	if errPublic != nil || errPrivate != nil || len(public) != 65 || public[0] != 4 || len(private) != 32 {
+		return nil, errors.New("webpush: invalid VAPID keys")
+	}
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(private),
+	}, nil
+}
+
+// encryptPushPayload encrypts the payload for the subscription as a single
+// aes128gcm record (RFC 8188, RFC 8291)
+func encryptPushPayload(sub *PushSubscription, payload []byte) ([]byte, error) {
+	clientPublic, errKey := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.P256dh, "="))
+	authSecret, errAuth := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Auth, "="))
+	if errKey != nil || errAuth != nil {
+		return nil, errors.New("webpush: invalid subscription keys")
+	}
+	clientKey, err := ecdh.P256().NewPublicKey(clientPublic)
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+
+	keyInfo := "WebPush: info\x00" + string(clientPublic) + string(serverPublic)
+	prkKey, err := hkdf.Extract(sha256.New, sharedSecret, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	ikm, err := hkdf.Expand(sha256.New, prkKey, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the last (and only) record
+	plaintext := append(append([]byte{}, payload...), 2)
+
+	var out bytes.Buffer
+	out.Write(salt)
+	binary.Write(&out, binary.BigEndian, uint32(4096))
+	out.WriteByte(byte(len(serverPublic)))
+	out.Write(serverPublic)
+	out.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return out.Bytes(), nil
+}
+
+// Local fakes log messages and keep the latest ones in memory
+const fakeOutboxSize = 100
+
+type FakeEmailSender struct {
+	mu   sync.Mutex
+	Sent []EmailMessage
+}
+
+func (s *FakeEmailSender) Name() string { return "fake" }
+
+func (s *FakeEmailSender) SendEmail(ctx context.Context, msg EmailMessage) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Sent = append(s.Sent, msg)
+	if len(s.Sent) > fakeOutboxSize {
+		s.Sent = s.Sent[1:]
+	}
+	log.Printf("Fake email to %s: %s", msg.To, msg.Subject)
+	return fmt.Sprintf("fake-email-%d", time.Now().UnixNano()), nil
+}
+
+type FakeSMSSender struct {
+	mu   sync.Mutex
+	Sent []string
+}
+
+func (s *FakeSMSSender) Name() string { return "fake" }
+
+func (s *FakeSMSSender) SendSMS(ctx context.Context, phone, text string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Sent = append(s.Sent, phone+": "+text)
+	if len(s.Sent) > fakeOutboxSize {
+		s.Sent = s.Sent[1:]
+	}
+	log.Printf("Fake SMS to %s: %s", phone, text)
+	return fmt.Sprintf("fake-sms-%d", time.Now().UnixNano()), nil
+}
+
+type FakePushSender struct {
+	mu   sync.Mutex
+	Sent [][]byte
+}
+
+func (s *FakePushSender) Name() string { return "fake" }
+
+func (s *FakePushSender) SendPush(ctx context.Context, sub *PushSubscription, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Sent = append(s.Sent, payload)
+	if len(s.Sent) > fakeOutboxSize {
+		s.Sent = s.Sent[1:]
+	}
+	log.Printf("Fake push to subscription %d: %s", sub.ID, payload)
+	return nil
+}
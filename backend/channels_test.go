@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestFakeSendersKeepLatest(t *testing.T) {
+	ctx := context.Background()
+	email := &FakeEmailSender{}
+	sms := &FakeSMSSender{}
+	push := &FakePushSender{}
+
+	for i := 0; i < fakeOutboxSize+5; i++ {
+		if _, err := email.SendEmail(ctx, EmailMessage{To: "user@example.com", Subject: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sms.SendSMS(ctx, "+79990000000", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := push.SendPush(ctx, &PushSubscription{ID: 1}, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		count int
+		last  string
+	}{
+		{"email", len(email.Sent), email.Sent[len(email.Sent)-1].Subject},
+		{"sms", len(sms.Sent), sms.Sent[len(sms.Sent)-1]},
+		{"push", len(push.Sent), string(push.Sent[len(push.Sent)-1])},
+	}
+	want := fmt.Sprint(fakeOutboxSize + 4)
+	for _, tt := range tests {
+		if tt.count != fakeOutboxSize {
+			t.Errorf("%s: kept %d messages, want %d", tt.name, tt.count, fakeOutboxSize)
+		}
+		if tt.last != want && tt.last != "+79990000000: "+want {
+			t.Errorf("%s: latest message = %q, want %q", tt.name, tt.last, want)
+		}
+	}
+}
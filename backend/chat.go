@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Chat message types, as in the frontend MessageType
+const (
+	ChatMessageText   = "text"
+	ChatMessageImage  = "image"
+	ChatMessageFile   = "file"
+	ChatMessageSystem = "system" // written by the platform only
+)
+
+const maxChatMessageLength = 4000
+
+// ChatRoom is a conversation of a client and a therapist, either about
+// anything or about one session
+type ChatRoom struct {
+	ID            uint           `json:"id" gorm:"primaryKey"`
+	RoomKey       string         `json:"-" gorm:"uniqueIndex;not null"` // pair:<client>:<therapist> or session:<id>
+	ClientID      uint           `json:"client_id" gorm:"not null;index"`
+	TherapistID   uint           `json:"therapist_id" gorm:"not null;index"`
+	SessionID     *uint          `json:"session_id,omitempty"`
+	IsActive      bool           `json:"is_active"`
+	LastMessageAt *time.Time     `json:"last_message_at,omitempty" gorm:"index"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	Participants  []User         `json:"participants" gorm:"-"`
+	Presence      []ChatPresence `json:"presence" gorm:"-"`
+	LastMessage   *ChatMessage   `json:"last_message,omitempty" gorm:"-"`
+	UnreadCount   int64          `json:"unread_count" gorm:"-"` // for the user asking
+}
+
+type ChatMessage struct {
+	ID        uint                   `json:"id" gorm:"primaryKey"`
+	RoomID    uint                   `json:"room_id" gorm:"not null;index"`
+	SenderID  uint                   `json:"sender_id" gorm:"not null"`
+	Sender    User                   `json:"sender" gorm:"foreignKey:SenderID"`
+	Message   string                 `json:"message" gorm:"type:text"`
+	Type      string                 `json:"type" gorm:"default:text"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty" gorm:"serializer:json"`
+	ReadAt    *time.Time             `json:"read_at,omitempty"` // by the other participant
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// ChatParticipant is how far a participant has read the room. Rows appear on
+// the first read; messages after LastReadMessageID from others are unread.
+type ChatParticipant struct {
+	RoomID            uint       `json:"room_id" gorm:"primaryKey;autoIncrement:false"`
+	UserID            uint       `json:"user_id" gorm:"primaryKey;autoIncrement:false;index"`
+	LastReadMessageID uint       `json:"last_read_message_id"`
+	LastReadAt        *time.Time `json:"last_read_at"`
+}
+
+// ChatReadReceipt is sent to the participants when one of them reads the room
+type ChatReadReceipt struct {
+	RoomID    uint      `json:"room_id"`
+	UserID    uint      `json:"user_id"`
+	MessageID uint      `json:"message_id"` // read up to and including
+	ReadAt    time.Time `json:"read_at"`
+}
+
+type CreateChatRoomRequest struct {
+	TherapistID uint `json:"therapist_id"`
+	ClientID    uint `json:"client_id"`
+	SessionID   uint `json:"session_id"`
+}
+
+type MarkChatReadRequest struct {
+	MessageID uint `json:"message_id"` // the latest message when empty
+}
+
+type SendChatMessageRequest struct {
+	Message  string                 `json:"message"`
+	Type     string                 `json:"type" binding:"omitempty,oneof=text image file"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+var (
+	errChatRoomNotFound    = errors.New("chat room not found")
+	errChatRoomInactive    = errors.New("chat room is closed")
+	errChatMessageInvalid  = errors.New("invalid chat message")
+	errChatPeerUnavailable = errors.New("chat peer unavailable")
+)
+
+// chatRoomUserIDs are the user accounts of the client and the therapist
+func chatRoomUserIDs(tx *gorm.DB, room *ChatRoom) []uint {
+	ids := []uint{room.ClientID}
+	if userID := therapistUserID(tx, room.TherapistID); userID != 0 {
+		ids = append(ids, userID)
+	}
+	return ids
+}
+
+// userChatRoom loads a room the user takes part in. Admins may read any room.
+func userChatRoom(tx *gorm.DB, roomID, userID uint, role string) (*ChatRoom, error) {
+	var room ChatRoom
+	if err := tx.First(&room, roomID).Error; err != nil {
+		return nil, errChatRoomNotFound
+	}
+	if role == "admin" {
+		return &room, nil
+	}
+	for _, id := range chatRoomUserIDs(tx, &room) {
+		if id == userID {
+			return &room, nil
+		}
+	}
+	return nil, errChatRoomNotFound
+}
+
+// openChatRoom returns the room of the pair or of the session, creating it
+// on first use
+func openChatRoom(tx *gorm.DB, clientID, therapistID uint, sessionID *uint) (*ChatRoom, error) {
+	room := ChatRoom{ClientID: clientID, TherapistID: therapistID, SessionID: sessionID, IsActive: true}
+	room.RoomKey = fmt.Sprintf("pair:%d:%d", clientID, therapistID)
+	if sessionID != nil {
+		room.RoomKey = fmt.Sprintf("session:%d", *sessionID)
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&room).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("room_key = ?", room.RoomKey).First(&room).Error; err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// loadRoomDetails fills the participants with their presence, the last
+// message and the unread count of the user for the rooms
+func loadRoomDetails(tx *gorm.DB, rooms []ChatRoom, userID uint) {
+	roomIDs := make([]uint, len(rooms))
+	for i, room := range rooms {
+		roomIDs[i] = room.ID
+	}
+	unread, err := chatUnreadCounts(tx, userID, roomIDs)
+	if err != nil {
+		log.Printf("Unread counts of user %d not loaded: %v", userID, err)
+	}
+
+	ctx := context.Background()
+	for i := range rooms {
+		room := &rooms[i]
+		tx.Where("id IN ?", chatRoomUserIDs(tx, room)).Find(&room.Participants)
+		room.Presence = make([]ChatPresence, len(room.Participants))
+		for j, participant := range room.Participants {
+			room.Presence[j] = userPresence(ctx, participant.ID)
+		}
+		var last ChatMessage
+		if tx.Preload("Sender").Where("room_id = ?", room.ID).Order("id DESC").First(&last).Error == nil {
+			room.LastMessage = &last
+		}
+		room.UnreadCount = unread[room.ID]
+	}
+}
+
+// chatUnreadCounts counts the messages from others the user has not read,
+// by room
+func chatUnreadCounts(tx *gorm.DB, userID uint, roomIDs []uint) (map[uint]int64, error) {
+	counts := make(map[uint]int64, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		RoomID uint
+		Count  int64
+	}
+	err := tx.Table("chat_messages").
+		Select("chat_messages.room_id, COUNT(*) AS count").
+		Joins("LEFT JOIN chat_participants ON chat_participants.room_id = chat_messages.room_id AND chat_participants.user_id = ?", userID).
+		Where("chat_messages.room_id IN ? AND chat_messages.sender_id <> ?", roomIDs, userID).
+		Where("chat_messages.id > COALESCE(chat_participants.last_read_message_id, 0)").
+		Group("chat_messages.room_id").
+		Scan(&rows).Error
+	for _, row := range rows {
+		counts[row.RoomID] = row.Count
+	}
+	return counts, err
+}
+
+// publishUnreadCount tells the connections of the user how many messages of
+// the room they have not read
+func publishUnreadCount(userID, roomID uint) {
+	counts, err := chatUnreadCounts(db, userID, []uint{roomID})
+	if err != nil {
+		log.Printf("Unread count of room %d for user %d not loaded: %v", roomID, userID, err)
+		return
+	}
+	publishChatEvent([]uint{userID}, ChatEvent{
+		Type:   ChatEventUnread,
+		RoomID: roomID,
+		Data:   map[string]interface{}{"unread_count": counts[roomID]},
+	})
+}
+
+// markChatRead marks the messages from others in the room read by the user up
+// to messageID, or up to the latest one when it is 0. Reading never moves
+// back: an older messageID changes nothing. It returns nil when there was
+// nothing new to read.
+func markChatRead(userID, roomID, messageID uint) (*ChatReadReceipt, error) {
+	var receipt *ChatReadReceipt
+	var recipients []uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		room, err := userChatRoom(tx, roomID, userID, "")
+		if err != nil {
+			return err
+		}
+
+		query := tx.Model(&ChatMessage{}).Where("room_id = ?", room.ID)
+		if messageID != 0 {
+			query = query.Where("id <= ?", messageID)
+		}
+		var upTo uint
+		if err := query.Select("COALESCE(MAX(id), 0)").Scan(&upTo).Error; err != nil {
+			return err
+		}
+		if upTo == 0 {
+			return nil
+		}
+
+		now := time.Now()
+		participant := ChatParticipant{RoomID: room.ID, UserID: userID, LastReadMessageID: upTo, LastReadAt: &now}
+		result := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "room_id"}, {Name: "user_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"last_read_message_id": upTo,
+				"last_read_at":         now,
+			}),
+			Where: clause.Where{Exprs: []clause.Expression{
+				clause.Expr{SQL: "chat_participants.last_read_message_id < ?", Vars: []interface{}{upTo}},
+			}},
+		}).Create(&participant)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		if err := tx.Model(&ChatMessage{}).
+			Where("room_id = ? AND sender_id <> ? AND id <= ? AND read_at IS NULL", room.ID, userID, upTo).
+			Update("read_at", now).Error; err != nil {
+			return err
+		}
+		receipt = &ChatReadReceipt{RoomID: room.ID, UserID: userID, MessageID: upTo, ReadAt: now}
+		recipients = chatRoomUserIDs(tx, room)
+		return nil
+	})
+	if err != nil || receipt == nil {
+		return nil, err
+	}
+
+	publishChatEvent(recipients, ChatEvent{Type: ChatEventRead, RoomID: receipt.RoomID, Data: receipt})
+	publishUnreadCount(userID, receipt.RoomID)
+	return receipt, nil
+}
+
+// validateChatMessage checks what a user may send: text up to the length
+// limit, or an image or file given by its URL in the metadata
+func validateChatMessage(req *SendChatMessageRequest) error {
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Type == "" {
+		req.Type = ChatMessageText
+	}
+	if utf8.RuneCountInString(req.Message) > maxChatMessageLength {
+		return errChatMessageInvalid
+	}
+	switch req.Type {
+	case ChatMessageText:
+		if req.Message == "" {
+			return errChatMessageInvalid
+		}
+	case ChatMessageImage, ChatMessageFile:
+		if url, _ := req.Metadata["url"].(string); !strings.HasPrefix(url, "https://") {
+			return errChatMessageInvalid
+		}
+	default:
+		return errChatMessageInvalid
+	}
+	return nil
+}
+
+// sendChatMessage stores a message of the user in the room, tells the other
+// party and delivers it to both in real time
+func sendChatMessage(userID, roomID uint, req SendChatMessageRequest) (*ChatMessage, error) {
+	if err := validateChatMessage(&req); err != nil {
+		return nil, err
+	}
+
+	var message ChatMessage
+	var recipients []uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		room, err := userChatRoom(tx, roomID, userID, "")
+		if err != nil {
+			return err
+		}
+		if !room.IsActive {
+			return errChatRoomInactive
+		}
+
+		message = ChatMessage{
+			RoomID:   room.ID,
+			SenderID: userID,
+			Message:  req.Message,
+			Type:     req.Type,
+			Metadata: req.Metadata,
+		}
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(room).Update("last_message_at", message.CreatedAt).Error; err != nil {
+			return err
+		}
+		if err := tx.Preload("Sender").First(&message, message.ID).Error; err != nil {
+			return err
+		}
+
+		recipients = chatRoomUserIDs(tx, room)
+		for _, recipient := range recipients {
+			if recipient == userID {
+				continue
+			}
+			if err := notifyChatMessage(tx, &message, recipient); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	publishChatEvent(recipients, ChatEvent{Type: ChatEventMessage, RoomID: message.RoomID, Data: message})
+	for _, recipient := range recipients {
+		if recipient != userID {
+			publishUnreadCount(recipient, message.RoomID)
+		}
+	}
+	return &message, nil
+}
+
+// notifyChatMessage emits a new_message notification, pushed to the devices
+// of the recipient
+func notifyChatMessage(tx *gorm.DB, message *ChatMessage, recipient uint) error {
+	preview := message.Message
+	if message.Type != ChatMessageText {
+		preview = "Вложение"
+	}
+	if runes := []rune(preview); len(runes) > 100 {
+		preview = string(runes[:100]) + "…"
+	}
+	_, err := emitNotification(tx, NotificationInput{
+		UserID:     recipient,
+		Type:       NotificationNewMessage,
+		Title:      "Новое сообщение от " + message.Sender.Name,
+		Message:    preview,
+		ActionURL:  fmt.Sprintf("/chat/%d", message.RoomID),
+		ActionText: "Ответить",
+		Data:       map[string]interface{}{"room_id": message.RoomID, "message_id": message.ID},
+	})
+	return err
+}
+
+func chatRoomID(c *gin.Context) uint {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	return uint(id)
+}
+
+func chatErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errChatRoomNotFound):
+		return http.StatusNotFound, "Чат не найден"
+	case errors.Is(err, errChatRoomInactive):
+		return http.StatusConflict, "Чат закрыт"
+	case errors.Is(err, errChatMessageInvalid):
+		return http.StatusBadRequest, "Сообщение пустое, слишком длинное или без ссылки на вложение"
+	case errors.Is(err, errChatPeerUnavailable):
+		return http.StatusForbidden, "Нельзя начать чат с этим пользователем"
+	}
+	return http.StatusInternalServerError, "Ошибка чата"
+}
+
+// Handlers
+func getChatRooms(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	query := db.Model(&ChatRoom{}).Where("client_id = ?", userID)
+	var therapist Therapist
+	if db.Where("user_id = ?", userID).First(&therapist).Error == nil {
+		query = query.Or("therapist_id = ?", therapist.ID)
+	}
+
+	var rooms []ChatRoom
+	if err := query.Order("last_message_at DESC NULLS LAST, id DESC").Find(&rooms).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке чатов",
+		})
+		return
+	}
+	loadRoomDetails(db, rooms, c.GetUint("user_id"))
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    rooms,
+	})
+}
+
+// createChatRoom opens the chat of the caller with a therapist (clients),
+// with a client they have had sessions with (therapists), or about a session
+// of theirs (either)
+func createChatRoom(c *gin.Context) {
+	var req CreateChatRoomRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	userID := c.GetUint("user_id")
+	var room *ChatRoom
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var own Therapist
+		isTherapist := tx.Where("user_id = ?", userID).First(&own).Error == nil
+
+		switch {
+		case req.SessionID != 0:
+			var session Session
+			if err := tx.First(&session, req.SessionID).Error; err != nil {
+				return errChatPeerUnavailable
+			}
+			if session.ClientID != userID && (!isTherapist || session.TherapistID != own.ID) {
+				return errChatPeerUnavailable
+			}
+			var err error
+			room, err = openChatRoom(tx, session.ClientID, session.TherapistID, &session.ID)
+			return err
+
+		case req.TherapistID != 0:
+			var therapist Therapist
+			if err := tx.First(&therapist, req.TherapistID).Error; err != nil || therapist.UserID == userID {
+				return errChatPeerUnavailable
+			}
+			var err error
+			room, err = openChatRoom(tx, userID, therapist.ID, nil)
+			return err
+
+		case req.ClientID != 0 && isTherapist:
+			var sessions int64
+			tx.Model(&Session{}).Where("client_id = ? AND therapist_id = ?", req.ClientID, own.ID).Count(&sessions)
+			if sessions == 0 {
+				return errChatPeerUnavailable
+			}
+			var err error
+			room, err = openChatRoom(tx, req.ClientID, own.ID, nil)
+			return err
+		}
+		return errChatPeerUnavailable
+	})
+	if err != nil {
+		status, message := chatErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+
+	rooms := []ChatRoom{*room}
+	loadRoomDetails(db, rooms, c.GetUint("user_id"))
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    rooms[0],
+	})
+}
+
+func getChatRoom(c *gin.Context) {
+	room, err := userChatRoom(db, chatRoomID(c), c.GetUint("user_id"), c.GetString("user_role"))
+	if err != nil {
+		status, message := chatErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+
+	rooms := []ChatRoom{*room}
+	loadRoomDetails(db, rooms, c.GetUint("user_id"))
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    rooms[0],
+	})
+}
+
+// getChatMessages returns the history newest first, older pages by cursor
+func getChatMessages(c *gin.Context) {
+	room, err := userChatRoom(db, chatRoomID(c), c.GetUint("user_id"), c.GetString("user_role"))
+	if err != nil {
+		status, message := chatErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+
+	limit := cursorLimit(c, 50, 200)
+	query, err := paginateByID(db.Model(&ChatMessage{}).Preload("Sender").Where("room_id = ?", room.ID), c, "chat_messages", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var messages []ChatMessage
+	if err := query.Find(&messages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке сообщений",
+		})
+		return
+	}
+
+	messages, meta := pageByID(messages, limit, func(m ChatMessage) uint { return m.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    messages,
+		Meta:    meta,
+	})
+}
+
+// markChatRoomRead marks the room read, up to message_id or entirely
+func markChatRoomRead(c *gin.Context) {
+	var req MarkChatReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	receipt, err := markChatRead(c.GetUint("user_id"), chatRoomID(c), req.MessageID)
+	if err != nil {
+		status, message := chatErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    receipt,
+	})
+}
+
+// postChatMessage sends a message without a WebSocket connection
+func postChatMessage(c *gin.Context) {
+	var req SendChatMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	message, err := sendChatMessage(c.GetUint("user_id"), chatRoomID(c), req)
+	if err != nil {
+		status, text := chatErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: text})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    message,
+	})
+}
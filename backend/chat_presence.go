@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	presenceKeyPrefix = "presence:user:"      // zset of the connections of a user, scored by expiry
+	lastSeenKeyPrefix = "presence:last_seen:" // unix time the user was last connected
+	// A connection counts as online this long after its last frame; the
+	// clients ping within chatReadTimeout
+	presenceTTL = chatReadTimeout + 30*time.Second
+	lastSeenTTL = 90 * 24 * time.Hour
+	// Typing frames are forwarded at most this often per room; clients
+	// drop the indicator when it is not repeated for twice as long
+	typingThrottle = 3 * time.Second
+)
+
+// ChatPresence is whether the user has a chat connection open anywhere
+type ChatPresence struct {
+	UserID     uint       `json:"user_id"`
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+func presenceKey(userID uint) string {
+	return presenceKeyPrefix + strconv.FormatUint(uint64(userID), 10)
+}
+
+func lastSeenKey(userID uint) string {
+	return lastSeenKeyPrefix + strconv.FormatUint(uint64(userID), 10)
+}
+
+// userPresence reads the presence of the user. Connections of an instance
+// that died stop counting once their heartbeats expire.
+func userPresence(ctx context.Context, userID uint) ChatPresence {
+	presence := ChatPresence{UserID: userID}
+	if rdb == nil {
+		chatConns.mu.RLock()
+		presence.Online = len(chatConns.conns[userID]) > 0
+		chatConns.mu.RUnlock()
+		return presence
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	online, err := rdb.ZCount(ctx, presenceKey(userID), "("+now, "+inf").Result()
+	if err != nil {
+		log.Printf("Presence of user %d not loaded: %v", userID, err)
+	}
+	presence.Online = online > 0
+	if seen, err := rdb.Get(ctx, lastSeenKey(userID)).Int64(); err == nil {
+		lastSeen := time.Unix(seen, 0)
+		presence.LastSeenAt = &lastSeen
+	}
+	return presence
+}
+
+// touchPresence records a heartbeat of the connection and reports whether
+// the user had no live connection before it
+func touchPresence(ctx context.Context, conn *chatConn) bool {
+	if rdb == nil {
+		first := !conn.touched
+		conn.touched = true
+		chatConns.mu.RLock()
+		defer chatConns.mu.RUnlock()
+		return first && len(chatConns.conns[conn.userID]) == 1
+	}
+	key := presenceKey(conn.userID)
+	now := time.Now()
+	var before *redis.IntCmd
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Unix(), 10))
+		before = pipe.ZCard(ctx, key)
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.Add(presenceTTL).Unix()), Member: conn.id})
+		pipe.Expire(ctx, key, presenceTTL)
+		pipe.Set(ctx, lastSeenKey(conn.userID), now.Unix(), lastSeenTTL)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Presence of user %d not updated: %v", conn.userID, err)
+		return false
+	}
+	return before.Val() == 0
+}
+
+// dropPresence removes the connection and reports whether it was the last
+// one of the user
+func dropPresence(ctx context.Context, conn *chatConn) bool {
+	if rdb == nil {
+		chatConns.mu.RLock()
+		defer chatConns.mu.RUnlock()
+		return len(chatConns.conns[conn.userID]) == 0
+	}
+	key := presenceKey(conn.userID)
+	now := time.Now()
+	var left *redis.IntCmd
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, key, conn.id)
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Unix(), 10))
+		left = pipe.ZCard(ctx, key)
+		pipe.Set(ctx, lastSeenKey(conn.userID), now.Unix(), lastSeenTTL)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Presence of user %d not updated: %v", conn.userID, err)
+		return false
+	}
+	return left.Val() == 0
+}
+
+// chatPeers are the users the user has chat rooms with, the ones who see
+// their presence
+func chatPeers(userID uint) []uint {
+	var pairs []struct {
+		ClientID uint
+		UserID   uint
+	}
+	err := db.Table("chat_rooms").
+		Select("chat_rooms.client_id, therapists.user_id").
+		Joins("JOIN therapists ON therapists.id = chat_rooms.therapist_id").
+		Where("chat_rooms.client_id = ? OR therapists.user_id = ?", userID, userID).
+		Scan(&pairs).Error
+	if err != nil {
+		log.Printf("Chat peers of user %d not loaded: %v", userID, err)
+		return nil
+	}
+
+	seen := make(map[uint]bool)
+	var peers []uint
+	for _, pair := range pairs {
+		peer := pair.ClientID
+		if peer == userID {
+			peer = pair.UserID
+		}
+		if peer != userID && !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// publishPresence tells the peers of the user that they came online or left
+func publishPresence(userID uint) {
+	presence := userPresence(context.Background(), userID)
+	publishChatEvent(chatPeers(userID), ChatEvent{Type: ChatEventPresence, Data: presence})
+}
+
+// publishTyping forwards the typing state of the connection's user to the
+// other participants of the room. Nothing is stored.
+func publishTyping(conn *chatConn, roomID uint, typing bool) error {
+	participants, err := conn.roomParticipants(roomID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if typing && now.Sub(conn.typingAt[roomID]) < typingThrottle {
+		return nil
+	}
+	if typing {
+		conn.typingAt[roomID] = now
+	} else {
+		delete(conn.typingAt, roomID)
+	}
+
+	var others []uint
+	for _, id := range participants {
+		if id != conn.userID {
+			others = append(others, id)
+		}
+	}
+	publishChatEvent(others, ChatEvent{
+		Type:   ChatEventTyping,
+		RoomID: roomID,
+		Data:   map[string]interface{}{"user_id": conn.userID, "typing": typing},
+	})
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// Events sent to the WebSocket clients
+const (
+	ChatEventMessage  = "message.new"
+	ChatEventAck      = "message.ack"  // the message sent by this connection was stored
+	ChatEventRead     = "message.read" // a participant read the room up to a message
+	ChatEventUnread   = "room.unread"  // the unread count of the room for this user
+	ChatEventTyping   = "typing"
+	ChatEventPresence = "presence" // a peer came online or left
+	ChatEventError    = "error"
+	ChatEventPong     = "pong"
+)
+
+const (
+	chatChannelPrefix = "chat:user:"
+	chatTicketPrefix  = "chat:ticket:"
+	// A ticket opens one WebSocket connection shortly after it was issued
+	chatTicketTTL = 30 * time.Second
+	// Clients send {"type":"ping"} more often than this, or get disconnected
+	chatReadTimeout  = 90 * time.Second
+	chatWriteTimeout = 10 * time.Second
+	chatMaxFrameSize = 64 << 10
+	chatSendBuffer   = 64
+)
+
+// ChatEvent is a frame sent from the server
+type ChatEvent struct {
+	Type     string      `json:"type"`
+	RoomID   uint        `json:"room_id,omitempty"`
+	ClientID string      `json:"client_id,omitempty"` // echoed from the client frame
+	Data     interface{} `json:"data,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// chatClientFrame is a frame sent from the client: "ping"; "message.send"
+// with the fields of SendChatMessageRequest; "message.read" with room_id and
+// optionally message_id; "typing" with room_id and typing
+type chatClientFrame struct {
+	Type        string                 `json:"type"`
+	ClientID    string                 `json:"client_id"`
+	RoomID      uint                   `json:"room_id"`
+	Message     string                 `json:"message"`
+	MessageType string                 `json:"message_type"`
+	Metadata    map[string]interface{} `json:"metadata"`
+	MessageID   uint                   `json:"message_id"`
+	Typing      bool                   `json:"typing"`
+}
+
+type chatConn struct {
+	id        string // in the presence set of the user
+	userID    uint
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Used by the reading goroutine only
+	touched  bool
+	rooms    map[uint][]uint // participants of the rooms the user was allowed in
+	typingAt map[uint]time.Time
+}
+
+// roomParticipants checks that the user takes part in the room, once per
+// connection, and returns the participants
+func (conn *chatConn) roomParticipants(roomID uint) ([]uint, error) {
+	if participants, ok := conn.rooms[roomID]; ok {
+		return participants, nil
+	}
+	room, err := userChatRoom(db, roomID, conn.userID, "")
+	if err != nil {
+		return nil, err
+	}
+	conn.rooms[roomID] = chatRoomUserIDs(db, room)
+	return conn.rooms[roomID], nil
+}
+
+func (conn *chatConn) close() {
+	conn.closeOnce.Do(func() { close(conn.done) })
+}
+
+// push queues a frame for the connection. A client that does not read its
+// frames is disconnected rather than allowed to hold up the others.
+func (conn *chatConn) push(payload []byte) {
+	select {
+	case conn.send <- payload:
+	case <-conn.done:
+	default:
+		conn.close()
+	}
+}
+
+func (conn *chatConn) pushEvent(event ChatEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Chat event %s not encoded: %v", event.Type, err)
+		return
+	}
+	conn.push(payload)
+}
+
+// chatHub holds the WebSocket connections to this instance by user
+type chatHub struct {
+	mu    sync.RWMutex
+	conns map[uint]map[*chatConn]struct{}
+}
+
+var chatConns = &chatHub{conns: make(map[uint]map[*chatConn]struct{})}
+
+func (h *chatHub) add(conn *chatConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[conn.userID] == nil {
+		h.conns[conn.userID] = make(map[*chatConn]struct{})
+	}
+	h.conns[conn.userID][conn] = struct{}{}
+}
+
+func (h *chatHub) remove(conn *chatConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns[conn.userID], conn)
+	if len(h.conns[conn.userID]) == 0 {
+		delete(h.conns, conn.userID)
+	}
+}
+
+func (h *chatHub) deliver(userID uint, payload []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for conn := range h.conns[userID] {
+		conn.push(payload)
+	}
+}
+
+func chatChannel(userID uint) string {
+	return chatChannelPrefix + strconv.FormatUint(uint64(userID), 10)
+}
+
+// publishChatEvent sends the event to every connection of the users, on any
+// instance: through Redis pub/sub, or directly when there is no Redis
+func publishChatEvent(userIDs []uint, event ChatEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Chat event %s not encoded: %v", event.Type, err)
+		return
+	}
+	for _, userID := range userIDs {
+		if rdb == nil {
+			chatConns.deliver(userID, payload)
+			continue
+		}
+		if err := rdb.Publish(context.Background(), chatChannel(userID), payload).Err(); err != nil {
+			log.Printf("Chat event for user %d not published, delivering locally: %v", userID, err)
+			chatConns.deliver(userID, payload)
+		}
+	}
+}
+
+// startChatFanout relays the chat events published by all instances to the
+// connections of this one. The subscription reconnects by itself.
+func startChatFanout(ctx context.Context) {
+	if rdb == nil {
+		return
+	}
+	pubsub := rdb.PSubscribe(ctx, chatChannelPrefix+"*")
+	go func() {
+		defer pubsub.Close()
+		for msg := range pubsub.Channel() {
+			userID, err := strconv.ParseUint(strings.TrimPrefix(msg.Channel, chatChannelPrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			chatConns.deliver(uint(userID), []byte(msg.Payload))
+		}
+	}()
+}
+
+// localChatTickets keep the tickets when there is no Redis
+var localChatTickets = struct {
+	sync.Mutex
+	users   map[string]uint
+	expires map[string]time.Time
+}{users: make(map[string]uint), expires: make(map[string]time.Time)}
+
+// newChatTicket stores a single-use ticket for the user
+func newChatTicket(ctx context.Context, userID uint) (string, error) {
+	ticket := randomHex(32)
+	if rdb != nil {
+		return ticket, rdb.Set(ctx, chatTicketPrefix+ticket, userID, chatTicketTTL).Err()
+	}
+	now := time.Now()
+	localChatTickets.Lock()
+	defer localChatTickets.Unlock()
+	for t, expires := range localChatTickets.expires {
+		if now.After(expires) {
+			delete(localChatTickets.users, t)
+			delete(localChatTickets.expires, t)
+		}
+	}
+	localChatTickets.users[ticket] = userID
+	localChatTickets.expires[ticket] = now.Add(chatTicketTTL)
+	return ticket, nil
+}
+
+// redeemChatTicket returns the user of the ticket and invalidates it
+func redeemChatTicket(ctx context.Context, ticket string) (uint, bool) {
+	if ticket == "" {
+		return 0, false
+	}
+	if rdb != nil {
+		userID, err := rdb.GetDel(ctx, chatTicketPrefix+ticket).Uint64()
+		return uint(userID), err == nil
+	}
+	localChatTickets.Lock()
+	defer localChatTickets.Unlock()
+	userID, ok := localChatTickets.users[ticket]
+	expires := localChatTickets.expires[ticket]
+	delete(localChatTickets.users, ticket)
+	delete(localChatTickets.expires, ticket)
+	return userID, ok && time.Now().Before(expires)
+}
+
+// chatWebSocket upgrades to the chat connection. Browsers cannot set headers
+// on WebSocket requests and a token in the URL ends up in logs, so they
+// connect with a ticket from issueChatTicket in the ticket query parameter.
+// Other clients may send the access token in the Authorization header.
+// Browser pages are accepted from the CORS origins only.
+func chatWebSocket(c *gin.Context) {
+	if origin := c.GetHeader("Origin"); origin != "" && !originAllowed(origin) {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Недопустимый источник запроса",
+		})
+		return
+	}
+
+	userID, ok := redeemChatTicket(c.Request.Context(), c.Query("ticket"))
+	if header := c.GetHeader("Authorization"); !ok && strings.HasPrefix(header, "Bearer ") {
+		if claims, err := verifyToken(strings.TrimPrefix(header, "Bearer ")); err == nil {
+			userID, ok = claims.UserID, true
+		}
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, ApiResponse{
+			Success: false,
+			Error:   "Недействительный билет",
+		})
+		return
+	}
+
+	server := websocket.Server{
+		// The origin was checked above
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			serveChatConn(ws, userID)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// issueChatTicket gives the user a ticket to open the chat WebSocket with
+func issueChatTicket(c *gin.Context) {
+	ticket, err := newChatTicket(c.Request.Context(), c.GetUint("user_id"))
+	if err != nil {
+		log.Printf("Chat ticket not issued: %v", err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Не удалось подключиться к чату",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data: gin.H{
+			"ticket":     ticket,
+			"expires_in": int(chatTicketTTL / time.Second),
+		},
+	})
+}
+
+func serveChatConn(ws *websocket.Conn, userID uint) {
+	ws.MaxPayloadBytes = chatMaxFrameSize
+	conn := &chatConn{
+		id:       randomHex(16),
+		userID:   userID,
+		send:     make(chan []byte, chatSendBuffer),
+		done:     make(chan struct{}),
+		rooms:    make(map[uint][]uint),
+		typingAt: make(map[uint]time.Time),
+	}
+	chatConns.add(conn)
+	defer leaveChat(conn)
+
+	go writeChatConn(ws, conn)
+
+	ctx := context.Background()
+	for {
+		// Every frame, pings included, is a presence heartbeat
+		if touchPresence(ctx, conn) {
+			publishPresence(userID)
+		}
+		ws.SetReadDeadline(time.Now().Add(chatReadTimeout))
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return
+		}
+		var frame chatClientFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			conn.pushEvent(ChatEvent{Type: ChatEventError, Error: "Неверный формат сообщения"})
+			continue
+		}
+		handleChatFrame(conn, frame)
+	}
+}
+
+// leaveChat closes the connection, stops its typing indicators and tells the
+// peers when the user went offline
+func leaveChat(conn *chatConn) {
+	conn.close()
+	chatConns.remove(conn)
+	for roomID := range conn.typingAt {
+		publishTyping(conn, roomID, false)
+	}
+	if dropPresence(context.Background(), conn) {
+		publishPresence(conn.userID)
+	}
+}
+
+// writeChatConn writes the queued frames until the connection is closed from
+// either side
+func writeChatConn(ws *websocket.Conn, conn *chatConn) {
+	defer ws.Close()
+	for {
+		select {
+		case payload := <-conn.send:
+			ws.SetWriteDeadline(time.Now().Add(chatWriteTimeout))
+			if err := websocket.Message.Send(ws, string(payload)); err != nil {
+				conn.close()
+				return
+			}
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+func handleChatFrame(conn *chatConn, frame chatClientFrame) {
+	switch frame.Type {
+	case "ping":
+		conn.pushEvent(ChatEvent{Type: ChatEventPong})
+
+	case "message.send":
+		message, err := sendChatMessage(conn.userID, frame.RoomID, SendChatMessageRequest{
+			Message:  frame.Message,
+			Type:     frame.MessageType,
+			Metadata: frame.Metadata,
+		})
+		if err != nil {
+			_, text := chatErrorStatus(err)
+			conn.pushEvent(ChatEvent{Type: ChatEventError, RoomID: frame.RoomID, ClientID: frame.ClientID, Error: text})
+			return
+		}
+		conn.pushEvent(ChatEvent{Type: ChatEventAck, RoomID: message.RoomID, ClientID: frame.ClientID, Data: message})
+		// The peers drop the typing indicator on the message itself
+		delete(conn.typingAt, frame.RoomID)
+
+	case "message.read":
+		if _, err := markChatRead(conn.userID, frame.RoomID, frame.MessageID); err != nil {
+			_, text := chatErrorStatus(err)
+			conn.pushEvent(ChatEvent{Type: ChatEventError, RoomID: frame.RoomID, ClientID: frame.ClientID, Error: text})
+		}
+
+	case "typing":
+		if err := publishTyping(conn, frame.RoomID, frame.Typing); err != nil {
+			_, text := chatErrorStatus(err)
+			conn.pushEvent(ChatEvent{Type: ChatEventError, RoomID: frame.RoomID, ClientID: frame.ClientID, Error: text})
+		}
+
+	default:
+		conn.pushEvent(ChatEvent{Type: ChatEventError, ClientID: frame.ClientID, Error: "Неизвестный тип сообщения"})
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm/clause"
+)
+
+// Supported currencies. Payments and the ledger are settled in roubles,
+// prices set in other currencies are converted at booking time.
+const (
+	CurrencyRUB = "RUB"
+	CurrencyEUR = "EUR"
+	CurrencyUSD = "USD"
+
+	settlementCurrency = CurrencyRUB
+)
+
+var supportedCurrencies = []string{CurrencyRUB, CurrencyEUR, CurrencyUSD}
+
+// Money is an amount in minor units (kopecks, cents) of the currency
+type Money struct {
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// ExchangeRate is the price of one unit of the currency in roubles
+type ExchangeRate struct {
+	Currency  string    `json:"currency" gorm:"primaryKey"`
+	Rate      float64   `json:"rate"`
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CurrencyRequest struct {
+	Currency string `json:"currency" binding:"required,oneof=RUB EUR USD"`
+}
+
+type CurrenciesResponse struct {
+	Currencies []string       `json:"currencies"`
+	Rates      []ExchangeRate `json:"rates"`
+}
+
+// RateSource fetches current rates in roubles per unit, keyed by currency
+type RateSource interface {
+	Name() string
+	FetchRates(ctx context.Context) (map[string]float64, error)
+}
+
+// FileRateSource reads rates from a JSON object like {"EUR": 98.5}. It is
+// meant for tests and for setting rates by hand.
+type FileRateSource struct {
+	Path string
+}
+
+func (s *FileRateSource) Name() string { return "file" }
+
+func (s *FileRateSource) FetchRates(ctx context.Context) (map[string]float64, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var rates map[string]float64
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("rates file %s: %w", s.Path, err)
+	}
+	return rates, nil
+}
+
+// CBRRateSource reads the official Central Bank of Russia rates from the
+// daily JSON published at cbr-xml-daily.ru
+type CBRRateSource struct {
+	URL string
+}
+
+func (s *CBRRateSource) Name() string { return "cbr" }
+
+func (s *CBRRateSource) FetchRates(ctx context.Context) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cbr rates: status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Valute map[string]struct {
+			Nominal float64 `json:"Nominal"`
+			Value   float64 `json:"Value"`
+		} `json:"Valute"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	rates := make(map[string]float64)
+	for code, v := range body.Valute {
+		if v.Nominal > 0 {
+			rates[code] = v.Value / v.Nominal
+		}
+	}
+	return rates, nil
+}
+
+var errRateUnavailable = errors.New("exchange rate unavailable")
+
+var (
+	rateSource RateSource
+	ratesMu    sync.RWMutex
+	rates      = map[string]float64{settlementCurrency: 1}
+)
+
+// newRateSource picks the source from RATE_SOURCE: cbr, file or none
+func newRateSource() RateSource {
+	switch getEnv("RATE_SOURCE", "cbr") {
+	case "file":
+		return &FileRateSource{Path: getEnv("RATE_SOURCE_FILE", "rates.json")}
+	case "none":
+		return nil
+	default:
+		return &CBRRateSource{URL: getEnv("CBR_RATES_URL", "https://www.cbr-xml-daily.ru/daily_json.js")}
+	}
+}
+
+func isSupportedCurrency(currency string) bool {
+	for _, c := range supportedCurrencies {
+		if c == currency {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRates fills the in-memory rates from the store
+func loadRates() error {
+	var stored []ExchangeRate
+	if err := db.Find(&stored).Error; err != nil {
+		return err
+	}
+	loaded := map[string]float64{settlementCurrency: 1}
+	for _, r := range stored {
+		if r.Rate > 0 {
+			loaded[r.Currency] = r.Rate
+		}
+	}
+	ratesMu.Lock()
+	rates = loaded
+	ratesMu.Unlock()
+	return nil
+}
+
+// refreshRates stores the supported rates from the source and reloads them.
+// Settlement prices of therapists follow the new rates.
+func refreshRates(ctx context.Context) error {
+	if rateSource != nil {
+		fetched, err := rateSource.FetchRates(ctx)
+		if err != nil {
+			return err
+		}
+		for _, currency := range supportedCurrencies {
+			rate, ok := fetched[currency]
+			if currency == settlementCurrency || !ok || rate <= 0 {
+				continue
+			}
+			stored := ExchangeRate{Currency: currency, Rate: rate, Source: rateSource.Name(), UpdatedAt: time.Now()}
+			if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&stored).Error; err != nil {
+				return err
+			}
+		}
+	}
+	if err := loadRates(); err != nil {
+		return err
+	}
+	if rdb != nil {
+		if err := rdb.Publish(ctx, ratesChannel, "").Err(); err != nil {
+			log.Printf("Exchange rates update not published: %v", err)
+		}
+	}
+	return syncTherapistSettlementPrices()
+}
+
+// The refresh runs on one instance, the others reload the stored rates when
+// it publishes on ratesChannel and, in case they missed it, every
+// ratesReloadInterval
+const (
+	ratesChannel        = "rates:updated"
+	ratesReloadInterval = 10 * time.Minute
+)
+
+// startRatesReload keeps the in-memory rates of this instance in line with
+// the store
+func startRatesReload(ctx context.Context) {
+	var updates <-chan *redis.Message
+	if rdb != nil {
+		pubsub := rdb.Subscribe(ctx, ratesChannel)
+		updates = pubsub.Channel()
+		go func() {
+			<-ctx.Done()
+			pubsub.Close()
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(ratesReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-updates:
+			}
+			if err := loadRates(); err != nil {
+				log.Printf("Exchange rates not loaded: %v", err)
+			}
+		}
+	}()
+}
+
+// syncTherapistSettlementPrices keeps the rouble price of every therapist,
+// which the catalog filters and sorts by, in line with the rates
+func syncTherapistSettlementPrices() error {
+	if err := db.Exec("UPDATE therapists SET price_per_hour_rub = price_per_hour WHERE currency = ?",
+		settlementCurrency).Error; err != nil {
+		return err
+	}
+	return db.Exec(`UPDATE therapists SET price_per_hour_rub = ROUND(therapists.price_per_hour * r.rate)
+		FROM exchange_rates r WHERE r.currency = therapists.currency`).Error
+}
+
+func initCurrencies() {
+	rateSource = newRateSource()
+	if err := refreshRates(context.Background()); err != nil {
+		log.Printf("Exchange rates not refreshed: %v", err)
+		if err := loadRates(); err != nil {
+			log.Printf("Exchange rates not loaded: %v", err)
+		}
+	}
+	startRatesReload(context.Background())
+}
+
+// The rates are refreshed every hour, on one instance of the cluster
+func init() {
+	registerPeriodicJob(JobRefreshRates, time.Hour, func(ctx context.Context) {
+		if err := refreshRates(ctx); err != nil {
+			log.Printf("Exchange rates not refreshed: %v", err)
+		}
+	})
+}
+
+// convertAmount converts minor units between currencies through roubles
+func convertAmount(amount int, from, to string) (int, error) {
+	if from == "" {
+		from = settlementCurrency
+	}
+	if to == "" {
+		to = settlementCurrency
+	}
+	if from == to {
+		return amount, nil
+	}
+	ratesMu.RLock()
+	fromRate, okFrom := rates[from]
+	toRate, okTo := rates[to]
+	ratesMu.RUnlock()
+	if !okFrom || !okTo {
+		return 0, fmt.Errorf("%w: %s -> %s", errRateUnavailable, from, to)
+	}
+	return int(math.Round(float64(amount) * fromRate / toRate)), nil
+}
+
+// toSettlement converts a price of the therapist currency into roubles
+func toSettlement(amount int, currency string) (int, error) {
+	return convertAmount(amount, currency, settlementCurrency)
+}
+
+// viewerCurrency is the currency to show prices in: the currency query
+// parameter, the X-Currency header, the preference of the signed-in user,
+// or roubles
+func viewerCurrency(c *gin.Context) string {
+	for _, value := range []string{c.Query("currency"), c.GetHeader("X-Currency")} {
+		if value = strings.ToUpper(value); isSupportedCurrency(value) {
+			return value
+		}
+	}
+
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		// Public routes do not require a token, but may carry one
+		if parts := strings.Split(c.GetHeader("Authorization"), " "); len(parts) == 2 && parts[0] == "Bearer" {
+			if claims, err := verifyToken(parts[1]); err == nil {
+				userID = claims.UserID
+			}
+		}
+	}
+	if userID != 0 {
+		var user User
+		if db.Select("currency").First(&user, userID).Error == nil && isSupportedCurrency(user.Currency) {
+			return user.Currency
+		}
+	}
+	return settlementCurrency
+}
+
+// displayMoney converts the amount for the viewer, keeping the original
+// currency when there is no rate
+func displayMoney(amount int, currency, viewer string) *Money {
+	converted, err := convertAmount(amount, currency, viewer)
+	if err != nil {
+		return &Money{Amount: amount, Currency: currency}
+	}
+	return &Money{Amount: converted, Currency: viewer}
+}
+
+// localizeTherapists sets the display price of each therapist
+func localizeTherapists(therapists []Therapist, viewer string) {
+	for i := range therapists {
+		therapists[i].DisplayPrice = displayMoney(therapists[i].PricePerHour, therapists[i].Currency, viewer)
+	}
+}
+
+// Handlers
+func getCurrencies(c *gin.Context) {
+	var stored []ExchangeRate
+	if err := db.Order("currency").Find(&stored).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке курсов валют",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data: CurrenciesResponse{
+			Currencies: supportedCurrencies,
+			Rates:      stored,
+		},
+	})
+}
+
+func updateProfileCurrency(c *gin.Context) {
+	var req CurrencyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Пользователь не найден",
+		})
+		return
+	}
+	user.Currency = req.Currency
+	if err := db.Save(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении настроек",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    user,
+	})
+}
+
+func refreshRatesHandler(c *gin.Context) {
+	if err := refreshRates(c.Request.Context()); err != nil {
+		log.Printf("Exchange rates not refreshed: %v", err)
+		c.JSON(http.StatusBadGateway, ApiResponse{
+			Success: false,
+			Error:   "Источник курсов валют недоступен",
+		})
+		return
+	}
+	getCurrencies(c)
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Delivery channels besides the in-app notification center
+const (
+	DeliveryChannelEmail = "email"
+	DeliveryChannelSMS   = "sms"
+	DeliveryChannelPush  = "push"
+)
+
+// Delivery statuses
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSent    = "sent"
+	DeliveryStatusFailed  = "failed"
+	DeliveryStatusSkipped = "skipped" // no address for the channel, or expired
+)
+
+const maxDeliveryAttempts = 5
+
+// Notification categories a user can switch off
+const (
+	notificationCategorySession   = "session"
+	notificationCategoryReminder  = "reminder"
+	notificationCategoryPayment   = "payment"
+	notificationCategoryMessage   = "message"
+	notificationCategoryMarketing = "marketing"
+)
+
+// notificationRoute is where a notification type goes besides the app
+type notificationRoute struct {
+	category string
+	channels []string
+}
+
+var notificationRoutes = map[string]notificationRoute{
+	NotificationSessionReminder:    {notificationCategoryReminder, []string{DeliveryChannelEmail, DeliveryChannelSMS, DeliveryChannelPush}},
+	NotificationSessionBooked:      {notificationCategorySession, []string{DeliveryChannelEmail, DeliveryChannelPush}},
+	NotificationSessionConfirmed:   {notificationCategorySession, []string{DeliveryChannelEmail, DeliveryChannelPush}},
+	NotificationSessionCancelled:   {notificationCategorySession, []string{DeliveryChannelEmail, DeliveryChannelSMS, DeliveryChannelPush}},
+	NotificationSessionRescheduled: {notificationCategorySession, []string{DeliveryChannelEmail, DeliveryChannelSMS, DeliveryChannelPush}},
+	NotificationSessionCompleted:   {notificationCategorySession, []string{DeliveryChannelEmail}},
+	NotificationPaymentSuccess:     {notificationCategoryPayment, []string{DeliveryChannelEmail, DeliveryChannelPush}},
+	NotificationPaymentFailed:      {notificationCategoryPayment, []string{DeliveryChannelEmail, DeliveryChannelPush}},
+	NotificationNewMessage:         {notificationCategoryMessage, []string{DeliveryChannelPush}},
+	NotificationTherapistResponse:  {notificationCategoryMessage, []string{DeliveryChannelEmail, DeliveryChannelPush}},
+	NotificationSystem:             {notificationCategoryMarketing, []string{DeliveryChannelEmail}},
+}
+
+// NotificationPreference holds the channels and categories a user wants, as
+// in the frontend NotificationPreferences. Quiet hours hold back SMS and push
+// until they end; email waits in the inbox anyway.
+type NotificationPreference struct {
+	UserID               uint      `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	EmailNotifications   bool      `json:"email_notifications"`
+	PushNotifications    bool      `json:"push_notifications"`
+	SMSNotifications     bool      `json:"sms_notifications" gorm:"column:sms_notifications"`
+	SessionReminders     bool      `json:"session_reminders"`
+	PaymentNotifications bool      `json:"payment_notifications"`
+	MarketingEmails      bool      `json:"marketing_emails"`
+	QuietHoursStart      string    `json:"quiet_hours_start,omitempty"` // HH:MM, empty for none
+	QuietHoursEnd        string    `json:"quiet_hours_end,omitempty"`
+	Timezone             string    `json:"timezone,omitempty"` // IANA name, the server zone if empty
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+type NotificationPreferenceRequest struct {
+	EmailNotifications   *bool   `json:"email_notifications"`
+	PushNotifications    *bool   `json:"push_notifications"`
+	SMSNotifications     *bool   `json:"sms_notifications"`
+	SessionReminders     *bool   `json:"session_reminders"`
+	PaymentNotifications *bool   `json:"payment_notifications"`
+	MarketingEmails      *bool   `json:"marketing_emails"`
+	QuietHoursStart      *string `json:"quiet_hours_start"`
+	QuietHoursEnd        *string `json:"quiet_hours_end"`
+	Timezone             *string `json:"timezone"`
+}
+
+// PushSubscription is a browser subscription from PushManager.subscribe()
+type PushSubscription struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"not null;index"`
+	Endpoint  string    `json:"endpoint" gorm:"uniqueIndex;not null"`
+	P256dh    string    `json:"-"`
+	Auth      string    `json:"-"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PushSubscriptionRequest struct {
+	Endpoint string `json:"endpoint" binding:"required,url"`
+	Keys     struct {
+		P256dh string `json:"p256dh" binding:"required"`
+		Auth   string `json:"auth" binding:"required"`
+	} `json:"keys"`
+}
+
+// NotificationDelivery tracks one notification on one channel
+type NotificationDelivery struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	NotificationID    uint       `json:"notification_id" gorm:"not null;uniqueIndex:idx_delivery_channel"`
+	UserID            uint       `json:"user_id" gorm:"not null;index"`
+	Channel           string     `json:"channel" gorm:"not null;uniqueIndex:idx_delivery_channel"`
+	Status            string     `json:"status" gorm:"default:pending;index"`
+	Provider          string     `json:"provider,omitempty"`
+	ProviderMessageID string     `json:"provider_message_id,omitempty"`
+	Attempts          int        `json:"attempts"`
+	NextAttemptAt     time.Time  `json:"next_attempt_at" gorm:"index"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"` // not sent after this, see NotificationInput
+	LastError         string     `json:"last_error,omitempty"`
+	SentAt            *time.Time `json:"sent_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+var (
+	emailSender EmailSender
+	smsSender   SMSSender
+	pushSender  PushSender
+)
+
+var (
+	errNoAddress       = errors.New("no address for the channel")
+	errDeliveryExpired = errors.New("expired before it could be sent")
+)
+
+// initDeliveryChannels picks real adapters when they are configured and
+// local fakes otherwise
+func initDeliveryChannels() {
+	if host := getEnv("SMTP_HOST", ""); host != "" {
+		emailSender = &SMTPSender{
+			Host:     host,
+			Port:     getEnv("SMTP_PORT", "587"),
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     getEnv("SMTP_FROM", "noreply@psy-portal.local"),
+		}
+	} else {
+		emailSender = &FakeEmailSender{}
+		log.Println("Using fake email sender, emails are only logged")
+	}
+
+	if apiID := getEnv("SMSRU_API_ID", ""); apiID != "" {
+		smsSender = &SMSRuSender{
+			APIID:   apiID,
+			From:    getEnv("SMSRU_FROM", ""),
+			BaseURL: getEnv("SMSRU_API_URL", "https://sms.ru"),
+		}
+	} else {
+		smsSender = &FakeSMSSender{}
+		log.Println("Using fake SMS sender, messages are only logged")
+	}
+
+	if key := getEnv("VAPID_PUBLIC_KEY", ""); key != "" {
+		pushSender = &WebPushSender{
+			PublicKey:  key,
+			PrivateKey: getEnv("VAPID_PRIVATE_KEY", ""),
+			Subject:    getEnv("VAPID_SUBJECT", "mailto:support@psy-portal.local"),
+			TTL:        24 * 60 * 60,
+		}
+	} else {
+		pushSender = &FakePushSender{}
+		log.Println("Using fake push sender, pushes are only logged")
+	}
+}
+
+func defaultNotificationPreference(userID uint) NotificationPreference {
+	return NotificationPreference{
+		UserID:               userID,
+		EmailNotifications:   true,
+		PushNotifications:    true,
+		SessionReminders:     true,
+		PaymentNotifications: true,
+	}
+}
+
+// notificationPreference returns the stored preferences or the defaults
+func notificationPreference(tx *gorm.DB, userID uint) NotificationPreference {
+	pref := defaultNotificationPreference(userID)
+	tx.Where("user_id = ?", userID).First(&pref)
+	return pref
+}
+
+func (p *NotificationPreference) channelEnabled(channel string) bool {
+	switch channel {
+	case DeliveryChannelEmail:
+		return p.EmailNotifications
+	case DeliveryChannelSMS:
+		return p.SMSNotifications
+	case DeliveryChannelPush:
+		return p.PushNotifications
+	}
+	return false
+}
+
+func (p *NotificationPreference) categoryEnabled(category string) bool {
+	switch category {
+	case notificationCategoryReminder:
+		return p.SessionReminders
+	case notificationCategoryPayment:
+		return p.PaymentNotifications
+	case notificationCategoryMarketing:
+		return p.MarketingEmails
+	}
+	return true
+}
+
+// quietUntil returns when the quiet hours around t end, or t itself if it is
+// outside of them
+func (p *NotificationPreference) quietUntil(t time.Time) time.Time {
+	from, errFrom := clockMinutes(p.QuietHoursStart)
+	to, errTo := clockMinutes(p.QuietHoursEnd)
+	if errFrom != nil || errTo != nil || from == to {
+		return t
+	}
+	location := time.Local
+	if p.Timezone != "" {
+		if loc, err := time.LoadLocation(p.Timezone); err == nil {
+			location = loc
+		}
+	}
+
+	local := t.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	quiet := minute >= from && minute < to
+	if from > to {
+		quiet = minute >= from || minute < to
+	}
+	if !quiet {
+		return t
+	}
+	end := time.Date(local.Year(), local.Month(), local.Day(), to/60, to%60, 0, 0, location)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// queueDeliveries creates the channel deliveries of a new notification
+// according to its route and the preferences of the user. A delivery that
+// quiet hours would hold back past expiresAt is recorded as skipped.
+func queueDeliveries(tx *gorm.DB, notification *Notification, expiresAt *time.Time) error {
+	route, ok := notificationRoutes[notification.Type]
+	if !ok {
+		return nil
+	}
+	pref := notificationPreference(tx, notification.UserID)
+	if !pref.categoryEnabled(route.category) {
+		return nil
+	}
+
+	now := time.Now()
+	for _, channel := range route.channels {
+		if !pref.channelEnabled(channel) {
+			continue
+		}
+		next := now
+		if channel != DeliveryChannelEmail {
+			next = pref.quietUntil(now)
+		}
+		delivery := NotificationDelivery{
+			NotificationID: notification.ID,
+			UserID:         notification.UserID,
+			Channel:        channel,
+			Status:         DeliveryStatusPending,
+			NextAttemptAt:  next,
+			ExpiresAt:      expiresAt,
+		}
+		if delivery.expiredBy(next) {
+			delivery.Status = DeliveryStatusSkipped
+			delivery.LastError = errDeliveryExpired.Error()
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notificationLink is the absolute frontend URL of the notification action
+func notificationLink(notification *Notification) string {
+	if notification.ActionURL == "" || strings.HasPrefix(notification.ActionURL, "http") {
+		return notification.ActionURL
+	}
+	return getEnv("FRONTEND_URL", "http://localhost:3000") + notification.ActionURL
+}
+
+// deliver sends the notification over the channel of the delivery
+func deliver(ctx context.Context, tx *gorm.DB, delivery *NotificationDelivery) error {
+	var notification Notification
+	if err := tx.First(&notification, delivery.NotificationID).Error; err != nil {
+		return err
+	}
+	var user User
+	if err := tx.First(&user, delivery.UserID).Error; err != nil {
+		return err
+	}
+
+	link := notificationLink(&notification)
+	switch delivery.Channel {
+	case DeliveryChannelEmail:
+		if user.Email == "" {
+			return errNoAddress
+		}
+		rendered, err := notificationEmail(tx, &user, &notification)
+		if err != nil {
+			return err
+		}
+		delivery.Provider = emailSender.Name()
+		id, err := emailSender.SendEmail(ctx, EmailMessage{
+			To:      user.Email,
+			Subject: rendered.Subject,
+			Text:    rendered.Text,
+			HTML:    rendered.HTML,
+		})
+		delivery.ProviderMessageID = id
+		return err
+
+	case DeliveryChannelSMS:
+		if user.Phone == "" {
+			return errNoAddress
+		}
+		delivery.Provider = smsSender.Name()
+		id, err := smsSender.SendSMS(ctx, user.Phone, notification.Title+". "+notification.Message)
+		delivery.ProviderMessageID = id
+		return err
+
+	case DeliveryChannelPush:
+		var subscriptions []PushSubscription
+		if err := tx.Where("user_id = ?", user.ID).Find(&subscriptions).Error; err != nil {
+			return err
+		}
+		if len(subscriptions) == 0 {
+			return errNoAddress
+		}
+		payload, _ := json.Marshal(map[string]interface{}{
+			"id":    notification.ID,
+			"type":  notification.Type,
+			"title": notification.Title,
+			"body":  notification.Message,
+			"url":   link,
+		})
+		delivery.Provider = pushSender.Name()
+		var lastErr error
+		sent := 0
+		for i := range subscriptions {
+			err := pushSender.SendPush(ctx, &subscriptions[i], payload)
+			switch {
+			case errors.Is(err, errPushSubscriptionGone):
+				tx.Delete(&subscriptions[i])
+			case err != nil:
+				lastErr = err
+			default:
+				sent++
+			}
+		}
+		if sent > 0 {
+			return nil
+		}
+		if lastErr == nil {
+			return errNoAddress
+		}
+		return lastErr
+	}
+	return fmt.Errorf("unknown channel %s", delivery.Channel)
+}
+
+// processDelivery makes one attempt and schedules the next one on failure.
+// Like processReceipt it only returns the error of saving the delivery.
+func processDelivery(ctx context.Context, tx *gorm.DB, delivery *NotificationDelivery) error {
+	now := time.Now()
+	if delivery.expiredBy(now) {
+		return skipExpiredDelivery(tx, delivery)
+	}
+
+	// Quiet hours are checked on every attempt, retries may fall into them
+	// and the user may have changed them since the notification was queued
+	if delivery.Channel != DeliveryChannelEmail {
+		pref := notificationPreference(tx, delivery.UserID)
+		if until := pref.quietUntil(now); until.After(now) {
+			if delivery.expiredBy(until) {
+				return skipExpiredDelivery(tx, delivery)
+			}
+			delivery.NextAttemptAt = until
+			return tx.Save(delivery).Error
+		}
+	}
+
+	delivery.Attempts++
+	delivery.LastError = ""
+	err := deliver(ctx, tx, delivery)
+	switch {
+	case err == nil:
+		now := time.Now()
+		delivery.Status = DeliveryStatusSent
+		delivery.SentAt = &now
+	case errors.Is(err, errNoAddress):
+		delivery.Status = DeliveryStatusSkipped
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delay := time.Duration(delivery.Attempts*delivery.Attempts) * time.Minute
+		delivery.NextAttemptAt = time.Now().Add(delay)
+		if delivery.Attempts >= maxDeliveryAttempts {
+			delivery.Status = DeliveryStatusFailed
+		}
+	}
+	return tx.Save(delivery).Error
+}
+
+// expiredBy reports whether the delivery would be too late at t
+func (d *NotificationDelivery) expiredBy(t time.Time) bool {
+	return d.ExpiresAt != nil && !t.Before(*d.ExpiresAt)
+}
+
+func skipExpiredDelivery(tx *gorm.DB, delivery *NotificationDelivery) error {
+	delivery.Status = DeliveryStatusSkipped
+	delivery.LastError = errDeliveryExpired.Error()
+	return tx.Save(delivery).Error
+}
+
+// sendPendingDeliveries sends due deliveries. Rows are locked with SKIP
+// LOCKED, so several replicas can run it at once.
+func sendPendingDeliveries(ctx context.Context) {
+	for {
+		var delivery NotificationDelivery
+		found := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? AND next_attempt_at <= ?", DeliveryStatusPending, time.Now()).
+				Order("id").Limit(1).Find(&delivery)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			found = true
+			if err := processDelivery(ctx, tx, &delivery); err != nil {
+				return err
+			}
+			if delivery.Status != DeliveryStatusSent && delivery.LastError != "" {
+				log.Printf("Delivery %d over %s (attempt %d): %s", delivery.ID, delivery.Channel, delivery.Attempts, delivery.LastError)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Delivery worker: %v", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+func init() {
+	registerPeriodicJob(JobSendDeliveries, 15*time.Second, sendPendingDeliveries)
+}
+
+// Handlers
+func getNotificationPreferences(c *gin.Context) {
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    notificationPreference(db, c.GetUint("user_id")),
+	})
+}
+
+func updateNotificationPreferences(c *gin.Context) {
+	var req NotificationPreferenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	pref := notificationPreference(db, c.GetUint("user_id"))
+	for _, field := range []struct {
+		value  *bool
+		target *bool
+	}{
+		{req.EmailNotifications, &pref.EmailNotifications},
+		{req.PushNotifications, &pref.PushNotifications},
+		{req.SMSNotifications, &pref.SMSNotifications},
+		{req.SessionReminders, &pref.SessionReminders},
+		{req.PaymentNotifications, &pref.PaymentNotifications},
+		{req.MarketingEmails, &pref.MarketingEmails},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+		}
+	}
+	if req.QuietHoursStart != nil {
+		pref.QuietHoursStart = *req.QuietHoursStart
+	}
+	if req.QuietHoursEnd != nil {
+		pref.QuietHoursEnd = *req.QuietHoursEnd
+	}
+	if req.Timezone != nil {
+		pref.Timezone = *req.Timezone
+	}
+
+	// Quiet hours are set together or not at all
+	if (pref.QuietHoursStart == "") != (pref.QuietHoursEnd == "") {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Укажите начало и конец тихих часов",
+		})
+		return
+	}
+	if pref.QuietHoursStart != "" {
+		_, errFrom := clockMinutes(pref.QuietHoursStart)
+		_, errTo := clockMinutes(pref.QuietHoursEnd)
+		if errFrom != nil || errTo != nil {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Время тихих часов должно быть в формате ЧЧ:ММ",
+			})
+			return
+		}
+	}
+	if pref.Timezone != "" {
+		if _, err := time.LoadLocation(pref.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Неизвестный часовой пояс",
+			})
+			return
+		}
+	}
+
+	if err := db.Save(&pref).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении настроек",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    pref,
+	})
+}
+
+func getPushPublicKey(c *gin.Context) {
+	key := ""
+	if sender, ok := pushSender.(*WebPushSender); ok {
+		key = sender.PublicKey
+	}
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    gin.H{"public_key": key},
+	})
+}
+
+func savePushSubscription(c *gin.Context) {
+	var req PushSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	if !validPushEndpoint(req.Endpoint) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Адрес подписки не принадлежит известному push-сервису",
+		})
+		return
+	}
+
+	// A browser endpoint belongs to whoever subscribed with it last
+	subscription := PushSubscription{
+		UserID:    c.GetUint("user_id"),
+		Endpoint:  req.Endpoint,
+		P256dh:    req.Keys.P256dh,
+		Auth:      req.Keys.Auth,
+		UserAgent: c.GetHeader("User-Agent"),
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "endpoint"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "p256dh", "auth", "user_agent"}),
+	}).Create(&subscription).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении подписки",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    subscription,
+	})
+}
+
+func deletePushSubscription(c *gin.Context) {
+	var req struct {
+		Endpoint string `json:"endpoint" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	db.Where("user_id = ? AND endpoint = ?", c.GetUint("user_id"), req.Endpoint).Delete(&PushSubscription{})
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+	})
+}
+
+func getNotificationDeliveries(c *gin.Context) {
+	var notification Notification
+	if err := db.Where("user_id = ?", c.GetUint("user_id")).First(&notification, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Уведомление не найдено",
+		})
+		return
+	}
+
+	var deliveries []NotificationDelivery
+	db.Where("notification_id = ?", notification.ID).Order("id").Find(&deliveries)
+	// Provider errors are for support, see getDeliveries
+	for i := range deliveries {
+		deliveries[i].LastError = ""
+	}
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    deliveries,
+	})
+}
+
+// getDeliveries lists deliveries for support, ?status=failed shows problems
+func getDeliveries(c *gin.Context) {
+	limit := cursorLimit(c, 50, 200)
+	base := db.Model(&NotificationDelivery{})
+	if status := c.Query("status"); status != "" {
+		base = base.Where("status = ?", status)
+	}
+	if channel := c.Query("channel"); channel != "" {
+		base = base.Where("channel = ?", channel)
+	}
+	query, err := paginateByID(base, c, "notification_deliveries", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var deliveries []NotificationDelivery
+	if err := query.Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке доставок",
+		})
+		return
+	}
+
+	deliveries, meta := pageByID(deliveries, limit, func(d NotificationDelivery) uint { return d.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    deliveries,
+		Meta:    meta,
+	})
+}
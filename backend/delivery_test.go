@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReminderDeliveryExpiry(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip("no time zone data")
+	}
+	pref := NotificationPreference{QuietHoursStart: "23:00", QuietHoursEnd: "09:00", Timezone: "Europe/Moscow"}
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		start   time.Time
+		expired bool
+	}{
+		{"held past the session start", time.Date(2026, 3, 2, 7, 0, 0, 0, moscow), time.Date(2026, 3, 2, 8, 0, 0, 0, moscow), true},
+		{"held until the end of quiet hours", time.Date(2026, 3, 2, 7, 0, 0, 0, moscow), time.Date(2026, 3, 2, 10, 0, 0, 0, moscow), false},
+		{"session at the end of quiet hours", time.Date(2026, 3, 2, 8, 0, 0, 0, moscow), time.Date(2026, 3, 2, 9, 0, 0, 0, moscow), true},
+		{"outside quiet hours", time.Date(2026, 3, 2, 12, 0, 0, 0, moscow), time.Date(2026, 3, 2, 13, 0, 0, 0, moscow), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := NotificationDelivery{Channel: DeliveryChannelSMS, ExpiresAt: &tt.start}
+			if got := delivery.expiredBy(pref.quietUntil(tt.now)); got != tt.expired {
+				t.Errorf("expiredBy(quietUntil(%s)) = %v, want %v", tt.now.Format("15:04"), got, tt.expired)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Accounting document types
+const (
+	DocumentTypeInvoice = "invoice" // счёт на оплату
+	DocumentTypeAct     = "act"     // акт об оказании услуг
+)
+
+// LegalEntity is a company of the platform that issues documents. Numbering
+// of invoices and acts is sequential per legal entity.
+type LegalEntity struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"not null"`
+	INN         string    `json:"inn"`
+	KPP         string    `json:"kpp"`
+	OGRN        string    `json:"ogrn"`
+	Address     string    `json:"address"`
+	BankName    string    `json:"bank_name"`
+	BankAccount string    `json:"bank_account"`
+	CorrAccount string    `json:"corr_account"`
+	BIK         string    `json:"bik"`
+	Director    string    `json:"director"`
+	IsDefault   bool      `json:"is_default"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type LegalEntityRequest struct {
+	Name        string `json:"name" binding:"required"`
+	INN         string `json:"inn" binding:"required,numeric,min=10,max=12"`
+	KPP         string `json:"kpp" binding:"omitempty,len=9"`
+	OGRN        string `json:"ogrn" binding:"omitempty,numeric"`
+	Address     string `json:"address" binding:"required"`
+	BankName    string `json:"bank_name" binding:"required"`
+	BankAccount string `json:"bank_account" binding:"required,numeric,len=20"`
+	CorrAccount string `json:"corr_account" binding:"omitempty,numeric,len=20"`
+	BIK         string `json:"bik" binding:"required,numeric,len=9"`
+	Director    string `json:"director"`
+	IsDefault   bool   `json:"is_default"`
+}
+
+// Document is an issued invoice or act. Parties and amounts are copied at
+// issue time, so the PDF stays the same when profiles change.
+type Document struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	LegalEntityID uint      `json:"legal_entity_id" gorm:"not null;uniqueIndex:idx_document_number"`
+	Type          string    `json:"type" gorm:"not null;uniqueIndex:idx_document_number;uniqueIndex:idx_document_session"`
+	Number        int       `json:"number" gorm:"not null;uniqueIndex:idx_document_number"`
+	SessionID     uint      `json:"session_id" gorm:"not null;uniqueIndex:idx_document_session"`
+	ClientID      uint      `json:"client_id" gorm:"not null;index"`
+	BuyerName     string    `json:"buyer_name"`
+	BuyerINN      string    `json:"buyer_inn,omitempty"`
+	BuyerKPP      string    `json:"buyer_kpp,omitempty"`
+	BuyerAddress  string    `json:"buyer_address,omitempty"`
+	Description   string    `json:"description"`
+	Amount        int       `json:"amount"` // in kopecks
+	IssuedAt      time.Time `json:"issued_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// DocumentRequest carries the buyer details for B2B documents. Without them
+// the document is issued to the client as a private person.
+type DocumentRequest struct {
+	Type         string `json:"type" binding:"required,oneof=invoice act"`
+	BuyerName    string `json:"buyer_name"`
+	BuyerINN     string `json:"buyer_inn" binding:"omitempty,numeric,min=10,max=12"`
+	BuyerKPP     string `json:"buyer_kpp" binding:"omitempty,len=9"`
+	BuyerAddress string `json:"buyer_address"`
+}
+
+var (
+	errNoLegalEntity      = errors.New("no default legal entity")
+	errSessionNotBillable = errors.New("session cannot be billed")
+)
+
+// seedLegalEntity creates the default legal entity from the environment
+func seedLegalEntity() {
+	name := getEnv("LEGAL_ENTITY_NAME", "")
+	if name == "" {
+		return
+	}
+	var count int64
+	db.Model(&LegalEntity{}).Count(&count)
+	if count > 0 {
+		return
+	}
+	entity := LegalEntity{
+		Name:        name,
+		INN:         getEnv("LEGAL_ENTITY_INN", ""),
+		KPP:         getEnv("LEGAL_ENTITY_KPP", ""),
+		OGRN:        getEnv("LEGAL_ENTITY_OGRN", ""),
+		Address:     getEnv("LEGAL_ENTITY_ADDRESS", ""),
+		BankName:    getEnv("LEGAL_ENTITY_BANK_NAME", ""),
+		BankAccount: getEnv("LEGAL_ENTITY_BANK_ACCOUNT", ""),
+		CorrAccount: getEnv("LEGAL_ENTITY_CORR_ACCOUNT", ""),
+		BIK:         getEnv("LEGAL_ENTITY_BIK", ""),
+		Director:    getEnv("LEGAL_ENTITY_DIRECTOR", ""),
+		IsDefault:   true,
+	}
+	if err := db.Create(&entity).Error; err != nil {
+		log.Printf("Failed to seed legal entity: %v", err)
+	}
+}
+
+func sessionDescription(tx *gorm.DB, session *Session) string {
+	var therapist Therapist
+	tx.Preload("User").First(&therapist, session.TherapistID)
+	return fmt.Sprintf("Психологическая консультация (%s), %s, %d мин., специалист %s",
+		sessionTypeNames[session.Type], session.StartTime.Format("02.01.2006 15:04"), session.Duration, therapist.User.Name)
+}
+
+var sessionTypeNames = map[string]string{
+	"individual": "индивидуальная",
+	"couple":     "парная",
+	"group":      "групповая",
+}
+
+// issueDocument creates the invoice or act for a session once; repeated calls
+// return the existing document. The legal entity row is locked while the
+// next number is taken, so numbers have no gaps or duplicates.
+func issueDocument(sessionID uint, req DocumentRequest) (*Document, bool, error) {
+	var document Document
+	created := false
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id = ? AND type = ?", sessionID, req.Type).First(&document).Error; err == nil {
+			return nil
+		}
+
+		var session Session
+		if err := tx.First(&session, sessionID).Error; err != nil {
+			return err
+		}
+		switch {
+		case req.Type == DocumentTypeAct && session.Status != SessionStatusCompleted:
+			return errSessionNotBillable
+		case session.Status == SessionStatusCancelled || session.Status == SessionStatusNoShow:
+			return errSessionNotBillable
+		}
+
+		var entity LegalEntity
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("is_default = ?", true).First(&entity).Error; err != nil {
+			return errNoLegalEntity
+		}
+
+		var last int
+		if err := tx.Model(&Document{}).
+			Where("legal_entity_id = ? AND type = ?", entity.ID, req.Type).
+			Select("COALESCE(MAX(number), 0)").Scan(&last).Error; err != nil {
+			return err
+		}
+
+		var client User
+		if err := tx.First(&client, session.ClientID).Error; err != nil {
+			return err
+		}
+
+		document = Document{
+			LegalEntityID: entity.ID,
+			Type:          req.Type,
+			Number:        last + 1,
+			SessionID:     session.ID,
+			ClientID:      session.ClientID,
+			BuyerName:     client.Name,
+			BuyerINN:      req.BuyerINN,
+			BuyerKPP:      req.BuyerKPP,
+			BuyerAddress:  req.BuyerAddress,
+			Description:   sessionDescription(tx, &session),
+			Amount:        session.Price,
+			IssuedAt:      time.Now(),
+		}
+		if req.BuyerName != "" {
+			document.BuyerName = req.BuyerName
+		}
+		created = true
+		return tx.Create(&document).Error
+	})
+	return &document, created, err
+}
+
+// Handlers
+func createSessionDocument(c *gin.Context) {
+	var req DocumentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var session Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+	if role := sessionRole(c, &session); role != "client" && role != "admin" {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+
+	document, created, err := issueDocument(session.ID, req)
+	switch {
+	case errors.Is(err, errSessionNotBillable):
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Документ нельзя выставить для сессии в текущем статусе",
+		})
+		return
+	case errors.Is(err, errNoLegalEntity):
+		c.JSON(http.StatusServiceUnavailable, ApiResponse{
+			Success: false,
+			Error:   "Реквизиты организации не настроены",
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при создании документа",
+		})
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, ApiResponse{
+		Success: true,
+		Data:    document,
+	})
+}
+
+func getSessionDocuments(c *gin.Context) {
+	var session Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil || sessionRole(c, &session) == "" {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+
+	var documents []Document
+	if err := db.Where("session_id = ?", session.ID).Order("id").Find(&documents).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке документов",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    documents,
+	})
+}
+
+func downloadDocument(c *gin.Context) {
+	var document Document
+	if err := db.First(&document, c.Param("id")).Error; err != nil ||
+		(c.GetString("user_role") != "admin" && document.ClientID != c.GetUint("user_id")) {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Документ не найден",
+		})
+		return
+	}
+
+	var entity LegalEntity
+	if err := db.First(&entity, document.LegalEntityID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при формировании документа",
+		})
+		return
+	}
+
+	data, err := renderDocumentPDF(&document, &entity)
+	if err != nil {
+		log.Printf("Failed to render document %d: %v", document.ID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при формировании документа",
+		})
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%d.pdf", document.Type, document.Number)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, "application/pdf", data)
+}
+
+func getLegalEntities(c *gin.Context) {
+	var entities []LegalEntity
+	if err := db.Order("id").Find(&entities).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке организаций",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    entities,
+	})
+}
+
+// saveLegalEntity creates an entity, or updates the one in the path
+func saveLegalEntity(c *gin.Context) {
+	var entity LegalEntity
+	if id := c.Param("id"); id != "" {
+		if err := db.First(&entity, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, ApiResponse{
+				Success: false,
+				Error:   "Организация не найдена",
+			})
+			return
+		}
+	}
+
+	var req LegalEntityRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	entity.Name = req.Name
+	entity.INN = req.INN
+	entity.KPP = req.KPP
+	entity.OGRN = req.OGRN
+	entity.Address = req.Address
+	entity.BankName = req.BankName
+	entity.BankAccount = req.BankAccount
+	entity.CorrAccount = req.CorrAccount
+	entity.BIK = req.BIK
+	entity.Director = req.Director
+	entity.IsDefault = req.IsDefault
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Only one entity issues new documents
+		if entity.IsDefault {
+			if err := tx.Model(&LegalEntity{}).Where("id <> ?", entity.ID).Update("is_default", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(&entity).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении организации",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    entity,
+	})
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Email templates live in templates/email: a shared layout.html and
+// layout.txt, and per locale a <name>.html defining "content" and a
+// <name>.txt defining "subject" and "content". They are embedded into the
+// binary, the image ships nothing else.
+//
+//go:embed templates/email
+var emailTemplateFS embed.FS
+
+const (
+	LocaleRU = "ru"
+	LocaleEN = "en"
+
+	defaultLocale = LocaleRU
+
+	// fallbackEmailTemplate renders notifications without a template of
+	// their own from the title and message they were emitted with
+	fallbackEmailTemplate = "notification"
+)
+
+var supportedLocales = []string{LocaleRU, LocaleEN}
+
+// emailStrings are the texts of the layouts, by locale
+var emailStrings = map[string]map[string]string{
+	LocaleRU: {
+		"greeting":    "Здравствуйте",
+		"footer":      "Вы получили это письмо, потому что зарегистрированы на",
+		"settings":    "Настроить уведомления",
+		"signature":   "Команда",
+		"session":     "Сессия",
+		"therapist":   "Специалист",
+		"amount":      "Сумма",
+		"minutes":     "мин",
+		"open":        "Открыть",
+		"date_format": "02.01.2006 15:04",
+	},
+	LocaleEN: {
+		"greeting":    "Hello",
+		"footer":      "You received this email because you are registered at",
+		"settings":    "Notification settings",
+		"signature":   "The team of",
+		"session":     "Session",
+		"therapist":   "Therapist",
+		"amount":      "Amount",
+		"minutes":     "min",
+		"open":        "Open",
+		"date_format": "Jan 2, 2006 15:04",
+	},
+}
+
+// EmailData is what email templates render
+type EmailData struct {
+	Locale        string
+	AppName       string
+	FrontendURL   string
+	RecipientName string
+	Notification  *Notification
+	Link          string // absolute URL of the notification action
+	Session       *Session
+	TherapistName string
+	Payment       *Payment
+	Year          int
+}
+
+// RenderedEmail is a template rendered for one recipient
+type RenderedEmail struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+type emailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+type LanguageRequest struct {
+	Language string `json:"language" binding:"required,oneof=ru en"`
+}
+
+type EmailTemplateInfo struct {
+	Name    string   `json:"name"`
+	Locales []string `json:"locales"`
+}
+
+type EmailTemplateCheck struct {
+	Name   string `json:"name"`
+	Locale string `json:"locale"`
+	Error  string `json:"error,omitempty"`
+}
+
+var (
+	emailTemplates map[string]map[string]*emailTemplate // by locale and name
+
+	errEmailTemplateNotFound = errors.New("email template not found")
+)
+
+// emailFuncs are the template functions of a locale: t looks up a layout
+// text, datetime and money format values the local way
+func emailFuncs(locale string) map[string]interface{} {
+	strs := emailStrings[locale]
+	if strs == nil {
+		strs = emailStrings[defaultLocale]
+	}
+	return map[string]interface{}{
+		"t": func(key string) string { return strs[key] },
+		"datetime": func(t time.Time) string {
+			return t.In(time.Local).Format(strs["date_format"])
+		},
+		"money": func(amount int, currency string) string {
+			if currency == "" {
+				currency = settlementCurrency
+			}
+			if locale == LocaleRU {
+				return formatRoubles(amount) + " " + currency
+			}
+			return formatMinorUnits(amount) + " " + currency
+		},
+	}
+}
+
+func isSupportedLocale(locale string) bool {
+	for _, l := range supportedLocales {
+		if l == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// loadEmailTemplates parses the embedded templates
+func loadEmailTemplates() error {
+	root := "templates/email"
+	layoutHTML, err := fs.ReadFile(emailTemplateFS, path.Join(root, "layout.html"))
+	if err != nil {
+		return err
+	}
+	layoutText, err := fs.ReadFile(emailTemplateFS, path.Join(root, "layout.txt"))
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]map[string]*emailTemplate)
+	for _, locale := range supportedLocales {
+		entries, err := fs.ReadDir(emailTemplateFS, path.Join(root, locale))
+		if err != nil {
+			return err
+		}
+		loaded[locale] = make(map[string]*emailTemplate)
+		for _, entry := range entries {
+			name, ok := strings.CutSuffix(entry.Name(), ".html")
+			if !ok {
+				continue
+			}
+			htmlBody, err := fs.ReadFile(emailTemplateFS, path.Join(root, locale, name+".html"))
+			if err != nil {
+				return err
+			}
+			textBody, err := fs.ReadFile(emailTemplateFS, path.Join(root, locale, name+".txt"))
+			if err != nil {
+				return fmt.Errorf("%s/%s: text version missing: %w", locale, name, err)
+			}
+
+			html, err := htmltemplate.New("layout").Funcs(emailFuncs(locale)).Parse(string(layoutHTML))
+			if err == nil {
+				_, err = html.Parse(string(htmlBody))
+			}
+			if err != nil {
+				return fmt.Errorf("%s/%s.html: %w", locale, name, err)
+			}
+			text, err := texttemplate.New("layout").Funcs(emailFuncs(locale)).Parse(string(layoutText))
+			if err == nil {
+				_, err = text.Parse(string(textBody))
+			}
+			if err != nil {
+				return fmt.Errorf("%s/%s.txt: %w", locale, name, err)
+			}
+			if text.Lookup("subject") == nil {
+				return fmt.Errorf("%s/%s.txt: subject is not defined", locale, name)
+			}
+			loaded[locale][name] = &emailTemplate{html: html, text: text}
+		}
+	}
+	if loaded[defaultLocale][fallbackEmailTemplate] == nil {
+		return fmt.Errorf("%s/%s: %w", defaultLocale, fallbackEmailTemplate, errEmailTemplateNotFound)
+	}
+	emailTemplates = loaded
+	return nil
+}
+
+// lookupEmailTemplate finds the template in the locale, falling back to the
+// default locale
+func lookupEmailTemplate(name, locale string) (*emailTemplate, string, error) {
+	if tmpl := emailTemplates[locale][name]; tmpl != nil {
+		return tmpl, locale, nil
+	}
+	if tmpl := emailTemplates[defaultLocale][name]; tmpl != nil {
+		return tmpl, defaultLocale, nil
+	}
+	return nil, "", fmt.Errorf("%w: %s", errEmailTemplateNotFound, name)
+}
+
+// renderEmail renders the template for the locale of the data
+func renderEmail(name string, data *EmailData) (*RenderedEmail, error) {
+	tmpl, locale, err := lookupEmailTemplate(name, data.Locale)
+	if err != nil {
+		return nil, err
+	}
+	data.Locale = locale
+	if data.AppName == "" {
+		data.AppName = getEnv("APP_NAME", "Psy Portal")
+	}
+	if data.FrontendURL == "" {
+		data.FrontendURL = getEnv("FRONTEND_URL", "http://localhost:3000")
+	}
+	if data.Year == 0 {
+		data.Year = time.Now().Year()
+	}
+
+	var subject, html, text bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := tmpl.text.ExecuteTemplate(&text, "layout", data); err != nil {
+		return nil, err
+	}
+	if err := tmpl.html.ExecuteTemplate(&html, "layout", data); err != nil {
+		return nil, err
+	}
+	return &RenderedEmail{
+		Subject: strings.TrimSpace(subject.String()),
+		HTML:    strings.TrimSpace(html.String()) + "\n",
+		Text:    strings.TrimSpace(text.String()) + "\n",
+	}, nil
+}
+
+// userLocale is the language of the user emails, the default when unset
+func userLocale(user *User) string {
+	if isSupportedLocale(user.Language) {
+		return user.Language
+	}
+	return defaultLocale
+}
+
+// notificationEmail renders the email of a notification: the template named
+// after its type if there is one, the generic template otherwise
+func notificationEmail(tx *gorm.DB, user *User, notification *Notification) (*RenderedEmail, error) {
+	data := EmailData{
+		Locale:        userLocale(user),
+		RecipientName: user.Name,
+		Notification:  notification,
+		Link:          notificationLink(notification),
+	}
+	if id, ok := notification.Data["session_id"].(float64); ok {
+		var session Session
+		if tx.First(&session, uint(id)).Error == nil {
+			data.Session = &session
+			var therapist Therapist
+			if tx.Preload("User").First(&therapist, session.TherapistID).Error == nil {
+				data.TherapistName = therapist.User.Name
+			}
+		}
+	}
+	if id, ok := notification.Data["payment_id"].(float64); ok {
+		var payment Payment
+		if tx.First(&payment, uint(id)).Error == nil {
+			data.Payment = &payment
+		}
+	}
+
+	name := notification.Type
+	if _, _, err := lookupEmailTemplate(name, data.Locale); err != nil {
+		name = fallbackEmailTemplate
+	}
+	// Type templates need the records they describe
+	if (strings.HasPrefix(name, "session_") && data.Session == nil) ||
+		(strings.HasPrefix(name, "payment_") && data.Payment == nil) {
+		name = fallbackEmailTemplate
+	}
+	return renderEmail(name, &data)
+}
+
+// sampleEmailData is what previews and the template check render
+func sampleEmailData(name, locale string) *EmailData {
+	start := time.Now().Add(24 * time.Hour).Truncate(time.Hour)
+	notificationType := name
+	if !notificationTypes[notificationType] {
+		notificationType = NotificationSystem
+	}
+	return &EmailData{
+		Locale:        locale,
+		RecipientName: "Анна",
+		Notification: &Notification{
+			ID:         1,
+			Type:       notificationType,
+			Title:      "Сессия подтверждена",
+			Message:    "Сессия " + start.Format("02.01.2006 15:04") + " подтверждена.",
+			ActionURL:  "/sessions/1",
+			ActionText: "Открыть сессию",
+			Data:       map[string]interface{}{"session_id": 1},
+		},
+		Link: getEnv("FRONTEND_URL", "http://localhost:3000") + "/sessions/1",
+		Session: &Session{
+			ID:              1,
+			StartTime:       start,
+			EndTime:         start.Add(time.Hour),
+			Status:          SessionStatusConfirmed,
+			Type:            "individual",
+			Duration:        60,
+			Price:           350000,
+			Currency:        CurrencyRUB,
+			CancelledBy:     CancelledByTherapist,
+			CancelledReason: "Болезнь",
+		},
+		TherapistName: "Мария Иванова",
+		Payment: &Payment{
+			ID:       1,
+			Amount:   350000,
+			Currency: CurrencyRUB,
+			Status:   PaymentStatusCompleted,
+		},
+	}
+}
+
+// emailTemplateNames lists the templates and the locales they exist in
+func emailTemplateNames() []EmailTemplateInfo {
+	byName := make(map[string][]string)
+	for _, locale := range supportedLocales {
+		for name := range emailTemplates[locale] {
+			byName[name] = append(byName[name], locale)
+		}
+	}
+	infos := make([]EmailTemplateInfo, 0, len(byName))
+	for name, locales := range byName {
+		infos = append(infos, EmailTemplateInfo{Name: name, Locales: locales})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// checkEmailTemplates renders every template in every locale with sample
+// data. A template that is missing a locale is reported as well, since its
+// readers would get the default language.
+func checkEmailTemplates() []EmailTemplateCheck {
+	var results []EmailTemplateCheck
+	for _, info := range emailTemplateNames() {
+		for _, locale := range supportedLocales {
+			result := EmailTemplateCheck{Name: info.Name, Locale: locale}
+			if emailTemplates[locale][info.Name] == nil {
+				result.Error = "template is missing in this locale"
+			} else if rendered, err := renderEmail(info.Name, sampleEmailData(info.Name, locale)); err != nil {
+				result.Error = err.Error()
+			} else if rendered.Subject == "" || strings.Contains(rendered.HTML+rendered.Text, "<no value>") {
+				result.Error = "rendered with an empty subject or a missing value"
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// Handlers
+func updateProfileLanguage(c *gin.Context) {
+	var req LanguageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Пользователь не найден",
+		})
+		return
+	}
+	user.Language = req.Language
+	if err := db.Save(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении настроек",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    user,
+	})
+}
+
+func getEmailTemplates(c *gin.Context) {
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    emailTemplateNames(),
+	})
+}
+
+// previewEmailTemplate renders a template with sample data. With
+// ?format=html or ?format=text the email itself is returned, for a browser
+// tab; by default the subject and both versions come as JSON.
+func previewEmailTemplate(c *gin.Context) {
+	locale := c.DefaultQuery("locale", defaultLocale)
+	if !isSupportedLocale(locale) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неподдерживаемый язык",
+		})
+		return
+	}
+
+	name := c.Param("name")
+	rendered, err := renderEmail(name, sampleEmailData(name, locale))
+	if errors.Is(err, errEmailTemplateNotFound) {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Шаблон не найден",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при отрисовке шаблона: " + err.Error(),
+		})
+		return
+	}
+
+	switch c.Query("format") {
+	case "html":
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(rendered.HTML))
+	case "text":
+		c.String(http.StatusOK, rendered.Text)
+	default:
+		c.JSON(http.StatusOK, ApiResponse{
+			Success: true,
+			Data:    rendered,
+		})
+	}
+}
+
+func checkEmailTemplatesHandler(c *gin.Context) {
+	results := checkEmailTemplates()
+	ok := true
+	for _, result := range results {
+		if result.Error != "" {
+			ok = false
+		}
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: ok,
+		Data:    results,
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestEmailTemplates(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatalf("loading templates: %v", err)
+	}
+
+	// Templates every notification depends on, in every locale
+	required := []string{
+		fallbackEmailTemplate,
+		NotificationSessionReminder,
+	}
+	for _, name := range required {
+		for _, locale := range supportedLocales {
+			if emailTemplates[locale][name] == nil {
+				t.Errorf("%s/%s: template is missing", locale, name)
+			}
+		}
+	}
+
+	results := checkEmailTemplates()
+	if len(results) == 0 {
+		t.Fatal("no templates were checked")
+	}
+	for _, result := range results {
+		t.Run(result.Locale+"/"+result.Name, func(t *testing.T) {
+			if result.Error != "" {
+				t.Error(result.Error)
+			}
+		})
+	}
+}
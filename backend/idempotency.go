@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	idempotencyTTL = 24 * time.Hour
+	// How long a key stays locked by a request that is still running. A
+	// crashed request frees the key after this instead of a day.
+	idempotencyLockTTL = 2 * time.Minute
+)
+
+// idempotencyRecord is stored under the client key. While the first request
+// runs it only holds the fingerprint.
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// IdempotencyKey stores the records in Postgres when there is no Redis
+type IdempotencyKey struct {
+	Key       string    `gorm:"primaryKey"`
+	Record    []byte    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// idempotencyStore keeps the records: in Redis, or in Postgres without it
+type idempotencyStore interface {
+	// acquire stores the record unless the key is taken and reports whether it did
+	acquire(ctx context.Context, key string, record []byte, ttl time.Duration) (bool, error)
+	// get returns nil when the key is free
+	get(ctx context.Context, key string) ([]byte, error)
+	set(ctx context.Context, key string, record []byte, ttl time.Duration) error
+	release(ctx context.Context, key string) error
+}
+
+func currentIdempotencyStore() idempotencyStore {
+	if rdb != nil {
+		return redisIdempotencyStore{}
+	}
+	return dbIdempotencyStore{}
+}
+
+type redisIdempotencyStore struct{}
+
+func (redisIdempotencyStore) acquire(ctx context.Context, key string, record []byte, ttl time.Duration) (bool, error) {
+	return rdb.SetNX(ctx, key, record, ttl).Result()
+}
+
+func (redisIdempotencyStore) get(ctx context.Context, key string) ([]byte, error) {
+	raw, err := rdb.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return raw, err
+}
+
+func (redisIdempotencyStore) set(ctx context.Context, key string, record []byte, ttl time.Duration) error {
+	return rdb.Set(ctx, key, record, ttl).Err()
+}
+
+func (redisIdempotencyStore) release(ctx context.Context, key string) error {
+	return rdb.Del(ctx, key).Err()
+}
+
+type dbIdempotencyStore struct{}
+
+// acquire inserts the key, or takes over an expired one
+func (dbIdempotencyStore) acquire(ctx context.Context, key string, record []byte, ttl time.Duration) (bool, error) {
+	row := IdempotencyKey{Key: key, Record: record, ExpiresAt: time.Now().Add(ttl)}
+	result := db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"record", "expires_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "idempotency_keys.expires_at <= ?", Vars: []interface{}{time.Now()}},
+		}},
+	}).Create(&row)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (dbIdempotencyStore) get(ctx context.Context, key string) ([]byte, error) {
+	var row IdempotencyKey
+	err := db.WithContext(ctx).Where("key = ? AND expires_at > ?", key, time.Now()).First(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return row.Record, err
+}
+
+func (dbIdempotencyStore) set(ctx context.Context, key string, record []byte, ttl time.Duration) error {
+	return db.WithContext(ctx).Model(&IdempotencyKey{}).Where("key = ?", key).
+		Updates(map[string]interface{}{"record": record, "expires_at": time.Now().Add(ttl)}).Error
+}
+
+func (dbIdempotencyStore) release(ctx context.Context, key string) error {
+	return db.WithContext(ctx).Where("key = ?", key).Delete(&IdempotencyKey{}).Error
+}
+
+// purgeIdempotencyKeys deletes the expired keys kept in Postgres
+func purgeIdempotencyKeys() {
+	if err := db.Where("expires_at <= ?", time.Now()).Delete(&IdempotencyKey{}).Error; err != nil {
+		log.Printf("Idempotency keys purge: %v", err)
+	}
+}
+
+func init() {
+	registerPeriodicJob(JobPurgeIdempotencyKeys, time.Hour, func(context.Context) { purgeIdempotencyKeys() })
+}
+
+// idempotencyWriter keeps a copy of the response to store it
+type idempotencyWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idempotencyWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotency honors the Idempotency-Key header: the first response for a key
+// is stored for 24 hours and replayed for repeats with the same request body.
+// Keys are scoped to the user, or to the client IP for anonymous requests.
+// Server errors are not stored so that the request can be retried; a request
+// that never finishes holds its key for idempotencyLockTTL only.
+func idempotency() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Слишком длинный Idempotency-Key",
+			})
+			c.Abort()
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Не удалось прочитать запрос",
+			})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256([]byte(c.Request.Method + " " + c.Request.URL.Path + "\n" + string(body)))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		scope := fmt.Sprintf("user:%d", c.GetUint("user_id"))
+		if _, authenticated := c.Get("user_id"); !authenticated {
+			scope = "ip:" + c.ClientIP()
+		}
+		storeKey := "idempotency:" + scope + ":" + key
+
+		// The store is written with a context of its own: the client going
+		// away must not leave the key locked
+		ctx := context.Background()
+		store := currentIdempotencyStore()
+		pending, _ := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+		acquired, err := store.acquire(ctx, storeKey, pending, idempotencyLockTTL)
+		if err != nil {
+			// Without the store the request is processed as if it had no key
+			log.Printf("Idempotency store unavailable: %v", err)
+			c.Next()
+			return
+		}
+
+		if !acquired {
+			replayIdempotent(c, store, storeKey, fingerprint)
+			return
+		}
+
+		// Unless the response gets stored, the key is released, also when
+		// the handler panics: the request may then be retried
+		stored := false
+		defer func() {
+			if !stored {
+				if err := store.release(ctx, storeKey); err != nil {
+					log.Printf("Failed to release idempotency key: %v", err)
+				}
+			}
+		}()
+
+		writer := &idempotencyWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		if writer.Status() >= http.StatusInternalServerError {
+			return
+		}
+		record, _ := json.Marshal(idempotencyRecord{
+			Fingerprint: fingerprint,
+			Done:        true,
+			Status:      writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+		})
+		// A response that fails to be stored keeps the lock until it
+		// expires; releasing it would let a repeat run the request again
+		if err := store.set(ctx, storeKey, record, idempotencyTTL); err != nil {
+			log.Printf("Failed to store idempotent response: %v", err)
+		}
+		stored = true
+	}
+}
+
+func replayIdempotent(c *gin.Context, store idempotencyStore, key, fingerprint string) {
+	raw, err := store.get(c.Request.Context(), key)
+	var record idempotencyRecord
+	if err == nil && raw != nil {
+		err = json.Unmarshal(raw, &record)
+	}
+	if err != nil {
+		log.Printf("Failed to read idempotent response: %v", err)
+	}
+
+	switch {
+	case err != nil || raw == nil:
+		// The first request failed and released the key in the meantime
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Запрос с этим Idempotency-Key обрабатывается, повторите позже",
+		})
+	case record.Fingerprint != fingerprint:
+		c.JSON(http.StatusUnprocessableEntity, ApiResponse{
+			Success: false,
+			Error:   "Idempotency-Key уже использован для другого запроса",
+		})
+	case !record.Done:
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Запрос с этим Idempotency-Key обрабатывается, повторите позже",
+		})
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(record.Status, record.ContentType, record.Body)
+	}
+	c.Abort()
+}
@@ -0,0 +1,771 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Background jobs are kept in Redis. Each queue has a ready list, a
+// processing list for jobs taken by a worker, a sorted set of jobs waiting
+// for their time (delayed ones and retries) and a sorted set of dead jobs
+// that ran out of attempts. Job bodies are stored apart under their ID.
+const (
+	jobQueueDefault = "default"
+	jobQueueEmails  = "emails"
+	jobQueueStats   = "stats"
+
+	defaultJobMaxAttempts = 5
+	jobBaseBackoff        = 10 * time.Second
+	jobMaxBackoff         = time.Hour
+	jobPollInterval       = time.Second
+	jobDeadListLimit      = 100
+	// Job bodies expire this long after the job was due, dead jobs are
+	// dropped this long after they failed
+	jobDataTTL = 7 * 24 * time.Hour
+)
+
+// Job types
+const (
+	JobSendEmail        = "email.send"
+	JobRecalculateStats = "stats.recalculate"
+
+	// Periodic jobs
+	JobRefreshRates         = "rates.refresh"
+	JobSendReceipts         = "receipts.send"
+	JobExpirePackages       = "packages.expire"
+	JobExpirePayments       = "payments.expire"
+	JobPurgeIdempotencyKeys = "idempotency.purge"
+	JobSendDeliveries       = "deliveries.send"
+	JobSendReminders        = "reminders.send"
+	JobRelayOutbox          = "outbox.relay"
+	JobTrimEvents           = "events.trim"
+	JobSyncRefunds          = "refunds.sync"
+	JobSendWebhooks         = "webhooks.send"
+)
+
+// jobTypeQueues are the queues job types go to unless told otherwise
+var jobTypeQueues = map[string]string{
+	JobSendEmail:        jobQueueEmails,
+	JobRecalculateStats: jobQueueStats,
+}
+
+type Job struct {
+	ID          string          `json:"id"`
+	Queue       string          `json:"queue"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	EnqueuedAt  time.Time       `json:"enqueued_at"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	FailedAt    *time.Time      `json:"failed_at,omitempty"`
+}
+
+// JobOptions tune a job when it is enqueued
+type JobOptions struct {
+	Queue       string
+	Delay       time.Duration
+	RunAt       time.Time
+	MaxAttempts int
+}
+
+// JobHandler runs a job. Returning an error retries the job, returning
+// errJobPermanent (wrapped) sends it to the dead jobs right away.
+type JobHandler func(ctx context.Context, payload json.RawMessage) error
+
+type JobQueueStats struct {
+	Queue      string `json:"queue"`
+	Ready      int64  `json:"ready"`
+	Scheduled  int64  `json:"scheduled"`
+	Processing int64  `json:"processing"`
+	Dead       int64  `json:"dead"`
+}
+
+type EnqueueJobRequest struct {
+	Queue        string          `json:"queue"`
+	Type         string          `json:"type" binding:"required"`
+	Payload      json.RawMessage `json:"payload"`
+	DelaySeconds int             `json:"delay_seconds" binding:"min=0"`
+}
+
+var (
+	errJobsUnavailable = errors.New("job queue unavailable")
+	errJobPermanent    = errors.New("permanent job failure")
+	errJobNotFound     = errors.New("job not found")
+	errUnknownJobType  = errors.New("unknown job type")
+)
+
+var (
+	jobHandlersMu sync.RWMutex
+	jobHandlers   = map[string]JobHandler{}
+)
+
+func jobReadyKey(queue string) string      { return "jobs:ready:" + queue }
+func jobProcessingKey(queue string) string { return "jobs:processing:" + queue }
+func jobScheduledKey(queue string) string  { return "jobs:scheduled:" + queue }
+func jobDeadKey(queue string) string       { return "jobs:dead:" + queue }
+func jobDataKey(id string) string          { return "jobs:data:" + id }
+func jobLeaseKey(id string) string         { return "jobs:lease:" + id }
+func periodicJobKey(jobType string) string { return "jobs:periodic:" + jobType }
+
+const jobQueuesKey = "jobs:queues"
+
+// promoteJobsScript moves the due scheduled jobs of a queue to its ready list
+var promoteJobsScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('LPUSH', KEYS[2], id)
+end
+return #ids
+`)
+
+// takeJobScript moves the oldest ready job to processing and leases it in
+// one step, so a job is never in processing without a lease
+var takeJobScript = redis.NewScript(`
+local id = redis.call('RPOP', KEYS[1])
+if not id then
+	return false
+end
+redis.call('LPUSH', KEYS[2], id)
+redis.call('SET', ARGV[1] .. id, ARGV[2], 'EX', ARGV[3])
+return id
+`)
+
+// registerJobHandler makes a job type runnable by workers
+func registerJobHandler(jobType string, handler JobHandler) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[jobType] = handler
+}
+
+func jobHandler(jobType string) (JobHandler, bool) {
+	jobHandlersMu.RLock()
+	defer jobHandlersMu.RUnlock()
+	handler, ok := jobHandlers[jobType]
+	return handler, ok
+}
+
+// jobTimeout bounds one run of a job, the lease outlives it a little
+func jobTimeout() time.Duration {
+	if d, err := time.ParseDuration(getEnv("JOB_TIMEOUT", "5m")); err == nil && d > 0 {
+		return d
+	}
+	return 5 * time.Minute
+}
+
+// jobBackoff is the delay before the next attempt: 10s, 20s, 40s... up to
+// an hour
+func jobBackoff(attempts int) time.Duration {
+	delay := time.Duration(float64(jobBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if delay > jobMaxBackoff || delay <= 0 {
+		return jobMaxBackoff
+	}
+	return delay
+}
+
+// enqueueJob stores a job for the workers of its queue
+func enqueueJob(ctx context.Context, jobType string, payload interface{}, opts JobOptions) (*Job, error) {
+	if rdb == nil {
+		return nil, errJobsUnavailable
+	}
+	if _, ok := jobHandler(jobType); !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownJobType, jobType)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := Job{
+		ID:          randomHex(16),
+		Queue:       opts.Queue,
+		Type:        jobType,
+		Payload:     raw,
+		MaxAttempts: opts.MaxAttempts,
+		EnqueuedAt:  now,
+		RunAt:       opts.RunAt,
+	}
+	if job.Queue == "" {
+		job.Queue = jobTypeQueues[jobType]
+	}
+	if job.Queue == "" {
+		job.Queue = jobQueueDefault
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = defaultJobMaxAttempts
+	}
+	if job.RunAt.IsZero() {
+		job.RunAt = now.Add(opts.Delay)
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, jobDataKey(job.ID), data, job.RunAt.Sub(now)+jobDataTTL)
+		pipe.SAdd(ctx, jobQueuesKey, job.Queue)
+		if job.RunAt.After(now) {
+			pipe.ZAdd(ctx, jobScheduledKey(job.Queue), redis.Z{Score: float64(job.RunAt.UnixMilli()), Member: job.ID})
+		} else {
+			pipe.LPush(ctx, jobReadyKey(job.Queue), job.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func loadJob(ctx context.Context, id string) (*Job, error) {
+	data, err := rdb.Get(ctx, jobDataKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// runJob calls the handler of the job, turning a panic into an error
+func runJob(ctx context.Context, job *Job) (err error) {
+	handler, ok := jobHandler(job.Type)
+	if !ok {
+		return fmt.Errorf("%w: %w: %s", errJobPermanent, errUnknownJobType, job.Type)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, jobTimeout())
+	defer cancel()
+	return handler(ctx, job.Payload)
+}
+
+// finishJob records the outcome: done jobs are dropped, failed ones are
+// scheduled again or, out of attempts, moved to the dead jobs
+func finishJob(ctx context.Context, job *Job, runErr error) error {
+	queue := job.Queue
+	if runErr == nil {
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.LRem(ctx, jobProcessingKey(queue), 1, job.ID)
+			pipe.Del(ctx, jobDataKey(job.ID), jobLeaseKey(job.ID))
+			return nil
+		})
+		return err
+	}
+
+	now := time.Now()
+	job.Attempts++
+	job.LastError = runErr.Error()
+	dead := job.Attempts >= job.MaxAttempts || errors.Is(runErr, errJobPermanent)
+	ttl := jobDataTTL
+	if dead {
+		job.FailedAt = &now
+	} else {
+		job.RunAt = now.Add(jobBackoff(job.Attempts))
+		ttl += job.RunAt.Sub(now)
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, jobDataKey(job.ID), data, ttl)
+		pipe.LRem(ctx, jobProcessingKey(queue), 1, job.ID)
+		pipe.Del(ctx, jobLeaseKey(job.ID))
+		if dead {
+			pipe.ZAdd(ctx, jobDeadKey(queue), redis.Z{Score: float64(now.UnixMilli()), Member: job.ID})
+		} else {
+			pipe.ZAdd(ctx, jobScheduledKey(queue), redis.Z{Score: float64(job.RunAt.UnixMilli()), Member: job.ID})
+		}
+		return nil
+	})
+	return err
+}
+
+// processNextJob takes and runs one ready job of the queue. It reports
+// whether there was one.
+func processNextJob(ctx context.Context, queue, workerID string) (bool, error) {
+	lease := jobTimeout() + 30*time.Second
+	id, err := takeJobScript.Run(ctx, rdb,
+		[]string{jobReadyKey(queue), jobProcessingKey(queue)},
+		"jobs:lease:", workerID, int(lease/time.Second)).Text()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	job, err := loadJob(ctx, id)
+	if errors.Is(err, errJobNotFound) {
+		// Deleted while waiting, nothing to run
+		rdb.LRem(ctx, jobProcessingKey(queue), 1, id)
+		rdb.Del(ctx, jobLeaseKey(id))
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	runErr := runJob(ctx, job)
+	if runErr != nil {
+		log.Printf("Job %s (%s) attempt %d failed: %v", job.ID, job.Type, job.Attempts+1, runErr)
+	}
+	// The outcome is recorded even when the worker is stopping
+	return true, finishJob(context.WithoutCancel(ctx), job, runErr)
+}
+
+// dropExpiredDeadJobs forgets the dead jobs whose bodies have expired
+func dropExpiredDeadJobs(ctx context.Context, queue string) {
+	before := strconv.FormatInt(time.Now().Add(-jobDataTTL).UnixMilli(), 10)
+	if err := rdb.ZRemRangeByScore(ctx, jobDeadKey(queue), "-inf", "("+before).Err(); err != nil {
+		log.Printf("Job queue %s: %v", queue, err)
+	}
+}
+
+// requeueAbandonedJobs returns jobs whose worker died to the ready list: a
+// job in processing without a lease is not being run by anybody
+func requeueAbandonedJobs(ctx context.Context, queue string) {
+	ids, err := rdb.LRange(ctx, jobProcessingKey(queue), 0, -1).Result()
+	if err != nil {
+		log.Printf("Job queue %s: %v", queue, err)
+		return
+	}
+	for _, id := range ids {
+		if rdb.Exists(ctx, jobLeaseKey(id)).Val() > 0 {
+			continue
+		}
+		if removed := rdb.LRem(ctx, jobProcessingKey(queue), 1, id).Val(); removed > 0 {
+			rdb.RPush(ctx, jobReadyKey(queue), id)
+			log.Printf("Job %s of queue %s abandoned by its worker, requeued", id, queue)
+		}
+	}
+}
+
+// jobQueues are the queues this process works on, from JOB_QUEUES
+func jobQueues() []string {
+	var queues []string
+	for _, queue := range strings.Split(getEnv("JOB_QUEUES", "default,emails,stats"), ",") {
+		if queue = strings.TrimSpace(queue); queue != "" {
+			queues = append(queues, queue)
+		}
+	}
+	return queues
+}
+
+// startJobWorkers runs JOB_CONCURRENCY workers per queue until the context
+// is done, plus a loop promoting due jobs, recovering abandoned ones and
+// making sure the periodic jobs are scheduled. The returned wait group is
+// done when the workers have finished their jobs.
+func startJobWorkers(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	if rdb == nil {
+		log.Println("Redis is not configured, background jobs are disabled")
+		startLocalPeriodicJobs(ctx)
+		return &wg
+	}
+	schedulePeriodicJobs(ctx)
+	concurrency, err := strconv.Atoi(getEnv("JOB_CONCURRENCY", "2"))
+	if err != nil || concurrency < 1 {
+		concurrency = 1
+	}
+	hostname, _ := os.Hostname()
+	queues := jobQueues()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(jobPollInterval)
+		defer ticker.Stop()
+		reapEvery := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, queue := range queues {
+				now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+				if err := promoteJobsScript.Run(ctx, rdb, []string{jobScheduledKey(queue), jobReadyKey(queue)}, now).Err(); err != nil && ctx.Err() == nil {
+					log.Printf("Job queue %s: %v", queue, err)
+				}
+			}
+			if reapEvery++; reapEvery%60 == 0 {
+				for _, queue := range queues {
+					requeueAbandonedJobs(ctx, queue)
+					dropExpiredDeadJobs(ctx, queue)
+				}
+				schedulePeriodicJobs(ctx)
+			}
+		}
+	}()
+
+	for _, queue := range queues {
+		for i := 0; i < concurrency; i++ {
+			workerID := fmt.Sprintf("%s:%d:%s:%d", hostname, os.Getpid(), queue, i)
+			wg.Add(1)
+			go func(queue string) {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					found, err := processNextJob(ctx, queue, workerID)
+					if err != nil && ctx.Err() == nil {
+						log.Printf("Job worker %s: %v", workerID, err)
+					}
+					if !found || err != nil {
+						select {
+						case <-ctx.Done():
+						case <-time.After(jobPollInterval):
+						}
+					}
+				}
+			}(queue)
+		}
+	}
+	log.Printf("Job workers started for queues %s", strings.Join(queues, ", "))
+	return &wg
+}
+
+// retryDeadJob puts a dead job back to the ready list with fresh attempts
+func retryDeadJob(ctx context.Context, id string) (*Job, error) {
+	job, err := loadJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if rdb.ZScore(ctx, jobDeadKey(job.Queue), id).Err() != nil {
+		return nil, errJobNotFound
+	}
+	job.Attempts = 0
+	job.FailedAt = nil
+	job.RunAt = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, jobDataKey(id), data, jobDataTTL)
+		pipe.ZRem(ctx, jobDeadKey(job.Queue), id)
+		pipe.LPush(ctx, jobReadyKey(job.Queue), id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Job handlers of this package
+func init() {
+	registerJobHandler(JobSendEmail, func(ctx context.Context, payload json.RawMessage) error {
+		var message EmailMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			return fmt.Errorf("%w: %v", errJobPermanent, err)
+		}
+		_, err := emailSender.SendEmail(ctx, message)
+		return err
+	})
+	// The platform stats are kept warm by a refresh every few minutes
+	registerPeriodicJob(JobRecalculateStats, 5*time.Minute, func(ctx context.Context) {
+		if _, err := refreshPlatformStats(ctx); err != nil {
+			log.Printf("Platform stats not refreshed: %v", err)
+		}
+	})
+}
+
+// periodicJob is background work repeated at an interval. With Redis it runs
+// as a job, one chain of runs for all instances: each run schedules the next,
+// and the current run is named by a token stored under periodicJobKey.
+// Without Redis every instance runs it on a ticker.
+type periodicJob struct {
+	jobType  string
+	interval time.Duration
+	run      func(ctx context.Context)
+}
+
+// periodicJobRun is the payload of a periodic job. A job without a token was
+// enqueued by hand and runs once.
+type periodicJobRun struct {
+	Token string `json:"token,omitempty"`
+}
+
+var periodicJobs []periodicJob
+
+// registerPeriodicJob makes the work run every interval. Errors are for run
+// to log: a failed run is not retried, the next one comes anyway.
+func registerPeriodicJob(jobType string, interval time.Duration, run func(ctx context.Context)) {
+	p := periodicJob{jobType: jobType, interval: interval, run: run}
+	periodicJobs = append(periodicJobs, p)
+	registerJobHandler(jobType, func(ctx context.Context, payload json.RawMessage) error {
+		var current periodicJobRun
+		json.Unmarshal(payload, &current)
+		if current.Token == "" {
+			run(ctx)
+			return nil
+		}
+		if !ownsPeriodicJob(ctx, p, current.Token) {
+			// Replaced by another run, this chain ends here
+			return nil
+		}
+		defer func() {
+			if err := schedulePeriodicJob(context.WithoutCancel(ctx), p, p.interval); err != nil {
+				log.Printf("Periodic job %s not rescheduled: %v", p.jobType, err)
+			}
+		}()
+		run(ctx)
+		return nil
+	})
+}
+
+// periodicJobTTL keeps the token of a scheduled run until well after the run
+// is due, so that it is not scheduled twice while waiting for a worker
+func periodicJobTTL(delay time.Duration) time.Duration {
+	return delay + jobTimeout() + 2*time.Minute
+}
+
+// ownsPeriodicJob reports whether the token names the current run. A run
+// whose token expired takes the job back unless another run has it.
+func ownsPeriodicJob(ctx context.Context, p periodicJob, token string) bool {
+	current, err := rdb.Get(ctx, periodicJobKey(p.jobType)).Result()
+	if errors.Is(err, redis.Nil) {
+		taken, err := rdb.SetNX(ctx, periodicJobKey(p.jobType), token, periodicJobTTL(0)).Result()
+		return err == nil && taken
+	}
+	return err == nil && current == token
+}
+
+// schedulePeriodicJob makes a new run the current one and enqueues it
+func schedulePeriodicJob(ctx context.Context, p periodicJob, delay time.Duration) error {
+	token := randomHex(16)
+	if err := rdb.Set(ctx, periodicJobKey(p.jobType), token, periodicJobTTL(delay)).Err(); err != nil {
+		return err
+	}
+	_, err := enqueueJob(ctx, p.jobType, periodicJobRun{Token: token}, JobOptions{Delay: delay, MaxAttempts: 1})
+	return err
+}
+
+// schedulePeriodicJobs enqueues a run of every periodic job that has none,
+// on the first start or after a chain was lost. Instances racing here
+// schedule it once: only the one that stores the token enqueues.
+func schedulePeriodicJobs(ctx context.Context) {
+	for _, p := range periodicJobs {
+		token := randomHex(16)
+		taken, err := rdb.SetNX(ctx, periodicJobKey(p.jobType), token, periodicJobTTL(0)).Result()
+		if err != nil || !taken {
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Periodic job %s: %v", p.jobType, err)
+			}
+			continue
+		}
+		if _, err := enqueueJob(ctx, p.jobType, periodicJobRun{Token: token}, JobOptions{MaxAttempts: 1}); err != nil {
+			log.Printf("Periodic job %s not enqueued: %v", p.jobType, err)
+			rdb.Del(ctx, periodicJobKey(p.jobType))
+		}
+	}
+}
+
+// startLocalPeriodicJobs runs the periodic jobs on tickers of this instance
+func startLocalPeriodicJobs(ctx context.Context) {
+	for _, p := range periodicJobs {
+		go func(p periodicJob) {
+			ticker := time.NewTicker(p.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					p.run(ctx)
+				}
+			}
+		}(p)
+	}
+}
+
+// startBackgroundWorkers starts the job workers and the event subscribers
+func startBackgroundWorkers(ctx context.Context) *sync.WaitGroup {
+	workers := startJobWorkers(ctx)
+	startEventSubscribers(ctx, workers)
+	return workers
+}
+
+// runWorkerMode runs the background workers until SIGINT or SIGTERM, then
+// lets the running jobs finish
+func runWorkerMode() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Println("Running in worker mode")
+	workers := startBackgroundWorkers(ctx)
+	<-ctx.Done()
+	log.Println("Stopping workers")
+	workers.Wait()
+}
+
+// Handlers
+func jobErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errJobNotFound):
+		return http.StatusNotFound, "Задача не найдена"
+	case errors.Is(err, errUnknownJobType):
+		return http.StatusBadRequest, "Неизвестный тип задачи"
+	case errors.Is(err, errJobsUnavailable):
+		return http.StatusServiceUnavailable, "Очередь задач недоступна"
+	}
+	return http.StatusInternalServerError, "Ошибка очереди задач"
+}
+
+func getJobQueues(c *gin.Context) {
+	if rdb == nil {
+		status, message := jobErrorStatus(errJobsUnavailable)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+	ctx := c.Request.Context()
+	queues, err := rdb.SMembers(ctx, jobQueuesKey).Result()
+	if err != nil {
+		status, message := jobErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+
+	stats := make([]JobQueueStats, 0, len(queues))
+	for _, queue := range queues {
+		stats = append(stats, JobQueueStats{
+			Queue:      queue,
+			Ready:      rdb.LLen(ctx, jobReadyKey(queue)).Val(),
+			Scheduled:  rdb.ZCard(ctx, jobScheduledKey(queue)).Val(),
+			Processing: rdb.LLen(ctx, jobProcessingKey(queue)).Val(),
+			Dead:       rdb.ZCard(ctx, jobDeadKey(queue)).Val(),
+		})
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    stats,
+	})
+}
+
+// getDeadJobs lists the latest dead jobs of a queue
+func getDeadJobs(c *gin.Context) {
+	if rdb == nil {
+		status, message := jobErrorStatus(errJobsUnavailable)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+	ctx := c.Request.Context()
+	queue := c.DefaultQuery("queue", jobQueueDefault)
+	ids, err := rdb.ZRevRange(ctx, jobDeadKey(queue), 0, jobDeadListLimit-1).Result()
+	if err != nil {
+		status, message := jobErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+
+	jobs := make([]Job, 0, len(ids))
+	for _, id := range ids {
+		if job, err := loadJob(ctx, id); err == nil {
+			jobs = append(jobs, *job)
+		}
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    jobs,
+	})
+}
+
+func retryJob(c *gin.Context) {
+	if rdb == nil {
+		status, message := jobErrorStatus(errJobsUnavailable)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+	job, err := retryDeadJob(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		status, message := jobErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    job,
+	})
+}
+
+// deleteDeadJob drops a dead job that is not worth retrying
+func deleteDeadJob(c *gin.Context) {
+	if rdb == nil {
+		status, message := jobErrorStatus(errJobsUnavailable)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+	ctx := c.Request.Context()
+	job, err := loadJob(ctx, c.Param("id"))
+	if err == nil && rdb.ZRem(ctx, jobDeadKey(job.Queue), job.ID).Val() == 0 {
+		err = errJobNotFound
+	}
+	if err != nil {
+		status, message := jobErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+	rdb.Del(ctx, jobDataKey(job.ID))
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+	})
+}
+
+func enqueueJobHandler(c *gin.Context) {
+	var req EnqueueJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	job, err := enqueueJob(c.Request.Context(), req.Type, req.Payload, JobOptions{
+		Queue: req.Queue,
+		Delay: time.Duration(req.DelaySeconds) * time.Second,
+	})
+	if err != nil {
+		status, message := jobErrorStatus(err)
+		c.JSON(status, ApiResponse{Success: false, Error: message})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    job,
+	})
+}
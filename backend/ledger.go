@@ -0,0 +1,546 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ledger accounts. Debits and credits of every transaction are equal, so the
+// books always balance: cash is what the platform holds, the other accounts
+// tell whom it belongs to.
+const (
+	LedgerAccountCash              = "cash"
+	LedgerAccountPlatformRevenue   = "platform_revenue"
+	LedgerAccountTherapistPayable  = "therapist_payable"
+	LedgerAccountClientPrepayments = "client_prepayments"
+)
+
+// Ledger transaction types
+const (
+	LedgerTypeCharge = "charge"
+	LedgerTypeRefund = "refund"
+	LedgerTypePayout = "payout"
+	LedgerTypeBonus  = "bonus"
+)
+
+// LedgerTransaction groups balanced entries. Reference makes posting
+// idempotent: a payment or refund is recorded once however often its
+// status is applied.
+type LedgerTransaction struct {
+	ID                uint          `json:"id" gorm:"primaryKey"`
+	Reference         string        `json:"reference" gorm:"uniqueIndex;not null"`
+	Type              string        `json:"type" gorm:"not null;index"`
+	TherapistID       *uint         `json:"therapist_id,omitempty" gorm:"index"`
+	SessionID         *uint         `json:"session_id,omitempty" gorm:"index"` // earned once the session is over
+	PaymentID         *uint         `json:"payment_id,omitempty" gorm:"index"`
+	RefundID          *uint         `json:"refund_id,omitempty"`
+	PayoutID          *uint         `json:"payout_id,omitempty"`
+	CommissionPercent int           `json:"commission_percent"`
+	Description       string        `json:"description,omitempty"`
+	Entries           []LedgerEntry `json:"entries,omitempty" gorm:"foreignKey:TransactionID"`
+	CreatedAt         time.Time     `json:"created_at" gorm:"index"`
+}
+
+type LedgerEntry struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TransactionID uint      `json:"transaction_id" gorm:"not null;index"`
+	Account       string    `json:"account" gorm:"not null;index"`
+	TherapistID   *uint     `json:"therapist_id,omitempty" gorm:"index"`
+	Debit         int       `json:"debit"`  // in kopecks
+	Credit        int       `json:"credit"` // in kopecks
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// PayoutAccount holds the bank details and the commission of a therapist
+type PayoutAccount struct {
+	ID                uint      `json:"id" gorm:"primaryKey"`
+	TherapistID       uint      `json:"therapist_id" gorm:"uniqueIndex;not null"`
+	RecipientName     string    `json:"recipient_name"`
+	INN               string    `json:"inn"`
+	BankAccount       string    `json:"bank_account"`
+	BIK               string    `json:"bik"`
+	CommissionPercent *int      `json:"commission_percent,omitempty"` // platform default when empty
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+type PayoutAccountRequest struct {
+	RecipientName     string `json:"recipient_name" binding:"required"`
+	INN               string `json:"inn" binding:"required,numeric,min=10,max=12"`
+	BankAccount       string `json:"bank_account" binding:"required,numeric,len=20"`
+	BIK               string `json:"bik" binding:"required,numeric,len=9"`
+	CommissionPercent *int   `json:"commission_percent" binding:"omitempty,min=0,max=100"`
+}
+
+type TherapistEarnings struct {
+	TherapistID uint      `json:"therapist_id"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	Sessions    int       `json:"sessions"`
+	Gross       int       `json:"gross"`      // charged to clients
+	Commission  int       `json:"commission"` // kept by the platform, net of refunds
+	Refunds     int       `json:"refunds"`    // returned to clients
+	Net         int       `json:"net"`        // earned by the therapist
+	PaidOut     int       `json:"paid_out"`
+	Balance     int       `json:"balance"`  // owed to the therapist now
+	Upcoming    int       `json:"upcoming"` // for sessions not held yet, owed once they are
+}
+
+var errUnbalancedTransaction = errors.New("ledger transaction is not balanced")
+
+// platformCommissionPercent is the commission for therapists without their own
+func platformCommissionPercent() int {
+	percent, err := strconv.Atoi(getEnv("PLATFORM_COMMISSION_PERCENT", "20"))
+	if err != nil || percent < 0 || percent > 100 {
+		return 20
+	}
+	return percent
+}
+
+func therapistCommissionPercent(tx *gorm.DB, therapistID uint) int {
+	var account PayoutAccount
+	if err := tx.Where("therapist_id = ?", therapistID).First(&account).Error; err == nil && account.CommissionPercent != nil {
+		return *account.CommissionPercent
+	}
+	return platformCommissionPercent()
+}
+
+// checkBalanced makes sure the debits of the entries equal their credits
+func checkBalanced(reference string, entries []LedgerEntry) error {
+	debit, credit := 0, 0
+	for _, e := range entries {
+		debit += e.Debit
+		credit += e.Credit
+	}
+	if debit != credit {
+		return fmt.Errorf("%w: %s debit %d, credit %d", errUnbalancedTransaction, reference, debit, credit)
+	}
+	return nil
+}
+
+// postLedgerTransaction records the transaction with its entries unless one
+// with the same reference exists
+func postLedgerTransaction(tx *gorm.DB, txn *LedgerTransaction, entries []LedgerEntry) error {
+	if err := checkBalanced(txn.Reference, entries); err != nil {
+		return err
+	}
+
+	result := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "reference"}}, DoNothing: true}).Create(txn)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	lines := entries[:0]
+	for _, e := range entries {
+		if e.Debit == 0 && e.Credit == 0 {
+			continue
+		}
+		e.TransactionID = txn.ID
+		lines = append(lines, e)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return tx.Create(&lines).Error
+}
+
+// paymentTherapistID returns the therapist a payment is for, if any
+func paymentTherapistID(tx *gorm.DB, payment *Payment) *uint {
+	if payment.SessionID == nil {
+		return nil
+	}
+	var session Session
+	if err := tx.Select("therapist_id").First(&session, *payment.SessionID).Error; err != nil {
+		return nil
+	}
+	return &session.TherapistID
+}
+
+// splitCommission divides an amount into the platform commission, rounded
+// down, and the therapist share
+func splitCommission(amount, percent int) (commission, share int) {
+	commission = amount * percent / 100
+	return commission, amount - commission
+}
+
+// chargeEntries take the amount from the given account and split it between
+// the platform and the therapist
+func chargeEntries(from string, amount int, therapistID *uint, percent int) []LedgerEntry {
+	commission, share := splitCommission(amount, percent)
+	return []LedgerEntry{
+		{Account: from, Debit: amount},
+		{Account: LedgerAccountPlatformRevenue, TherapistID: therapistID, Credit: commission},
+		{Account: LedgerAccountTherapistPayable, TherapistID: therapistID, Credit: share},
+	}
+}
+
+// refundEntries reverse amount of a charge of which refunded was returned
+// before. The commission reversed is the difference of the rounded
+// commissions of what is refunded after and before, so refunds adding up to
+// the charge reverse its split exactly.
+func refundEntries(refunded, amount int, therapistID *uint, percent int) []LedgerEntry {
+	before, _ := splitCommission(refunded, percent)
+	after, _ := splitCommission(refunded+amount, percent)
+	return []LedgerEntry{
+		{Account: LedgerAccountCash, Credit: amount},
+		{Account: LedgerAccountPlatformRevenue, TherapistID: therapistID, Debit: after - before},
+		{Account: LedgerAccountTherapistPayable, TherapistID: therapistID, Debit: amount - (after - before)},
+	}
+}
+
+// payoutEntries pay out what the platform owes the therapist
+func payoutEntries(therapistID uint, amount int) []LedgerEntry {
+	return []LedgerEntry{
+		{Account: LedgerAccountTherapistPayable, TherapistID: &therapistID, Debit: amount},
+		{Account: LedgerAccountCash, Credit: amount},
+	}
+}
+
+// Session statuses after which what the therapist got for the session is
+// theirs to be paid out
+var sessionSettledStatuses = []string{SessionStatusCompleted, SessionStatusCancelled, SessionStatusNoShow}
+
+// postPaymentCharge records a completed payment: the therapist share is owed
+// to the therapist, the commission is platform revenue. Payments not tied to a
+// session are held as client prepayments.
+func postPaymentCharge(tx *gorm.DB, payment *Payment) error {
+	paymentID := payment.ID
+	txn := &LedgerTransaction{
+		Reference:   fmt.Sprintf("payment:%d", payment.ID),
+		Type:        LedgerTypeCharge,
+		PaymentID:   &paymentID,
+		TherapistID: paymentTherapistID(tx, payment),
+		Description: payment.Description,
+	}
+	if txn.TherapistID != nil {
+		txn.SessionID = payment.SessionID
+	}
+
+	if txn.TherapistID == nil {
+		return postLedgerTransaction(tx, txn, []LedgerEntry{
+			{Account: LedgerAccountCash, Debit: payment.Amount},
+			{Account: LedgerAccountClientPrepayments, Credit: payment.Amount},
+		})
+	}
+
+	txn.CommissionPercent = therapistCommissionPercent(tx, *txn.TherapistID)
+	return postLedgerTransaction(tx, txn,
+		chargeEntries(LedgerAccountCash, payment.Amount, txn.TherapistID, txn.CommissionPercent))
+}
+
+// postRefund reverses the refunded part of a charge in the same proportion
+// between the therapist and the platform as the charge itself
+func postRefund(tx *gorm.DB, refund *Refund, payment *Payment) error {
+	var charge LedgerTransaction
+	if err := tx.Where("reference = ?", fmt.Sprintf("payment:%d", payment.ID)).First(&charge).Error; err != nil {
+		return err
+	}
+
+	paymentID, refundID := payment.ID, refund.ID
+	txn := &LedgerTransaction{
+		Reference:         fmt.Sprintf("refund:%d", refund.ID),
+		Type:              LedgerTypeRefund,
+		PaymentID:         &paymentID,
+		RefundID:          &refundID,
+		TherapistID:       charge.TherapistID,
+		SessionID:         charge.SessionID,
+		CommissionPercent: charge.CommissionPercent,
+		Description:       refund.Reason,
+	}
+
+	if charge.TherapistID == nil {
+		return postLedgerTransaction(tx, txn, []LedgerEntry{
+			{Account: LedgerAccountCash, Credit: refund.Amount},
+			{Account: LedgerAccountClientPrepayments, Debit: refund.Amount},
+		})
+	}
+
+	// What earlier refunds of the payment returned
+	var refunded int
+	if err := tx.Table("ledger_entries e").
+		Joins("JOIN ledger_transactions t ON t.id = e.transaction_id").
+		Where("t.type = ? AND t.payment_id = ? AND t.reference <> ? AND e.account = ?",
+			LedgerTypeRefund, payment.ID, txn.Reference, LedgerAccountCash).
+		Select("COALESCE(SUM(e.credit), 0)").
+		Scan(&refunded).Error; err != nil {
+		return err
+	}
+	return postLedgerTransaction(tx, txn,
+		refundEntries(refunded, refund.Amount, charge.TherapistID, charge.CommissionPercent))
+}
+
+// therapistBalance is what the platform owes the therapist: earnings posted
+// before the given time, less every payout already made. What was paid for a
+// session counts once the session is over and it started before that time;
+// until then a refund may still take it back.
+func therapistBalance(tx *gorm.DB, therapistID uint, before time.Time) (int, error) {
+	var balance int
+	err := tx.Table("ledger_entries e").
+		Joins("JOIN ledger_transactions t ON t.id = e.transaction_id").
+		Joins("LEFT JOIN sessions s ON s.id = t.session_id").
+		Where("e.account = ? AND e.therapist_id = ?", LedgerAccountTherapistPayable, therapistID).
+		Where("t.type = ? OR (t.session_id IS NULL AND t.created_at < ?) OR (s.status IN ? AND s.start_time < ?)",
+			LedgerTypePayout, before, sessionSettledStatuses, before).
+		Select("COALESCE(SUM(e.credit - e.debit), 0)").
+		Scan(&balance).Error
+	return balance, err
+}
+
+// therapistUpcoming is what the therapist got for sessions not over yet
+func therapistUpcoming(tx *gorm.DB, therapistID uint) (int, error) {
+	var upcoming int
+	err := tx.Table("ledger_entries e").
+		Joins("JOIN ledger_transactions t ON t.id = e.transaction_id").
+		Joins("JOIN sessions s ON s.id = t.session_id").
+		Where("e.account = ? AND e.therapist_id = ?", LedgerAccountTherapistPayable, therapistID).
+		Where("s.status NOT IN ?", sessionSettledStatuses).
+		Select("COALESCE(SUM(e.credit - e.debit), 0)").
+		Scan(&upcoming).Error
+	return upcoming, err
+}
+
+func therapistEarnings(therapistID uint, from, to time.Time) (*TherapistEarnings, error) {
+	var rows []struct {
+		Type    string
+		Account string
+		Debit   int
+		Credit  int
+		Count   int
+	}
+	err := db.Table("ledger_entries e").
+		Joins("JOIN ledger_transactions t ON t.id = e.transaction_id").
+		Where("t.therapist_id = ? AND t.created_at >= ? AND t.created_at < ?", therapistID, from, to).
+		Group("t.type, e.account").
+		Select("t.type, e.account, SUM(e.debit) AS debit, SUM(e.credit) AS credit, COUNT(DISTINCT t.id) AS count").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	earnings := &TherapistEarnings{TherapistID: therapistID, From: from, To: to}
+	for _, row := range rows {
+		switch {
+		case row.Account == LedgerAccountCash && row.Type == LedgerTypeCharge:
+			earnings.Gross += row.Debit
+			earnings.Sessions += row.Count
+		case row.Account == LedgerAccountClientPrepayments && row.Type == LedgerTypeCharge:
+			// Sessions paid with prepaid credits
+			earnings.Gross += row.Debit
+			earnings.Sessions += row.Count
+		case row.Account == LedgerAccountCash && row.Type == LedgerTypeRefund:
+			earnings.Refunds += row.Credit
+		case row.Account == LedgerAccountClientPrepayments && row.Type == LedgerTypeRefund:
+			earnings.Refunds += row.Credit
+		case row.Account == LedgerAccountPlatformRevenue:
+			earnings.Commission += row.Credit - row.Debit
+		case row.Account == LedgerAccountTherapistPayable && row.Type == LedgerTypePayout:
+			earnings.PaidOut += row.Debit
+		case row.Account == LedgerAccountTherapistPayable:
+			earnings.Net += row.Credit - row.Debit
+		}
+	}
+
+	if earnings.Balance, err = therapistBalance(db, therapistID, time.Now()); err != nil {
+		return nil, err
+	}
+	earnings.Upcoming, err = therapistUpcoming(db, therapistID)
+	return earnings, err
+}
+
+// parsePeriod reads from/to dates (YYYY-MM-DD, to inclusive) and defaults to
+// the current month
+func parsePeriod(c *gin.Context, fromKey, toKey string) (time.Time, time.Time, error) {
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, 0)
+
+	if value := c.Query(fromKey); value != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return from, to, err
+		}
+		from = parsed
+	}
+	if value := c.Query(toKey); value != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return from, to, err
+		}
+		to = parsed.AddDate(0, 0, 1)
+	}
+	if !to.After(from) {
+		return from, to, errors.New("empty period")
+	}
+	return from, to, nil
+}
+
+// ownTherapist loads the therapist from the path and checks that the user is
+// that therapist or an admin, writing the error response otherwise
+func ownTherapist(c *gin.Context) (*Therapist, bool) {
+	var therapist Therapist
+	if err := db.First(&therapist, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Therapist not found",
+		})
+		return nil, false
+	}
+
+	if c.GetString("user_role") != "admin" && therapist.UserID != c.GetUint("user_id") {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Недостаточно прав",
+		})
+		return nil, false
+	}
+	return &therapist, true
+}
+
+// Handlers
+func getTherapistEarnings(c *gin.Context) {
+	therapist, ok := ownTherapist(c)
+	if !ok {
+		return
+	}
+
+	from, to, err := parsePeriod(c, "from", "to")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный период",
+		})
+		return
+	}
+
+	earnings, err := therapistEarnings(therapist.ID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при расчёте заработка",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    earnings,
+	})
+}
+
+func getPayoutAccount(c *gin.Context) {
+	therapist, ok := ownTherapist(c)
+	if !ok {
+		return
+	}
+
+	var account PayoutAccount
+	if err := db.Where("therapist_id = ?", therapist.ID).First(&account).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Реквизиты для выплат не указаны",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    account,
+	})
+}
+
+func updatePayoutAccount(c *gin.Context) {
+	therapist, ok := ownTherapist(c)
+	if !ok {
+		return
+	}
+
+	var req PayoutAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var account PayoutAccount
+	db.Where("therapist_id = ?", therapist.ID).First(&account)
+	account.TherapistID = therapist.ID
+	account.RecipientName = req.RecipientName
+	account.INN = req.INN
+	account.BankAccount = req.BankAccount
+	account.BIK = req.BIK
+
+	// Only the platform sets the commission
+	if req.CommissionPercent != nil {
+		if c.GetString("user_role") != "admin" {
+			c.JSON(http.StatusForbidden, ApiResponse{
+				Success: false,
+				Error:   "Недостаточно прав",
+			})
+			return
+		}
+		account.CommissionPercent = req.CommissionPercent
+	}
+
+	if err := db.Save(&account).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении реквизитов",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    account,
+	})
+}
+
+// postPrepaymentUsage recognizes part of a client prepayment as earned by the
+// therapist, when a prepaid credit is used for a session or expires. A
+// negative amount returns a credit to the client.
+func postPrepaymentUsage(tx *gorm.DB, reference string, therapistID uint, sessionID *uint, amount int, description string) error {
+	txn := &LedgerTransaction{
+		Reference:         reference,
+		Type:              LedgerTypeCharge,
+		TherapistID:       &therapistID,
+		SessionID:         sessionID,
+		CommissionPercent: therapistCommissionPercent(tx, therapistID),
+		Description:       description,
+	}
+
+	sign := 1
+	if amount < 0 {
+		sign, amount = -1, -amount
+		txn.Type = LedgerTypeRefund
+	}
+	entries := chargeEntries(LedgerAccountClientPrepayments, amount, &therapistID, txn.CommissionPercent)
+	if sign < 0 {
+		for i := range entries {
+			entries[i].Debit, entries[i].Credit = entries[i].Credit, entries[i].Debit
+		}
+	}
+	return postLedgerTransaction(tx, txn, entries)
+}
+
+// postBonus records money the platform gives to a client balance, such as a
+// referral reward. It is paid out of the platform revenue.
+func postBonus(tx *gorm.DB, reference string, amount int, description string) error {
+	txn := &LedgerTransaction{
+		Reference:   reference,
+		Type:        LedgerTypeBonus,
+		Description: description,
+	}
+	return postLedgerTransaction(tx, txn, []LedgerEntry{
+		{Account: LedgerAccountPlatformRevenue, Debit: amount},
+		{Account: LedgerAccountClientPrepayments, Credit: amount},
+	})
+}
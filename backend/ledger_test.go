@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+// accountTotals sums credit less debit per account
+func accountTotals(entries ...[]LedgerEntry) map[string]int {
+	totals := map[string]int{}
+	for _, list := range entries {
+		for _, e := range list {
+			totals[e.Account] += e.Credit - e.Debit
+		}
+	}
+	return totals
+}
+
+func TestSplitCommission(t *testing.T) {
+	tests := []struct {
+		amount, percent   int
+		commission, share int
+	}{
+		{350000, 20, 70000, 280000},
+		{101, 20, 20, 81},
+		{99999, 15, 14999, 85000},
+		{1, 20, 0, 1},
+		{333, 33, 109, 224},
+		{500, 0, 0, 500},
+		{500, 100, 500, 0},
+	}
+	for _, tt := range tests {
+		commission, share := splitCommission(tt.amount, tt.percent)
+		if commission != tt.commission || share != tt.share {
+			t.Errorf("splitCommission(%d, %d) = %d, %d, want %d, %d",
+				tt.amount, tt.percent, commission, share, tt.commission, tt.share)
+		}
+		if commission+share != tt.amount {
+			t.Errorf("splitCommission(%d, %d) loses %d kopecks", tt.amount, tt.percent, tt.amount-commission-share)
+		}
+	}
+}
+
+func TestLedgerEntriesBalance(t *testing.T) {
+	therapistID := uint(7)
+	tests := []struct {
+		name    string
+		entries []LedgerEntry
+	}{
+		{"charge", chargeEntries(LedgerAccountCash, 350001, &therapistID, 20)},
+		{"prepayment usage", chargeEntries(LedgerAccountClientPrepayments, 99999, &therapistID, 33)},
+		{"first partial refund", refundEntries(0, 12345, &therapistID, 20)},
+		{"later partial refund", refundEntries(12345, 777, &therapistID, 20)},
+		{"payout", payoutEntries(therapistID, 280001)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkBalanced(tt.name, tt.entries); err != nil {
+				t.Error(err)
+			}
+			for _, e := range tt.entries {
+				if e.Debit < 0 || e.Credit < 0 {
+					t.Errorf("negative entry %+v", e)
+				}
+			}
+		})
+	}
+
+	unbalanced := []LedgerEntry{{Account: LedgerAccountCash, Debit: 100}, {Account: LedgerAccountTherapistPayable, Credit: 99}}
+	if err := checkBalanced("broken", unbalanced); err == nil {
+		t.Error("checkBalanced accepted unbalanced entries")
+	}
+}
+
+// Refunds adding up to the charge must leave nothing on the revenue and
+// payable accounts, however the amount is split
+func TestRefundsReverseCharge(t *testing.T) {
+	therapistID := uint(7)
+	tests := []struct {
+		name    string
+		amount  int
+		percent int
+		refunds []int
+	}{
+		{"full refund", 350000, 20, []int{350000}},
+		{"odd kopecks in thirds", 3, 50, []int{1, 1, 1}},
+		{"odd amount in halves", 101, 20, []int{51, 50}},
+		{"uneven parts", 99999, 33, []int{1, 33333, 2, 66663}},
+		{"kopeck by kopeck", 7, 15, []int{1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all := [][]LedgerEntry{chargeEntries(LedgerAccountCash, tt.amount, &therapistID, tt.percent)}
+			refunded := 0
+			for _, amount := range tt.refunds {
+				entries := refundEntries(refunded, amount, &therapistID, tt.percent)
+				if err := checkBalanced("refund", entries); err != nil {
+					t.Fatal(err)
+				}
+				all = append(all, entries)
+				refunded += amount
+
+				// Neither side is ever taken back more than it got
+				totals := accountTotals(all...)
+				if totals[LedgerAccountPlatformRevenue] < 0 || totals[LedgerAccountTherapistPayable] < 0 {
+					t.Fatalf("after refunding %d: revenue %d, payable %d", refunded,
+						totals[LedgerAccountPlatformRevenue], totals[LedgerAccountTherapistPayable])
+				}
+			}
+			for account, total := range accountTotals(all...) {
+				if total != 0 {
+					t.Errorf("%s left with %d", account, total)
+				}
+			}
+		})
+	}
+}
@@ -33,7 +33,9 @@ type User struct {
 	Name               string         `json:"name" gorm:"not null"`
 	Phone              string         `json:"phone"`
 	Avatar             string         `json:"avatar"`
-	Role               string         `json:"role" gorm:"default:client"` // client, therapist, admin
+	Role               string         `json:"role" gorm:"default:client"`  // client, therapist, admin
+	Currency           string         `json:"currency" gorm:"default:RUB"` // preferred for displaying prices
+	Language           string         `json:"language" gorm:"default:ru"`  // of emails: ru, en
 	IsEmailVerified    bool           `json:"is_email_verified" gorm:"default:false"`
 	EmailVerifyToken   string         `json:"-"`
 	PasswordResetToken string         `json:"-"`
@@ -53,31 +55,61 @@ type RefreshToken struct {
 }
 
 type Therapist struct {
-	ID             uint       `json:"id" gorm:"primaryKey"`
-	UserID         uint       `json:"user_id"`
-	User           User       `json:"user" gorm:"foreignKey:UserID"`
-	Specialization string     `json:"specialization"`
-	Approach       string     `json:"approach"`
-	Experience     int        `json:"experience"`     // years
-	PricePerHour   int        `json:"price_per_hour"` // in kopecks
-	Rating         float64    `json:"rating"`
-	ReviewCount    int        `json:"review_count"`
-	Bio            string     `json:"bio"`
-	Languages      string     `json:"languages"` // JSON array as string
-	IsOnline       bool       `json:"is_online"`
-	NextSlot       *time.Time `json:"next_available_slot"`
-	CreatedAt      time.Time  `json:"created_at"`
+	ID              uint       `json:"id" gorm:"primaryKey"`
+	UserID          uint       `json:"user_id"`
+	User            User       `json:"user" gorm:"foreignKey:UserID"`
+	Specialization  string     `json:"specialization"`
+	Approach        string     `json:"approach"`
+	Experience      int        `json:"experience"`                               // years
+	PricePerHour    int        `json:"price_per_hour"`                           // in minor units of Currency
+	Currency        string     `json:"currency" gorm:"default:RUB"`              // of all prices of the therapist
+	PricePerHourRUB int        `json:"-" gorm:"column:price_per_hour_rub;index"` // for sorting and filtering the catalog
+	Rating          float64    `json:"rating"`
+	ReviewCount     int        `json:"review_count"`
+	Bio             string     `json:"bio"`
+	Languages       string     `json:"languages"` // JSON array as string
+	IsOnline        bool       `json:"is_online"`
+	NextSlot        *time.Time `json:"next_available_slot"`
+	CreatedAt       time.Time  `json:"created_at"`
+
+	Terms []TaxonomyTerm `json:"terms,omitempty" gorm:"many2many:therapist_terms"`
+
+	// In the currency of the viewer
+	DisplayPrice *Money `json:"display_price,omitempty" gorm:"-"`
+
+	// Filled only by full-text search queries
+	SearchRank    float64 `json:"search_rank,omitempty" gorm:"->;-:migration"`
+	SearchSnippet string  `json:"search_snippet,omitempty" gorm:"->;-:migration"`
 }
 
 type Session struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
-	ClientID    uint      `json:"client_id"`
-	TherapistID uint      `json:"therapist_id"`
+	ClientID    uint      `json:"client_id" gorm:"index"`
+	TherapistID uint      `json:"therapist_id" gorm:"index"`
 	StartTime   time.Time `json:"start_time"`
 	EndTime     time.Time `json:"end_time"`
-	Status      string    `json:"status"` // scheduled, active, completed, cancelled
-	Price       int       `json:"price"`
+	Status      string    `json:"status"`                         // scheduled, confirmed, in_progress, completed, cancelled, no_show
+	Type        string    `json:"type" gorm:"default:individual"` // individual, couple, group
+	Duration    int       `json:"duration" gorm:"default:60"`     // minutes
+	Notes       string    `json:"notes,omitempty"`
+	Price       int       `json:"price"` // in kopecks
+	Currency    string    `json:"currency" gorm:"default:RUB"`
 	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// The quoted price in the therapist currency, when it is not roubles
+	ListPrice    int    `json:"list_price,omitempty"`
+	ListCurrency string `json:"list_currency,omitempty"`
+
+	CancelledBy     string     `json:"cancelled_by,omitempty"` // client, therapist, system
+	CancelledReason string     `json:"cancelled_reason,omitempty"`
+	CancelledAt     *time.Time `json:"cancelled_at,omitempty"`
+	RescheduleCount int        `json:"reschedule_count" gorm:"default:0"`
+	ClientPackageID *uint      `json:"client_package_id,omitempty"` // paid with a prepaid credit
+	Discount        int        `json:"discount,omitempty"`          // promo code discount, in kopecks
+	PromoCode       string     `json:"promo_code,omitempty"`
+	BalanceUsed     int        `json:"balance_used,omitempty"`  // paid from the client balance, in kopecks
+	SlidingScale    bool       `json:"sliding_scale,omitempty"` // booked at a reduced fee
 }
 
 // JWT Claims
@@ -101,7 +133,8 @@ type RegisterRequest struct {
 	Password string `json:"password" binding:"required,min=6"`
 	Name     string `json:"name" binding:"required"`
 	Phone    string `json:"phone"`
-	Role     string `json:"role"` // optional, defaults to "client"
+
+	ReferralCode string `json:"referral_code"` // optional, code of the inviting user
 }
 
 type LoginRequest struct {
@@ -153,8 +186,19 @@ func initDB() {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
-	db.AutoMigrate(&User{}, &RefreshToken{}, &Therapist{}, &Session{})
+	db.AutoMigrate(&User{}, &RefreshToken{}, &Therapist{}, &Session{}, &TaxonomyTerm{}, &Payment{}, &WebhookEvent{},
+		&Refund{}, &CancellationPolicy{}, &SessionReschedule{}, &LedgerTransaction{}, &LedgerEntry{}, &PayoutAccount{},
+		&PayoutBatch{}, &Payout{}, &Receipt{}, &LegalEntity{}, &Document{},
+		&SessionPackage{}, &ClientPackage{}, &PackageCredit{}, &PromoCode{}, &PromoRedemption{}, &BalanceEntry{},
+		&GiftCertificate{}, &ReferralCode{}, &Referral{}, &PriceListItem{}, &PriceRule{},
+		&ExchangeRate{}, &Notification{}, &NotificationPreference{}, &PushSubscription{},
+		&NotificationDelivery{}, &SessionReminder{}, &OutboxEvent{},
+		&Partner{}, &PartnerMember{}, &WebhookEndpoint{}, &WebhookDelivery{}, &ChatRoom{}, &ChatMessage{}, &ChatParticipant{}, &IdempotencyKey{})
+	initSearch()
 	seedData()
+	seedTaxonomy()
+	seedLegalEntity()
+	seedAdmin()
 	log.Println("Database connected and migrated successfully")
 }
 
@@ -178,6 +222,41 @@ func initRedis() {
 	log.Println("Redis подключён успешно")
 }
 
+// isDevelopment reports whether the server runs locally, APP_ENV=development.
+// Anything else is treated as production.
+func isDevelopment() bool {
+	return getEnv("APP_ENV", "production") == "development"
+}
+
+// corsOrigins are the frontend origins allowed to call the API, from the
+// comma separated CORS_ORIGINS. "https://*.vercel.app" covers preview deploys.
+func corsOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(getEnv("CORS_ORIGINS",
+		"http://localhost:3000,http://localhost:3001,https://psy-portal.vercel.app,https://*.vercel.app"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// originAllowed checks an Origin header against corsOrigins
+func originAllowed(origin string) bool {
+	for _, allowed := range corsOrigins() {
+		if allowed == origin {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+			!strings.Contains(origin[len(prefix):len(origin)-len(suffix)], "/") {
+			return true
+		}
+	}
+	return false
+}
+
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -421,6 +500,26 @@ func authMiddleware() gin.HandlerFunc {
 	}
 }
 
+// requireRole allows the request only for users with one of the given roles.
+// Must be used after authMiddleware.
+func requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("user_role")
+		for _, r := range roles {
+			if role == r {
+				c.Next()
+				return
+			}
+		}
+
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Недостаточно прав",
+		})
+		c.Abort()
+	}
+}
+
 // Auth handlers
 func register(c *gin.Context) {
 	var req RegisterRequest
@@ -462,19 +561,14 @@ func register(c *gin.Context) {
 		return
 	}
 
-	// Set default role
-	role := req.Role
-	if role == "" {
-		role = "client"
-	}
-
-	// Create user
+	// Create user. Everyone signs up as a client, therapist and admin roles
+	// are granted by an admin or the seed.
 	user := &User{
 		Email:            req.Email,
 		Password:         string(hashedPassword),
 		Name:             req.Name,
 		Phone:            req.Phone,
-		Role:             role,
+		Role:             "client",
 		EmailVerifyToken: verifyToken,
 	}
 
@@ -486,6 +580,13 @@ func register(c *gin.Context) {
 		return
 	}
 
+	// A wrong referral code does not stop the registration
+	if req.ReferralCode != "" {
+		if err := linkReferral(user.ID, req.ReferralCode); err != nil {
+			log.Printf("Referral code %q for user %d not linked: %v", req.ReferralCode, user.ID, err)
+		}
+	}
+
 	c.JSON(http.StatusCreated, ApiResponse{
 		Success: true,
 		Data: gin.H{
@@ -634,11 +735,140 @@ func getProfile(c *gin.Context) {
 	})
 }
 
+// UpdateRoleRequest is the body of the admin call granting a role
+type UpdateRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=client therapist admin"`
+}
+
+// seedAdmin grants the admin role to the registered user with ADMIN_EMAIL
+func seedAdmin() {
+	email := getEnv("ADMIN_EMAIL", "")
+	if email == "" {
+		return
+	}
+	result := db.Model(&User{}).Where("email = ? AND role <> ?", email, "admin").Update("role", "admin")
+	if result.Error != nil {
+		log.Printf("Failed to grant admin role to %s: %v", email, result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Granted admin role to %s", email)
+	}
+}
+
+// updateUserRole grants a role. A new therapist gets an empty profile, and
+// the refresh tokens of the user are dropped so that the role takes effect
+// on the next login.
+func updateUserRole(c *gin.Context) {
+	var req UpdateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var user User
+	if err := db.First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Пользователь не найден",
+		})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("role", req.Role).Error; err != nil {
+			return err
+		}
+		if req.Role == "therapist" {
+			var count int64
+			tx.Model(&Therapist{}).Where("user_id = ?", user.ID).Count(&count)
+			if count == 0 {
+				if err := tx.Create(&Therapist{UserID: user.ID, Currency: CurrencyRUB, Languages: "[]"}).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&RefreshToken{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Не удалось изменить роль",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    user,
+	})
+}
+
 // Existing handlers
+
 func getTherapists(c *gin.Context) {
 	var therapists []Therapist
 	var total int64
 
+	viewer := viewerCurrency(c)
+	filters := therapistFilters(c, viewer)
+
+	// Build query
+	query := db.Model(&Therapist{}).Preload("User").Preload("Terms").Scopes(filters.scopes()...)
+	query, sortName, sort := applyTherapistSort(query, c)
+
+	// Cursor pagination skips the total count
+	if cursorMode(c) {
+		limit := cursorLimit(c, 10, 50)
+		cursor := c.Query("cursor")
+		if cursor != "" {
+			values, err := decodeCursor(cursor, sortName, len(sort.keys))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, ApiResponse{
+					Success: false,
+					Error:   "Неверный курсор",
+				})
+				return
+			}
+			query = keysetAfter(query, sort.keys, values)
+		}
+
+		if err := query.Limit(limit + 1).Find(&therapists).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Failed to fetch therapists",
+			})
+			return
+		}
+
+		localizeTherapists(therapists, viewer)
+		pageMeta := &CursorMeta{}
+		if len(therapists) > limit {
+			therapists = therapists[:limit]
+			pageMeta = &CursorMeta{
+				NextCursor: encodeCursor(sortName, sort.values(therapists[limit-1])),
+				HasMore:    true,
+			}
+		}
+
+		meta := TherapistListMeta{Sort: sortName}
+		if cursor == "" {
+			meta = therapistListMeta(filters, sortName, viewer)
+		}
+		meta.CursorMeta = pageMeta
+
+		c.JSON(http.StatusOK, ApiResponse{
+			Success: true,
+			Data: TherapistListResponse{
+				Therapists: therapists,
+				PerPage:    limit,
+			},
+			Meta: meta,
+		})
+		return
+	}
+
 	// Parse query parameters
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "10"))
@@ -652,36 +882,8 @@ func getTherapists(c *gin.Context) {
 
 	offset := (page - 1) * perPage
 
-	// Build query
-	query := db.Model(&Therapist{}).Preload("User")
-
-	// Apply filters
-	if spec := c.Query("specialization"); spec != "" {
-		query = query.Where("specialization ILIKE ?", "%"+spec+"%")
-	}
-
-	if approach := c.Query("approach"); approach != "" {
-		query = query.Where("approach ILIKE ?", "%"+approach+"%")
-	}
-
-	if minExp := c.Query("min_experience"); minExp != "" {
-		if exp, err := strconv.Atoi(minExp); err == nil {
-			query = query.Where("experience >= ?", exp)
-		}
-	}
-
-	if maxPrice := c.Query("max_price"); maxPrice != "" {
-		if price, err := strconv.Atoi(maxPrice); err == nil {
-			query = query.Where("price_per_hour <= ?", price*100)
-		}
-	}
-
-	if onlineOnly := c.Query("online_only"); onlineOnly == "true" {
-		query = query.Where("is_online = ?", true)
-	}
-
 	// Get total count
-	query.Count(&total)
+	db.Model(&Therapist{}).Scopes(filters.scopes()...).Count(&total)
 
 	// Get therapists with pagination
 	result := query.Offset(offset).Limit(perPage).Find(&therapists)
@@ -693,6 +895,7 @@ func getTherapists(c *gin.Context) {
 		return
 	}
 
+	localizeTherapists(therapists, viewer)
 	response := TherapistListResponse{
 		Therapists: therapists,
 		Total:      total,
@@ -703,16 +906,16 @@ func getTherapists(c *gin.Context) {
 	c.JSON(http.StatusOK, ApiResponse{
 		Success: true,
 		Data:    response,
+		Meta:    therapistListMeta(filters, sortName, viewer),
 	})
 }
 
 func getStats(c *gin.Context) {
 	ctx := context.Background()
-	cacheKey := "platform:stats"
 
 	// Try to get from cache if Redis is available
 	if rdb != nil {
-		cached, err := rdb.Get(ctx, cacheKey).Result()
+		cached, err := rdb.Get(ctx, platformStatsKey).Result()
 		if err == nil {
 			var stats StatsResponse
 			if json.Unmarshal([]byte(cached), &stats) == nil {
@@ -725,7 +928,18 @@ func getStats(c *gin.Context) {
 		}
 	}
 
-	// Calculate stats
+	stats, _ := refreshPlatformStats(ctx)
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    stats,
+	})
+}
+
+const platformStatsKey = "platform:stats"
+
+// refreshPlatformStats calculates the stats and caches them for 5 minutes if
+// Redis is available
+func refreshPlatformStats(ctx context.Context) (*StatsResponse, error) {
 	var stats StatsResponse
 	var totalTherapists, totalSessions, activeTherapists int64
 	var avgRating float64
@@ -740,23 +954,20 @@ func getStats(c *gin.Context) {
 	stats.ActiveTherapists = int(activeTherapists)
 	stats.AverageRating = avgRating
 
-	// Cache for 5 minutes if Redis is available
 	if rdb != nil {
 		statsJSON, _ := json.Marshal(stats)
-		rdb.Set(ctx, cacheKey, statsJSON, 5*time.Minute)
+		if err := rdb.Set(ctx, platformStatsKey, statsJSON, 5*time.Minute).Err(); err != nil {
+			return &stats, err
+		}
 	}
-
-	c.JSON(http.StatusOK, ApiResponse{
-		Success: true,
-		Data:    stats,
-	})
+	return &stats, nil
 }
 
 func getTherapistById(c *gin.Context) {
 	id := c.Param("id")
 
 	var therapist Therapist
-	result := db.Preload("User").First(&therapist, id)
+	result := db.Preload("User").Preload("Terms").First(&therapist, id)
 	if result.Error != nil {
 		c.JSON(http.StatusNotFound, ApiResponse{
 			Success: false,
@@ -765,6 +976,7 @@ func getTherapistById(c *gin.Context) {
 		return
 	}
 
+	therapist.DisplayPrice = displayMoney(therapist.PricePerHour, therapist.Currency, viewerCurrency(c))
 	c.JSON(http.StatusOK, ApiResponse{
 		Success: true,
 		Data:    therapist,
@@ -782,23 +994,49 @@ func healthCheck(c *gin.Context) {
 }
 
 func main() {
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
 	// Initialize services
+	if err := loadEmailTemplates(); err != nil {
+		log.Fatal("Failed to load email templates:", err)
+	}
 	initDB()
 	initRedis()
+	initPayments()
+	initCurrencies()
+	initDeliveryChannels()
+
+	// "worker" runs only the background work, so that it can be scaled apart
+	// from the API; the API runs it as well unless BACKGROUND_WORKERS=false
+	if command == "worker" {
+		runWorkerMode()
+		return
+	}
+	if getEnv("BACKGROUND_WORKERS", "true") != "false" {
+		startBackgroundWorkers(context.Background())
+	}
+	startChatFanout(context.Background())
 
 	// Setup Gin
 	r := gin.Default()
 
+	// Client IPs are taken from X-Forwarded-For only behind known proxies,
+	// webhook IP allowlists rely on it
+	var trustedProxies []string
+	if proxies := getEnv("TRUSTED_PROXIES", ""); proxies != "" {
+		trustedProxies = strings.Split(proxies, ",")
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	r.Use(cors.New(cors.Config{
-		AllowOrigins: []string{
-			"http://localhost:3000",
-			"http://localhost:3001",
-			"https://psy-portal.vercel.app",
-			"https://*.vercel.app", // для preview деплоев
-		},
+		AllowOrigins:     corsOrigins(),
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Idempotency-Key"},
+		ExposeHeaders:    []string{"Content-Length", "Idempotent-Replayed"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -813,23 +1051,159 @@ func main() {
 		// Auth routes
 		auth := api.Group("/auth")
 		{
-			auth.POST("/register", register)
+			auth.POST("/register", idempotency(), register)
 			auth.POST("/login", login)
 			auth.POST("/refresh", refreshToken)
 			auth.POST("/logout", logout)
 		}
 
+		// Payment provider callbacks
+		api.POST("/webhooks/payments/:provider", paymentWebhook)
+
 		// Public therapist routes (for browsing)
 		api.GET("/therapists", getTherapists)
 		api.GET("/therapists/:id", getTherapistById)
+		api.GET("/therapists/suggest", suggestTherapists)
+		api.POST("/therapists/match", matchTherapists)
+		api.GET("/therapists/:id/cancellation-policy", getCancellationPolicy)
+		api.GET("/therapists/:id/packages", getTherapistPackages)
+		api.GET("/therapists/:id/prices", getTherapistPrices)
+		api.GET("/therapists/:id/price-quote", getPriceQuote)
+		api.GET("/taxonomies", getTaxonomies)
+		api.GET("/currencies", getCurrencies)
+		api.GET("/taxonomies/:vocabulary", getTaxonomies)
+
+		// Chat connection, authenticated by the token it carries
+		api.GET("/chat/ws", chatWebSocket)
 
 		// Protected routes
 		protected := api.Group("")
 		protected.Use(authMiddleware())
 		{
 			protected.GET("/profile", getProfile)
+			protected.PUT("/profile/currency", updateProfileCurrency)
+			protected.PUT("/profile/language", updateProfileLanguage)
+			protected.PUT("/therapists/:id/terms", requireRole("therapist", "admin"), updateTherapistTerms)
+			protected.PUT("/therapists/:id/cancellation-policy", requireRole("therapist", "admin"), updateCancellationPolicy)
+
+			protected.PUT("/therapists/:id/prices", requireRole("therapist", "admin"), updateTherapistPrices)
+			protected.POST("/therapists/:id/packages", requireRole("therapist", "admin"), createSessionPackage)
+			protected.PUT("/packages/:id", requireRole("therapist", "admin"), updateSessionPackage)
+			protected.DELETE("/packages/:id", requireRole("therapist", "admin"), deleteSessionPackage)
+			protected.POST("/packages/:id/purchase", idempotency(), purchasePackage)
+			protected.GET("/client-packages", getClientPackages)
+			protected.POST("/client-packages/:id/refund", idempotency(), refundClientPackageHandler)
+
+			protected.POST("/promo-codes/validate", validatePromoCode)
+			protected.GET("/balance", getBalance)
+			protected.GET("/balance/entries", getBalanceEntries)
+			protected.GET("/gift-certificates", getGiftCertificates)
+			protected.POST("/gift-certificates", idempotency(), purchaseGiftCertificate)
+			protected.POST("/gift-certificates/redeem", idempotency(), redeemGiftCertificateHandler)
+			protected.GET("/referrals", getReferrals)
+
+			// Reviews are not stored by the backend yet, so there is no
+			// review list to paginate
+			protected.GET("/sessions", getSessions)
+			protected.GET("/sessions/upcoming", getUpcomingSessions)
+			protected.GET("/sessions/history", getSessionHistory)
+			protected.POST("/sessions", idempotency(), bookSession)
+			protected.POST("/sessions/:id/cancel", idempotency(), cancelSession)
+			protected.POST("/sessions/:id/no-show", markSessionNoShow)
+			protected.POST("/sessions/:id/reschedule", idempotency(), rescheduleSessionHandler)
+			protected.POST("/sessions/:id/complete", requireRole("therapist", "admin"), completeSession)
+			protected.GET("/sessions/:id/documents", getSessionDocuments)
+			protected.POST("/sessions/:id/documents", createSessionDocument)
+			protected.GET("/documents/:id/pdf", downloadDocument)
+
+			protected.GET("/therapists/:id/earnings", requireRole("therapist", "admin"), getTherapistEarnings)
+			protected.GET("/therapists/:id/payout-account", requireRole("therapist", "admin"), getPayoutAccount)
+			protected.PUT("/therapists/:id/payout-account", requireRole("therapist", "admin"), updatePayoutAccount)
+
+			protected.GET("/notifications", getNotifications)
+			protected.GET("/notifications/unread-count", getUnreadNotificationCount)
+			protected.GET("/notifications/preferences", getNotificationPreferences)
+			protected.PUT("/notifications/preferences", updateNotificationPreferences)
+			protected.GET("/notifications/push-key", getPushPublicKey)
+			protected.POST("/notifications/push-subscriptions", savePushSubscription)
+			protected.DELETE("/notifications/push-subscriptions", deletePushSubscription)
+			protected.GET("/notifications/:id/deliveries", getNotificationDeliveries)
+			protected.POST("/notifications/mark-all-read", markAllNotificationsRead)
+			protected.POST("/notifications/:id/read", markNotificationRead)
+			protected.DELETE("/notifications/:id", deleteNotification)
+
+			protected.POST("/chat/ws-ticket", issueChatTicket)
+			protected.GET("/chat/rooms", getChatRooms)
+			protected.POST("/chat/rooms", createChatRoom)
+			protected.GET("/chat/rooms/:id", getChatRoom)
+			protected.GET("/chat/rooms/:id/messages", getChatMessages)
+			protected.POST("/chat/rooms/:id/messages", postChatMessage)
+			protected.POST("/chat/rooms/:id/read", markChatRoomRead)
+
+			protected.GET("/payments", getPayments)
+			protected.GET("/payments/:id", getPayment)
+			protected.GET("/payments/:id/receipts", getPaymentReceipts)
+			protected.POST("/payments/:id/refund", requireRole("admin"), idempotency(), refundPayment)
 			// Add more protected routes here
 		}
+
+		// Admin routes
+		admin := api.Group("/admin")
+		admin.Use(authMiddleware(), requireRole("admin"))
+		{
+			admin.PUT("/users/:id/role", updateUserRole)
+			admin.POST("/taxonomies/:vocabulary", createTaxonomyTerm)
+			admin.PUT("/taxonomies/:vocabulary/:id", updateTaxonomyTerm)
+			admin.DELETE("/taxonomies/:vocabulary/:id", deleteTaxonomyTerm)
+
+			admin.GET("/webhooks/events", getWebhookEvents)
+			admin.POST("/webhooks/events/:id/replay", replayWebhookEvent)
+
+			admin.GET("/payouts", getPayoutBatches)
+			admin.POST("/payouts", idempotency(), createPayoutBatchHandler)
+			admin.GET("/payouts/:id/export", exportPayoutBatch)
+			admin.POST("/payouts/:id/confirm", idempotency(), confirmPayoutBatchHandler)
+
+			admin.POST("/receipts/:id/retry", retryReceipt)
+			admin.GET("/legal-entities", getLegalEntities)
+			admin.POST("/legal-entities", saveLegalEntity)
+			admin.PUT("/legal-entities/:id", saveLegalEntity)
+
+			admin.POST("/exchange-rates/refresh", refreshRatesHandler)
+
+			admin.GET("/promo-codes", getPromoCodes)
+			admin.POST("/promo-codes", savePromoCode)
+
+			admin.GET("/notification-deliveries", getDeliveries)
+			admin.GET("/email-templates", getEmailTemplates)
+			admin.GET("/email-templates/check", checkEmailTemplatesHandler)
+			admin.GET("/email-templates/:name/preview", previewEmailTemplate)
+
+			admin.GET("/jobs", getJobQueues)
+			admin.POST("/jobs", enqueueJobHandler)
+			admin.GET("/jobs/dead", getDeadJobs)
+			admin.POST("/jobs/:id/retry", retryJob)
+			admin.DELETE("/jobs/:id", deleteDeadJob)
+
+			admin.GET("/outbox-events", getOutboxEvents)
+			admin.POST("/outbox-events/:id/retry", retryOutboxEvent)
+
+			admin.GET("/partners", getPartners)
+			admin.POST("/partners", savePartner)
+			admin.PUT("/partners/:id", savePartner)
+			admin.GET("/partners/:id/members", getPartnerMembers)
+			admin.POST("/partners/:id/members", addPartnerMember)
+			admin.DELETE("/partners/:id/members/:user_id", removePartnerMember)
+			admin.GET("/partners/:id/webhooks", getWebhookEndpoints)
+			admin.POST("/partners/:id/webhooks", createWebhookEndpoint)
+			admin.PUT("/partner-webhooks/:id", updateWebhookEndpoint)
+			admin.DELETE("/partner-webhooks/:id", deleteWebhookEndpoint)
+			admin.POST("/partner-webhooks/:id/rotate-secret", rotateWebhookSecret)
+			admin.POST("/partner-webhooks/:id/test", testWebhookEndpoint)
+			admin.GET("/partner-webhooks/:id/deliveries", getWebhookDeliveries)
+			admin.POST("/partner-webhook-deliveries/:id/redeliver", redeliverWebhook)
+			admin.PUT("/promo-codes/:id", savePromoCode)
+		}
 	}
 
 	port := getEnv("PORT", "8080")
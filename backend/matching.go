@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Matching questionnaire types
+type MatchSchedule struct {
+	EarliestStart *time.Time `json:"earliest_start"`
+	LatestStart   *time.Time `json:"latest_start"`
+	OnlineNow     bool       `json:"online_now"`
+}
+
+type MatchRequest struct {
+	Concerns []string      `json:"concerns" binding:"required,min=1"`
+	Approach string        `json:"approach"`
+	Language string        `json:"language"`
+	Budget   int           `json:"budget"` // max price per hour in roubles, 0 = any
+	Schedule MatchSchedule `json:"schedule"`
+	Limit    int           `json:"limit"`
+}
+
+type MatchReason struct {
+	Criterion string  `json:"criterion"`
+	Score     float64 `json:"score"`
+	MaxScore  float64 `json:"max_score"`
+	Reason    string  `json:"reason"`
+}
+
+type TherapistMatch struct {
+	Therapist Therapist     `json:"therapist"`
+	Score     float64       `json:"score"`
+	Reasons   []MatchReason `json:"reasons"`
+}
+
+type MatchResponse struct {
+	Matches []TherapistMatch `json:"matches"`
+	Total   int              `json:"total"`
+}
+
+// MatchMeta tells whether only part of the eligible therapists was scored
+type MatchMeta struct {
+	Eligible  int  `json:"eligible"` // therapists meeting the hard requirements
+	Scored    int  `json:"scored"`
+	Truncated bool `json:"truncated"`
+}
+
+// Weights of every criterion, they add up to 100
+const (
+	matchWeightSpecialization = 35.0
+	matchWeightApproach       = 15.0
+	matchWeightExperience     = 10.0
+	matchWeightRating         = 15.0
+	matchWeightAvailability   = 15.0
+	matchWeightPrice          = 10.0
+)
+
+// matchCandidateLimit caps how many therapists are scored per request. The
+// candidates are picked by how well their specialization and bio cover the
+// concerns, so the cap cuts off the least relevant ones.
+const matchCandidateLimit = 500
+
+// Words that carry no meaning for matching
+var matchStopWords = map[string]bool{
+	"и": true, "в": true, "во": true, "не": true, "на": true, "с": true, "со": true, "по": true,
+	"к": true, "ко": true, "у": true, "о": true, "об": true, "от": true, "до": true, "за": true,
+	"из": true, "для": true, "при": true, "про": true, "без": true, "над": true, "под": true,
+	"или": true, "но": true, "а": true, "да": true, "же": true, "ли": true, "бы": true,
+	"что": true, "как": true, "так": true, "это": true, "мне": true, "меня": true, "мой": true,
+	"моя": true, "мои": true, "мое": true, "моё": true, "я": true, "мы": true, "он": true,
+	"она": true, "они": true, "его": true, "её": true, "их": true, "очень": true, "есть": true,
+	"нет": true, "уже": true, "еще": true, "ещё": true, "когда": true, "после": true,
+	"the": true, "and": true, "for": true, "with": true, "from": true, "about": true,
+	"my": true, "me": true, "of": true, "to": true, "in": true, "on": true, "at": true,
+	"is": true, "are": true, "was": true, "have": true, "has": true, "not": true, "but": true,
+	"or": true, "an": true, "a": true, "i": true, "it": true, "this": true, "that": true,
+}
+
+// concernKeywords maps questionnaire concern codes to word stems found in
+// therapist specializations and bios. Free-text concerns are stemmed as is.
+var concernKeywords = map[string][]string{
+	"anxiety":       {"тревож", "паник", "страх", "фоби"},
+	"depression":    {"депресс", "апати", "выгоран"},
+	"relationships": {"отношен", "пар", "семей", "семь"},
+	"family":        {"семей", "семь", "родител"},
+	"children":      {"детск", "дет", "подрост"},
+	"addiction":     {"зависим", "созависим", "алког"},
+	"trauma":        {"травм", "птср", "насили"},
+	"self_esteem":   {"самооцен", "уверен"},
+	"grief":         {"утрат", "горе", "потер"},
+}
+
+// matchStems turns concerns into lowercase word stems used for matching
+func matchStems(concerns []string) []string {
+	var stems []string
+	seen := map[string]bool{}
+	add := func(stem string) {
+		if stem != "" && !seen[stem] {
+			seen[stem] = true
+			stems = append(stems, stem)
+		}
+	}
+
+	for _, concern := range concerns {
+		concern = strings.TrimSpace(concern)
+		if keywords, ok := concernKeywords[strings.ToLower(concern)]; ok {
+			for _, k := range keywords {
+				add(k)
+			}
+			continue
+		}
+		for _, word := range strings.Fields(concern) {
+			add(wordStem(word))
+		}
+	}
+	return stems
+}
+
+// wordStem crudely strips Russian endings so that "тревога" matches
+// "тревожные". Abbreviations like "ОКР" are kept whole; stop words and other
+// words shorter than 3 runes give no stem.
+func wordStem(word string) string {
+	word = strings.Trim(word, ".,;:!?\"'()«»")
+	n := utf8.RuneCountInString(word)
+	if n >= 2 && isAbbreviation(word) {
+		return strings.ToLower(word)
+	}
+	word = strings.ToLower(word)
+	if n < 3 || matchStopWords[word] {
+		return ""
+	}
+	if n < 4 {
+		return word
+	}
+	runes := []rune(word)
+	if n > 6 {
+		return string(runes[:n-2])
+	}
+	return string(runes[:n-1])
+}
+
+// isAbbreviation reports whether all letters of the word are capitals
+func isAbbreviation(word string) bool {
+	letters := 0
+	for _, r := range word {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters > 0
+}
+
+// matchRelevance is an SQL expression ranking therapists by how many stems
+// their specialization (2 points) or bio (1 point) contains
+func matchRelevance(stems []string) clause.Expr {
+	if len(stems) == 0 {
+		return clause.Expr{SQL: "0"}
+	}
+	parts := make([]string, len(stems))
+	vars := make([]interface{}, 0, 2*len(stems))
+	for i, stem := range stems {
+		parts[i] = "CASE WHEN therapists.specialization ILIKE ? THEN 2 WHEN therapists.bio ILIKE ? THEN 1 ELSE 0 END"
+		vars = append(vars, "%"+stem+"%", "%"+stem+"%")
+	}
+	return clause.Expr{SQL: strings.Join(parts, " + "), Vars: vars}
+}
+
+// parseLanguages decodes the JSON array stored in Therapist.Languages
+func parseLanguages(t Therapist) []string {
+	var languages []string
+	if t.Languages == "" {
+		return languages
+	}
+	_ = json.Unmarshal([]byte(t.Languages), &languages)
+	return languages
+}
+
+// scoreTherapist evaluates one therapist against the questionnaire
+func scoreTherapist(t Therapist, req MatchRequest, stems []string, now time.Time) TherapistMatch {
+	var reasons []MatchReason
+
+	// Specialization: share of concerns covered by specialization (full) or bio (half)
+	specText := strings.ToLower(t.Specialization)
+	bioText := strings.ToLower(t.Bio)
+	var specHits, bioHits int
+	for _, stem := range stems {
+		if strings.Contains(specText, stem) {
+			specHits++
+		} else if strings.Contains(bioText, stem) {
+			bioHits++
+		}
+	}
+	specScore := 0.0
+	specReason := "Специализация не связана с вашим запросом"
+	if len(stems) > 0 {
+		coverage := (float64(specHits) + 0.5*float64(bioHits)) / float64(len(stems))
+		specScore = matchWeightSpecialization * math.Min(1, coverage*2)
+	}
+	if specHits > 0 {
+		specReason = "Специализация «" + t.Specialization + "» соответствует вашему запросу"
+	} else if bioHits > 0 {
+		specReason = "Работает с вашим запросом (по описанию специалиста)"
+	}
+	reasons = append(reasons, MatchReason{"specialization", specScore, matchWeightSpecialization, specReason})
+
+	// Approach
+	approachScore := matchWeightApproach / 2
+	approachReason := "Предпочтительный подход не указан"
+	if req.Approach != "" {
+		approachStems := matchStems([]string{req.Approach})
+		approachText := strings.ToLower(t.Approach)
+		approachScore = 0
+		approachReason = "Работает в другом подходе: " + t.Approach
+		for _, stem := range approachStems {
+			if strings.Contains(approachText, stem) {
+				approachScore = matchWeightApproach
+				approachReason = "Работает в предпочитаемом подходе: " + t.Approach
+				break
+			}
+		}
+	}
+	reasons = append(reasons, MatchReason{"approach", approachScore, matchWeightApproach, approachReason})
+
+	// Experience: saturates at 15 years
+	expScore := matchWeightExperience * math.Min(1, float64(t.Experience)/15)
+	reasons = append(reasons, MatchReason{"experience", expScore, matchWeightExperience,
+		"Опыт работы: " + pluralYears(t.Experience)})
+
+	// Rating: 3.0 and below gives nothing, 5.0 gives the full weight
+	ratingScore := matchWeightRating * math.Max(0, math.Min(1, (t.Rating-3)/2))
+	reasons = append(reasons, MatchReason{"rating", ratingScore, matchWeightRating,
+		"Рейтинг " + formatRating(t.Rating) + " на основе " + pluralReviews(t.ReviewCount)})
+
+	// Availability
+	availScore, availReason := scoreAvailability(t, req.Schedule, now)
+	reasons = append(reasons, MatchReason{"availability", availScore, matchWeightAvailability, availReason})
+
+	// Price
+	priceScore := matchWeightPrice
+	priceReason := "Бюджет не указан"
+	if req.Budget > 0 {
+		budget := req.Budget * 100
+		if t.PricePerHourRUB <= budget {
+			priceScore = matchWeightPrice * (0.5 + 0.5*(1-float64(t.PricePerHourRUB)/float64(budget)))
+			priceReason = "Стоимость в пределах вашего бюджета"
+		} else {
+			priceScore = 0
+			priceReason = "Стоимость превышает ваш бюджет"
+		}
+	}
+	reasons = append(reasons, MatchReason{"price", priceScore, matchWeightPrice, priceReason})
+
+	total := 0.0
+	for i := range reasons {
+		reasons[i].Score = math.Round(reasons[i].Score*10) / 10
+		total += reasons[i].Score
+	}
+
+	return TherapistMatch{
+		Therapist: t,
+		Score:     math.Round(total*10) / 10,
+		Reasons:   reasons,
+	}
+}
+
+func scoreAvailability(t Therapist, schedule MatchSchedule, now time.Time) (float64, string) {
+	if schedule.OnlineNow {
+		if t.IsOnline {
+			return matchWeightAvailability, "Сейчас онлайн"
+		}
+		return 0, "Сейчас не в сети"
+	}
+
+	if t.NextSlot == nil {
+		if t.IsOnline {
+			return matchWeightAvailability / 2, "Сейчас онлайн, ближайшее время уточняется"
+		}
+		return 0, "Нет свободного времени в расписании"
+	}
+
+	// Only a slot inside the requested window counts
+	slot := *t.NextSlot
+	if schedule.EarliestStart != nil && slot.Before(*schedule.EarliestStart) {
+		return 0, "Ближайшее свободное время раньше удобного для вас"
+	}
+	if schedule.LatestStart != nil && slot.After(*schedule.LatestStart) {
+		return 0, "Ближайшее свободное время позже удобного для вас"
+	}
+	if schedule.EarliestStart != nil || schedule.LatestStart != nil {
+		return matchWeightAvailability, "Есть свободное время в удобный для вас период"
+	}
+
+	// No preference: the sooner, the better, within two weeks
+	days := slot.Sub(now).Hours() / 24
+	score := matchWeightAvailability * math.Max(0, math.Min(1, 1-days/14))
+	return score, "Ближайшая сессия: " + slot.Format("02.01.2006 15:04")
+}
+
+func pluralYears(n int) string {
+	return strconv.Itoa(n) + " " + pluralRu(n, "год", "года", "лет")
+}
+
+func pluralReviews(n int) string {
+	return strconv.Itoa(n) + " " + pluralRu(n, "отзыва", "отзывов", "отзывов")
+}
+
+// pluralRu picks the Russian plural form for n (1 год, 2 года, 5 лет)
+func pluralRu(n int, one, few, many string) string {
+	n = n % 100
+	if n >= 11 && n <= 14 {
+		return many
+	}
+	switch n % 10 {
+	case 1:
+		return one
+	case 2, 3, 4:
+		return few
+	}
+	return many
+}
+
+func formatRating(r float64) string {
+	return strings.TrimRight(strings.TrimRight(strconv.FormatFloat(r, 'f', 1, 64), "0"), ".")
+}
+
+// Handlers
+func matchTherapists(c *gin.Context) {
+	var req MatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	if req.Limit < 1 || req.Limit > 20 {
+		req.Limit = 5
+	}
+
+	// Hard requirements are applied in the query, and only the best rated
+	// candidates are scored
+	query := db.Model(&Therapist{}).
+		Joins("JOIN users ON users.id = therapists.user_id AND users.deleted_at IS NULL")
+	if language := strings.ToLower(strings.TrimSpace(req.Language)); language != "" {
+		query = query.Scopes(filterByTerms(VocabularyLanguage, []string{language}))
+	}
+	if req.Budget > 0 {
+		query = query.Where("therapists.price_per_hour_rub <= ?", req.Budget*100)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var eligible int64
+	if err := query.Count(&eligible).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch therapists",
+		})
+		return
+	}
+
+	stems := matchStems(req.Concerns)
+	relevance := matchRelevance(stems)
+	var therapists []Therapist
+	if err := query.Preload("User").Preload("Terms").
+		Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "(?) DESC, therapists.rating DESC, therapists.id",
+			Vars:               []interface{}{relevance},
+			WithoutParentheses: true,
+		}}).
+		Limit(matchCandidateLimit).
+		Find(&therapists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch therapists",
+		})
+		return
+	}
+
+	now := time.Now()
+
+	matches := make([]TherapistMatch, 0, len(therapists))
+	for _, t := range therapists {
+		matches = append(matches, scoreTherapist(t, req, stems, now))
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Therapist.Rating > matches[j].Therapist.Rating
+	})
+
+	meta := MatchMeta{Eligible: int(eligible), Scored: len(matches), Truncated: int(eligible) > len(matches)}
+	if len(matches) > req.Limit {
+		matches = matches[:req.Limit]
+	}
+	viewer := viewerCurrency(c)
+	for i := range matches {
+		t := &matches[i].Therapist
+		t.DisplayPrice = displayMoney(t.PricePerHour, t.Currency, viewer)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data: MatchResponse{
+			Matches: matches,
+			Total:   meta.Scored,
+		},
+		Meta: meta,
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMatchStems(t *testing.T) {
+	tests := []struct {
+		concerns []string
+		want     []string
+	}{
+		{[]string{"тревога и стресс"}, []string{"трево", "стрес"}},
+		{[]string{"ОКР"}, []string{"окр"}},
+		{[]string{"ПТСР, в отношениях"}, []string{"птср", "отношени"}},
+		{[]string{"сон"}, []string{"сон"}},
+		{[]string{"не могу с этим"}, []string{"мог", "эти"}},
+		{[]string{"anxiety"}, concernKeywords["anxiety"]},
+		{[]string{"Anxiety"}, concernKeywords["anxiety"]},
+		{[]string{"stress at work"}, []string{"stres", "wor"}},
+	}
+	for _, tt := range tests {
+		if got := matchStems(tt.concerns); !slices.Equal(got, tt.want) {
+			t.Errorf("matchStems(%q) = %q, want %q", tt.concerns, got, tt.want)
+		}
+	}
+}
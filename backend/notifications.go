@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Notification types, as in the frontend NotificationType
+const (
+	NotificationSessionReminder    = "session_reminder"
+	NotificationSessionBooked      = "session_booked"
+	NotificationSessionConfirmed   = "session_confirmed"
+	NotificationSessionCancelled   = "session_cancelled"
+	NotificationSessionRescheduled = "session_rescheduled"
+	NotificationSessionCompleted   = "session_completed"
+	NotificationPaymentSuccess     = "payment_success"
+	NotificationPaymentFailed      = "payment_failed"
+	NotificationNewMessage         = "new_message"
+	NotificationTherapistResponse  = "therapist_response"
+	NotificationSystem             = "system_announcement"
+)
+
+var notificationTypes = map[string]bool{
+	NotificationSessionReminder:    true,
+	NotificationSessionBooked:      true,
+	NotificationSessionConfirmed:   true,
+	NotificationSessionCancelled:   true,
+	NotificationSessionRescheduled: true,
+	NotificationSessionCompleted:   true,
+	NotificationPaymentSuccess:     true,
+	NotificationPaymentFailed:      true,
+	NotificationNewMessage:         true,
+	NotificationTherapistResponse:  true,
+	NotificationSystem:             true,
+}
+
+// unreadCountTTL bounds how long a cached counter may be stale when it is
+// recomputed concurrently with a change
+const unreadCountTTL = 10 * time.Minute
+
+type Notification struct {
+	ID         uint                   `json:"id" gorm:"primaryKey"`
+	UserID     uint                   `json:"user_id" gorm:"not null;index:idx_notifications_user_read"`
+	Type       string                 `json:"type" gorm:"not null"`
+	Title      string                 `json:"title"`
+	Message    string                 `json:"message"`
+	ActionURL  string                 `json:"action_url,omitempty"`
+	ActionText string                 `json:"action_text,omitempty"`
+	Data       map[string]interface{} `json:"data,omitempty" gorm:"serializer:json"`
+	ReadAt     *time.Time             `json:"read_at,omitempty" gorm:"index:idx_notifications_user_read"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+// NotificationInput is what a part of the backend passes to emit a notification
+type NotificationInput struct {
+	UserID     uint
+	Type       string
+	Title      string
+	Message    string
+	ActionURL  string
+	ActionText string
+	Data       map[string]interface{}
+	ExpiresAt  *time.Time // deliveries not made by then are skipped, e.g. the session start of a reminder
+}
+
+type UnreadCountResponse struct {
+	Count int64 `json:"count"`
+}
+
+var errUnknownNotificationType = errors.New("unknown notification type")
+
+func unreadCountKey(userID uint) string {
+	return fmt.Sprintf("notifications:unread:%d", userID)
+}
+
+// invalidateUnreadCount drops the cached counter, the next read recounts
+func invalidateUnreadCount(userID uint) {
+	if rdb == nil {
+		return
+	}
+	if err := rdb.Del(context.Background(), unreadCountKey(userID)).Err(); err != nil {
+		log.Printf("Unread counter of user %d not invalidated: %v", userID, err)
+	}
+}
+
+// unreadCount returns the number of unread notifications, cached in Redis
+func unreadCount(ctx context.Context, userID uint) (int64, error) {
+	key := unreadCountKey(userID)
+	if rdb != nil {
+		if cached, err := rdb.Get(ctx, key).Result(); err == nil {
+			if count, err := strconv.ParseInt(cached, 10, 64); err == nil {
+				return count, nil
+			}
+		}
+	}
+
+	var count int64
+	if err := db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	if rdb != nil {
+		rdb.Set(ctx, key, count, unreadCountTTL)
+	}
+	return count, nil
+}
+
+// emitNotification stores a notification for the user. It may be called
+// inside the transaction of the change it reports, so that the notification
+// exists exactly when the change does. The cached unread counter is then
+// dropped again once the transaction commits, by an outbox event: dropped
+// only now, it could be recounted without the notification before that.
+func emitNotification(tx *gorm.DB, input NotificationInput) (*Notification, error) {
+	if !notificationTypes[input.Type] {
+		return nil, fmt.Errorf("%w: %s", errUnknownNotificationType, input.Type)
+	}
+	notification := Notification{
+		UserID:     input.UserID,
+		Type:       input.Type,
+		Title:      input.Title,
+		Message:    input.Message,
+		ActionURL:  input.ActionURL,
+		ActionText: input.ActionText,
+		Data:       input.Data,
+	}
+	if err := tx.Create(&notification).Error; err != nil {
+		return nil, err
+	}
+	if err := queueDeliveries(tx, &notification, input.ExpiresAt); err != nil {
+		return nil, err
+	}
+	if _, inTransaction := tx.Statement.ConnPool.(gorm.TxCommitter); inTransaction && rdb != nil {
+		err := recordEvent(tx, EventNotificationCreated, "notification", notification.ID,
+			map[string]interface{}{"user_id": notification.UserID})
+		if err != nil {
+			return nil, err
+		}
+	}
+	invalidateUnreadCount(input.UserID)
+	return &notification, nil
+}
+
+// emitNotificationSavepoint emits the notification in a savepoint of the
+// transaction: a failure is rolled back alone and leaves the transaction
+// usable, where a failed statement would abort it in Postgres
+func emitNotificationSavepoint(tx *gorm.DB, input NotificationInput) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		_, err := emitNotification(tx, input)
+		return err
+	})
+}
+
+// therapistUserID returns the user account of the therapist
+func therapistUserID(tx *gorm.DB, therapistID uint) uint {
+	var therapist Therapist
+	if err := tx.Select("id, user_id").First(&therapist, therapistID).Error; err != nil {
+		return 0
+	}
+	return therapist.UserID
+}
+
+// sessionNotificationTexts are the titles and messages of session events,
+// the message gets the session time
+var sessionNotificationTexts = map[string][2]string{
+	NotificationSessionBooked:      {"Новая запись", "Клиент записался на сессию %s."},
+	NotificationSessionConfirmed:   {"Сессия подтверждена", "Сессия %s подтверждена."},
+	NotificationSessionCancelled:   {"Сессия отменена", "Сессия %s отменена."},
+	NotificationSessionRescheduled: {"Сессия перенесена", "Сессия перенесена на %s."},
+	NotificationSessionCompleted:   {"Сессия завершена", "Сессия %s завершена. Спасибо, что были с нами!"},
+}
+
+// notifySession emits a session event to the client or the therapist of the
+// session. Failures are logged: a missing notification must not undo the
+// change it reports.
+func notifySession(tx *gorm.DB, session *Session, notificationType, recipient string) {
+	userID := session.ClientID
+	if recipient == "therapist" {
+		userID = therapistUserID(tx, session.TherapistID)
+	}
+	if userID == 0 {
+		return
+	}
+
+	texts := sessionNotificationTexts[notificationType]
+	err := emitNotificationSavepoint(tx, NotificationInput{
+		UserID:     userID,
+		Type:       notificationType,
+		Title:      texts[0],
+		Message:    fmt.Sprintf(texts[1], session.StartTime.In(time.Local).Format("02.01.2006 15:04")),
+		ActionURL:  fmt.Sprintf("/sessions/%d", session.ID),
+		ActionText: "Открыть сессию",
+		Data:       map[string]interface{}{"session_id": session.ID},
+	})
+	if err != nil {
+		log.Printf("Notification %s for session %d not emitted: %v", notificationType, session.ID, err)
+	}
+}
+
+// notifyOtherParties emits a session event to the parties other than the
+// one who caused it: client, therapist or system (both are told)
+func notifyOtherParties(tx *gorm.DB, session *Session, notificationType, by string) {
+	if by != CancelledByClient {
+		notifySession(tx, session, notificationType, "client")
+	}
+	if by != CancelledByTherapist {
+		notifySession(tx, session, notificationType, "therapist")
+	}
+}
+
+// notifyPayment tells the payer that the payment went through or failed
+func notifyPayment(tx *gorm.DB, payment *Payment) {
+	input := NotificationInput{
+		UserID:     payment.UserID,
+		ActionURL:  fmt.Sprintf("/payments/%d", payment.ID),
+		ActionText: "Подробнее",
+		Data:       map[string]interface{}{"payment_id": payment.ID},
+	}
+	amount := formatRoubles(payment.Amount) + " ₽"
+	switch payment.Status {
+	case PaymentStatusCompleted:
+		input.Type = NotificationPaymentSuccess
+		input.Title = "Оплата прошла"
+		input.Message = "Платёж на " + amount + " успешно проведён."
+	case PaymentStatusFailed:
+		input.Type = NotificationPaymentFailed
+		input.Title = "Оплата не прошла"
+		input.Message = "Платёж на " + amount + " не прошёл. Попробуйте ещё раз."
+	default:
+		return
+	}
+	if err := emitNotificationSavepoint(tx, input); err != nil {
+		log.Printf("Notification for payment %d not emitted: %v", payment.ID, err)
+	}
+}
+
+// Handlers
+func getNotifications(c *gin.Context) {
+	limit := cursorLimit(c, 20, 100)
+	base := db.Model(&Notification{}).Where("user_id = ?", c.GetUint("user_id"))
+	if c.Query("unread") == "true" {
+		base = base.Where("read_at IS NULL")
+	}
+	if notificationType := c.Query("type"); notificationType != "" {
+		base = base.Where("type = ?", notificationType)
+	}
+	query, err := paginateByID(base, c, "notifications", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var notifications []Notification
+	if err := query.Find(&notifications).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке уведомлений",
+		})
+		return
+	}
+
+	notifications, meta := pageByID(notifications, limit, func(n Notification) uint { return n.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    notifications,
+		Meta:    meta,
+	})
+}
+
+func getUnreadNotificationCount(c *gin.Context) {
+	count, err := unreadCount(c.Request.Context(), c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при подсчёте уведомлений",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    UnreadCountResponse{Count: count},
+	})
+}
+
+func markNotificationRead(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	var notification Notification
+	if err := db.Where("user_id = ?", userID).First(&notification, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Уведомление не найдено",
+		})
+		return
+	}
+
+	if notification.ReadAt == nil {
+		now := time.Now()
+		notification.ReadAt = &now
+		if err := db.Save(&notification).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Ошибка при обновлении уведомления",
+			})
+			return
+		}
+		invalidateUnreadCount(userID)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    notification,
+	})
+}
+
+func markAllNotificationsRead(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	result := db.Model(&Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		Update("read_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при обновлении уведомлений",
+		})
+		return
+	}
+	invalidateUnreadCount(userID)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    gin.H{"updated": result.RowsAffected},
+	})
+}
+
+func deleteNotification(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	result := db.Where("user_id = ?", userID).Delete(&Notification{}, c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при удалении уведомления",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Уведомление не найдено",
+		})
+		return
+	}
+	invalidateUnreadCount(userID)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+	})
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Domain event types
+const (
+	EventSessionBooked      = "session.booked"
+	EventSessionConfirmed   = "session.confirmed"
+	EventSessionCancelled   = "session.cancelled"
+	EventSessionRescheduled = "session.rescheduled"
+	EventSessionCompleted   = "session.completed"
+	EventPaymentSucceeded   = "payment.succeeded"
+	EventPaymentRefunded    = "payment.refunded"
+
+	// Internal events, not sent to partners
+	EventNotificationCreated = "notification.created"
+)
+
+var domainEventTypes = []string{
+	EventSessionBooked, EventSessionConfirmed, EventSessionCancelled, EventSessionRescheduled,
+	EventSessionCompleted, EventPaymentSucceeded, EventPaymentRefunded,
+}
+
+const (
+	maxOutboxAttempts = 10
+	outboxBatchSize   = 100
+
+	// Stream entries not acknowledged by a subscriber for this long are
+	// taken over by another consumer of its group
+	eventClaimIdle = time.Minute
+	// A subscriber gets an event this many times before it is moved to the
+	// dead letter stream
+	maxEventDeliveries = 10
+	deadEventsMaxLen   = 10000
+)
+
+// OutboxEvent is a domain event written in the transaction of the change it
+// describes. The relay publishes it to the event stream afterwards, so an
+// event exists exactly when its change was committed and is published at
+// least once.
+type OutboxEvent struct {
+	ID            uint                   `json:"id" gorm:"primaryKey"`
+	Type          string                 `json:"type" gorm:"not null;index"`
+	AggregateType string                 `json:"aggregate_type" gorm:"not null"`
+	AggregateID   uint                   `json:"aggregate_id" gorm:"not null"`
+	Payload       map[string]interface{} `json:"payload" gorm:"serializer:json"`
+	Attempts      int                    `json:"attempts"`
+	NextAttemptAt time.Time              `json:"next_attempt_at"`
+	LastError     string                 `json:"last_error,omitempty"`
+	PublishedAt   *time.Time             `json:"published_at,omitempty" gorm:"index"`
+	CreatedAt     time.Time              `json:"created_at"`
+}
+
+// DomainEvent is an event as subscribers receive it
+type DomainEvent struct {
+	ID            uint                   `json:"id"`
+	Type          string                 `json:"type"`
+	AggregateType string                 `json:"aggregate_type"`
+	AggregateID   uint                   `json:"aggregate_id"`
+	Payload       map[string]interface{} `json:"payload"`
+	OccurredAt    time.Time              `json:"occurred_at"`
+}
+
+// EventHandler handles a delivered event. Delivery is at least once, so
+// handlers must tolerate an event they have seen already; the event ID
+// identifies it. Returning an error leaves the event to be redelivered.
+type EventHandler func(ctx context.Context, event DomainEvent) error
+
+type eventSubscriber struct {
+	name    string
+	types   map[string]bool // empty for every type
+	handler EventHandler
+}
+
+var (
+	eventSubscribersMu sync.RWMutex
+	eventSubscribers   []eventSubscriber
+)
+
+// eventStream is the Redis stream the relay publishes to
+func eventStream() string {
+	return getEnv("EVENT_STREAM", "domain-events")
+}
+
+// deadEventStream keeps the events subscribers failed to handle
+func deadEventStream() string {
+	return eventStream() + ":dead"
+}
+
+func eventGroup(subscriber string) string {
+	return "subscriber:" + subscriber
+}
+
+// recordEvent adds an event to the outbox. It must be called with the
+// transaction of the change.
+func recordEvent(tx *gorm.DB, eventType, aggregateType string, aggregateID uint, payload map[string]interface{}) error {
+	event := OutboxEvent{
+		Type:          eventType,
+		AggregateType: aggregateType,
+		AggregateID:   aggregateID,
+		Payload:       payload,
+		NextAttemptAt: time.Now(),
+	}
+	return tx.Create(&event).Error
+}
+
+// recordSessionEvent adds a session event with the session fields partners
+// and subscribers need
+func recordSessionEvent(tx *gorm.DB, eventType string, session *Session) error {
+	payload := map[string]interface{}{
+		"session_id":   session.ID,
+		"client_id":    session.ClientID,
+		"therapist_id": session.TherapistID,
+		"status":       session.Status,
+		"type":         session.Type,
+		"start_time":   session.StartTime,
+		"end_time":     session.EndTime,
+		"price":        session.Price,
+		"currency":     session.Currency,
+	}
+	if session.CancelledBy != "" {
+		payload["cancelled_by"] = session.CancelledBy
+	}
+	return recordEvent(tx, eventType, "session", session.ID, payload)
+}
+
+// recordPaymentEvent adds a payment event
+func recordPaymentEvent(tx *gorm.DB, eventType string, payment *Payment) error {
+	payload := map[string]interface{}{
+		"payment_id": payment.ID,
+		"user_id":    payment.UserID,
+		"amount":     payment.Amount,
+		"currency":   payment.Currency,
+		"status":     payment.Status,
+		"provider":   payment.Provider,
+	}
+	if payment.SessionID != nil {
+		payload["session_id"] = *payment.SessionID
+	}
+	if payment.ClientPackageID != nil {
+		payload["client_package_id"] = *payment.ClientPackageID
+	}
+	return recordEvent(tx, eventType, "payment", payment.ID, payload)
+}
+
+// recordRefundEvent adds the refund of a payment, which the provider has
+// accepted
+func recordRefundEvent(tx *gorm.DB, refund *Refund, payment *Payment) error {
+	payload := map[string]interface{}{
+		"payment_id":    payment.ID,
+		"refund_id":     refund.ID,
+		"user_id":       payment.UserID,
+		"amount":        refund.Amount,
+		"refund_amount": payment.RefundAmount,
+		"currency":      payment.Currency,
+		"status":        payment.Status,
+	}
+	if payment.SessionID != nil {
+		payload["session_id"] = *payment.SessionID
+	}
+	return recordEvent(tx, EventPaymentRefunded, "payment", payment.ID, payload)
+}
+
+// subscribeEvents registers an internal subscriber. Each subscriber is a
+// consumer group of the event stream, so it gets every event once per
+// group however many instances run it.
+func subscribeEvents(name string, types []string, handler EventHandler) {
+	subscriber := eventSubscriber{name: name, types: map[string]bool{}, handler: handler}
+	for _, t := range types {
+		subscriber.types[t] = true
+	}
+	eventSubscribersMu.Lock()
+	eventSubscribers = append(eventSubscribers, subscriber)
+	eventSubscribersMu.Unlock()
+}
+
+func (s *eventSubscriber) wants(eventType string) bool {
+	return len(s.types) == 0 || s.types[eventType]
+}
+
+func (e *OutboxEvent) domainEvent() DomainEvent {
+	return DomainEvent{
+		ID:            e.ID,
+		Type:          e.Type,
+		AggregateType: e.AggregateType,
+		AggregateID:   e.AggregateID,
+		Payload:       e.Payload,
+		OccurredAt:    e.CreatedAt,
+	}
+}
+
+// publishEvent hands an event over. With Redis it goes to the stream; without
+// it the subscribers are called right here, which keeps single-instance
+// setups working.
+func publishEvent(ctx context.Context, event DomainEvent) error {
+	if rdb == nil {
+		return dispatchEvent(ctx, event)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// The stream is trimmed by trimEventStream once every group is past
+	// an entry, never by length
+	return rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: eventStream(),
+		Values: map[string]interface{}{"type": event.Type, "event": data},
+	}).Err()
+}
+
+// dispatchEvent calls every interested subscriber directly
+func dispatchEvent(ctx context.Context, event DomainEvent) error {
+	eventSubscribersMu.RLock()
+	subscribers := append([]eventSubscriber(nil), eventSubscribers...)
+	eventSubscribersMu.RUnlock()
+
+	var errs []error
+	for _, s := range subscribers {
+		if !s.wants(event.Type) {
+			continue
+		}
+		if err := s.handler(ctx, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// relayOutbox publishes due outbox events in order of their IDs. Rows are
+// locked with SKIP LOCKED, so several replicas can relay at once.
+func relayOutbox(ctx context.Context) {
+	for {
+		var events []OutboxEvent
+		err := db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("published_at IS NULL AND attempts < ? AND next_attempt_at <= ?", maxOutboxAttempts, time.Now()).
+				Order("id").Limit(outboxBatchSize).Find(&events).Error
+			if err != nil {
+				return err
+			}
+			for i := range events {
+				event := &events[i]
+				event.Attempts++
+				if err := publishEvent(ctx, event.domainEvent()); err != nil {
+					event.LastError = err.Error()
+					delay := time.Duration(event.Attempts*event.Attempts) * time.Minute
+					event.NextAttemptAt = time.Now().Add(delay)
+					log.Printf("Outbox event %d (%s) not published (attempt %d): %v", event.ID, event.Type, event.Attempts, err)
+				} else {
+					now := time.Now()
+					event.PublishedAt = &now
+					event.LastError = ""
+				}
+				if err := tx.Save(event).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Outbox relay: %v", err)
+			return
+		}
+		if len(events) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// consumeEvents reads the stream for one subscriber as a member of its
+// consumer group and acknowledges each entry once handled. Entries left
+// unacknowledged, by a failed handler or a consumer that died, are claimed
+// again after eventClaimIdle, up to maxEventDeliveries times.
+func consumeEvents(ctx context.Context, s eventSubscriber, consumer string) {
+	stream := eventStream()
+	group := eventGroup(s.name)
+	// A new group starts from the oldest entry kept, so events published
+	// before the subscriber first ran are not missed
+	if err := rdb.XGroupCreateMkStream(ctx, stream, group, "0").Err(); err != nil &&
+		!strings.Contains(err.Error(), "BUSYGROUP") {
+		log.Printf("Event subscriber %s: %v", s.name, err)
+		return
+	}
+
+	handle := func(messages []redis.XMessage, claimed bool) {
+		for _, message := range messages {
+			if claimed && eventDeliveries(ctx, stream, group, message.ID) >= maxEventDeliveries {
+				deadLetterEvent(ctx, s.name, message)
+				continue
+			}
+			raw, _ := message.Values["event"].(string)
+			var event DomainEvent
+			if err := json.Unmarshal([]byte(raw), &event); err != nil {
+				log.Printf("Event subscriber %s: malformed entry %s dropped: %v", s.name, message.ID, err)
+				rdb.XAck(ctx, stream, group, message.ID)
+				continue
+			}
+			if s.wants(event.Type) {
+				if err := s.handler(ctx, event); err != nil {
+					log.Printf("Event subscriber %s: event %d (%s): %v", s.name, event.ID, event.Type, err)
+					continue
+				}
+			}
+			rdb.XAck(ctx, stream, group, message.ID)
+		}
+	}
+
+	lastClaim := time.Time{}
+	for ctx.Err() == nil {
+		if time.Since(lastClaim) > eventClaimIdle/2 {
+			lastClaim = time.Now()
+			claimed, _, err := rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   stream,
+				Group:    group,
+				Consumer: consumer,
+				MinIdle:  eventClaimIdle,
+				Start:    "0-0",
+				Count:    100,
+			}).Result()
+			if err == nil {
+				handle(claimed, true)
+			}
+		}
+
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, ">"},
+			Count:    100,
+			Block:    5 * time.Second,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Event subscriber %s: %v", s.name, err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		for _, st := range streams {
+			handle(st.Messages, false)
+		}
+	}
+}
+
+// eventDeliveries is how many times the entry was delivered to the group
+func eventDeliveries(ctx context.Context, stream, group, id string) int64 {
+	pending, err := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 0
+	}
+	return pending[0].RetryCount
+}
+
+// deadLetterEvent gives up on an entry for the subscriber: it is copied to
+// the dead letter stream and acknowledged
+func deadLetterEvent(ctx context.Context, subscriber string, message redis.XMessage) {
+	stream := eventStream()
+	log.Printf("Event subscriber %s: entry %s failed %d times, moved to %s",
+		subscriber, message.ID, maxEventDeliveries, deadEventStream())
+	err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: deadEventStream(),
+		MaxLen: deadEventsMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"subscriber": subscriber,
+			"entry_id":   message.ID,
+			"type":       message.Values["type"],
+			"event":      message.Values["event"],
+		},
+	}).Err()
+	if err != nil {
+		// Left pending, it is claimed and dead-lettered again later
+		log.Printf("Event subscriber %s: entry %s not dead-lettered: %v", subscriber, message.ID, err)
+		return
+	}
+	rdb.XAck(ctx, stream, eventGroup(subscriber), message.ID)
+}
+
+// compareStreamIDs orders two stream entry IDs, "<ms>-<seq>"
+func compareStreamIDs(a, b string) int {
+	parse := func(id string) (uint64, uint64) {
+		ms, seq, _ := strings.Cut(id, "-")
+		m, _ := strconv.ParseUint(ms, 10, 64)
+		s, _ := strconv.ParseUint(seq, 10, 64)
+		return m, s
+	}
+	am, as := parse(a)
+	bm, bs := parse(b)
+	switch {
+	case am != bm:
+		if am < bm {
+			return -1
+		}
+		return 1
+	case as != bs:
+		if as < bs {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// trimEventStream drops the entries every subscriber is done with: those
+// before the oldest entry a group still has pending, or has not read yet
+func trimEventStream(ctx context.Context) {
+	if rdb == nil {
+		return
+	}
+	stream := eventStream()
+	groups, err := rdb.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		if ctx.Err() == nil && !strings.Contains(err.Error(), "no such key") {
+			log.Printf("Event stream trim: %v", err)
+		}
+		return
+	}
+
+	eventSubscribersMu.RLock()
+	subscribed := make(map[string]bool, len(eventSubscribers))
+	for _, s := range eventSubscribers {
+		subscribed[eventGroup(s.name)] = true
+	}
+	eventSubscribersMu.RUnlock()
+
+	minID := ""
+	for _, g := range groups {
+		// Groups of subscribers that were removed do not hold the stream
+		if !subscribed[g.Name] {
+			continue
+		}
+		oldest := g.LastDeliveredID
+		if g.Pending > 0 {
+			pending, err := rdb.XPending(ctx, stream, g.Name).Result()
+			if err != nil {
+				log.Printf("Event stream trim: %v", err)
+				return
+			}
+			oldest = pending.Lower
+		}
+		if minID == "" || compareStreamIDs(oldest, minID) < 0 {
+			minID = oldest
+		}
+	}
+	if minID == "" || minID == "0-0" {
+		return
+	}
+	if err := rdb.XTrimMinID(ctx, stream, minID).Err(); err != nil {
+		log.Printf("Event stream trim: %v", err)
+	}
+}
+
+// startEventSubscribers runs every registered subscriber until the context
+// is done
+func startEventSubscribers(ctx context.Context, wg *sync.WaitGroup) {
+	if rdb == nil {
+		return
+	}
+	hostname, _ := os.Hostname()
+	consumer := hostname + ":" + strconv.Itoa(os.Getpid())
+
+	eventSubscribersMu.RLock()
+	defer eventSubscribersMu.RUnlock()
+	for _, s := range eventSubscribers {
+		wg.Add(1)
+		go func(s eventSubscriber) {
+			defer wg.Done()
+			consumeEvents(ctx, s, consumer)
+		}(s)
+	}
+}
+
+// Internal subscribers
+func init() {
+	registerPeriodicJob(JobRelayOutbox, 2*time.Second, relayOutbox)
+	registerPeriodicJob(JobTrimEvents, time.Minute, trimEventStream)
+
+	// Platform stats count therapists and sessions, a new or cancelled
+	// session makes the cached ones stale
+	subscribeEvents("stats", []string{EventSessionBooked, EventSessionCancelled, EventSessionCompleted},
+		func(ctx context.Context, event DomainEvent) error {
+			if rdb == nil {
+				return nil
+			}
+			return rdb.Del(ctx, platformStatsKey).Err()
+		})
+
+	// Unread counters cached while a notification was being committed
+	// miss it
+	subscribeEvents("unread_counts", []string{EventNotificationCreated},
+		func(ctx context.Context, event DomainEvent) error {
+			userID, _ := event.Payload["user_id"].(float64)
+			invalidateUnreadCount(uint(userID))
+			return nil
+		})
+}
+
+// Handlers
+func getOutboxEvents(c *gin.Context) {
+	limit := cursorLimit(c, 50, 200)
+	base := db.Model(&OutboxEvent{})
+	switch c.Query("status") {
+	case "pending":
+		base = base.Where("published_at IS NULL AND attempts < ?", maxOutboxAttempts)
+	case "failed":
+		base = base.Where("published_at IS NULL AND attempts >= ?", maxOutboxAttempts)
+	case "published":
+		base = base.Where("published_at IS NOT NULL")
+	}
+	if eventType := c.Query("type"); eventType != "" {
+		base = base.Where("type = ?", eventType)
+	}
+	query, err := paginateByID(base, c, "outbox_events", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var events []OutboxEvent
+	if err := query.Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке событий",
+		})
+		return
+	}
+
+	events, meta := pageByID(events, limit, func(e OutboxEvent) uint { return e.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    events,
+		Meta:    meta,
+	})
+}
+
+// retryOutboxEvent gives a failed event a fresh set of attempts
+func retryOutboxEvent(c *gin.Context) {
+	result := db.Model(&OutboxEvent{}).
+		Where("id = ? AND published_at IS NULL", c.Param("id")).
+		Updates(map[string]interface{}{"attempts": 0, "next_attempt_at": time.Now(), "last_error": ""})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при обновлении события",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Событие не найдено или уже опубликовано",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+	})
+}
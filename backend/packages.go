@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Package kinds
+const (
+	PackageKindPackage      = "package"      // a course of sessions
+	PackageKindSubscription = "subscription" // sessions per month
+)
+
+// Client package statuses
+const (
+	ClientPackageStatusPending   = "pending" // waiting for payment
+	ClientPackageStatusActive    = "active"
+	ClientPackageStatusExpired   = "expired"
+	ClientPackageStatusRefunded  = "refunded"
+	ClientPackageStatusCancelled = "cancelled" // payment failed
+)
+
+// subscriptionPeriodDays is the term of a monthly subscription. Unused
+// sessions do not roll over to the next month.
+const subscriptionPeriodDays = 30
+
+// SessionPackage is an offer of a therapist: a discounted course of sessions
+// or a monthly subscription
+type SessionPackage struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	TherapistID   uint      `json:"therapist_id" gorm:"not null;index"`
+	Kind          string    `json:"kind" gorm:"not null;default:package"`
+	Name          string    `json:"name" gorm:"not null"`
+	Description   string    `json:"description,omitempty"`
+	SessionsCount int       `json:"sessions_count"`
+	SessionType   string    `json:"session_type" gorm:"default:individual"`
+	Duration      int       `json:"duration" gorm:"default:60"` // minutes of each session
+	Price         int       `json:"price"`                      // in minor units, for the whole package or month
+	Currency      string    `json:"currency" gorm:"default:RUB"`
+	ValidDays     int       `json:"valid_days"` // credits expire after this many days
+	IsActive      bool      `json:"is_active"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+
+	DisplayPrice *Money `json:"display_price,omitempty" gorm:"-"` // in the viewer currency
+}
+
+type SessionPackageRequest struct {
+	Kind          string `json:"kind" binding:"required,oneof=package subscription"`
+	Name          string `json:"name" binding:"required"`
+	Description   string `json:"description"`
+	SessionsCount int    `json:"sessions_count" binding:"required,min=1,max=50"`
+	SessionType   string `json:"session_type" binding:"omitempty,oneof=individual couple group"`
+	Duration      int    `json:"duration" binding:"omitempty,min=30,max=180"`
+	Price         int    `json:"price" binding:"required,min=1"` // in minor units of Currency
+	Currency      string `json:"currency" binding:"omitempty,oneof=RUB EUR USD"`
+	ValidDays     int    `json:"valid_days" binding:"omitempty,min=1,max=730"`
+	IsActive      *bool  `json:"is_active"`
+}
+
+// ClientPackage is a package bought by a client. ConsumedAmount is the part
+// of the price already earned by the therapist through used or expired
+// credits; the rest is refundable.
+type ClientPackage struct {
+	ID             uint            `json:"id" gorm:"primaryKey"`
+	ClientID       uint            `json:"client_id" gorm:"not null;index"`
+	TherapistID    uint            `json:"therapist_id" gorm:"not null;index"`
+	PackageID      uint            `json:"package_id" gorm:"not null"`
+	Package        *SessionPackage `json:"package,omitempty" gorm:"foreignKey:PackageID"`
+	Kind           string          `json:"kind"`
+	Status         string          `json:"status" gorm:"default:pending;index"`
+	SessionsTotal  int             `json:"sessions_total"`
+	SessionsUsed   int             `json:"sessions_used"`
+	SessionType    string          `json:"session_type"`
+	Duration       int             `json:"duration"`
+	Price          int             `json:"price"` // in kopecks
+	ConsumedAmount int             `json:"consumed_amount"`
+	PaymentID      *uint           `json:"payment_id,omitempty"`
+	ActivatedAt    *time.Time      `json:"activated_at,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty" gorm:"index"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// PackageCredit is a credit of a client package spent on a session
+type PackageCredit struct {
+	ID              uint       `json:"id" gorm:"primaryKey"`
+	ClientPackageID uint       `json:"client_package_id" gorm:"not null;index"`
+	SessionID       uint       `json:"session_id" gorm:"not null;uniqueIndex"`
+	Amount          int        `json:"amount"` // share of the package price, in kopecks
+	ReturnedAt      *time.Time `json:"returned_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type PackagePurchaseRequest struct {
+	Provider  string `json:"provider"`
+	ReturnURL string `json:"return_url"`
+}
+
+type ClientPackageRefundResponse struct {
+	ClientPackage *ClientPackage `json:"client_package"`
+	Refund        *Refund        `json:"refund"`
+}
+
+type PackagePurchaseResponse struct {
+	ClientPackage ClientPackage `json:"client_package"`
+	Payment       Payment       `json:"payment"`
+}
+
+var errPackageNotRefundable = errors.New("package cannot be refunded")
+
+func (p *ClientPackage) remaining() int {
+	return p.SessionsTotal - p.SessionsUsed
+}
+
+// activatePackage starts the validity of a paid package
+func activatePackage(tx *gorm.DB, clientPackageID uint) error {
+	var cp ClientPackage
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cp, clientPackageID).Error; err != nil {
+		return err
+	}
+	if cp.Status != ClientPackageStatusPending {
+		return nil
+	}
+
+	var offer SessionPackage
+	if err := tx.First(&offer, cp.PackageID).Error; err != nil {
+		return err
+	}
+	days := offer.ValidDays
+	if cp.Kind == PackageKindSubscription || days == 0 {
+		days = subscriptionPeriodDays
+	}
+
+	now := time.Now()
+	expires := now.AddDate(0, 0, days)
+	cp.Status = ClientPackageStatusActive
+	cp.ActivatedAt = &now
+	cp.ExpiresAt = &expires
+	return tx.Save(&cp).Error
+}
+
+// useCredit pays the session with a credit of an active package of the
+// client with the same therapist, session type and duration, taking the
+// package that expires first. It returns nil when the client has no credit.
+func useCredit(tx *gorm.DB, session *Session) (*ClientPackage, error) {
+	var cp ClientPackage
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("client_id = ? AND therapist_id = ? AND status = ?", session.ClientID, session.TherapistID, ClientPackageStatusActive).
+		Where("session_type = ? AND duration = ?", session.Type, session.Duration).
+		Where("sessions_used < sessions_total AND expires_at > ?", session.StartTime).
+		Order("expires_at").Limit(1).Find(&cp)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+
+	// The remainder of the division goes to the last credits
+	amount := (cp.Price - cp.ConsumedAmount) / cp.remaining()
+	credit := PackageCredit{ClientPackageID: cp.ID, SessionID: session.ID, Amount: amount}
+	if err := tx.Create(&credit).Error; err != nil {
+		return nil, err
+	}
+
+	cp.SessionsUsed++
+	cp.ConsumedAmount += amount
+	if err := tx.Save(&cp).Error; err != nil {
+		return nil, err
+	}
+
+	session.ClientPackageID = &cp.ID
+	session.Status = SessionStatusConfirmed
+	if err := tx.Save(session).Error; err != nil {
+		return nil, err
+	}
+	if err := recordSessionEvent(tx, EventSessionConfirmed, session); err != nil {
+		return nil, err
+	}
+	if err := scheduleSessionReminders(tx, session); err != nil {
+		return nil, err
+	}
+
+	return &cp, postPrepaymentUsage(tx, fmt.Sprintf("credit:%d", credit.ID), cp.TherapistID, &session.ID, amount,
+		fmt.Sprintf("Сессия №%d по пакету №%d", session.ID, cp.ID))
+}
+
+// returnCredit gives the credit of a cancelled session back to its package.
+// It reports whether there was a credit to return.
+func returnCredit(tx *gorm.DB, session *Session) (bool, error) {
+	var credit PackageCredit
+	if err := tx.Where("session_id = ? AND returned_at IS NULL", session.ID).First(&credit).Error; err != nil {
+		return false, nil
+	}
+	var cp ClientPackage
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cp, credit.ClientPackageID).Error; err != nil {
+		return false, err
+	}
+	// Credits of expired or refunded packages are settled already
+	if cp.Status != ClientPackageStatusActive {
+		return false, nil
+	}
+
+	now := time.Now()
+	credit.ReturnedAt = &now
+	if err := tx.Save(&credit).Error; err != nil {
+		return false, err
+	}
+
+	cp.SessionsUsed--
+	cp.ConsumedAmount -= credit.Amount
+	if err := tx.Save(&cp).Error; err != nil {
+		return false, err
+	}
+	return true, postPrepaymentUsage(tx, fmt.Sprintf("credit-return:%d", credit.ID), cp.TherapistID, &session.ID, -credit.Amount,
+		fmt.Sprintf("Возврат сессии №%d в пакет №%d", session.ID, cp.ID))
+}
+
+// expirePackages closes packages past their validity; what was not used is
+// earned by the therapist. Safe to run on several replicas.
+func expirePackages() {
+	for {
+		found := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var cp ClientPackage
+			result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? AND expires_at <= ?", ClientPackageStatusActive, time.Now()).
+				Order("id").Limit(1).Find(&cp)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			found = true
+
+			unused := cp.Price - cp.ConsumedAmount
+			cp.Status = ClientPackageStatusExpired
+			cp.ConsumedAmount = cp.Price
+			if err := tx.Save(&cp).Error; err != nil {
+				return err
+			}
+			if unused <= 0 {
+				return nil
+			}
+			return postPrepaymentUsage(tx, fmt.Sprintf("package-expiry:%d", cp.ID), cp.TherapistID, nil, unused,
+				fmt.Sprintf("Истёк срок пакета №%d", cp.ID))
+		})
+		if err != nil {
+			log.Printf("Package expiry: %v", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+func init() {
+	registerPeriodicJob(JobExpirePackages, time.Hour, func(context.Context) { expirePackages() })
+}
+
+// refundClientPackage returns the unused part of a package price. The package
+// is closed and the refund reserved in one transaction so that its credits
+// cannot be used in the meantime; the package is reopened if the provider
+// declines the refund.
+func refundClientPackage(ctx context.Context, clientPackageID uint) (*ClientPackage, *Refund, error) {
+	var cp ClientPackage
+	var refund *Refund
+	var payment *Payment
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cp, clientPackageID).Error; err != nil {
+			return err
+		}
+		amount := cp.Price - cp.ConsumedAmount
+		if cp.Status != ClientPackageStatusActive || cp.PaymentID == nil || amount <= 0 {
+			return errPackageNotRefundable
+		}
+		var paid Payment
+		if err := tx.First(&paid, *cp.PaymentID).Error; err != nil {
+			return err
+		}
+		amount = min(amount, refundable(&paid))
+		if amount <= 0 {
+			return errPackageNotRefundable
+		}
+		cp.Status = ClientPackageStatusRefunded
+		if err := tx.Save(&cp).Error; err != nil {
+			return err
+		}
+		var err error
+		refund, payment, err = reserveRefund(tx, paid.ID, amount, fmt.Sprintf("Возврат неиспользованных сессий пакета №%d", cp.ID))
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refund, err = submitRefund(ctx, refund, payment)
+	if err != nil {
+		db.Model(&cp).Update("status", ClientPackageStatusActive)
+		cp.Status = ClientPackageStatusActive
+		return &cp, refund, err
+	}
+	return &cp, refund, nil
+}
+
+func bindSessionPackage(c *gin.Context, offer *SessionPackage) bool {
+	var req SessionPackageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return false
+	}
+
+	offer.Kind = req.Kind
+	offer.Name = req.Name
+	offer.Description = req.Description
+	offer.SessionsCount = req.SessionsCount
+	offer.SessionType = req.SessionType
+	if offer.SessionType == "" {
+		offer.SessionType = "individual"
+	}
+	offer.Duration = req.Duration
+	if offer.Duration == 0 {
+		offer.Duration = 60
+	}
+	offer.Price = req.Price
+	if req.Currency != "" {
+		offer.Currency = req.Currency
+	}
+	offer.ValidDays = req.ValidDays
+	if offer.Kind == PackageKindSubscription {
+		offer.ValidDays = subscriptionPeriodDays
+	} else if offer.ValidDays == 0 {
+		offer.ValidDays = 90
+	}
+	if req.IsActive != nil {
+		offer.IsActive = *req.IsActive
+	}
+	return true
+}
+
+// Handlers
+func getTherapistPackages(c *gin.Context) {
+	var packages []SessionPackage
+	if err := db.Where("therapist_id = ? AND is_active = ?", c.Param("id"), true).
+		Order("price").Find(&packages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке пакетов",
+		})
+		return
+	}
+	viewer := viewerCurrency(c)
+	for i := range packages {
+		packages[i].DisplayPrice = displayMoney(packages[i].Price, packages[i].Currency, viewer)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    packages,
+	})
+}
+
+func createSessionPackage(c *gin.Context) {
+	therapist, ok := ownTherapist(c)
+	if !ok {
+		return
+	}
+
+	offer := SessionPackage{TherapistID: therapist.ID, Currency: therapist.Currency, IsActive: true}
+	if !bindSessionPackage(c, &offer) {
+		return
+	}
+	if err := db.Create(&offer).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при создании пакета",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    offer,
+	})
+}
+
+// loadOwnPackage loads the package from the path for its therapist or an admin
+func loadOwnPackage(c *gin.Context) (*SessionPackage, bool) {
+	var offer SessionPackage
+	if err := db.First(&offer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Пакет не найден",
+		})
+		return nil, false
+	}
+
+	var therapist Therapist
+	if c.GetString("user_role") != "admin" &&
+		(db.First(&therapist, offer.TherapistID).Error != nil || therapist.UserID != c.GetUint("user_id")) {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Недостаточно прав",
+		})
+		return nil, false
+	}
+	return &offer, true
+}
+
+func updateSessionPackage(c *gin.Context) {
+	offer, ok := loadOwnPackage(c)
+	if !ok || !bindSessionPackage(c, offer) {
+		return
+	}
+
+	// Bought packages keep the terms they were sold with
+	if err := db.Save(offer).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении пакета",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    offer,
+	})
+}
+
+func deleteSessionPackage(c *gin.Context) {
+	offer, ok := loadOwnPackage(c)
+	if !ok {
+		return
+	}
+
+	// Packages are withdrawn from sale, not deleted, as clients may hold them
+	if err := db.Model(offer).Update("is_active", false).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при удалении пакета",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    offer,
+	})
+}
+
+func purchasePackage(c *gin.Context) {
+	var req PackagePurchaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+	if _, ok := paymentProvider(req.Provider); !ok {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неизвестный платёжный провайдер",
+		})
+		return
+	}
+
+	var offer SessionPackage
+	if err := db.Where("is_active = ?", true).First(&offer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Пакет не найден",
+		})
+		return
+	}
+
+	// Packages priced in other currencies are charged in roubles at the
+	// current rate
+	price, err := toSettlement(offer.Price, offer.Currency)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, ApiResponse{
+			Success: false,
+			Error:   "Курс валюты пакета временно недоступен",
+		})
+		return
+	}
+
+	clientID := c.GetUint("user_id")
+	cp := ClientPackage{
+		ClientID:      clientID,
+		TherapistID:   offer.TherapistID,
+		PackageID:     offer.ID,
+		Kind:          offer.Kind,
+		Status:        ClientPackageStatusPending,
+		SessionsTotal: offer.SessionsCount,
+		SessionType:   offer.SessionType,
+		Duration:      offer.Duration,
+		Price:         price,
+	}
+	var payment Payment
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&cp).Error; err != nil {
+			return err
+		}
+		payment = Payment{
+			ClientPackageID: &cp.ID,
+			UserID:          clientID,
+			Amount:          cp.Price,
+			Currency:        settlementCurrency,
+			Status:          PaymentStatusPending,
+			Provider:        req.Provider,
+			Description:     fmt.Sprintf("%s (%d %s)", offer.Name, offer.SessionsCount, pluralRu(offer.SessionsCount, "сессия", "сессии", "сессий")),
+		}
+		if payment.Provider == "" {
+			payment.Provider = defaultPaymentProvider
+		}
+		if err := tx.Create(&payment).Error; err != nil {
+			return err
+		}
+		cp.PaymentID = &payment.ID
+		return tx.Save(&cp).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при покупке пакета",
+		})
+		return
+	}
+
+	returnURL := req.ReturnURL
+	if returnURL == "" {
+		returnURL = fmt.Sprintf("%s/packages/%d", getEnv("FRONTEND_URL", "http://localhost:3000"), cp.ID)
+	}
+	if err := startPayment(c.Request.Context(), &payment, returnURL); err != nil {
+		log.Printf("Failed to start payment %d: %v", payment.ID, err)
+		c.JSON(http.StatusBadGateway, ApiResponse{
+			Success: false,
+			Error:   "Платёжная система недоступна, попробуйте позже",
+		})
+		return
+	}
+
+	db.First(&cp, cp.ID)
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data: PackagePurchaseResponse{
+			ClientPackage: cp,
+			Payment:       payment,
+		},
+	})
+}
+
+func getClientPackages(c *gin.Context) {
+	limit := cursorLimit(c, 20, 100)
+	query := db.Model(&ClientPackage{}).Preload("Package")
+	if c.GetString("user_role") != "admin" {
+		query = query.Where("client_id = ?", c.GetUint("user_id"))
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	query, err := paginateByID(query, c, "client_packages", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var packages []ClientPackage
+	if err := query.Find(&packages).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке пакетов",
+		})
+		return
+	}
+
+	packages, meta := pageByID(packages, limit, func(p ClientPackage) uint { return p.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    packages,
+		Meta:    meta,
+	})
+}
+
+func refundClientPackageHandler(c *gin.Context) {
+	var cp ClientPackage
+	if err := db.First(&cp, c.Param("id")).Error; err != nil ||
+		(c.GetString("user_role") != "admin" && cp.ClientID != c.GetUint("user_id")) {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Пакет не найден",
+		})
+		return
+	}
+
+	updated, refund, err := refundClientPackage(c.Request.Context(), cp.ID)
+	if errors.Is(err, errPackageNotRefundable) || errors.Is(err, errNothingToRefund) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "В пакете нет неиспользованных сессий для возврата",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Refund of client package %d failed: %v", cp.ID, err)
+		c.JSON(http.StatusBadGateway, ApiResponse{
+			Success: false,
+			Data:    refund,
+			Error:   "Не удалось выполнить возврат",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data: ClientPackageRefundResponse{
+			ClientPackage: updated,
+			Refund:        refund,
+		},
+	})
+}
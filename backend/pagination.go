@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CursorMeta is the pagination part of the response meta for cursor-paginated lists
+type CursorMeta struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// sortKey is one column of a keyset ordering. Column may be an SQL
+// expression, its placeholders are filled from Args.
+type sortKey struct {
+	Column    string
+	Args      []interface{}
+	Desc      bool
+	NullsLast bool
+}
+
+// cursorPayload is what an opaque cursor encodes: the sort it was issued
+// for and the sort key values of the last returned row
+type cursorPayload struct {
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// cursorMode reports whether the client asked for cursor pagination
+func cursorMode(c *gin.Context) bool {
+	return c.Query("cursor") != "" || c.Query("pagination") == "cursor"
+}
+
+// cursorLimit reads the page size from limit (or per_page)
+func cursorLimit(c *gin.Context, def, max int) int {
+	value := c.Query("limit")
+	if value == "" {
+		value = c.Query("per_page")
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > max {
+		return def
+	}
+	return limit
+}
+
+func encodeCursor(sort string, values []interface{}) string {
+	raw, _ := json.Marshal(cursorPayload{Sort: sort, Values: values})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor returns the key values of the cursor, which must have been
+// issued for the same sort
+func decodeCursor(cursor, sort string, keys int) ([]interface{}, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var payload cursorPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, errInvalidCursor
+	}
+	if payload.Sort != sort || len(payload.Values) != keys {
+		return nil, errInvalidCursor
+	}
+	return payload.Values, nil
+}
+
+// keysetOrder applies the ORDER BY matching the keyset
+func keysetOrder(query *gorm.DB, keys []sortKey) *gorm.DB {
+	for _, key := range keys {
+		order := key.Column
+		if key.Desc {
+			order += " DESC"
+		} else {
+			order += " ASC"
+		}
+		if key.NullsLast {
+			order += " NULLS LAST"
+		}
+		query = query.Order(gorm.Expr(order, key.Args...))
+	}
+	return query
+}
+
+// keysetAfter restricts the query to rows after the cursor values:
+// (k1 after v1) OR (k1 = v1 AND k2 after v2) OR ...
+func keysetAfter(query *gorm.DB, keys []sortKey, values []interface{}) *gorm.DB {
+	var terms []string
+	var args []interface{}
+
+	for i, key := range keys {
+		var parts []string
+		var partArgs []interface{}
+
+		for j := 0; j < i; j++ {
+			if values[j] == nil {
+				parts = append(parts, keys[j].Column+" IS NULL")
+				partArgs = append(partArgs, keys[j].Args...)
+			} else {
+				parts = append(parts, keys[j].Column+" = ?")
+				partArgs = append(partArgs, keys[j].Args...)
+				partArgs = append(partArgs, values[j])
+			}
+		}
+
+		// Nothing comes after NULL in a NULLS LAST ordering
+		if values[i] == nil {
+			continue
+		}
+		op := " > ?"
+		if key.Desc {
+			op = " < ?"
+		}
+		after := key.Column + op
+		afterArgs := append(append([]interface{}{}, key.Args...), values[i])
+		if key.NullsLast {
+			after = "(" + after + " OR " + key.Column + " IS NULL)"
+			afterArgs = append(afterArgs, key.Args...)
+		}
+		parts = append(parts, after)
+		partArgs = append(partArgs, afterArgs...)
+
+		terms = append(terms, "("+strings.Join(parts, " AND ")+")")
+		args = append(args, partArgs...)
+	}
+
+	if len(terms) == 0 {
+		return query.Where("FALSE")
+	}
+	return query.Where(strings.Join(terms, " OR "), args...)
+}
+
+// paginateByID applies newest-first cursor pagination by primary key, the
+// usual case for feeds like sessions, notifications and messages. It returns
+// the query limited to limit+1 rows; pass the loaded rows to pageByID.
+func paginateByID(query *gorm.DB, c *gin.Context, table string, limit int) (*gorm.DB, error) {
+	keys := []sortKey{{Column: table + ".id", Desc: true}}
+	if cursor := c.Query("cursor"); cursor != "" {
+		values, err := decodeCursor(cursor, "id", len(keys))
+		if err != nil {
+			return nil, err
+		}
+		query = keysetAfter(query, keys, values)
+	}
+	return keysetOrder(query, keys).Limit(limit + 1), nil
+}
+
+// pageByID cuts the rows loaded with paginateByID, the extra probe row
+// included, to the page and builds its meta. id returns the ID of a row.
+func pageByID[T any](rows []T, limit int, id func(T) uint) ([]T, CursorMeta) {
+	if len(rows) <= limit {
+		return rows, CursorMeta{}
+	}
+	return rows[:limit], CursorMeta{
+		NextCursor: encodeCursor("id", []interface{}{id(rows[limit-1])}),
+		HasMore:    true,
+	}
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Partner webhook delivery statuses
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// EventWebhookPing is sent by the test button, it is not a domain event
+const EventWebhookPing = "webhook.ping"
+
+const (
+	maxWebhookAttempts = 8
+
+	// An endpoint is disabled after this many failed attempts in a row,
+	// whatever events they were for
+	webhookDisableAfter = 50
+
+	webhookResponseBodyLimit = 2048
+)
+
+// WebhookEndpoint is a URL of a partner that receives the selected events
+type WebhookEndpoint struct {
+	ID                  uint       `json:"id" gorm:"primaryKey"`
+	PartnerID           uint       `json:"partner_id" gorm:"not null;index"`
+	URL                 string     `json:"url" gorm:"not null"`
+	Description         string     `json:"description,omitempty"`
+	Secret              string     `json:"-" gorm:"not null"`
+	EventTypes          []string   `json:"event_types" gorm:"serializer:json"`
+	IsActive            bool       `json:"is_active"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	DisabledReason      string     `json:"disabled_reason,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// WebhookDelivery is one event sent to one endpoint, with the outcome of
+// its last attempt. A manual redelivery is a new delivery of the same body.
+type WebhookDelivery struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	EndpointID     uint       `json:"endpoint_id" gorm:"not null;index"`
+	EventID        uint       `json:"event_id"` // outbox event, 0 for pings
+	EventType      string     `json:"event_type"`
+	DedupKey       *string    `json:"-" gorm:"uniqueIndex"` // endpoint and event, unset for manual sends
+	Payload        string     `json:"payload" gorm:"type:text"`
+	Status         string     `json:"status" gorm:"default:pending;index"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at" gorm:"index"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	ResponseBody   string     `json:"response_body,omitempty"`
+	DurationMs     int64      `json:"duration_ms,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	RedeliveryOfID *uint      `json:"redelivery_of_id,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+type WebhookEndpointRequest struct {
+	URL         string   `json:"url" binding:"required,url"`
+	Description string   `json:"description"`
+	EventTypes  []string `json:"event_types" binding:"required,min=1"`
+	IsActive    *bool    `json:"is_active"`
+}
+
+// WebhookEndpointSecret is returned once, when the secret is created
+type WebhookEndpointSecret struct {
+	WebhookEndpoint
+	Secret string `json:"secret"`
+}
+
+// webhookClient does not follow redirects and, unless
+// WEBHOOK_ALLOW_PRIVATE=true, refuses to connect to loopback and private
+// addresses, so that a partner URL cannot reach our own network
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: publicOnlyTransport("WEBHOOK_ALLOW_PRIVATE"),
+}
+
+func newWebhookSecret() string {
+	return "whsec_" + randomHex(24)
+}
+
+// validWebhookURL requires https, plain http is allowed for local testing
+// with WEBHOOK_ALLOW_HTTP=true
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Scheme == "https" || (u.Scheme == "http" && getEnv("WEBHOOK_ALLOW_HTTP", "false") == "true")
+}
+
+func validWebhookEventTypes(types []string) bool {
+	for _, t := range types {
+		known := false
+		for _, k := range domainEventTypes {
+			if t == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *WebhookEndpoint) wants(eventType string) bool {
+	for _, t := range e.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookBody is what partners receive
+func webhookBody(eventID uint, eventType string, occurredAt time.Time, data map[string]interface{}) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":         fmt.Sprintf("evt_%d", eventID),
+		"type":       eventType,
+		"created_at": occurredAt,
+		"data":       data,
+	})
+	return string(body), err
+}
+
+// eventUserIDs are the users an event is about: the client and the therapist
+// of a session, the payer of a payment
+func eventUserIDs(tx *gorm.DB, event DomainEvent) []uint {
+	var ids []uint
+	for _, key := range []string{"client_id", "user_id"} {
+		if id, ok := event.Payload[key].(float64); ok && id > 0 {
+			ids = append(ids, uint(id))
+		}
+	}
+	if id, ok := event.Payload["therapist_id"].(float64); ok && id > 0 {
+		if userID := therapistUserID(tx, uint(id)); userID != 0 {
+			ids = append(ids, userID)
+		}
+	}
+	return ids
+}
+
+// queueWebhookDeliveries creates the deliveries of an event to the endpoints
+// of the partners of the users it is about. Redelivered events are not
+// queued twice.
+func queueWebhookDeliveries(ctx context.Context, event DomainEvent) error {
+	tx := db.WithContext(ctx)
+	userIDs := eventUserIDs(tx, event)
+	if len(userIDs) == 0 {
+		return nil
+	}
+	partnerIDs, err := userPartnerIDs(tx, userIDs)
+	if err != nil || len(partnerIDs) == 0 {
+		return err
+	}
+
+	var endpoints []WebhookEndpoint
+	if err := tx.Where("partner_id IN ? AND is_active", partnerIDs).Find(&endpoints).Error; err != nil {
+		return err
+	}
+	body, err := webhookBody(event.ID, event.Type, event.OccurredAt, event.Payload)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		if !endpoint.wants(event.Type) {
+			continue
+		}
+		key := fmt.Sprintf("%d:%d", endpoint.ID, event.ID)
+		delivery := WebhookDelivery{
+			EndpointID:    endpoint.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			DedupKey:      &key,
+			Payload:       body,
+			Status:        WebhookDeliveryPending,
+			NextAttemptAt: time.Now(),
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendWebhook posts the delivery, signed like the provider webhooks we
+// accept: HMAC-SHA256 of "<timestamp>.<body>" with the endpoint secret
+func sendWebhook(ctx context.Context, endpoint *WebhookEndpoint, delivery *WebhookDelivery) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PsyPortal-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Id", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "v1="+hmacSHA256Hex(endpoint.Secret, timestamp+"."+delivery.Payload))
+
+	started := time.Now()
+	resp, err := webhookClient.Do(req)
+	delivery.DurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		delivery.ResponseStatus = 0
+		delivery.ResponseBody = ""
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseBodyLimit))
+	delivery.ResponseStatus = resp.StatusCode
+	delivery.ResponseBody = string(body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordWebhookOutcome keeps the failure streak of the endpoint and disables
+// it when the streak gets too long
+func recordWebhookOutcome(tx *gorm.DB, endpoint *WebhookEndpoint, succeeded bool) error {
+	if succeeded {
+		if endpoint.ConsecutiveFailures == 0 {
+			return nil
+		}
+		return tx.Model(endpoint).UpdateColumn("consecutive_failures", 0).Error
+	}
+
+	if err := tx.Model(endpoint).UpdateColumn("consecutive_failures", gorm.Expr("consecutive_failures + 1")).Error; err != nil {
+		return err
+	}
+	if err := tx.Select("consecutive_failures").First(endpoint, endpoint.ID).Error; err != nil {
+		return err
+	}
+	if endpoint.ConsecutiveFailures < webhookDisableAfter || !endpoint.IsActive {
+		return nil
+	}
+
+	now := time.Now()
+	reason := fmt.Sprintf("%d неудачных попыток подряд", endpoint.ConsecutiveFailures)
+	if err := tx.Model(endpoint).Updates(map[string]interface{}{
+		"is_active":       false,
+		"disabled_at":     now,
+		"disabled_reason": reason,
+	}).Error; err != nil {
+		return err
+	}
+	log.Printf("Webhook endpoint %d disabled: %s", endpoint.ID, reason)
+
+	var partner Partner
+	if tx.First(&partner, endpoint.PartnerID).Error == nil && partner.ContactEmail != "" {
+		_, err := enqueueJob(context.Background(), JobSendEmail, EmailMessage{
+			To:      partner.ContactEmail,
+			Subject: "Вебхук отключён",
+			Text: fmt.Sprintf("Вебхук %s отключён: %s. Проверьте адрес и включите его снова.",
+				endpoint.URL, reason),
+		}, JobOptions{})
+		if err != nil {
+			log.Printf("Webhook endpoint %d: contact not told: %v", endpoint.ID, err)
+		}
+	}
+	return nil
+}
+
+// processWebhookDelivery makes one attempt. Like processReceipt it only
+// returns the error of saving the outcome.
+func processWebhookDelivery(ctx context.Context, tx *gorm.DB, delivery *WebhookDelivery) error {
+	var endpoint WebhookEndpoint
+	if err := tx.First(&endpoint, delivery.EndpointID).Error; err != nil {
+		delivery.Status = WebhookDeliveryFailed
+		delivery.LastError = "endpoint deleted"
+		return tx.Save(delivery).Error
+	}
+	if !endpoint.IsActive {
+		delivery.Status = WebhookDeliveryFailed
+		delivery.LastError = "endpoint disabled"
+		return tx.Save(delivery).Error
+	}
+
+	delivery.Attempts++
+	delivery.LastError = ""
+	err := sendWebhook(ctx, &endpoint, delivery)
+	if err == nil {
+		now := time.Now()
+		delivery.Status = WebhookDeliverySucceeded
+		delivery.DeliveredAt = &now
+	} else {
+		delivery.LastError = err.Error()
+		delay := time.Duration(delivery.Attempts*delivery.Attempts) * time.Minute
+		delivery.NextAttemptAt = time.Now().Add(delay)
+		if delivery.Attempts >= maxWebhookAttempts || errors.Is(err, errDestinationNotAllowed) {
+			delivery.Status = WebhookDeliveryFailed
+		}
+	}
+	if err := tx.Save(delivery).Error; err != nil {
+		return err
+	}
+	return recordWebhookOutcome(tx, &endpoint, err == nil)
+}
+
+// sendPendingWebhooks sends due deliveries. Rows are locked with SKIP
+// LOCKED, so several replicas can run it at once.
+func sendPendingWebhooks(ctx context.Context) {
+	for {
+		var delivery WebhookDelivery
+		found := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? AND next_attempt_at <= ?", WebhookDeliveryPending, time.Now()).
+				Order("id").Limit(1).Find(&delivery)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			found = true
+			if err := processWebhookDelivery(ctx, tx, &delivery); err != nil {
+				return err
+			}
+			if delivery.LastError != "" {
+				log.Printf("Webhook delivery %d to endpoint %d (attempt %d): %s",
+					delivery.ID, delivery.EndpointID, delivery.Attempts, delivery.LastError)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Webhook worker: %v", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+func init() {
+	subscribeEvents("partner_webhooks", domainEventTypes, queueWebhookDeliveries)
+	registerPeriodicJob(JobSendWebhooks, 10*time.Second, sendPendingWebhooks)
+}
+
+// Handlers
+func getWebhookEndpoints(c *gin.Context) {
+	var endpoints []WebhookEndpoint
+	if err := db.Where("partner_id = ?", c.Param("id")).Order("id").Find(&endpoints).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке вебхуков",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    endpoints,
+	})
+}
+
+// bindWebhookEndpoint validates the request into the endpoint
+func bindWebhookEndpoint(c *gin.Context, endpoint *WebhookEndpoint) bool {
+	var req WebhookEndpointRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return false
+	}
+	if !validWebhookURL(req.URL) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Адрес вебхука должен начинаться с https://",
+		})
+		return false
+	}
+	if !validWebhookEventTypes(req.EventTypes) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неизвестный тип события",
+		})
+		return false
+	}
+
+	endpoint.URL = req.URL
+	endpoint.Description = req.Description
+	endpoint.EventTypes = req.EventTypes
+	if req.IsActive != nil {
+		if *req.IsActive && !endpoint.IsActive {
+			// Enabled again, the streak starts over
+			endpoint.ConsecutiveFailures = 0
+			endpoint.DisabledAt = nil
+			endpoint.DisabledReason = ""
+		}
+		endpoint.IsActive = *req.IsActive
+	}
+	return true
+}
+
+func createWebhookEndpoint(c *gin.Context) {
+	var partner Partner
+	if err := db.First(&partner, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Партнёр не найден",
+		})
+		return
+	}
+
+	endpoint := WebhookEndpoint{PartnerID: partner.ID, IsActive: true, Secret: newWebhookSecret()}
+	if !bindWebhookEndpoint(c, &endpoint) {
+		return
+	}
+	if err := db.Create(&endpoint).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении вебхука",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    WebhookEndpointSecret{WebhookEndpoint: endpoint, Secret: endpoint.Secret},
+	})
+}
+
+func updateWebhookEndpoint(c *gin.Context) {
+	var endpoint WebhookEndpoint
+	if err := db.First(&endpoint, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Вебхук не найден",
+		})
+		return
+	}
+	if !bindWebhookEndpoint(c, &endpoint) {
+		return
+	}
+	if err := db.Save(&endpoint).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении вебхука",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    endpoint,
+	})
+}
+
+func deleteWebhookEndpoint(c *gin.Context) {
+	result := db.Delete(&WebhookEndpoint{}, c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при удалении вебхука",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Вебхук не найден",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+	})
+}
+
+// rotateWebhookSecret replaces the secret at once, the partner has to
+// update it on their side
+func rotateWebhookSecret(c *gin.Context) {
+	var endpoint WebhookEndpoint
+	if err := db.First(&endpoint, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Вебхук не найден",
+		})
+		return
+	}
+	endpoint.Secret = newWebhookSecret()
+	if err := db.Save(&endpoint).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении вебхука",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    WebhookEndpointSecret{WebhookEndpoint: endpoint, Secret: endpoint.Secret},
+	})
+}
+
+// testWebhookEndpoint queues a ping to the endpoint
+func testWebhookEndpoint(c *gin.Context) {
+	var endpoint WebhookEndpoint
+	if err := db.First(&endpoint, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Вебхук не найден",
+		})
+		return
+	}
+
+	body, _ := webhookBody(0, EventWebhookPing, time.Now(), map[string]interface{}{"endpoint_id": endpoint.ID})
+	delivery := WebhookDelivery{
+		EndpointID:    endpoint.ID,
+		EventType:     EventWebhookPing,
+		Payload:       body,
+		Status:        WebhookDeliveryPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := db.Create(&delivery).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при отправке тестового события",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, ApiResponse{
+		Success: true,
+		Data:    delivery,
+	})
+}
+
+func getWebhookDeliveries(c *gin.Context) {
+	limit := cursorLimit(c, 50, 200)
+	base := db.Model(&WebhookDelivery{}).Where("endpoint_id = ?", c.Param("id"))
+	if status := c.Query("status"); status != "" {
+		base = base.Where("status = ?", status)
+	}
+	query, err := paginateByID(base, c, "webhook_deliveries", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var deliveries []WebhookDelivery
+	if err := query.Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке доставок",
+		})
+		return
+	}
+
+	deliveries, meta := pageByID(deliveries, limit, func(d WebhookDelivery) uint { return d.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    deliveries,
+		Meta:    meta,
+	})
+}
+
+// redeliverWebhook sends the body of a delivery again as a new delivery
+func redeliverWebhook(c *gin.Context) {
+	var original WebhookDelivery
+	if err := db.First(&original, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Доставка не найдена",
+		})
+		return
+	}
+
+	delivery := WebhookDelivery{
+		EndpointID:     original.EndpointID,
+		EventID:        original.EventID,
+		EventType:      original.EventType,
+		Payload:        original.Payload,
+		Status:         WebhookDeliveryPending,
+		NextAttemptAt:  time.Now(),
+		RedeliveryOfID: &original.ID,
+	}
+	if err := db.Create(&delivery).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при повторной отправке",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, ApiResponse{
+		Success: true,
+		Data:    delivery,
+	})
+}
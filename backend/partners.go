@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Partner is a corporate client or a clinic. Its members are the employees
+// it pays for or the therapists it employs; the partner learns about their
+// sessions through its webhooks.
+type Partner struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	Name         string    `json:"name" gorm:"not null"`
+	ContactEmail string    `json:"contact_email"` // told when a webhook gets disabled
+	IsActive     bool      `json:"is_active"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type PartnerMember struct {
+	PartnerID uint      `json:"partner_id" gorm:"primaryKey;autoIncrement:false"`
+	UserID    uint      `json:"user_id" gorm:"primaryKey;autoIncrement:false;index"`
+	User      User      `json:"user" gorm:"foreignKey:UserID"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PartnerRequest struct {
+	Name         string `json:"name" binding:"required"`
+	ContactEmail string `json:"contact_email" binding:"omitempty,email"`
+	IsActive     *bool  `json:"is_active"`
+}
+
+type PartnerMemberRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+// userPartnerIDs returns the active partners the users belong to
+func userPartnerIDs(tx *gorm.DB, userIDs []uint) ([]uint, error) {
+	var ids []uint
+	err := tx.Model(&PartnerMember{}).
+		Joins("JOIN partners ON partners.id = partner_members.partner_id AND partners.is_active").
+		Where("partner_members.user_id IN ?", userIDs).
+		Distinct().Pluck("partner_members.partner_id", &ids).Error
+	return ids, err
+}
+
+// Handlers
+func getPartners(c *gin.Context) {
+	var partners []Partner
+	if err := db.Order("id").Find(&partners).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке партнёров",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    partners,
+	})
+}
+
+// savePartner creates a partner, or updates the one in the path
+func savePartner(c *gin.Context) {
+	partner := Partner{IsActive: true}
+	if id := c.Param("id"); id != "" {
+		if err := db.First(&partner, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, ApiResponse{
+				Success: false,
+				Error:   "Партнёр не найден",
+			})
+			return
+		}
+	}
+
+	var req PartnerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	partner.Name = req.Name
+	partner.ContactEmail = req.ContactEmail
+	if req.IsActive != nil {
+		partner.IsActive = *req.IsActive
+	}
+	if err := db.Save(&partner).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении партнёра",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    partner,
+	})
+}
+
+func getPartnerMembers(c *gin.Context) {
+	var members []PartnerMember
+	if err := db.Preload("User").Where("partner_id = ?", c.Param("id")).Order("created_at").Find(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке участников",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    members,
+	})
+}
+
+func addPartnerMember(c *gin.Context) {
+	var partner Partner
+	if err := db.First(&partner, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Партнёр не найден",
+		})
+		return
+	}
+
+	var req PartnerMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+	var user User
+	if err := db.First(&user, req.UserID).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Пользователь не найден",
+		})
+		return
+	}
+
+	member := PartnerMember{PartnerID: partner.ID, UserID: user.ID}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при добавлении участника",
+		})
+		return
+	}
+	member.User = user
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    member,
+	})
+}
+
+func removePartnerMember(c *gin.Context) {
+	userID, _ := strconv.ParseUint(c.Param("user_id"), 10, 64)
+	result := db.Where("partner_id = ? AND user_id = ?", c.Param("id"), userID).Delete(&PartnerMember{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при удалении участника",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Участник не найден",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+	})
+}
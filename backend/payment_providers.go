@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PaymentProvider is implemented by every payment gateway adapter.
+// Amounts are in minor units (kopecks, cents).
+type PaymentProvider interface {
+	Name() string
+	CreatePayment(ctx context.Context, req ProviderPaymentRequest) (*ProviderPayment, error)
+	GetPayment(ctx context.Context, providerPaymentID string) (*ProviderPayment, error)
+	Refund(ctx context.Context, providerPaymentID string, amount int, currency, idempotencyKey string) (*ProviderRefund, error)
+	GetRefund(ctx context.Context, providerRefundID string) (*ProviderRefund, error)
+	// CancelPayment voids a payment that has not succeeded, so that it can
+	// no longer be paid
+	CancelPayment(ctx context.Context, providerPaymentID string) error
+}
+
+type ProviderPaymentRequest struct {
+	Amount         int
+	Currency       string
+	Description    string
+	ReturnURL      string
+	IdempotencyKey string
+	Metadata       map[string]string
+}
+
+// ProviderPayment is the provider view of a payment mapped onto our statuses
+type ProviderPayment struct {
+	ProviderPaymentID string
+	Status            string
+	ConfirmationURL   string
+	ClientSecret      string
+	FailureReason     string
+}
+
+type ProviderRefund struct {
+	ProviderRefundID string
+	Status           string // pending, completed, failed
+}
+
+var errProviderUnavailable = errors.New("payment provider unavailable")
+
+var providerHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// formatMinorUnits renders 315000 as "3150.00"
+func formatMinorUnits(amount int) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
+
+// YooKassa adapter (https://yookassa.ru/developers/api)
+type YooKassaProvider struct {
+	ShopID     string
+	SecretKey  string
+	BaseURL    string
+	WebhookIPs []*net.IPNet
+}
+
+type yooKassaAmount struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+type yooKassaPayment struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	Confirmation struct {
+		ConfirmationURL string `json:"confirmation_url"`
+	} `json:"confirmation"`
+	CancellationDetails struct {
+		Reason string `json:"reason"`
+	} `json:"cancellation_details"`
+}
+
+func (p *YooKassaProvider) Name() string { return "yookassa" }
+
+func (p *YooKassaProvider) do(ctx context.Context, method, path, idempotencyKey string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.ShopID, p.SecretKey)
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotence-Key", idempotencyKey)
+	}
+
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("yookassa %s %s: %d %s", method, path, resp.StatusCode, raw)
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func (p *YooKassaProvider) mapPayment(yp yooKassaPayment) *ProviderPayment {
+	status := PaymentStatusPending
+	switch yp.Status {
+	case "waiting_for_capture":
+		status = PaymentStatusProcessing
+	case "succeeded":
+		status = PaymentStatusCompleted
+	case "canceled":
+		status = PaymentStatusFailed
+	}
+	return &ProviderPayment{
+		ProviderPaymentID: yp.ID,
+		Status:            status,
+		ConfirmationURL:   yp.Confirmation.ConfirmationURL,
+		FailureReason:     yp.CancellationDetails.Reason,
+	}
+}
+
+func (p *YooKassaProvider) CreatePayment(ctx context.Context, req ProviderPaymentRequest) (*ProviderPayment, error) {
+	body := map[string]interface{}{
+		"amount":       yooKassaAmount{formatMinorUnits(req.Amount), req.Currency},
+		"capture":      true,
+		"description":  req.Description,
+		"metadata":     req.Metadata,
+		"confirmation": map[string]string{"type": "redirect", "return_url": req.ReturnURL},
+	}
+	var yp yooKassaPayment
+	if err := p.do(ctx, http.MethodPost, "/payments", req.IdempotencyKey, body, &yp); err != nil {
+		return nil, err
+	}
+	return p.mapPayment(yp), nil
+}
+
+func (p *YooKassaProvider) GetPayment(ctx context.Context, providerPaymentID string) (*ProviderPayment, error) {
+	var yp yooKassaPayment
+	if err := p.do(ctx, http.MethodGet, "/payments/"+url.PathEscape(providerPaymentID), "", nil, &yp); err != nil {
+		return nil, err
+	}
+	return p.mapPayment(yp), nil
+}
+
+func (p *YooKassaProvider) Refund(ctx context.Context, providerPaymentID string, amount int, currency, idempotencyKey string) (*ProviderRefund, error) {
+	// YooKassa refunds require the currency, which is that of the payment
+	body := map[string]interface{}{
+		"payment_id": providerPaymentID,
+		"amount":     yooKassaAmount{formatMinorUnits(amount), currency},
+	}
+	var out struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := p.do(ctx, http.MethodPost, "/refunds", idempotencyKey, body, &out); err != nil {
+		return nil, err
+	}
+	return &ProviderRefund{ProviderRefundID: out.ID, Status: yooKassaRefundStatus(out.Status)}, nil
+}
+
+func (p *YooKassaProvider) GetRefund(ctx context.Context, providerRefundID string) (*ProviderRefund, error) {
+	var out struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := p.do(ctx, http.MethodGet, "/refunds/"+url.PathEscape(providerRefundID), "", nil, &out); err != nil {
+		return nil, err
+	}
+	return &ProviderRefund{ProviderRefundID: out.ID, Status: yooKassaRefundStatus(out.Status)}, nil
+}
+
+func yooKassaRefundStatus(status string) string {
+	switch status {
+	case "succeeded":
+		return RefundStatusCompleted
+	case "canceled":
+		return RefundStatusFailed
+	}
+	return RefundStatusPending
+}
+
+// CancelPayment works only for payments waiting for capture; ours are
+// captured at once, so a payment the client has not paid yet cannot be
+// voided and simply expires at YooKassa
+func (p *YooKassaProvider) CancelPayment(ctx context.Context, providerPaymentID string) error {
+	var yp yooKassaPayment
+	path := "/payments/" + url.PathEscape(providerPaymentID) + "/cancel"
+	return p.do(ctx, http.MethodPost, path, "cancel-"+providerPaymentID, map[string]interface{}{}, &yp)
+}
+
+// Stripe adapter (https://stripe.com/docs/api/payment_intents)
+type StripeProvider struct {
+	SecretKey     string
+	BaseURL       string
+	WebhookSecret string
+}
+
+type stripePaymentIntent struct {
+	ID               string `json:"id"`
+	Status           string `json:"status"`
+	ClientSecret     string `json:"client_secret"`
+	LastPaymentError *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+}
+
+func (p *StripeProvider) Name() string { return "stripe" }
+
+func (p *StripeProvider) do(ctx context.Context, method, path, idempotencyKey string, form url.Values, out interface{}) error {
+	var reader io.Reader
+	if form != nil {
+		reader = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.SecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("stripe %s %s: %d %s", method, path, resp.StatusCode, raw)
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func (p *StripeProvider) mapPayment(pi stripePaymentIntent) *ProviderPayment {
+	status := PaymentStatusPending
+	switch pi.Status {
+	case "processing", "requires_capture":
+		status = PaymentStatusProcessing
+	case "succeeded":
+		status = PaymentStatusCompleted
+	case "canceled":
+		status = PaymentStatusFailed
+	}
+	result := &ProviderPayment{
+		ProviderPaymentID: pi.ID,
+		Status:            status,
+		ClientSecret:      pi.ClientSecret,
+	}
+	if pi.LastPaymentError != nil {
+		result.FailureReason = pi.LastPaymentError.Message
+	}
+	return result
+}
+
+func (p *StripeProvider) CreatePayment(ctx context.Context, req ProviderPaymentRequest) (*ProviderPayment, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.Itoa(req.Amount))
+	form.Set("currency", strings.ToLower(req.Currency))
+	form.Set("description", req.Description)
+	form.Set("automatic_payment_methods[enabled]", "true")
+	for k, v := range req.Metadata {
+		form.Set("metadata["+k+"]", v)
+	}
+
+	var pi stripePaymentIntent
+	if err := p.do(ctx, http.MethodPost, "/v1/payment_intents", req.IdempotencyKey, form, &pi); err != nil {
+		return nil, err
+	}
+	return p.mapPayment(pi), nil
+}
+
+func (p *StripeProvider) GetPayment(ctx context.Context, providerPaymentID string) (*ProviderPayment, error) {
+	var pi stripePaymentIntent
+	if err := p.do(ctx, http.MethodGet, "/v1/payment_intents/"+url.PathEscape(providerPaymentID), "", nil, &pi); err != nil {
+		return nil, err
+	}
+	return p.mapPayment(pi), nil
+}
+
+func (p *StripeProvider) Refund(ctx context.Context, providerPaymentID string, amount int, currency, idempotencyKey string) (*ProviderRefund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", providerPaymentID)
+	form.Set("amount", strconv.Itoa(amount))
+
+	var out struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := p.do(ctx, http.MethodPost, "/v1/refunds", idempotencyKey, form, &out); err != nil {
+		return nil, err
+	}
+	return &ProviderRefund{ProviderRefundID: out.ID, Status: stripeRefundStatus(out.Status)}, nil
+}
+
+func (p *StripeProvider) GetRefund(ctx context.Context, providerRefundID string) (*ProviderRefund, error) {
+	var out struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := p.do(ctx, http.MethodGet, "/v1/refunds/"+url.PathEscape(providerRefundID), "", nil, &out); err != nil {
+		return nil, err
+	}
+	return &ProviderRefund{ProviderRefundID: out.ID, Status: stripeRefundStatus(out.Status)}, nil
+}
+
+func stripeRefundStatus(status string) string {
+	switch status {
+	case "succeeded":
+		return RefundStatusCompleted
+	case "failed", "canceled":
+		return RefundStatusFailed
+	}
+	return RefundStatusPending
+}
+
+func (p *StripeProvider) CancelPayment(ctx context.Context, providerPaymentID string) error {
+	var pi stripePaymentIntent
+	path := "/v1/payment_intents/" + url.PathEscape(providerPaymentID) + "/cancel"
+	return p.do(ctx, http.MethodPost, path, "cancel-"+providerPaymentID, url.Values{}, &pi)
+}
+
+// FakeProvider is an in-process provider for local development and tests.
+// Payments settle with Outcome the first time their status is requested.
+type FakeProvider struct {
+	mu       sync.Mutex
+	payments map[string]*fakePayment
+	seq      int
+	Outcome  string // completed (default), failed or pending
+
+	WebhookSecret string
+}
+
+type fakePayment struct {
+	ProviderPayment
+	amount   int
+	refunded int
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{payments: map[string]*fakePayment{}, Outcome: PaymentStatusCompleted}
+}
+
+func (p *FakeProvider) Name() string { return "fake" }
+
+func (p *FakeProvider) CreatePayment(ctx context.Context, req ProviderPaymentRequest) (*ProviderPayment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.seq++
+	id := fmt.Sprintf("fake_%d_%d", time.Now().Unix(), p.seq)
+	payment := &fakePayment{
+		ProviderPayment: ProviderPayment{
+			ProviderPaymentID: id,
+			Status:            PaymentStatusPending,
+			ConfirmationURL:   req.ReturnURL,
+		},
+		amount: req.Amount,
+	}
+	p.payments[id] = payment
+	result := payment.ProviderPayment
+	return &result, nil
+}
+
+func (p *FakeProvider) GetPayment(ctx context.Context, providerPaymentID string) (*ProviderPayment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, ok := p.payments[providerPaymentID]
+	if !ok {
+		return nil, fmt.Errorf("fake payment %s not found", providerPaymentID)
+	}
+	if payment.Status == PaymentStatusPending && p.Outcome != PaymentStatusPending {
+		payment.Status = p.Outcome
+		if p.Outcome == PaymentStatusFailed {
+			payment.FailureReason = "fake_declined"
+		}
+	}
+	result := payment.ProviderPayment
+	return &result, nil
+}
+
+// SetStatus moves a fake payment to the given status, as a provider callback would
+func (p *FakeProvider) SetStatus(providerPaymentID, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if payment, ok := p.payments[providerPaymentID]; ok {
+		payment.Status = status
+	}
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, providerPaymentID string, amount int, currency, idempotencyKey string) (*ProviderRefund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, ok := p.payments[providerPaymentID]
+	if !ok {
+		return nil, fmt.Errorf("fake payment %s not found", providerPaymentID)
+	}
+	if payment.refunded+amount > payment.amount {
+		return nil, errors.New("refund exceeds payment amount")
+	}
+	payment.refunded += amount
+	p.seq++
+	return &ProviderRefund{ProviderRefundID: fmt.Sprintf("fake_refund_%d", p.seq), Status: "completed"}, nil
+}
+
+// GetRefund reports every refund as completed, as fake refunds complete at once
+func (p *FakeProvider) GetRefund(ctx context.Context, providerRefundID string) (*ProviderRefund, error) {
+	return &ProviderRefund{ProviderRefundID: providerRefundID, Status: RefundStatusCompleted}, nil
+}
+
+func (p *FakeProvider) CancelPayment(ctx context.Context, providerPaymentID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	payment, ok := p.payments[providerPaymentID]
+	if !ok {
+		return fmt.Errorf("fake payment %s not found", providerPaymentID)
+	}
+	if payment.Status == PaymentStatusCompleted {
+		return errors.New("fake payment already succeeded")
+	}
+	payment.Status = PaymentStatusFailed
+	payment.FailureReason = "canceled"
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFakeProviderOutcome(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		outcome string
+		reason  string
+	}{
+		{PaymentStatusCompleted, ""},
+		{PaymentStatusFailed, "fake_declined"},
+		{PaymentStatusPending, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outcome, func(t *testing.T) {
+			provider := NewFakeProvider()
+			provider.Outcome = tt.outcome
+
+			created, err := provider.CreatePayment(ctx, ProviderPaymentRequest{Amount: 350000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.Status != PaymentStatusPending {
+				t.Errorf("new payment status = %s, want %s", created.Status, PaymentStatusPending)
+			}
+
+			payment, err := provider.GetPayment(ctx, created.ProviderPaymentID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payment.Status != tt.outcome || payment.FailureReason != tt.reason {
+				t.Errorf("payment = %s (%q), want %s (%q)", payment.Status, payment.FailureReason, tt.outcome, tt.reason)
+			}
+		})
+	}
+}
+
+func TestFakeProviderRefund(t *testing.T) {
+	ctx := context.Background()
+	provider := NewFakeProvider()
+	payment, err := provider.CreatePayment(ctx, ProviderPaymentRequest{Amount: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		amount int
+		ok     bool
+	}{
+		{600, true},
+		{500, false}, // over what is left
+		{400, true},
+		{1, false},
+	}
+	for _, tt := range tests {
+		_, err := provider.Refund(ctx, payment.ProviderPaymentID, tt.amount, CurrencyRUB, "")
+		if (err == nil) != tt.ok {
+			t.Errorf("refund of %d: err = %v, want ok = %v", tt.amount, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Payment statuses, as in the frontend PaymentStatus type
+const (
+	PaymentStatusPending           = "pending"
+	PaymentStatusProcessing        = "processing"
+	PaymentStatusCompleted         = "completed"
+	PaymentStatusFailed            = "failed"
+	PaymentStatusCancelled         = "cancelled"
+	PaymentStatusRefunded          = "refunded"
+	PaymentStatusPartiallyRefunded = "partially_refunded"
+)
+
+type Payment struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	SessionID         *uint      `json:"session_id,omitempty" gorm:"index"`
+	ClientPackageID   *uint      `json:"client_package_id,omitempty" gorm:"index"`
+	GiftCertificateID *uint      `json:"gift_certificate_id,omitempty" gorm:"index"`
+	UserID            uint       `json:"user_id" gorm:"not null;index"`
+	Amount            int        `json:"amount"` // in kopecks
+	Currency          string     `json:"currency" gorm:"default:RUB"`
+	Status            string     `json:"status" gorm:"default:pending;index"`
+	Provider          string     `json:"provider"`
+	ProviderPaymentID string     `json:"provider_payment_id,omitempty" gorm:"index"`
+	ConfirmationURL   string     `json:"confirmation_url,omitempty"`
+	ClientSecret      string     `json:"client_secret,omitempty" gorm:"-"` // Stripe, only returned on creation
+	Description       string     `json:"description,omitempty"`
+	ProcessedAt       *time.Time `json:"processed_at,omitempty"`
+	FailedAt          *time.Time `json:"failed_at,omitempty"`
+	FailureReason     string     `json:"failure_reason,omitempty"`
+	RefundedAt        *time.Time `json:"refunded_at,omitempty"`
+	RefundAmount      int        `json:"refund_amount,omitempty"`
+	CancelledAt       *time.Time `json:"cancelled_at,omitempty"` // by us; a success reported later is refunded
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// Allowed payment status transitions
+var paymentTransitions = map[string][]string{
+	PaymentStatusPending:           {PaymentStatusProcessing, PaymentStatusCompleted, PaymentStatusFailed, PaymentStatusCancelled},
+	PaymentStatusProcessing:        {PaymentStatusCompleted, PaymentStatusFailed, PaymentStatusCancelled},
+	PaymentStatusCompleted:         {PaymentStatusRefunded, PaymentStatusPartiallyRefunded},
+	PaymentStatusPartiallyRefunded: {PaymentStatusRefunded, PaymentStatusPartiallyRefunded},
+	// The provider has the last word on money: a payment we cancelled may
+	// still have been paid, it is then recorded and refunded
+	PaymentStatusCancelled: {PaymentStatusCompleted},
+}
+
+var errInvalidPaymentTransition = errors.New("invalid payment status transition")
+
+// Registered payment providers
+var paymentProviders = map[string]PaymentProvider{}
+var defaultPaymentProvider string
+
+func initPayments() {
+	if shopID := getEnv("YOOKASSA_SHOP_ID", ""); shopID != "" {
+		registerPaymentProvider(&YooKassaProvider{
+			ShopID:     shopID,
+			SecretKey:  getEnv("YOOKASSA_SECRET_KEY", ""),
+			BaseURL:    getEnv("YOOKASSA_API_URL", "https://api.yookassa.ru/v3"),
+			WebhookIPs: parseCIDRList(getEnv("YOOKASSA_WEBHOOK_IPS", defaultYooKassaWebhookIPs)),
+		})
+	}
+	if key := getEnv("STRIPE_SECRET_KEY", ""); key != "" {
+		registerPaymentProvider(&StripeProvider{
+			SecretKey:     key,
+			BaseURL:       getEnv("STRIPE_API_URL", "https://api.stripe.com"),
+			WebhookSecret: getEnv("STRIPE_WEBHOOK_SECRET", ""),
+		})
+	}
+
+	// There is no default: a missing setting must not silently confirm
+	// bookings without charging anyone
+	defaultPaymentProvider = getEnv("PAYMENT_PROVIDER", "")
+	if defaultPaymentProvider == "" {
+		log.Fatal("PAYMENT_PROVIDER is not set: use yookassa or stripe, or fake with APP_ENV=development")
+	}
+	if defaultPaymentProvider == "fake" {
+		if !isDevelopment() {
+			log.Fatal("The fake payment provider is only allowed with APP_ENV=development")
+		}
+		fake := NewFakeProvider()
+		fake.Outcome = getEnv("FAKE_PAYMENT_OUTCOME", PaymentStatusCompleted)
+		fake.WebhookSecret = getEnv("FAKE_WEBHOOK_SECRET", "")
+		registerPaymentProvider(fake)
+		log.Println("Using fake payment provider, payments are not charged")
+	}
+
+	if _, ok := paymentProviders[defaultPaymentProvider]; !ok {
+		log.Fatalf("Payment provider %q is not configured", defaultPaymentProvider)
+	}
+}
+
+func registerPaymentProvider(p PaymentProvider) {
+	paymentProviders[p.Name()] = p
+}
+
+func paymentProvider(name string) (PaymentProvider, bool) {
+	if name == "" {
+		name = defaultPaymentProvider
+	}
+	p, ok := paymentProviders[name]
+	return p, ok
+}
+
+// isFinalPaymentStatus reports whether the provider has settled the payment
+func isFinalPaymentStatus(status string) bool {
+	return status != PaymentStatusPending && status != PaymentStatusProcessing
+}
+
+// applyPaymentStatus moves a locked payment to a new status and updates its
+// session: a completed payment confirms the session, a failed one releases it.
+// Repeating the current status is a no-op.
+func applyPaymentStatus(tx *gorm.DB, payment *Payment, status, reason string) error {
+	if payment.Status == status && status != PaymentStatusPartiallyRefunded {
+		return nil
+	}
+
+	allowed := false
+	for _, next := range paymentTransitions[payment.Status] {
+		if next == status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s -> %s", errInvalidPaymentTransition, payment.Status, status)
+	}
+
+	lateSuccess := payment.Status == PaymentStatusCancelled
+	now := time.Now()
+	payment.Status = status
+	switch status {
+	case PaymentStatusCompleted:
+		payment.ProcessedAt = &now
+	case PaymentStatusFailed, PaymentStatusCancelled:
+		payment.FailedAt = &now
+		payment.FailureReason = reason
+		if status == PaymentStatusCancelled {
+			payment.CancelledAt = &now
+		}
+	case PaymentStatusRefunded, PaymentStatusPartiallyRefunded:
+		payment.RefundedAt = &now
+	}
+	if err := tx.Save(payment).Error; err != nil {
+		return err
+	}
+
+	if !lateSuccess {
+		notifyPayment(tx, payment)
+	}
+	if status == PaymentStatusCompleted {
+		if err := recordPaymentEvent(tx, EventPaymentSucceeded, payment); err != nil {
+			return err
+		}
+		if err := postPaymentCharge(tx, payment); err != nil {
+			return err
+		}
+		if err := queueReceipt(tx, payment, nil); err != nil {
+			return err
+		}
+	}
+	// What the payment was for is gone; refundLatePayment returns the money
+	// once this commits
+	if lateSuccess {
+		return nil
+	}
+
+	if payment.ClientPackageID != nil {
+		switch status {
+		case PaymentStatusCompleted:
+			return activatePackage(tx, *payment.ClientPackageID)
+		case PaymentStatusFailed, PaymentStatusCancelled:
+			return tx.Model(&ClientPackage{}).
+				Where("id = ? AND status = ?", *payment.ClientPackageID, ClientPackageStatusPending).
+				Update("status", ClientPackageStatusCancelled).Error
+		}
+	}
+
+	if payment.GiftCertificateID != nil {
+		switch status {
+		case PaymentStatusCompleted:
+			return activateGiftCertificate(tx, *payment.GiftCertificateID)
+		case PaymentStatusFailed, PaymentStatusCancelled:
+			return tx.Model(&GiftCertificate{}).
+				Where("id = ? AND status = ?", *payment.GiftCertificateID, GiftCertificateStatusPending).
+				Update("status", GiftCertificateStatusCancelled).Error
+		}
+	}
+
+	if payment.SessionID == nil {
+		return nil
+	}
+	switch status {
+	case PaymentStatusCompleted:
+		var session Session
+		err := tx.Where("id = ? AND status = ?", *payment.SessionID, SessionStatusScheduled).First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		session.Status = SessionStatusConfirmed
+		if err := tx.Save(&session).Error; err != nil {
+			return err
+		}
+		if err := recordSessionEvent(tx, EventSessionConfirmed, &session); err != nil {
+			return err
+		}
+		if err := scheduleSessionReminders(tx, &session); err != nil {
+			return err
+		}
+		notifySession(tx, &session, NotificationSessionConfirmed, "client")
+		notifySession(tx, &session, NotificationSessionBooked, "therapist")
+		return nil
+	case PaymentStatusFailed, PaymentStatusCancelled:
+		var session Session
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND status = ?", *payment.SessionID, SessionStatusScheduled).First(&session).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		session.Status = SessionStatusCancelled
+		if err := tx.Save(&session).Error; err != nil {
+			return err
+		}
+		if err := recordSessionEvent(tx, EventSessionCancelled, &session); err != nil {
+			return err
+		}
+		// An unpaid booking gives back what the promo code and balance covered
+		return releaseSessionDiscounts(tx, &session, 100)
+	}
+	return nil
+}
+
+// pendingPaymentTTL is how long a payment may wait for the client before it
+// is cancelled and the session slot it holds is released
+func pendingPaymentTTL() time.Duration {
+	ttl, err := time.ParseDuration(getEnv("PAYMENT_PENDING_TTL", "30m"))
+	if err != nil || ttl <= 0 {
+		return 30 * time.Minute
+	}
+	return ttl
+}
+
+// expireAbandonedPayments cancels payments the client has left unpaid. Each
+// is checked with its provider first, in case the callback got lost.
+// Processing payments are left alone, the provider is already on them.
+func expireAbandonedPayments(ctx context.Context) {
+	var stale []Payment
+	if err := db.Where("status = ? AND created_at <= ?", PaymentStatusPending, time.Now().Add(-pendingPaymentTTL())).
+		Order("id").Limit(100).Find(&stale).Error; err != nil {
+		log.Printf("Payment expiry: %v", err)
+		return
+	}
+
+	for i := range stale {
+		payment := &stale[i]
+		if err := syncPayment(ctx, payment); err != nil {
+			log.Printf("Payment expiry: payment %d not synced: %v", payment.ID, err)
+			continue
+		}
+		if payment.Status != PaymentStatusPending {
+			continue
+		}
+		updated, err := updatePaymentStatus(payment.ID, PaymentStatusCancelled, "expired")
+		if errors.Is(err, errInvalidPaymentTransition) {
+			continue // settled in the meantime
+		}
+		if err != nil {
+			log.Printf("Payment expiry: payment %d not cancelled: %v", payment.ID, err)
+			continue
+		}
+		cancelProviderPayments(ctx, []Payment{*updated})
+	}
+}
+
+func init() {
+	registerPeriodicJob(JobExpirePayments, 5*time.Minute, expireAbandonedPayments)
+}
+
+// cancelProviderPayments voids payments we have cancelled at their providers.
+// Not every pending payment can be voided; if one is paid anyway, the success
+// is refunded by refundLatePayment.
+func cancelProviderPayments(ctx context.Context, payments []Payment) {
+	for _, payment := range payments {
+		if payment.ProviderPaymentID == "" {
+			continue
+		}
+		provider, ok := paymentProvider(payment.Provider)
+		if !ok {
+			continue
+		}
+		if err := provider.CancelPayment(ctx, payment.ProviderPaymentID); err != nil {
+			log.Printf("Payment %d not cancelled at %s: %v", payment.ID, payment.Provider, err)
+		}
+	}
+}
+
+// updatePaymentStatus locks the payment row and applies the status in a transaction
+func updatePaymentStatus(paymentID uint, status, reason string) (*Payment, error) {
+	var payment Payment
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, paymentID).Error; err != nil {
+			return err
+		}
+		return applyPaymentStatus(tx, &payment, status, reason)
+	})
+	return &payment, err
+}
+
+// startPayment registers a created payment with its provider
+func startPayment(ctx context.Context, payment *Payment, returnURL string) error {
+	provider, ok := paymentProvider(payment.Provider)
+	if !ok {
+		return fmt.Errorf("payment provider %q is not configured", payment.Provider)
+	}
+
+	metadata := map[string]string{"payment_id": fmt.Sprint(payment.ID)}
+	if payment.SessionID != nil {
+		metadata["session_id"] = fmt.Sprint(*payment.SessionID)
+	}
+
+	result, err := provider.CreatePayment(ctx, ProviderPaymentRequest{
+		Amount:         payment.Amount,
+		Currency:       payment.Currency,
+		Description:    payment.Description,
+		ReturnURL:      returnURL,
+		IdempotencyKey: fmt.Sprintf("payment-%d", payment.ID),
+		Metadata:       metadata,
+	})
+	if err != nil {
+		if _, updateErr := updatePaymentStatus(payment.ID, PaymentStatusFailed, "provider_error"); updateErr != nil {
+			log.Printf("Failed to mark payment %d as failed: %v", payment.ID, updateErr)
+		}
+		return err
+	}
+
+	payment.ProviderPaymentID = result.ProviderPaymentID
+	payment.ConfirmationURL = result.ConfirmationURL
+	payment.ClientSecret = result.ClientSecret
+	if err := db.Model(payment).Updates(map[string]interface{}{
+		"provider_payment_id": result.ProviderPaymentID,
+		"confirmation_url":    result.ConfirmationURL,
+	}).Error; err != nil {
+		return err
+	}
+
+	if result.Status != payment.Status {
+		updated, err := updatePaymentStatus(payment.ID, result.Status, result.FailureReason)
+		if err != nil {
+			return err
+		}
+		payment.Status = updated.Status
+	}
+	return nil
+}
+
+// syncPayment pulls the payment status from the provider
+func syncPayment(ctx context.Context, payment *Payment) error {
+	if payment.ProviderPaymentID == "" || isFinalPaymentStatus(payment.Status) {
+		return nil
+	}
+	provider, ok := paymentProvider(payment.Provider)
+	if !ok {
+		return fmt.Errorf("payment provider %q is not configured", payment.Provider)
+	}
+
+	result, err := provider.GetPayment(ctx, payment.ProviderPaymentID)
+	if err != nil {
+		return err
+	}
+	updated, err := updatePaymentStatus(payment.ID, result.Status, result.FailureReason)
+	if err != nil {
+		return err
+	}
+	*payment = *updated
+	return nil
+}
+
+// Handlers
+func getPayments(c *gin.Context) {
+	limit := cursorLimit(c, 20, 100)
+	query := db.Model(&Payment{})
+	if c.GetString("user_role") != "admin" {
+		query = query.Where("user_id = ?", c.GetUint("user_id"))
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	query, err := paginateByID(query, c, "payments", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var payments []Payment
+	if err := query.Find(&payments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке платежей",
+		})
+		return
+	}
+
+	payments, meta := pageByID(payments, limit, func(p Payment) uint { return p.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    payments,
+		Meta:    meta,
+	})
+}
+
+func getPayment(c *gin.Context) {
+	var payment Payment
+	if err := db.First(&payment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Платёж не найден",
+		})
+		return
+	}
+
+	if c.GetString("user_role") != "admin" && payment.UserID != c.GetUint("user_id") {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Платёж не найден",
+		})
+		return
+	}
+
+	if err := syncPayment(c.Request.Context(), &payment); err != nil {
+		log.Printf("Failed to sync payment %d: %v", payment.ID, err)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    payment,
+	})
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Payout batch statuses
+const (
+	PayoutBatchStatusCreated  = "created"
+	PayoutBatchStatusExported = "exported"
+	PayoutBatchStatusPaid     = "paid" // the bank confirmed the transfers
+)
+
+// Payout statuses. The payout is posted to the ledger once paid; a failed
+// one stays owed and goes into the next batch.
+const (
+	PayoutStatusPending = "pending"
+	PayoutStatusPaid    = "paid"
+	PayoutStatusFailed  = "failed"
+)
+
+// PayoutBatch pays therapists what they earned up to the end of the period
+type PayoutBatch struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Status      string    `json:"status" gorm:"default:created"`
+	Total       int       `json:"total"` // in kopecks
+	Payouts     []Payout  `json:"payouts,omitempty" gorm:"foreignKey:BatchID"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Payout copies the bank details at the time of the batch
+type Payout struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	BatchID       uint       `json:"batch_id" gorm:"not null;index"`
+	TherapistID   uint       `json:"therapist_id" gorm:"not null;index"`
+	Amount        int        `json:"amount"` // in kopecks
+	RecipientName string     `json:"recipient_name"`
+	INN           string     `json:"inn"`
+	BankAccount   string     `json:"bank_account"`
+	BIK           string     `json:"bik"`
+	Status        string     `json:"status" gorm:"default:pending;index"`
+	PaidAt        *time.Time `json:"paid_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type PayoutBatchRequest struct {
+	PeriodStart string `json:"period_start" binding:"required"` // YYYY-MM-DD
+	PeriodEnd   string `json:"period_end" binding:"required"`   // YYYY-MM-DD, inclusive
+}
+
+type PayoutBatchResponse struct {
+	Batch *PayoutBatch `json:"batch,omitempty"`
+	// Therapists with a balance but no bank details
+	Skipped []uint `json:"skipped,omitempty"`
+}
+
+// ConfirmPayoutBatchRequest lists the transfers the bank rejected; the rest
+// of the batch was paid
+type ConfirmPayoutBatchRequest struct {
+	FailedPayoutIDs []uint `json:"failed_payout_ids"`
+}
+
+var (
+	errNothingToPay        = errors.New("nothing to pay out")
+	errPayoutBatchNotFound = errors.New("payout batch not found")
+	errPayoutBatchPaid     = errors.New("payout batch already confirmed")
+)
+
+// pendingPayouts is what is already in batches not confirmed yet
+func pendingPayouts(tx *gorm.DB, therapistID uint) (int, error) {
+	var pending int
+	err := tx.Model(&Payout{}).
+		Where("therapist_id = ? AND status = ?", therapistID, PayoutStatusPending).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&pending).Error
+	return pending, err
+}
+
+// payoutCandidate is a therapist a batch may pay
+type payoutCandidate struct {
+	TherapistID uint
+	Balance     int            // owed as of the end of the period
+	Pending     int            // already in batches not confirmed yet
+	Account     *PayoutAccount // nil without bank details
+}
+
+// buildPayoutBatch pays each candidate the balance less the pending payouts.
+// Candidates with something to pay but no bank details are returned apart.
+func buildPayoutBatch(start, end time.Time, candidates []payoutCandidate) (*PayoutBatch, []uint) {
+	batch := &PayoutBatch{PeriodStart: start, PeriodEnd: end, Status: PayoutBatchStatusCreated}
+	var skipped []uint
+	for _, candidate := range candidates {
+		amount := candidate.Balance - candidate.Pending
+		if amount <= 0 {
+			continue
+		}
+		account := candidate.Account
+		if account == nil || account.BankAccount == "" {
+			skipped = append(skipped, candidate.TherapistID)
+			continue
+		}
+		batch.Payouts = append(batch.Payouts, Payout{
+			TherapistID:   candidate.TherapistID,
+			Amount:        amount,
+			RecipientName: account.RecipientName,
+			INN:           account.INN,
+			BankAccount:   account.BankAccount,
+			BIK:           account.BIK,
+			Status:        PayoutStatusPending,
+		})
+		batch.Total += amount
+	}
+	return batch, skipped
+}
+
+// createPayoutBatch pays every therapist with a positive balance as of the
+// end of the period. Earnings before the period that were not paid yet are
+// included, so a missed batch is caught up by the next one. Nothing is posted
+// to the ledger until the transfers are confirmed; what earlier batches are
+// still paying is left out.
+func createPayoutBatch(start, end time.Time) (*PayoutBatchResponse, error) {
+	response := &PayoutBatchResponse{}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// One batch at a time, so that balances are not paid twice
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('payout_batches'))").Error; err != nil {
+			return err
+		}
+
+		var therapistIDs []uint
+		if err := tx.Model(&LedgerEntry{}).
+			Where("account = ? AND therapist_id IS NOT NULL", LedgerAccountTherapistPayable).
+			Distinct().Pluck("therapist_id", &therapistIDs).Error; err != nil {
+			return err
+		}
+
+		candidates := make([]payoutCandidate, 0, len(therapistIDs))
+		for _, therapistID := range therapistIDs {
+			candidate := payoutCandidate{TherapistID: therapistID}
+			var err error
+			if candidate.Balance, err = therapistBalance(tx, therapistID, end); err != nil {
+				return err
+			}
+			if candidate.Pending, err = pendingPayouts(tx, therapistID); err != nil {
+				return err
+			}
+			if candidate.Balance <= candidate.Pending {
+				continue
+			}
+			var account PayoutAccount
+			if err := tx.Where("therapist_id = ?", therapistID).First(&account).Error; err == nil {
+				candidate.Account = &account
+			}
+			candidates = append(candidates, candidate)
+		}
+
+		batch, skipped := buildPayoutBatch(start, end, candidates)
+		response.Skipped = skipped
+		if len(batch.Payouts) == 0 {
+			return errNothingToPay
+		}
+
+		if err := tx.Create(batch).Error; err != nil {
+			return err
+		}
+
+		response.Batch = batch
+		return nil
+	})
+	return response, err
+}
+
+// confirmPayoutBatch records the result of the bank transfers: the paid
+// payouts are posted to the ledger, the failed ones are owed again
+func confirmPayoutBatch(batchID uint, failed []uint) (*PayoutBatch, error) {
+	var batch PayoutBatch
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('payout_batches'))").Error; err != nil {
+			return err
+		}
+		if err := tx.Preload("Payouts", func(tx *gorm.DB) *gorm.DB {
+			return tx.Order("id")
+		}).First(&batch, batchID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errPayoutBatchNotFound
+			}
+			return err
+		}
+		if batch.Status == PayoutBatchStatusPaid {
+			return errPayoutBatchPaid
+		}
+
+		isFailed := make(map[uint]bool, len(failed))
+		for _, id := range failed {
+			isFailed[id] = true
+		}
+		now := time.Now()
+		batch.Total = 0
+		for i := range batch.Payouts {
+			payout := &batch.Payouts[i]
+			if payout.Status != PayoutStatusPending {
+				continue
+			}
+			if isFailed[payout.ID] {
+				payout.Status = PayoutStatusFailed
+				if err := tx.Model(payout).Update("status", payout.Status).Error; err != nil {
+					return err
+				}
+				continue
+			}
+
+			therapistID, payoutID := payout.TherapistID, payout.ID
+			err := postLedgerTransaction(tx, &LedgerTransaction{
+				Reference:   fmt.Sprintf("payout:%d", payout.ID),
+				Type:        LedgerTypePayout,
+				TherapistID: &therapistID,
+				PayoutID:    &payoutID,
+				Description: fmt.Sprintf("Payout batch %d", batch.ID),
+			}, payoutEntries(therapistID, payout.Amount))
+			if err != nil {
+				return err
+			}
+			payout.Status, payout.PaidAt = PayoutStatusPaid, &now
+			if err := tx.Model(payout).Updates(map[string]interface{}{"status": payout.Status, "paid_at": now}).Error; err != nil {
+				return err
+			}
+			batch.Total += payout.Amount
+		}
+
+		batch.Status = PayoutBatchStatusPaid
+		return tx.Model(&batch).Updates(map[string]interface{}{"status": batch.Status, "total": batch.Total}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// payoutRegistry renders the batch as a semicolon separated bank transfer
+// registry, amounts in roubles
+func payoutRegistry(batch *PayoutBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	// Excel and most bank clients need the BOM to detect UTF-8
+	buf.WriteString("\ufeff")
+	w := csv.NewWriter(&buf)
+	w.Comma = ';'
+
+	w.Write([]string{"№", "Получатель", "ИНН", "Счёт", "БИК", "Сумма", "Назначение платежа"})
+	purpose := fmt.Sprintf("Выплата вознаграждения за период с %s по %s, НДС не облагается",
+		batch.PeriodStart.Format("02.01.2006"), batch.PeriodEnd.AddDate(0, 0, -1).Format("02.01.2006"))
+	for i, payout := range batch.Payouts {
+		w.Write([]string{
+			fmt.Sprint(i + 1),
+			payout.RecipientName,
+			payout.INN,
+			payout.BankAccount,
+			payout.BIK,
+			formatMinorUnits(payout.Amount),
+			purpose,
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Handlers
+func createPayoutBatchHandler(c *gin.Context) {
+	var req PayoutBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	start, errStart := time.ParseInLocation("2006-01-02", req.PeriodStart, time.Local)
+	end, errEnd := time.ParseInLocation("2006-01-02", req.PeriodEnd, time.Local)
+	end = end.AddDate(0, 0, 1)
+	if errStart != nil || errEnd != nil || !end.After(start) || end.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный период",
+		})
+		return
+	}
+
+	response, err := createPayoutBatch(start, end)
+	if errors.Is(err, errNothingToPay) {
+		c.JSON(http.StatusOK, ApiResponse{
+			Success: true,
+			Data:    response,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create payout batch: %v", err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при формировании выплат",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    response,
+	})
+}
+
+func confirmPayoutBatchHandler(c *gin.Context) {
+	batchID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Выплата не найдена",
+		})
+		return
+	}
+	var req ConfirmPayoutBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	batch, err := confirmPayoutBatch(uint(batchID), req.FailedPayoutIDs)
+	switch {
+	case errors.Is(err, errPayoutBatchNotFound):
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Выплата не найдена",
+		})
+		return
+	case errors.Is(err, errPayoutBatchPaid):
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Выплата уже подтверждена",
+		})
+		return
+	case err != nil:
+		log.Printf("Failed to confirm payout batch %d: %v", batchID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при подтверждении выплаты",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    batch,
+	})
+}
+
+func getPayoutBatches(c *gin.Context) {
+	limit := cursorLimit(c, 20, 100)
+	query, err := paginateByID(db.Model(&PayoutBatch{}), c, "payout_batches", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var batches []PayoutBatch
+	if err := query.Find(&batches).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке выплат",
+		})
+		return
+	}
+
+	batches, meta := pageByID(batches, limit, func(b PayoutBatch) uint { return b.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    batches,
+		Meta:    meta,
+	})
+}
+
+func exportPayoutBatch(c *gin.Context) {
+	var batch PayoutBatch
+	if err := db.Preload("Payouts", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("id")
+	}).First(&batch, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Выплата не найдена",
+		})
+		return
+	}
+
+	data, err := payoutRegistry(&batch)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при формировании реестра",
+		})
+		return
+	}
+
+	if batch.Status == PayoutBatchStatusCreated {
+		db.Model(&batch).Update("status", PayoutBatchStatusExported)
+	}
+
+	filename := fmt.Sprintf("payouts-%d-%s.csv", batch.ID, batch.PeriodStart.Format("2006-01"))
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", data)
+}
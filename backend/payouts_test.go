@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildPayoutBatch(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)
+	end := start.AddDate(0, 1, 0)
+	account := &PayoutAccount{RecipientName: "Анна Смирнова", INN: "7707083893", BankAccount: "40817810099910004312", BIK: "044525225"}
+
+	batch, skipped := buildPayoutBatch(start, end, []payoutCandidate{
+		{TherapistID: 1, Balance: 280001, Account: account},
+		{TherapistID: 2, Balance: 100000, Pending: 60000, Account: account}, // partly in an earlier batch
+		{TherapistID: 3, Balance: 50000, Pending: 50000, Account: account},  // fully in an earlier batch
+		{TherapistID: 4, Balance: 40000, Pending: 45000, Account: account},  // refunded after the earlier batch
+		{TherapistID: 5, Balance: 0, Account: account},
+		{TherapistID: 6, Balance: 1000}, // no bank details
+		{TherapistID: 7, Balance: 1000, Account: &PayoutAccount{INN: "7707083893"}},
+		{TherapistID: 8, Balance: 1000, Pending: 1000}, // nothing left, not reported
+	})
+
+	want := map[uint]int{1: 280001, 2: 40000}
+	got := map[uint]int{}
+	for _, payout := range batch.Payouts {
+		got[payout.TherapistID] = payout.Amount
+		if payout.Status != PayoutStatusPending || payout.BankAccount != account.BankAccount {
+			t.Errorf("payout to %d = %+v", payout.TherapistID, payout)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("payouts = %v, want %v", got, want)
+	}
+	for therapistID, amount := range want {
+		if got[therapistID] != amount {
+			t.Errorf("payout to %d = %d, want %d", therapistID, got[therapistID], amount)
+		}
+	}
+	if batch.Total != 320001 {
+		t.Errorf("total = %d, want %d", batch.Total, 320001)
+	}
+	if !slices.Equal(skipped, []uint{6, 7}) {
+		t.Errorf("skipped = %v, want [6 7]", skipped)
+	}
+	if batch.Status != PayoutBatchStatusCreated || !batch.PeriodStart.Equal(start) || !batch.PeriodEnd.Equal(end) {
+		t.Errorf("batch = %+v", batch)
+	}
+
+	// Confirming the batch posts balanced payouts of the same total
+	var entries [][]LedgerEntry
+	for _, payout := range batch.Payouts {
+		posted := payoutEntries(payout.TherapistID, payout.Amount)
+		if err := checkBalanced("payout", posted); err != nil {
+			t.Error(err)
+		}
+		entries = append(entries, posted)
+	}
+	if totals := accountTotals(entries...); totals[LedgerAccountCash] != batch.Total || totals[LedgerAccountTherapistPayable] != -batch.Total {
+		t.Errorf("posted payouts = %v, want %d out of cash", totals, batch.Total)
+	}
+}
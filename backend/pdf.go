@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// PDFs need a TrueType font with Cyrillic glyphs
+func pdfFontDir() string {
+	return getEnv("PDF_FONT_DIR", "/usr/share/fonts/truetype/dejavu")
+}
+
+func newPDF() *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "A4", pdfFontDir())
+	pdf.AddUTF8Font("DejaVu", "", "DejaVuSans.ttf")
+	pdf.AddUTF8Font("DejaVu", "B", "DejaVuSans-Bold.ttf")
+	pdf.SetMargins(15, 15, 15)
+	pdf.AddPage()
+	return pdf
+}
+
+// formatRoubles renders 315000 as "3 150,00"
+func formatRoubles(amount int) string {
+	roubles := fmt.Sprint(amount / 100)
+	var groups []string
+	for len(roubles) > 3 {
+		groups = append([]string{roubles[len(roubles)-3:]}, groups...)
+		roubles = roubles[:len(roubles)-3]
+	}
+	groups = append([]string{roubles}, groups...)
+	return fmt.Sprintf("%s,%02d", strings.Join(groups, " "), amount%100)
+}
+
+var (
+	onesMasculine = []string{"", "один", "два", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять"}
+	onesFeminine  = []string{"", "одна", "две", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять"}
+	teens         = []string{"десять", "одиннадцать", "двенадцать", "тринадцать", "четырнадцать", "пятнадцать",
+		"шестнадцать", "семнадцать", "восемнадцать", "девятнадцать"}
+	tens     = []string{"", "", "двадцать", "тридцать", "сорок", "пятьдесят", "шестьдесят", "семьдесят", "восемьдесят", "девяносто"}
+	hundreds = []string{"", "сто", "двести", "триста", "четыреста", "пятьсот", "шестьсот", "семьсот", "восемьсот", "девятьсот"}
+)
+
+// triadWords spells a number below 1000
+func triadWords(n int, feminine bool) []string {
+	var words []string
+	if hundreds[n/100] != "" {
+		words = append(words, hundreds[n/100])
+	}
+	n %= 100
+	if n >= 10 && n < 20 {
+		return append(words, teens[n-10])
+	}
+	if tens[n/10] != "" {
+		words = append(words, tens[n/10])
+	}
+	ones := onesMasculine
+	if feminine {
+		ones = onesFeminine
+	}
+	if ones[n%10] != "" {
+		words = append(words, ones[n%10])
+	}
+	return words
+}
+
+// amountInWords spells the amount for documents:
+// 315050 is "Три тысячи сто пятьдесят рублей 50 копеек"
+func amountInWords(amount int) string {
+	roubles, kopecks := amount/100, amount%100
+	scales := []struct {
+		forms    [3]string
+		feminine bool
+	}{
+		{[3]string{"", "", ""}, false},
+		{[3]string{"тысяча", "тысячи", "тысяч"}, true},
+		{[3]string{"миллион", "миллиона", "миллионов"}, false},
+	}
+
+	var words []string
+	for i := len(scales) - 1; i >= 0; i-- {
+		divisor := 1
+		for j := 0; j < i; j++ {
+			divisor *= 1000
+		}
+		triad := roubles / divisor % 1000
+		if triad == 0 {
+			continue
+		}
+		words = append(words, triadWords(triad, scales[i].feminine)...)
+		if i > 0 {
+			words = append(words, pluralRu(triad, scales[i].forms[0], scales[i].forms[1], scales[i].forms[2]))
+		}
+	}
+	if len(words) == 0 {
+		words = []string{"ноль"}
+	}
+
+	text := strings.Join(words, " ") + " " + pluralRu(roubles, "рубль", "рубля", "рублей") +
+		fmt.Sprintf(" %02d ", kopecks) + pluralRu(kopecks, "копейка", "копейки", "копеек")
+	runes := []rune(text)
+	return strings.ToUpper(string(runes[0])) + string(runes[1:])
+}
+
+func pdfParty(pdf *gofpdf.Fpdf, label, name, inn, kpp, address string) {
+	details := name
+	if inn != "" {
+		details += ", ИНН " + inn
+	}
+	if kpp != "" {
+		details += ", КПП " + kpp
+	}
+	if address != "" {
+		details += ", " + address
+	}
+	pdf.SetFont("DejaVu", "", 9)
+	pdf.CellFormat(30, 5, label, "", 0, "L", false, 0, "")
+	pdf.SetFont("DejaVu", "B", 9)
+	pdf.MultiCell(0, 5, details, "", "L", false)
+	pdf.Ln(2)
+}
+
+// pdfBankDetails draws the payment details block of an invoice
+func pdfBankDetails(pdf *gofpdf.Fpdf, entity *LegalEntity) {
+	pdf.SetFont("DejaVu", "", 9)
+	pdf.CellFormat(110, 6, entity.BankName, "LTR", 0, "L", false, 0, "")
+	pdf.CellFormat(20, 6, "БИК", "1", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 6, entity.BIK, "LTR", 1, "L", false, 0, "")
+	pdf.CellFormat(110, 6, "Банк получателя", "LBR", 0, "L", false, 0, "")
+	pdf.CellFormat(20, 6, "Сч. №", "1", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 6, entity.CorrAccount, "LBR", 1, "L", false, 0, "")
+	pdf.CellFormat(55, 6, "ИНН "+entity.INN, "1", 0, "L", false, 0, "")
+	pdf.CellFormat(55, 6, "КПП "+entity.KPP, "1", 0, "L", false, 0, "")
+	pdf.CellFormat(20, 6, "Сч. №", "LTR", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 6, entity.BankAccount, "LTR", 1, "L", false, 0, "")
+	pdf.CellFormat(110, 6, entity.Name, "LR", 0, "L", false, 0, "")
+	pdf.CellFormat(20, 6, "", "LR", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 6, "", "LR", 1, "L", false, 0, "")
+	pdf.CellFormat(110, 6, "Получатель", "LBR", 0, "L", false, 0, "")
+	pdf.CellFormat(20, 6, "", "LBR", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 6, "", "LBR", 1, "L", false, 0, "")
+	pdf.Ln(6)
+}
+
+// pdfServicesTable draws the single service line with totals
+func pdfServicesTable(pdf *gofpdf.Fpdf, document *Document) {
+	widths := []float64{10, 95, 15, 15, 22, 23}
+	headers := []string{"№", "Наименование услуги", "Кол-во", "Ед.", "Цена", "Сумма"}
+	pdf.SetFont("DejaVu", "B", 9)
+	for i, header := range headers {
+		pdf.CellFormat(widths[i], 7, header, "1", 0, "C", false, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("DejaVu", "", 9)
+	// The description wraps, the other cells take its height
+	x, y := pdf.GetXY()
+	pdf.SetX(x + widths[0])
+	pdf.MultiCell(widths[1], 5, document.Description, "1", "L", false)
+	height := pdf.GetY() - y
+	pdf.SetXY(x, y)
+	pdf.CellFormat(widths[0], height, "1", "1", 0, "C", false, 0, "")
+	pdf.SetXY(x+widths[0]+widths[1], y)
+	pdf.CellFormat(widths[2], height, "1", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(widths[3], height, "усл.", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(widths[4], height, formatRoubles(document.Amount), "1", 0, "R", false, 0, "")
+	pdf.CellFormat(widths[5], height, formatRoubles(document.Amount), "1", 1, "R", false, 0, "")
+
+	pdf.SetFont("DejaVu", "B", 9)
+	pdf.CellFormat(157, 6, "Итого:", "", 0, "R", false, 0, "")
+	pdf.CellFormat(23, 6, formatRoubles(document.Amount), "", 1, "R", false, 0, "")
+	pdf.CellFormat(157, 6, "Без налога (НДС)", "", 0, "R", false, 0, "")
+	pdf.CellFormat(23, 6, "-", "", 1, "R", false, 0, "")
+	pdf.Ln(2)
+
+	pdf.SetFont("DejaVu", "", 9)
+	pdf.MultiCell(0, 5, "Всего наименований 1, на сумму "+formatRoubles(document.Amount)+" руб.", "", "L", false)
+	pdf.SetFont("DejaVu", "B", 9)
+	pdf.MultiCell(0, 5, amountInWords(document.Amount), "", "L", false)
+	pdf.Ln(8)
+}
+
+// renderDocumentPDF renders an invoice or an act of services rendered
+func renderDocumentPDF(document *Document, entity *LegalEntity) ([]byte, error) {
+	pdf := newPDF()
+	date := document.IssuedAt.Format("02.01.2006")
+
+	if document.Type == DocumentTypeInvoice {
+		pdfBankDetails(pdf, entity)
+		pdf.SetFont("DejaVu", "B", 14)
+		pdf.CellFormat(0, 10, fmt.Sprintf("Счёт на оплату № %d от %s", document.Number, date), "B", 1, "L", false, 0, "")
+		pdf.Ln(4)
+		pdfParty(pdf, "Поставщик:", entity.Name, entity.INN, entity.KPP, entity.Address)
+		pdfParty(pdf, "Покупатель:", document.BuyerName, document.BuyerINN, document.BuyerKPP, document.BuyerAddress)
+	} else {
+		pdf.SetFont("DejaVu", "B", 14)
+		pdf.CellFormat(0, 10, fmt.Sprintf("Акт № %d от %s", document.Number, date), "B", 1, "L", false, 0, "")
+		pdf.Ln(4)
+		pdfParty(pdf, "Исполнитель:", entity.Name, entity.INN, entity.KPP, entity.Address)
+		pdfParty(pdf, "Заказчик:", document.BuyerName, document.BuyerINN, document.BuyerKPP, document.BuyerAddress)
+	}
+	pdf.Ln(2)
+	pdfServicesTable(pdf, document)
+
+	pdf.SetFont("DejaVu", "", 9)
+	if document.Type == DocumentTypeInvoice {
+		pdf.CellFormat(40, 6, "Руководитель", "", 0, "L", false, 0, "")
+		pdf.CellFormat(50, 6, "", "B", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 6, "  "+entity.Director, "", 1, "L", false, 0, "")
+	} else {
+		pdf.MultiCell(0, 5, "Вышеперечисленные услуги выполнены полностью и в срок. "+
+			"Заказчик претензий по объёму, качеству и срокам оказания услуг не имеет.", "", "L", false)
+		pdf.Ln(10)
+		pdf.CellFormat(90, 6, "Исполнитель", "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 6, "Заказчик", "", 1, "L", false, 0, "")
+		pdf.Ln(6)
+		pdf.CellFormat(70, 6, entity.Director, "B", 0, "L", false, 0, "")
+		pdf.CellFormat(20, 6, "", "", 0, "L", false, 0, "")
+		pdf.CellFormat(70, 6, document.BuyerName, "B", 1, "L", false, 0, "")
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
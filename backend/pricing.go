@@ -0,0 +1,451 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Price rule kinds
+const (
+	PriceRuleSurcharge    = "surcharge"     // raises the price, e.g. evenings and weekends
+	PriceRuleSlidingScale = "sliding_scale" // reduced-fee slots a client may ask for
+)
+
+// PriceListItem is the price of a session of the type and duration, in the
+// therapist currency. A therapist without a price list is charged by
+// PricePerHour.
+type PriceListItem struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	TherapistID uint      `json:"therapist_id" gorm:"not null;uniqueIndex:idx_price_list_item"`
+	SessionType string    `json:"session_type" gorm:"not null;uniqueIndex:idx_price_list_item"`
+	Duration    int       `json:"duration" gorm:"not null;uniqueIndex:idx_price_list_item"` // minutes
+	Price       int       `json:"price"`                                                    // in minor units
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// PriceRule changes the price of sessions starting in a weekly time window.
+// The window is in the server time zone; an end before the start wraps past
+// midnight.
+type PriceRule struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	TherapistID uint      `json:"therapist_id" gorm:"not null;index"`
+	Kind        string    `json:"kind" gorm:"not null"`
+	Label       string    `json:"label,omitempty"`
+	Weekdays    []int     `json:"weekdays,omitempty" gorm:"serializer:json"` // 0 is Sunday, empty for every day
+	StartTime   string    `json:"start_time"`                                // HH:MM
+	EndTime     string    `json:"end_time"`                                  // HH:MM
+	Percent     int       `json:"percent"`                                   // added by surcharges, taken off by the sliding scale
+	MaxPerWeek  int       `json:"max_per_week"`                              // sliding-scale sessions a week, 0 is unlimited
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type PriceListItemRequest struct {
+	SessionType string `json:"session_type" binding:"required,oneof=individual couple group"`
+	Duration    int    `json:"duration" binding:"required,min=30,max=180"`
+	Price       int    `json:"price" binding:"required,min=1"`
+}
+
+type PriceRuleRequest struct {
+	Kind       string `json:"kind" binding:"required,oneof=surcharge sliding_scale"`
+	Label      string `json:"label"`
+	Weekdays   []int  `json:"weekdays" binding:"dive,min=0,max=6"`
+	StartTime  string `json:"start_time" binding:"required"`
+	EndTime    string `json:"end_time" binding:"required"`
+	Percent    int    `json:"percent" binding:"required,min=1,max=100"`
+	MaxPerWeek int    `json:"max_per_week" binding:"min=0"`
+}
+
+// PriceListRequest replaces the whole price list and rules of a therapist.
+// Currency and PricePerHour, when given, change the therapist defaults.
+type PriceListRequest struct {
+	Currency     string                 `json:"currency" binding:"omitempty,oneof=RUB EUR USD"`
+	PricePerHour *int                   `json:"price_per_hour" binding:"omitempty,min=1"`
+	Items        []PriceListItemRequest `json:"items" binding:"dive"`
+	Rules        []PriceRuleRequest     `json:"rules" binding:"dive"`
+}
+
+type PriceList struct {
+	Currency     string          `json:"currency"`
+	PricePerHour int             `json:"price_per_hour"` // used when Items is empty
+	Items        []PriceListItem `json:"items"`
+	Rules        []PriceRule     `json:"rules"`
+}
+
+type PriceAdjustment struct {
+	Kind    string `json:"kind"`
+	Label   string `json:"label,omitempty"`
+	Percent int    `json:"percent"`
+	Amount  int    `json:"amount"` // in the quote currency, negative for reductions
+}
+
+// PriceQuote is what a booking of the session will be charged, before promo
+// codes and the client balance. Prices are in the therapist currency, Charge
+// is the amount in roubles the booking pays.
+type PriceQuote struct {
+	TherapistID  uint              `json:"therapist_id"`
+	SessionType  string            `json:"session_type"`
+	Duration     int               `json:"duration"`
+	StartTime    time.Time         `json:"start_time"`
+	SlidingScale bool              `json:"sliding_scale"`
+	BasePrice    int               `json:"base_price"`
+	Adjustments  []PriceAdjustment `json:"adjustments"`
+	Price        int               `json:"price"`
+	Currency     string            `json:"currency"`
+	Charge       Money             `json:"charge"`
+	Display      *Money            `json:"display,omitempty"` // in the viewer currency
+}
+
+var (
+	errPriceNotOffered          = errors.New("therapist does not offer this session")
+	errSlidingScaleUnavailable  = errors.New("no sliding-scale slot at this time")
+	errInvalidClock             = errors.New("time must be HH:MM")
+	errQuotedPriceChanged       = errors.New("price differs from the quote")
+	errSlidingScaleLimitReached = errors.New("sliding-scale slots of the week are taken")
+)
+
+// clockMinutes parses HH:MM into minutes since midnight
+func clockMinutes(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errInvalidClock
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// matches reports whether a session starting at start falls into the window
+func (r *PriceRule) matches(start time.Time) bool {
+	local := start.In(time.Local)
+	if len(r.Weekdays) > 0 {
+		found := false
+		for _, day := range r.Weekdays {
+			if day == int(local.Weekday()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	from, errFrom := clockMinutes(r.StartTime)
+	to, errTo := clockMinutes(r.EndTime)
+	if errFrom != nil || errTo != nil {
+		return false
+	}
+	minute := local.Hour()*60 + local.Minute()
+	if from < to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// weekStart returns the Monday midnight of the week of t
+func weekStart(t time.Time) time.Time {
+	local := t.In(time.Local)
+	offset := (int(local.Weekday()) + 6) % 7
+	return time.Date(local.Year(), local.Month(), local.Day()-offset, 0, 0, 0, 0, time.Local)
+}
+
+// quotePrice prices a session of the therapist. Booking calls it inside the
+// transaction holding the therapist lock, so sliding-scale limits hold.
+func quotePrice(tx *gorm.DB, therapist *Therapist, sessionType string, duration int, start time.Time, slidingScale bool) (*PriceQuote, error) {
+	quote := &PriceQuote{
+		TherapistID:  therapist.ID,
+		SessionType:  sessionType,
+		Duration:     duration,
+		StartTime:    start,
+		SlidingScale: slidingScale,
+		Adjustments:  []PriceAdjustment{},
+	}
+
+	var items []PriceListItem
+	if err := tx.Where("therapist_id = ?", therapist.ID).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		quote.BasePrice = therapist.PricePerHour * duration / 60
+	} else {
+		found := false
+		for _, item := range items {
+			if item.SessionType == sessionType && item.Duration == duration {
+				quote.BasePrice = item.Price
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errPriceNotOffered
+		}
+	}
+
+	var rules []PriceRule
+	if err := tx.Where("therapist_id = ?", therapist.ID).Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	price := quote.BasePrice
+	for _, rule := range rules {
+		if rule.Kind != PriceRuleSurcharge || !rule.matches(start) {
+			continue
+		}
+		amount := quote.BasePrice * rule.Percent / 100
+		quote.Adjustments = append(quote.Adjustments, PriceAdjustment{
+			Kind: rule.Kind, Label: rule.Label, Percent: rule.Percent, Amount: amount,
+		})
+		price += amount
+	}
+
+	if slidingScale {
+		var slot *PriceRule
+		for i := range rules {
+			if rules[i].Kind == PriceRuleSlidingScale && rules[i].matches(start) {
+				slot = &rules[i]
+				break
+			}
+		}
+		if slot == nil {
+			return nil, errSlidingScaleUnavailable
+		}
+		if slot.MaxPerWeek > 0 {
+			from := weekStart(start)
+			var count int64
+			if err := tx.Model(&Session{}).
+				Where("therapist_id = ? AND sliding_scale = ? AND status NOT IN ?", therapist.ID, true,
+					[]string{SessionStatusCancelled, SessionStatusNoShow}).
+				Where("start_time >= ? AND start_time < ?", from, from.AddDate(0, 0, 7)).
+				Count(&count).Error; err != nil {
+				return nil, err
+			}
+			if int(count) >= slot.MaxPerWeek {
+				return nil, errSlidingScaleLimitReached
+			}
+		}
+		amount := price * slot.Percent / 100
+		quote.Adjustments = append(quote.Adjustments, PriceAdjustment{
+			Kind: slot.Kind, Label: slot.Label, Percent: slot.Percent, Amount: -amount,
+		})
+		price -= amount
+	}
+
+	quote.Price = price
+	quote.Currency = therapist.Currency
+	charge, err := toSettlement(price, therapist.Currency)
+	if err != nil {
+		return nil, err
+	}
+	quote.Charge = Money{Amount: charge, Currency: settlementCurrency}
+	return quote, nil
+}
+
+// priceErrorMessage maps pricing errors to messages for the client
+func priceErrorMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, errPriceNotOffered):
+		return "Специалист не проводит сессии такого типа и длительности", true
+	case errors.Is(err, errSlidingScaleUnavailable):
+		return "В это время нет мест по сниженной цене", true
+	case errors.Is(err, errSlidingScaleLimitReached):
+		return "Места по сниженной цене на этой неделе закончились", true
+	case errors.Is(err, errQuotedPriceChanged):
+		return "Цена изменилась, запросите расчёт стоимости заново", true
+	case errors.Is(err, errRateUnavailable):
+		return "Курс валюты специалиста временно недоступен", true
+	}
+	return "", false
+}
+
+// Handlers
+func getTherapistPrices(c *gin.Context) {
+	var therapist Therapist
+	if err := db.First(&therapist, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Therapist not found",
+		})
+		return
+	}
+
+	list := PriceList{Currency: therapist.Currency, PricePerHour: therapist.PricePerHour}
+	db.Where("therapist_id = ?", therapist.ID).Order("session_type, duration").Find(&list.Items)
+	db.Where("therapist_id = ?", therapist.ID).Order("id").Find(&list.Rules)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+func updateTherapistPrices(c *gin.Context) {
+	therapist, ok := ownTherapist(c)
+	if !ok {
+		return
+	}
+
+	var req PriceListRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	if req.Currency != "" {
+		therapist.Currency = req.Currency
+	}
+	if req.PricePerHour != nil {
+		therapist.PricePerHour = *req.PricePerHour
+	}
+	list := PriceList{Currency: therapist.Currency, PricePerHour: therapist.PricePerHour, Items: []PriceListItem{}, Rules: []PriceRule{}}
+	seen := make(map[string]bool)
+	for _, item := range req.Items {
+		key := fmt.Sprintf("%s/%d", item.SessionType, item.Duration)
+		if seen[key] {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Цена для " + item.SessionType + ", " + strconv.Itoa(item.Duration) + " мин указана дважды",
+			})
+			return
+		}
+		seen[key] = true
+		list.Items = append(list.Items, PriceListItem{
+			TherapistID: therapist.ID,
+			SessionType: item.SessionType,
+			Duration:    item.Duration,
+			Price:       item.Price,
+		})
+	}
+	for _, rule := range req.Rules {
+		from, errFrom := clockMinutes(rule.StartTime)
+		to, errTo := clockMinutes(rule.EndTime)
+		if errFrom != nil || errTo != nil || from == to {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Время правила должно быть в формате ЧЧ:ММ, начало и конец не должны совпадать",
+			})
+			return
+		}
+		list.Rules = append(list.Rules, PriceRule{
+			TherapistID: therapist.ID,
+			Kind:        rule.Kind,
+			Label:       rule.Label,
+			Weekdays:    rule.Weekdays,
+			StartTime:   rule.StartTime,
+			EndTime:     rule.EndTime,
+			Percent:     rule.Percent,
+			MaxPerWeek:  rule.MaxPerWeek,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockTherapist(tx, therapist.ID); err != nil {
+			return err
+		}
+		rub, err := toSettlement(therapist.PricePerHour, therapist.Currency)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(therapist).Updates(map[string]interface{}{
+			"currency": therapist.Currency, "price_per_hour": therapist.PricePerHour, "price_per_hour_rub": rub,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("therapist_id = ?", therapist.ID).Delete(&PriceListItem{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("therapist_id = ?", therapist.ID).Delete(&PriceRule{}).Error; err != nil {
+			return err
+		}
+		if len(list.Items) > 0 {
+			if err := tx.Create(&list.Items).Error; err != nil {
+				return err
+			}
+		}
+		if len(list.Rules) > 0 {
+			return tx.Create(&list.Rules).Error
+		}
+		return nil
+	})
+	if errors.Is(err, errRateUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, ApiResponse{
+			Success: false,
+			Error:   "Курс выбранной валюты пока недоступен",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении цен",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// getPriceQuote prices a session: ?type=&duration=&start_time=&sliding_scale=
+func getPriceQuote(c *gin.Context) {
+	var therapist Therapist
+	if err := db.First(&therapist, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Therapist not found",
+		})
+		return
+	}
+
+	sessionType := c.DefaultQuery("type", "individual")
+	duration, err := strconv.Atoi(c.DefaultQuery("duration", "60"))
+	if err != nil || duration < 30 || duration > 180 {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Длительность сессии должна быть от 30 до 180 минут",
+		})
+		return
+	}
+	start := time.Now()
+	if value := c.Query("start_time"); value != "" {
+		if start, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Неверный формат start_time, ожидается RFC 3339",
+			})
+			return
+		}
+	}
+
+	quote, err := quotePrice(db, &therapist, sessionType, duration, start, c.Query("sliding_scale") == "true")
+	if message, ok := priceErrorMessage(err); ok {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   message,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при расчёте стоимости",
+		})
+		return
+	}
+	quote.Display = displayMoney(quote.Price, quote.Currency, viewerCurrency(c))
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    quote,
+	})
+}
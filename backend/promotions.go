@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Promo code kinds
+const (
+	PromoKindPercent = "percent"
+	PromoKindFixed   = "fixed"
+)
+
+// PromoCode gives a discount on session bookings. Discounts reduce the session
+// price, so the therapist and the platform share them as they share the price.
+type PromoCode struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	Code           string     `json:"code" gorm:"uniqueIndex;not null"`
+	Kind           string     `json:"kind" gorm:"not null"`
+	Value          int        `json:"value"`           // percent, or kopecks for fixed codes
+	MinAmount      int        `json:"min_amount"`      // in kopecks
+	MaxRedemptions int        `json:"max_redemptions"` // 0 is unlimited
+	PerUserLimit   int        `json:"per_user_limit"`  // 0 is unlimited
+	ValidFrom      *time.Time `json:"valid_from,omitempty"`
+	ValidUntil     *time.Time `json:"valid_until,omitempty"`
+	TherapistIDs   []uint     `json:"therapist_ids,omitempty" gorm:"serializer:json"` // empty for all therapists
+	IsActive       bool       `json:"is_active"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+type PromoCodeRequest struct {
+	Code           string     `json:"code" binding:"required,min=3,max=32"`
+	Kind           string     `json:"kind" binding:"required,oneof=percent fixed"`
+	Value          int        `json:"value" binding:"required,min=1"`
+	MinAmount      int        `json:"min_amount" binding:"min=0"`
+	MaxRedemptions int        `json:"max_redemptions" binding:"min=0"`
+	PerUserLimit   *int       `json:"per_user_limit" binding:"omitempty,min=0"`
+	ValidFrom      *time.Time `json:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until"`
+	TherapistIDs   []uint     `json:"therapist_ids"`
+	IsActive       *bool      `json:"is_active"`
+}
+
+// PromoRedemption is a use of a code by a booking. Redemptions of cancelled
+// sessions do not count towards the limits.
+type PromoRedemption struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	PromoCodeID uint       `json:"promo_code_id" gorm:"not null;index"`
+	UserID      uint       `json:"user_id" gorm:"not null;index"`
+	SessionID   uint       `json:"session_id" gorm:"not null;uniqueIndex"`
+	Discount    int        `json:"discount"` // in kopecks
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type PromoValidateRequest struct {
+	Code        string `json:"code" binding:"required"`
+	TherapistID uint   `json:"therapist_id" binding:"required"`
+	Amount      int    `json:"amount" binding:"required,min=1"` // session price in kopecks
+}
+
+type PromoQuote struct {
+	Code     string `json:"code"`
+	Discount int    `json:"discount"`
+	Amount   int    `json:"amount"` // after the discount
+}
+
+var (
+	errPromoNotFound      = errors.New("promo code not found")
+	errPromoExpired       = errors.New("promo code is not valid now")
+	errPromoLimitReached  = errors.New("promo code limit reached")
+	errPromoNotApplicable = errors.New("promo code does not apply")
+)
+
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// promoDiscount checks the code for the user, therapist and amount and
+// returns the discount. With lock set the code row is locked, so that
+// concurrent bookings cannot exceed its limits.
+func promoDiscount(tx *gorm.DB, code string, userID, therapistID uint, amount int, lock bool) (*PromoCode, int, error) {
+	var promo PromoCode
+	query := tx.Where("code = ? AND is_active = ?", normalizePromoCode(code), true)
+	if lock {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	if err := query.First(&promo).Error; err != nil {
+		return nil, 0, errPromoNotFound
+	}
+
+	now := time.Now()
+	if (promo.ValidFrom != nil && now.Before(*promo.ValidFrom)) || (promo.ValidUntil != nil && now.After(*promo.ValidUntil)) {
+		return nil, 0, errPromoExpired
+	}
+	if amount < promo.MinAmount {
+		return nil, 0, errPromoNotApplicable
+	}
+	if len(promo.TherapistIDs) > 0 {
+		allowed := false
+		for _, id := range promo.TherapistIDs {
+			if id == therapistID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, 0, errPromoNotApplicable
+		}
+	}
+
+	active := tx.Model(&PromoRedemption{}).Where("promo_code_id = ? AND cancelled_at IS NULL", promo.ID)
+	if promo.MaxRedemptions > 0 {
+		var used int64
+		if err := active.Session(&gorm.Session{}).Count(&used).Error; err != nil {
+			return nil, 0, err
+		}
+		if int(used) >= promo.MaxRedemptions {
+			return nil, 0, errPromoLimitReached
+		}
+	}
+	if promo.PerUserLimit > 0 {
+		var used int64
+		if err := active.Session(&gorm.Session{}).Where("user_id = ?", userID).Count(&used).Error; err != nil {
+			return nil, 0, err
+		}
+		if int(used) >= promo.PerUserLimit {
+			return nil, 0, errPromoLimitReached
+		}
+	}
+
+	discount := promo.Value
+	if promo.Kind == PromoKindPercent {
+		discount = amount * promo.Value / 100
+	}
+	if discount > amount {
+		discount = amount
+	}
+	return &promo, discount, nil
+}
+
+// redeemPromoCode applies the code to a new session, lowering its price
+func redeemPromoCode(tx *gorm.DB, code string, session *Session) error {
+	promo, discount, err := promoDiscount(tx, code, session.ClientID, session.TherapistID, session.Price, true)
+	if err != nil {
+		return err
+	}
+	redemption := PromoRedemption{
+		PromoCodeID: promo.ID,
+		UserID:      session.ClientID,
+		SessionID:   session.ID,
+		Discount:    discount,
+	}
+	if err := tx.Create(&redemption).Error; err != nil {
+		return err
+	}
+
+	session.Price -= discount
+	session.Discount = discount
+	session.PromoCode = promo.Code
+	return tx.Save(session).Error
+}
+
+// releasePromoCode frees the redemption of a cancelled session
+func releasePromoCode(tx *gorm.DB, sessionID uint) error {
+	return tx.Model(&PromoRedemption{}).
+		Where("session_id = ? AND cancelled_at IS NULL", sessionID).
+		Update("cancelled_at", time.Now()).Error
+}
+
+// promoErrorMessage maps promo errors to messages for the client
+func promoErrorMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, errPromoNotFound):
+		return "Промокод не найден", true
+	case errors.Is(err, errPromoExpired):
+		return "Срок действия промокода истёк или ещё не начался", true
+	case errors.Is(err, errPromoLimitReached):
+		return "Промокод уже использован максимальное число раз", true
+	case errors.Is(err, errPromoNotApplicable):
+		return "Промокод не применим к этой сессии", true
+	}
+	return "", false
+}
+
+// Handlers
+func validatePromoCode(c *gin.Context) {
+	var req PromoValidateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	promo, discount, err := promoDiscount(db, req.Code, c.GetUint("user_id"), req.TherapistID, req.Amount, false)
+	if message, ok := promoErrorMessage(err); ok {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   message,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при проверке промокода",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data: PromoQuote{
+			Code:     promo.Code,
+			Discount: discount,
+			Amount:   req.Amount - discount,
+		},
+	})
+}
+
+func getPromoCodes(c *gin.Context) {
+	limit := cursorLimit(c, 50, 200)
+	query, err := paginateByID(db.Model(&PromoCode{}), c, "promo_codes", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var promos []PromoCode
+	if err := query.Find(&promos).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке промокодов",
+		})
+		return
+	}
+
+	promos, meta := pageByID(promos, limit, func(p PromoCode) uint { return p.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    promos,
+		Meta:    meta,
+	})
+}
+
+// savePromoCode creates a code, or updates the one in the path
+func savePromoCode(c *gin.Context) {
+	promo := PromoCode{IsActive: true, PerUserLimit: 1}
+	if id := c.Param("id"); id != "" {
+		if err := db.First(&promo, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, ApiResponse{
+				Success: false,
+				Error:   "Промокод не найден",
+			})
+			return
+		}
+	}
+
+	var req PromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+	if req.Kind == PromoKindPercent && req.Value > 100 {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Скидка не может превышать 100%",
+		})
+		return
+	}
+
+	promo.Code = normalizePromoCode(req.Code)
+	promo.Kind = req.Kind
+	promo.Value = req.Value
+	promo.MinAmount = req.MinAmount
+	promo.MaxRedemptions = req.MaxRedemptions
+	if req.PerUserLimit != nil {
+		promo.PerUserLimit = *req.PerUserLimit
+	}
+	promo.ValidFrom = req.ValidFrom
+	promo.ValidUntil = req.ValidUntil
+	promo.TherapistIDs = req.TherapistIDs
+	if req.IsActive != nil {
+		promo.IsActive = *req.IsActive
+	}
+
+	if err := db.Save(&promo).Error; err != nil {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Промокод с таким кодом уже существует",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    promo,
+	})
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReceiptProvider is implemented by payment providers that register fiscal
+// receipts (54-FZ) with the tax service through their online cash register
+type ReceiptProvider interface {
+	SendReceipt(ctx context.Context, req ProviderReceiptRequest) (*ProviderReceipt, error)
+	GetReceipt(ctx context.Context, providerReceiptID string) (*ProviderReceipt, error)
+}
+
+// Receipt types
+const (
+	ReceiptTypePayment = "payment"
+	ReceiptTypeRefund  = "refund"
+)
+
+// Receipt statuses
+const (
+	ReceiptStatusPending = "pending"
+	ReceiptStatusSent    = "sent"
+	ReceiptStatusFailed  = "failed"
+)
+
+const (
+	maxReceiptAttempts = 10
+	// Receipts the provider has accepted but not registered yet are
+	// looked up this often
+	receiptPollInterval = time.Minute
+	receiptClaimTTL     = 2 * time.Minute
+)
+
+// ReceiptItem is a line of a fiscal receipt
+type ReceiptItem struct {
+	Description    string `json:"description"`
+	Quantity       int    `json:"quantity"`
+	Amount         int    `json:"amount"` // in kopecks, for the whole line
+	VatCode        int    `json:"vat_code"`
+	PaymentSubject string `json:"payment_subject"` // service
+	PaymentMode    string `json:"payment_mode"`    // full_payment
+}
+
+type ProviderReceiptRequest struct {
+	Type              string
+	ProviderPaymentID string
+	ProviderRefundID  string
+	CustomerEmail     string
+	Items             []ReceiptItem
+	Currency          string
+	TaxSystemCode     int
+	IdempotencyKey    string
+}
+
+type ProviderReceipt struct {
+	ProviderReceiptID    string
+	Status               string // pending, sent, failed
+	FiscalDocumentNumber string
+	FiscalStorageNumber  string
+	FiscalAttribute      string
+	RegisteredAt         *time.Time
+}
+
+type Receipt struct {
+	ID                   uint          `json:"id" gorm:"primaryKey"`
+	PaymentID            uint          `json:"payment_id" gorm:"not null;uniqueIndex:idx_receipt_source"`
+	RefundID             uint          `json:"refund_id,omitempty" gorm:"uniqueIndex:idx_receipt_source"` // 0 for payment receipts
+	Type                 string        `json:"type"`
+	Status               string        `json:"status" gorm:"default:pending;index"`
+	CustomerEmail        string        `json:"customer_email"`
+	Items                []ReceiptItem `json:"items" gorm:"serializer:json"`
+	Amount               int           `json:"amount"` // in kopecks
+	ProviderReceiptID    string        `json:"provider_receipt_id,omitempty"`
+	FiscalDocumentNumber string        `json:"fiscal_document_number,omitempty"`
+	FiscalStorageNumber  string        `json:"fiscal_storage_number,omitempty"`
+	FiscalAttribute      string        `json:"fiscal_attribute,omitempty"`
+	RegisteredAt         *time.Time    `json:"registered_at,omitempty"`
+	Attempts             int           `json:"attempts"`
+	NextAttemptAt        time.Time     `json:"-" gorm:"index"`
+	LastError            string        `json:"last_error,omitempty"`
+	CreatedAt            time.Time     `json:"created_at"`
+	UpdatedAt            time.Time     `json:"updated_at"`
+}
+
+var errReceiptsUnsupported = errors.New("payment provider does not register fiscal receipts")
+
+func fiscalSetting(key string, def int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(def)))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// queueReceipt records a pending receipt for a completed payment, or for a
+// refund when refund is set. It is sent later by the receipt worker.
+func queueReceipt(tx *gorm.DB, payment *Payment, refund *Refund) error {
+	var user User
+	if err := tx.Select("email").First(&user, payment.UserID).Error; err != nil {
+		return err
+	}
+
+	description := payment.Description
+	if description == "" {
+		description = "Психологическая консультация"
+	}
+	receipt := Receipt{
+		PaymentID:     payment.ID,
+		Type:          ReceiptTypePayment,
+		Status:        ReceiptStatusPending,
+		CustomerEmail: user.Email,
+		Amount:        payment.Amount,
+		NextAttemptAt: time.Now(),
+	}
+	if refund != nil {
+		receipt.RefundID = refund.ID
+		receipt.Type = ReceiptTypeRefund
+		receipt.Amount = refund.Amount
+	}
+	receipt.Items = []ReceiptItem{{
+		Description:    description,
+		Quantity:       1,
+		Amount:         receipt.Amount,
+		VatCode:        fiscalSetting("FISCAL_VAT_CODE", 1),
+		PaymentSubject: "service",
+		PaymentMode:    "full_payment",
+	}}
+
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&receipt).Error
+}
+
+// sendReceipt registers the receipt with the payment provider, or looks up
+// one the provider accepted but has not registered yet. The receipt is left
+// pending until the provider reports it registered.
+func sendReceipt(ctx context.Context, receipt *Receipt) error {
+	var payment Payment
+	if err := db.First(&payment, receipt.PaymentID).Error; err != nil {
+		return err
+	}
+	provider, ok := paymentProvider(payment.Provider)
+	if !ok {
+		return fmt.Errorf("payment provider %q is not configured", payment.Provider)
+	}
+	fiscal, ok := provider.(ReceiptProvider)
+	if !ok {
+		return errReceiptsUnsupported
+	}
+
+	var result *ProviderReceipt
+	var err error
+	if receipt.ProviderReceiptID != "" {
+		result, err = fiscal.GetReceipt(ctx, receipt.ProviderReceiptID)
+	} else {
+		req := ProviderReceiptRequest{
+			Type:              receipt.Type,
+			ProviderPaymentID: payment.ProviderPaymentID,
+			CustomerEmail:     receipt.CustomerEmail,
+			Items:             receipt.Items,
+			Currency:          payment.Currency,
+			TaxSystemCode:     fiscalSetting("FISCAL_TAX_SYSTEM_CODE", 1),
+			IdempotencyKey:    fmt.Sprintf("receipt-%d", receipt.ID),
+		}
+		if receipt.RefundID != 0 {
+			var refund Refund
+			if err := db.First(&refund, receipt.RefundID).Error; err != nil {
+				return err
+			}
+			req.ProviderRefundID = refund.ProviderRefundID
+		}
+		result, err = fiscal.SendReceipt(ctx, req)
+	}
+	if err != nil {
+		return err
+	}
+	if result.Status == ReceiptStatusFailed {
+		return errors.New("receipt rejected by the cash register")
+	}
+	receipt.ProviderReceiptID = result.ProviderReceiptID
+	receipt.FiscalDocumentNumber = result.FiscalDocumentNumber
+	receipt.FiscalStorageNumber = result.FiscalStorageNumber
+	receipt.FiscalAttribute = result.FiscalAttribute
+	receipt.RegisteredAt = result.RegisteredAt
+	receipt.Status = result.Status
+	return nil
+}
+
+// processReceipt sends a claimed receipt and saves the outcome, retrying with
+// a growing delay. The send error is kept in LastError. A receipt the
+// provider is still registering is looked up again after receiptPollInterval.
+func processReceipt(ctx context.Context, receipt *Receipt) error {
+	receipt.LastError = ""
+	if err := sendReceipt(ctx, receipt); err != nil {
+		receipt.Attempts++
+		receipt.LastError = err.Error()
+		delay := time.Duration(receipt.Attempts*receipt.Attempts) * time.Minute
+		receipt.NextAttemptAt = time.Now().Add(delay)
+		if receipt.Attempts >= maxReceiptAttempts || errors.Is(err, errReceiptsUnsupported) {
+			receipt.Status = ReceiptStatusFailed
+		}
+	} else if receipt.Status == ReceiptStatusPending {
+		receipt.NextAttemptAt = time.Now().Add(receiptPollInterval)
+	}
+	return db.Save(receipt).Error
+}
+
+// claimReceipt takes the next due receipt. Its next attempt is pushed past
+// receiptClaimTTL, which keeps other workers off it while the provider is
+// called outside the transaction; a worker that dies leaves it due again.
+func claimReceipt() (*Receipt, error) {
+	var receipt Receipt
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", ReceiptStatusPending, time.Now()).
+			Order("id").Limit(1).Find(&receipt)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		receipt.NextAttemptAt = time.Now().Add(receiptClaimTTL)
+		return tx.Model(&receipt).Update("next_attempt_at", receipt.NextAttemptAt).Error
+	})
+	if err != nil || receipt.ID == 0 {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// sendPendingReceipts sends due receipts. They are claimed one at a time, so
+// several replicas can run it at once.
+func sendPendingReceipts(ctx context.Context) {
+	for {
+		receipt, err := claimReceipt()
+		if err != nil {
+			log.Printf("Receipt worker: %v", err)
+			return
+		}
+		if receipt == nil {
+			return
+		}
+		if err := processReceipt(ctx, receipt); err != nil {
+			log.Printf("Receipt worker: %v", err)
+			return
+		}
+		if receipt.LastError != "" {
+			log.Printf("Failed to send receipt %d (attempt %d): %s", receipt.ID, receipt.Attempts, receipt.LastError)
+		}
+	}
+}
+
+func init() {
+	registerPeriodicJob(JobSendReceipts, 30*time.Second, sendPendingReceipts)
+}
+
+// YooKassa receipts (https://yookassa.ru/developers/api#create_receipt)
+func (p *YooKassaProvider) SendReceipt(ctx context.Context, req ProviderReceiptRequest) (*ProviderReceipt, error) {
+	items := make([]map[string]interface{}, len(req.Items))
+	for i, item := range req.Items {
+		items[i] = map[string]interface{}{
+			"description":     item.Description,
+			"quantity":        strconv.Itoa(item.Quantity),
+			"amount":          yooKassaAmount{formatMinorUnits(item.Amount), req.Currency},
+			"vat_code":        item.VatCode,
+			"payment_subject": item.PaymentSubject,
+			"payment_mode":    item.PaymentMode,
+		}
+	}
+	total := 0
+	for _, item := range req.Items {
+		total += item.Amount
+	}
+
+	body := map[string]interface{}{
+		"type":            req.Type,
+		"payment_id":      req.ProviderPaymentID,
+		"customer":        map[string]string{"email": req.CustomerEmail},
+		"send":            true,
+		"items":           items,
+		"tax_system_code": req.TaxSystemCode,
+		"settlements": []map[string]interface{}{
+			{"type": "cashless", "amount": yooKassaAmount{formatMinorUnits(total), req.Currency}},
+		},
+	}
+	if req.Type == ReceiptTypeRefund {
+		body["refund_id"] = req.ProviderRefundID
+	}
+
+	var out yooKassaReceipt
+	if err := p.do(ctx, http.MethodPost, "/receipts", req.IdempotencyKey, body, &out); err != nil {
+		return nil, err
+	}
+	return out.providerReceipt(), nil
+}
+
+func (p *YooKassaProvider) GetReceipt(ctx context.Context, providerReceiptID string) (*ProviderReceipt, error) {
+	var out yooKassaReceipt
+	if err := p.do(ctx, http.MethodGet, "/receipts/"+url.PathEscape(providerReceiptID), "", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.providerReceipt(), nil
+}
+
+type yooKassaReceipt struct {
+	ID                   string     `json:"id"`
+	Status               string     `json:"status"`
+	FiscalDocumentNumber string     `json:"fiscal_document_number"`
+	FiscalStorageNumber  string     `json:"fiscal_storage_number"`
+	FiscalAttribute      string     `json:"fiscal_attribute"`
+	RegisteredAt         *time.Time `json:"registered_at"`
+}
+
+func (r *yooKassaReceipt) providerReceipt() *ProviderReceipt {
+	status := ReceiptStatusPending
+	switch r.Status {
+	case "succeeded":
+		status = ReceiptStatusSent
+	case "canceled":
+		status = ReceiptStatusFailed
+	}
+	return &ProviderReceipt{
+		ProviderReceiptID:    r.ID,
+		Status:               status,
+		FiscalDocumentNumber: r.FiscalDocumentNumber,
+		FiscalStorageNumber:  r.FiscalStorageNumber,
+		FiscalAttribute:      r.FiscalAttribute,
+		RegisteredAt:         r.RegisteredAt,
+	}
+}
+
+func (p *FakeProvider) SendReceipt(ctx context.Context, req ProviderReceiptRequest) (*ProviderReceipt, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.payments[req.ProviderPaymentID]; !ok {
+		return nil, fmt.Errorf("fake payment %s not found", req.ProviderPaymentID)
+	}
+	p.seq++
+	now := time.Now()
+	return &ProviderReceipt{
+		ProviderReceiptID:    fmt.Sprintf("fake_receipt_%d", p.seq),
+		Status:               ReceiptStatusSent,
+		FiscalDocumentNumber: strconv.Itoa(p.seq),
+		FiscalStorageNumber:  "9999078900000000",
+		FiscalAttribute:      fmt.Sprintf("%010d", p.seq),
+		RegisteredAt:         &now,
+	}, nil
+}
+
+// GetReceipt is not reached for fake receipts, they are registered at once
+func (p *FakeProvider) GetReceipt(ctx context.Context, providerReceiptID string) (*ProviderReceipt, error) {
+	return nil, fmt.Errorf("fake receipt %s not found", providerReceiptID)
+}
+
+// Handlers
+func getPaymentReceipts(c *gin.Context) {
+	var payment Payment
+	if err := db.First(&payment, c.Param("id")).Error; err != nil ||
+		(c.GetString("user_role") != "admin" && payment.UserID != c.GetUint("user_id")) {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Платёж не найден",
+		})
+		return
+	}
+
+	var receipts []Receipt
+	if err := db.Where("payment_id = ?", payment.ID).Order("id").Find(&receipts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке чеков",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    receipts,
+	})
+}
+
+func retryReceipt(c *gin.Context) {
+	var receipt Receipt
+	claimed := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&receipt, c.Param("id")).Error; err != nil {
+			return err
+		}
+		if receipt.Status == ReceiptStatusSent ||
+			(receipt.Status == ReceiptStatusPending && receipt.NextAttemptAt.After(time.Now())) {
+			// Registered, or being sent or looked up by the worker
+			return nil
+		}
+		receipt.Status = ReceiptStatusPending
+		receipt.Attempts = 0
+		receipt.NextAttemptAt = time.Now().Add(receiptClaimTTL)
+		claimed = true
+		return tx.Save(&receipt).Error
+	})
+	if err == nil && claimed {
+		err = processReceipt(c.Request.Context(), &receipt)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Чек не найден",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при отправке чека",
+		})
+		return
+	}
+	if receipt.LastError != "" {
+		c.JSON(http.StatusBadGateway, ApiResponse{
+			Success: false,
+			Data:    receipt,
+			Error:   "Не удалось отправить чек: " + receipt.LastError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    receipt,
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Referral statuses
+const (
+	ReferralStatusPending  = "pending" // waiting for the first completed session
+	ReferralStatusRewarded = "rewarded"
+)
+
+// ReferralCode is the invitation code of a user, created on first request
+type ReferralCode struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex;not null"`
+	Code      string    `json:"code" gorm:"uniqueIndex;not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Referral links an invited user to the one who invited them. Both get a
+// bonus on the balance once the invited user completes a first session.
+type Referral struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	ReferrerID uint       `json:"referrer_id" gorm:"not null;index"`
+	RefereeID  uint       `json:"referee_id" gorm:"uniqueIndex;not null"`
+	Status     string     `json:"status" gorm:"default:pending"`
+	SessionID  *uint      `json:"session_id,omitempty"`
+	RewardedAt *time.Time `json:"rewarded_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type ReferralStats struct {
+	Code     string `json:"code"`
+	Link     string `json:"link"`
+	Invited  int64  `json:"invited"`
+	Rewarded int64  `json:"rewarded"`
+	Earned   int    `json:"earned"` // in kopecks
+}
+
+var errReferralCodeInvalid = errors.New("referral code not found")
+
+// referralBonus reads a bonus amount in kopecks from the environment
+func referralBonus(key string, def int) int {
+	amount, err := strconv.Atoi(getEnv(key, strconv.Itoa(def)))
+	if err != nil || amount < 0 {
+		return def
+	}
+	return amount
+}
+
+// referralCodeFor returns the code of the user, creating it if needed
+func referralCodeFor(userID uint) (*ReferralCode, error) {
+	var code ReferralCode
+	if err := db.Where("user_id = ?", userID).First(&code).Error; err == nil {
+		return &code, nil
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		value, err := randomCode(8)
+		if err != nil {
+			return nil, err
+		}
+		code = ReferralCode{UserID: userID, Code: value}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&code)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected > 0 {
+			return &code, nil
+		}
+		// Either a concurrent request created the code of the user or the
+		// random code is taken
+		if err := db.Where("user_id = ?", userID).First(&code).Error; err == nil {
+			return &code, nil
+		}
+	}
+	return nil, errors.New("could not generate a referral code")
+}
+
+// linkReferral records that the new user came with the code
+func linkReferral(refereeID uint, code string) error {
+	var referralCode ReferralCode
+	if err := db.Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).First(&referralCode).Error; err != nil {
+		return errReferralCodeInvalid
+	}
+	if referralCode.UserID == refereeID {
+		return errReferralCodeInvalid
+	}
+	referral := Referral{
+		ReferrerID: referralCode.UserID,
+		RefereeID:  refereeID,
+		Status:     ReferralStatusPending,
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&referral).Error
+}
+
+// rewardReferral credits the bonuses when the client of a completed session
+// was invited and has not been rewarded yet
+func rewardReferral(tx *gorm.DB, session *Session) error {
+	var referral Referral
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("referee_id = ? AND status = ?", session.ClientID, ReferralStatusPending).
+		First(&referral).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	referral.Status = ReferralStatusRewarded
+	referral.SessionID = &session.ID
+	referral.RewardedAt = &now
+	if err := tx.Save(&referral).Error; err != nil {
+		return err
+	}
+
+	bonuses := []struct {
+		userID uint
+		amount int
+		role   string
+	}{
+		{referral.ReferrerID, referralBonus("REFERRAL_REFERRER_BONUS", 50000), "referrer"},
+		{referral.RefereeID, referralBonus("REFERRAL_REFEREE_BONUS", 50000), "referee"},
+	}
+	for _, bonus := range bonuses {
+		if bonus.amount == 0 {
+			continue
+		}
+		reference := fmt.Sprintf("referral:%d:%s", referral.ID, bonus.role)
+		description := "Бонус за приглашение"
+		if err := creditBalance(tx, bonus.userID, bonus.amount, BalanceKindReferral, reference, description); err != nil {
+			return err
+		}
+		if err := postBonus(tx, reference, bonus.amount, description); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handlers
+func getReferrals(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	code, err := referralCodeFor(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при создании реферального кода",
+		})
+		return
+	}
+
+	stats := ReferralStats{
+		Code: code.Code,
+		Link: getEnv("FRONTEND_URL", "http://localhost:3000") + "/register?ref=" + code.Code,
+	}
+	db.Model(&Referral{}).Where("referrer_id = ?", userID).Count(&stats.Invited)
+	db.Model(&Referral{}).Where("referrer_id = ? AND status = ?", userID, ReferralStatusRewarded).Count(&stats.Rewarded)
+	db.Model(&BalanceEntry{}).Where("user_id = ? AND kind = ? AND reference LIKE ?", userID, BalanceKindReferral, "%:referrer").
+		Select("COALESCE(SUM(amount), 0)").Scan(&stats.Earned)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    stats,
+	})
+}
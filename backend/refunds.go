@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Refund statuses
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusCompleted = "completed"
+	RefundStatusFailed    = "failed"
+)
+
+type Refund struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	PaymentID        uint       `json:"payment_id" gorm:"not null;index"`
+	Amount           int        `json:"amount"` // in kopecks
+	Status           string     `json:"status" gorm:"default:pending;index"`
+	Reason           string     `json:"reason,omitempty"`
+	ProviderRefundID string     `json:"provider_refund_id,omitempty"`
+	FailureReason    string     `json:"failure_reason,omitempty"`
+	Attempts         int        `json:"attempts"`
+	NextAttemptAt    *time.Time `json:"next_attempt_at,omitempty"` // when the provider could not be reached
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+type RefundRequest struct {
+	Amount int    `json:"amount"` // in kopecks, 0 refunds the remaining amount
+	Reason string `json:"reason"`
+}
+
+const (
+	// A refund the provider cannot be reached for is given up after this
+	// many attempts
+	maxRefundAttempts = 8
+	// Refunds the provider has not completed are checked this often
+	refundSyncInterval = time.Minute
+)
+
+var (
+	errNothingToRefund        = errors.New("nothing to refund")
+	errRefundExceedsAvailable = errors.New("refund exceeds the refundable amount")
+)
+
+// refundable returns the amount of the payment that can still be refunded
+func refundable(payment *Payment) int {
+	if payment.Status != PaymentStatusCompleted && payment.Status != PaymentStatusPartiallyRefunded {
+		return 0
+	}
+	return payment.Amount - payment.RefundAmount
+}
+
+// issueRefund refunds amount of the payment through its provider, 0 meaning
+// what is left. The refund is recorded and its amount reserved before
+// calling the provider; see submitRefund for what happens then.
+func issueRefund(ctx context.Context, paymentID uint, amount int, reason string) (*Refund, error) {
+	var refund *Refund
+	var payment *Payment
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		refund, payment, err = reserveRefund(tx, paymentID, amount, reason)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return submitRefund(ctx, refund, payment)
+}
+
+// reserveRefund records a pending refund of the payment and reserves its
+// amount, 0 meaning what is left. Committed together with what the refund is
+// for, it makes sure the money goes back even if the process stops before
+// the provider call: syncRefunds sends pending refunds that never reached
+// the provider.
+func reserveRefund(tx *gorm.DB, paymentID uint, amount int, reason string) (*Refund, *Payment, error) {
+	var payment Payment
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, paymentID).Error; err != nil {
+		return nil, nil, err
+	}
+	available := refundable(&payment)
+	if available <= 0 {
+		return nil, nil, errNothingToRefund
+	}
+	if amount > available {
+		return nil, nil, errRefundExceedsAvailable
+	}
+	if amount <= 0 {
+		amount = available
+	}
+
+	refund := Refund{PaymentID: payment.ID, Amount: amount, Reason: reason, Status: RefundStatusPending}
+	if err := tx.Create(&refund).Error; err != nil {
+		return nil, nil, err
+	}
+
+	// Reserve the amount so that concurrent refunds cannot exceed the payment
+	payment.RefundAmount += amount
+	status := PaymentStatusPartiallyRefunded
+	if payment.RefundAmount >= payment.Amount {
+		status = PaymentStatusRefunded
+	}
+	if err := applyPaymentStatus(tx, &payment, status, ""); err != nil {
+		return nil, nil, err
+	}
+	return &refund, &payment, nil
+}
+
+// submitRefund sends a reserved refund to the provider. When the provider
+// cannot be reached the refund stays pending and syncRefunds tries again
+// under the same idempotency key; a declined refund releases the reserved
+// amount and is returned with the error. A refund the provider accepted but
+// has not completed yet is checked on by syncRefunds.
+func submitRefund(ctx context.Context, refund *Refund, payment *Payment) (*Refund, error) {
+	provider, ok := paymentProvider(payment.Provider)
+	if !ok {
+		return refund, failRefund(refund, fmt.Errorf("payment provider %q is not configured", payment.Provider))
+	}
+	result, err := provider.Refund(ctx, payment.ProviderPaymentID, refund.Amount, payment.Currency, fmt.Sprintf("refund-%d", refund.ID))
+	switch {
+	case errors.Is(err, errProviderUnavailable) && refund.Attempts+1 < maxRefundAttempts:
+		refund.Attempts++
+		next := time.Now().Add(time.Duration(refund.Attempts*refund.Attempts) * time.Minute)
+		refund.NextAttemptAt = &next
+		refund.FailureReason = err.Error()
+		log.Printf("Refund %d not sent (attempt %d), retrying: %v", refund.ID, refund.Attempts, err)
+		if err := db.Save(refund).Error; err != nil {
+			log.Printf("Failed to save refund %d: %v", refund.ID, err)
+		}
+		return refund, nil
+	case err != nil:
+		return refund, failRefund(refund, err)
+	case result.Status == RefundStatusFailed:
+		return refund, failRefund(refund, errors.New("refund declined by provider"))
+	}
+
+	refund.ProviderRefundID = result.ProviderRefundID
+	refund.NextAttemptAt = nil
+	refund.FailureReason = ""
+	if result.Status == RefundStatusPending {
+		if err := db.Save(refund).Error; err != nil {
+			log.Printf("Failed to save refund %d: %v", refund.ID, err)
+		}
+		return refund, nil
+	}
+	if err := completeRefund(refund, payment); err != nil {
+		// Still pending: syncRefunds sends it again under the same
+		// idempotency key and completes it
+		log.Printf("Failed to complete refund %d: %v", refund.ID, err)
+	}
+	return refund, nil
+}
+
+// completeRefund records a refund the provider completed together with its
+// event, ledger entries and receipt. If any of them fails the refund stays
+// pending and syncRefunds completes it later; a refund completed already is
+// left alone.
+func completeRefund(refund *Refund, payment *Payment) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Refund{}).Where("id = ? AND status = ?", refund.ID, RefundStatusPending).
+			Updates(map[string]interface{}{
+				"status":             RefundStatusCompleted,
+				"provider_refund_id": refund.ProviderRefundID,
+				"next_attempt_at":    nil,
+				"failure_reason":     "",
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		refund.Status = RefundStatusCompleted
+		if err := recordRefundEvent(tx, refund, payment); err != nil {
+			return err
+		}
+		if err := postRefund(tx, refund, payment); err != nil {
+			return err
+		}
+		return queueReceipt(tx, payment, refund)
+	})
+	if err != nil {
+		refund.Status = RefundStatusPending
+	}
+	return err
+}
+
+// failRefund gives up on a refund and returns its amount to the payment
+func failRefund(refund *Refund, cause error) error {
+	refund.Status = RefundStatusFailed
+	refund.FailureReason = cause.Error()
+	refund.NextAttemptAt = nil
+	if err := releaseRefund(refund); err != nil {
+		log.Printf("Failed to release refund %d: %v", refund.ID, err)
+	}
+	return cause
+}
+
+// releaseRefund returns the reserved amount of a failed refund to the payment
+func releaseRefund(refund *Refund) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var payment Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, refund.PaymentID).Error; err != nil {
+			return err
+		}
+		payment.RefundAmount -= refund.Amount
+		if payment.RefundAmount <= 0 {
+			payment.RefundAmount = 0
+			payment.Status = PaymentStatusCompleted
+			payment.RefundedAt = nil
+		} else {
+			payment.Status = PaymentStatusPartiallyRefunded
+		}
+		if err := tx.Save(&payment).Error; err != nil {
+			return err
+		}
+		return tx.Save(refund).Error
+	})
+}
+
+// syncRefunds moves the pending refunds on: those that did not reach the
+// provider are sent again, also after a crash in between, and those the
+// provider has not completed are looked up
+func syncRefunds(ctx context.Context) {
+	now := time.Now()
+	var refunds []Refund
+	err := db.Where("status = ?", RefundStatusPending).
+		Where("next_attempt_at <= ? OR (next_attempt_at IS NULL AND updated_at <= ?)", now, now.Add(-refundSyncInterval)).
+		Order("id").Limit(100).Find(&refunds).Error
+	if err != nil {
+		log.Printf("Refund sync: %v", err)
+		return
+	}
+
+	for i := range refunds {
+		refund := &refunds[i]
+		var payment Payment
+		if err := db.First(&payment, refund.PaymentID).Error; err != nil {
+			log.Printf("Refund sync: payment of refund %d: %v", refund.ID, err)
+			continue
+		}
+		if refund.ProviderRefundID == "" {
+			if _, err := submitRefund(ctx, refund, &payment); err != nil {
+				log.Printf("Refund %d failed: %v", refund.ID, err)
+			}
+			continue
+		}
+
+		provider, ok := paymentProvider(payment.Provider)
+		if !ok {
+			continue
+		}
+		result, err := provider.GetRefund(ctx, refund.ProviderRefundID)
+		if err != nil {
+			log.Printf("Refund sync: refund %d: %v", refund.ID, err)
+			continue
+		}
+		switch result.Status {
+		case RefundStatusCompleted:
+			if err := completeRefund(refund, &payment); err != nil {
+				log.Printf("Refund sync: refund %d: %v", refund.ID, err)
+			}
+		case RefundStatusFailed:
+			log.Printf("Refund %d declined by provider", refund.ID)
+			failRefund(refund, errors.New("refund declined by provider"))
+		default:
+			// Looked up again after refundSyncInterval
+			db.Model(refund).Update("updated_at", now)
+		}
+	}
+}
+
+// refundLatePayment refunds a payment that succeeded after we had cancelled
+// it, e.g. paid on the provider page after the session was cancelled.
+// Refunding what is left makes it safe to see the event twice.
+func refundLatePayment(ctx context.Context, event DomainEvent) error {
+	paymentID, _ := event.Payload["payment_id"].(float64)
+	var payment Payment
+	if err := db.First(&payment, uint(paymentID)).Error; err != nil {
+		return nil
+	}
+	if payment.CancelledAt == nil || refundable(&payment) == 0 {
+		return nil
+	}
+
+	refund, err := issueRefund(ctx, payment.ID, 0, "payment_after_cancellation")
+	if errors.Is(err, errNothingToRefund) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Payment %d succeeded after cancellation, refund %d issued", payment.ID, refund.ID)
+	return nil
+}
+
+func init() {
+	subscribeEvents("late_payment_refunds", []string{EventPaymentSucceeded}, refundLatePayment)
+	registerPeriodicJob(JobSyncRefunds, refundSyncInterval, syncRefunds)
+}
+
+// Handlers
+func refundPayment(c *gin.Context) {
+	var req RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var payment Payment
+	if err := db.First(&payment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Платёж не найден",
+		})
+		return
+	}
+
+	refund, err := issueRefund(c.Request.Context(), payment.ID, req.Amount, req.Reason)
+	if errors.Is(err, errNothingToRefund) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Платёж нельзя вернуть",
+		})
+		return
+	}
+	if errors.Is(err, errRefundExceedsAvailable) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Сумма возврата превышает доступную",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Refund of payment %d failed: %v", payment.ID, err)
+		c.JSON(http.StatusBadGateway, ApiResponse{
+			Success: false,
+			Data:    refund,
+			Error:   "Не удалось выполнить возврат",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    refund,
+	})
+}
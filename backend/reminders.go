@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reminder statuses
+const (
+	ReminderStatusPending   = "pending"
+	ReminderStatusSent      = "sent"
+	ReminderStatusCancelled = "cancelled"
+	ReminderStatusExpired   = "expired" // too late to go out, or the session started
+)
+
+// SessionReminder is one reminder to one party of a confirmed session. It
+// is keyed by the start time it refers to, so a reminder that went out is
+// never sent again, and a rescheduled session gets reminders of its own.
+type SessionReminder struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	SessionID     uint       `json:"session_id" gorm:"not null;uniqueIndex:idx_session_reminder"`
+	Recipient     string     `json:"recipient" gorm:"not null;uniqueIndex:idx_session_reminder"` // client or therapist
+	OffsetMinutes int        `json:"offset_minutes" gorm:"not null;uniqueIndex:idx_session_reminder"`
+	StartTime     time.Time  `json:"start_time" gorm:"not null;uniqueIndex:idx_session_reminder"`
+	SendAt        time.Time  `json:"send_at" gorm:"not null;index"`
+	Status        string     `json:"status" gorm:"default:pending;index"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// reminderOffsets returns how long before a session reminders go out, from
+// SESSION_REMINDER_OFFSETS like "24h,1h"
+func reminderOffsets() []time.Duration {
+	var offsets []time.Duration
+	for _, value := range strings.Split(getEnv("SESSION_REMINDER_OFFSETS", "24h,1h"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		offset, err := time.ParseDuration(value)
+		if err != nil || offset <= 0 {
+			log.Printf("Ignoring session reminder offset %q", value)
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets
+}
+
+// scheduleSessionReminders plans the reminders of a confirmed session and
+// cancels those left from an earlier start time. Offsets that are already
+// past are not planned.
+func scheduleSessionReminders(tx *gorm.DB, session *Session) error {
+	if err := tx.Model(&SessionReminder{}).
+		Where("session_id = ? AND status = ? AND start_time <> ?", session.ID, ReminderStatusPending, session.StartTime).
+		Update("status", ReminderStatusCancelled).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, offset := range reminderOffsets() {
+		sendAt := session.StartTime.Add(-offset)
+		if !sendAt.After(now) {
+			continue
+		}
+		for _, recipient := range []string{"client", "therapist"} {
+			reminder := SessionReminder{
+				SessionID:     session.ID,
+				Recipient:     recipient,
+				OffsetMinutes: int(offset / time.Minute),
+				StartTime:     session.StartTime,
+				SendAt:        sendAt,
+				Status:        ReminderStatusPending,
+			}
+			// A reminder cancelled earlier for the same start time comes
+			// back, one that was sent stays sent
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "session_id"}, {Name: "recipient"}, {Name: "offset_minutes"}, {Name: "start_time"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{"status": ReminderStatusPending, "updated_at": now}),
+				Where: clause.Where{Exprs: []clause.Expression{
+					clause.Eq{Column: "session_reminders.status", Value: ReminderStatusCancelled},
+				}},
+			}).Create(&reminder).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cancelSessionReminders drops the pending reminders of the session
+func cancelSessionReminders(tx *gorm.DB, sessionID uint) error {
+	return tx.Model(&SessionReminder{}).
+		Where("session_id = ? AND status = ?", sessionID, ReminderStatusPending).
+		Update("status", ReminderStatusCancelled).Error
+}
+
+// formatReminderOffset is the offset for the message: "24 ч" or "30 мин"
+func formatReminderOffset(minutes int) string {
+	if minutes%60 == 0 {
+		return fmt.Sprintf("%d ч", minutes/60)
+	}
+	return fmt.Sprintf("%d мин", minutes)
+}
+
+// reminderTimeLeft is the time until the session for the message, in minutes,
+// rounded to hours from two hours on
+func reminderTimeLeft(start, now time.Time) int {
+	minutes := int(start.Sub(now).Round(time.Minute) / time.Minute)
+	if minutes >= 120 {
+		minutes = (minutes + 30) / 60 * 60
+	}
+	return max(minutes, 1)
+}
+
+// reminderTooLate reports whether the reminder is so far behind its send
+// time, after the workers were down, that it would only come with the next
+// one: more than a quarter of its offset
+func reminderTooLate(reminder *SessionReminder, now time.Time) bool {
+	offset := time.Duration(reminder.OffsetMinutes) * time.Minute
+	return now.Sub(reminder.SendAt) > offset/4
+}
+
+// sendReminder emits the reminder notification, or expires the reminder when
+// the session is no longer going to take place as planned or the reminder is
+// too late. The message tells the time actually left.
+func sendReminder(tx *gorm.DB, reminder *SessionReminder) error {
+	now := time.Now()
+	var session Session
+	err := tx.First(&session, reminder.SessionID).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		reminder.Status = ReminderStatusCancelled
+	case err != nil:
+		return err
+	case session.Status != SessionStatusConfirmed || !session.StartTime.Equal(reminder.StartTime):
+		reminder.Status = ReminderStatusCancelled
+	case !session.StartTime.After(now) || reminderTooLate(reminder, now):
+		reminder.Status = ReminderStatusExpired
+	}
+	if reminder.Status != ReminderStatusPending {
+		return tx.Save(reminder).Error
+	}
+
+	userID := session.ClientID
+	if reminder.Recipient == "therapist" {
+		userID = therapistUserID(tx, session.TherapistID)
+	}
+	if userID != 0 {
+		_, err := emitNotification(tx, NotificationInput{
+			UserID: userID,
+			Type:   NotificationSessionReminder,
+			Title:  "Напоминание о сессии",
+			Message: fmt.Sprintf("Сессия начнётся через %s, %s.",
+				formatReminderOffset(reminderTimeLeft(session.StartTime, now)), session.StartTime.In(time.Local).Format("02.01.2006 15:04")),
+			ActionURL:  fmt.Sprintf("/sessions/%d", session.ID),
+			ActionText: "Открыть сессию",
+			Data:       map[string]interface{}{"session_id": session.ID, "offset_minutes": reminder.OffsetMinutes},
+			ExpiresAt:  &session.StartTime,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	reminder.Status = ReminderStatusSent
+	reminder.SentAt = &now
+	return tx.Save(reminder).Error
+}
+
+// sendDueReminders sends due reminders. The notification and the sent
+// status are committed together on a row locked with SKIP LOCKED, so each
+// reminder goes out once however many replicas run the worker.
+func sendDueReminders() {
+	for {
+		var reminder SessionReminder
+		found := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("status = ? AND send_at <= ?", ReminderStatusPending, time.Now()).
+				Order("send_at, id").Limit(1).Find(&reminder)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			found = true
+			return sendReminder(tx, &reminder)
+		})
+		if err != nil {
+			log.Printf("Reminder worker: %v", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+func init() {
+	registerPeriodicJob(JobSendReminders, time.Minute, func(context.Context) { sendDueReminders() })
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SessionReschedule is the history of moved sessions
+type SessionReschedule struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	SessionID     uint      `json:"session_id" gorm:"not null;index"`
+	OldStartTime  time.Time `json:"old_start_time"`
+	NewStartTime  time.Time `json:"new_start_time"`
+	RescheduledBy string    `json:"rescheduled_by"` // client, therapist, system
+	Reason        string    `json:"reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type RescheduleRequest struct {
+	StartTime time.Time `json:"start_time" binding:"required"`
+	Reason    string    `json:"reason"`
+}
+
+var (
+	errRescheduleLimit  = errors.New("reschedule limit reached")
+	errRescheduleNotice = errors.New("reschedule notice period not respected")
+)
+
+// rescheduleSession moves the session to newStart in one transaction. The
+// therapist row is locked as for bookings, so the new slot cannot be taken
+// concurrently, and the old slot stays occupied until the move commits.
+func rescheduleSession(sessionID uint, newStart time.Time, by, reason string, enforceLimits bool) (*Session, error) {
+	var session Session
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var current Session
+		if err := tx.First(&current, sessionID).Error; err != nil {
+			return err
+		}
+		if _, err := lockTherapist(tx, current.TherapistID); err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, sessionID).Error; err != nil {
+			return err
+		}
+		if session.Status != SessionStatusScheduled && session.Status != SessionStatusConfirmed {
+			return errSessionNotCancellable
+		}
+
+		now := time.Now()
+		if enforceLimits {
+			policy := therapistCancellationPolicy(tx, session.TherapistID)
+			notice := time.Duration(policy.RescheduleNoticeHours) * time.Hour
+			if session.StartTime.Sub(now) < notice || newStart.Sub(now) < notice {
+				return errRescheduleNotice
+			}
+			if session.RescheduleCount >= policy.RescheduleLimit {
+				return errRescheduleLimit
+			}
+		} else if !newStart.After(now) {
+			return errRescheduleNotice
+		}
+
+		newEnd := newStart.Add(session.EndTime.Sub(session.StartTime))
+		if err := checkSlotFree(tx, session.TherapistID, newStart, newEnd, session.ID); err != nil {
+			return err
+		}
+
+		history := SessionReschedule{
+			SessionID:     session.ID,
+			OldStartTime:  session.StartTime,
+			NewStartTime:  newStart,
+			RescheduledBy: by,
+			Reason:        reason,
+		}
+		if err := tx.Create(&history).Error; err != nil {
+			return err
+		}
+
+		session.StartTime = newStart
+		session.EndTime = newEnd
+		session.RescheduleCount++
+		if err := tx.Save(&session).Error; err != nil {
+			return err
+		}
+		if err := recordSessionEvent(tx, EventSessionRescheduled, &session); err != nil {
+			return err
+		}
+		// Unpaid bookings get their reminders once confirmed
+		if session.Status == SessionStatusConfirmed {
+			return scheduleSessionReminders(tx, &session)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// notifySessionRescheduled tells the other party that the session was moved
+func notifySessionRescheduled(session *Session, by string) {
+	notifyOtherParties(db, session, NotificationSessionRescheduled, by)
+}
+
+// Handlers
+func rescheduleSessionHandler(c *gin.Context) {
+	var req RescheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	var session Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+
+	by := ""
+	switch sessionRole(c, &session) {
+	case "client":
+		by = CancelledByClient
+	case "therapist":
+		by = CancelledByTherapist
+	case "admin":
+		by = CancelledBySystem
+	default:
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+
+	// Admins move sessions regardless of the therapist limits
+	updated, err := rescheduleSession(session.ID, req.StartTime, by, req.Reason, by != CancelledBySystem)
+	switch {
+	case errors.Is(err, errSessionNotCancellable):
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Сессию нельзя перенести в текущем статусе",
+		})
+		return
+	case errors.Is(err, errRescheduleNotice):
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Перенос возможен не позднее установленного срока до начала сессии",
+		})
+		return
+	case errors.Is(err, errRescheduleLimit):
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Достигнут лимит переносов для этой сессии",
+		})
+		return
+	case errors.Is(err, errSlotTaken):
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Это время уже занято",
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при переносе сессии",
+		})
+		return
+	}
+
+	notifySessionRescheduled(updated, by)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    updated,
+	})
+}
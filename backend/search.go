@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Search result and suggestion types
+type SearchSuggestion struct {
+	Type        string `json:"type"` // therapist, specialization, approach
+	Value       string `json:"value"`
+	TherapistID uint   `json:"therapist_id,omitempty"`
+}
+
+// The search vector lives in its own column maintained by
+// refreshSearchVectors: therapist names come from the users table, so a
+// generated column cannot be used. Weights: name and specialization A,
+// approach B, bio C.
+const searchVectorSQL = `
+	setweight(to_tsvector('russian', coalesce(u.name, '')), 'A') ||
+	setweight(to_tsvector('russian', coalesce(therapists.specialization, '')), 'A') ||
+	setweight(to_tsvector('russian', coalesce(therapists.approach, '')), 'B') ||
+	setweight(to_tsvector('russian', coalesce(therapists.bio, '')), 'C')`
+
+// Both the stemmed query and the prefix query are OR-ed: the Russian stemmer
+// alone maps "тревога" and "тревожные" to different lexemes.
+const searchQuerySQL = "(websearch_to_tsquery('russian', @q) || to_tsquery('simple', @prefix))"
+
+func initSearch() {
+	statements := []string{
+		"ALTER TABLE therapists ADD COLUMN IF NOT EXISTS search_vector tsvector",
+		"CREATE INDEX IF NOT EXISTS idx_therapists_search_vector ON therapists USING GIN (search_vector)",
+	}
+	for _, stmt := range statements {
+		if err := db.Exec(stmt).Error; err != nil {
+			log.Printf("Failed to prepare search index: %v", err)
+			return
+		}
+	}
+
+	if err := refreshSearchVectors(db, "therapists.search_vector IS NULL"); err != nil {
+		log.Printf("Failed to build search vectors: %v", err)
+	}
+}
+
+// refreshSearchVectors recalculates search_vector for therapists matching the condition
+func refreshSearchVectors(tx *gorm.DB, condition string, args ...interface{}) error {
+	sql := "UPDATE therapists SET search_vector = " + searchVectorSQL +
+		" FROM users u WHERE u.id = therapists.user_id"
+	if condition != "" {
+		sql += " AND " + condition
+	}
+	return tx.Exec(sql, args...).Error
+}
+
+// Keep search vectors in sync with therapist and user changes
+func (t *Therapist) AfterSave(tx *gorm.DB) error {
+	return refreshSearchVectors(tx.Session(&gorm.Session{NewDB: true}), "therapists.id = ?", t.ID)
+}
+
+func (u *User) AfterUpdate(tx *gorm.DB) error {
+	if u.Role != "therapist" {
+		return nil
+	}
+	return refreshSearchVectors(tx.Session(&gorm.Session{NewDB: true}), "therapists.user_id = ?", u.ID)
+}
+
+// searchPrefixQuery builds a to_tsquery('simple') expression of word prefixes,
+// trimming endings so that different word forms share a prefix.
+func searchPrefixQuery(search string) string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(search), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		n := utf8.RuneCountInString(word)
+		if n < 2 {
+			continue
+		}
+		keep := n
+		if n > 5 {
+			keep = n - 3
+			if keep < 4 {
+				keep = 4
+			}
+		}
+		terms = append(terms, string([]rune(word)[:keep])+":*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// applyTherapistSearch filters the therapist query by full-text search.
+// It reports false when the search string has no searchable words.
+func applyTherapistSearch(query *gorm.DB, search string) (*gorm.DB, bool) {
+	prefix := searchPrefixQuery(search)
+	if prefix == "" {
+		return query, false
+	}
+	args := map[string]interface{}{"q": search, "prefix": prefix}
+	return query.Where("therapists.search_vector @@ "+searchQuerySQL, args), true
+}
+
+// selectSearchRank adds rank and highlighted snippet columns to the query
+func selectSearchRank(query *gorm.DB, search string) *gorm.DB {
+	args := map[string]interface{}{"q": search, "prefix": searchPrefixQuery(search)}
+	return query.Select("therapists.*, "+
+		"ts_rank(therapists.search_vector, "+searchQuerySQL+") AS search_rank, "+
+		"ts_headline('russian', therapists.specialization || '. ' || therapists.approach || '. ' || therapists.bio, "+
+		searchQuerySQL+", 'StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2') AS search_snippet",
+		args)
+}
+
+// searchRankKey is the keyset column for ordering by relevance
+func searchRankKey(search string) sortKey {
+	return sortKey{
+		Column: "ts_rank(therapists.search_vector, (websearch_to_tsquery('russian', ?) || to_tsquery('simple', ?)))",
+		Args:   []interface{}{search, searchPrefixQuery(search)},
+		Desc:   true,
+	}
+}
+
+// escapeLike escapes LIKE wildcards in user input
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Handlers
+func suggestTherapists(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if utf8.RuneCountInString(q) < 2 {
+		c.JSON(http.StatusOK, ApiResponse{
+			Success: true,
+			Data:    []SearchSuggestion{},
+		})
+		return
+	}
+
+	const limit = 10
+	startsWith := escapeLike(q) + "%"
+	wordStartsWith := "% " + escapeLike(q) + "%"
+	suggestions := []SearchSuggestion{}
+
+	var names []struct {
+		ID   uint
+		Name string
+	}
+	db.Table("therapists").
+		Select("therapists.id, u.name").
+		Joins("JOIN users u ON u.id = therapists.user_id AND u.deleted_at IS NULL").
+		Where("u.name ILIKE ? OR u.name ILIKE ?", startsWith, wordStartsWith).
+		Order("u.name").Limit(limit).Scan(&names)
+	for _, n := range names {
+		suggestions = append(suggestions, SearchSuggestion{Type: "therapist", Value: n.Name, TherapistID: n.ID})
+	}
+
+	for _, field := range []string{"specialization", "approach"} {
+		var values []string
+		db.Model(&Therapist{}).
+			Distinct(field).
+			Where(field+" ILIKE ? OR "+field+" ILIKE ?", startsWith, wordStartsWith).
+			Order(field).Limit(limit).Pluck(field, &values)
+		for _, v := range values {
+			suggestions = append(suggestions, SearchSuggestion{Type: field, Value: v})
+		}
+	}
+
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    suggestions,
+	})
+}
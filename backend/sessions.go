@@ -0,0 +1,465 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Session statuses, as in the frontend SessionStatus type
+const (
+	SessionStatusScheduled  = "scheduled"
+	SessionStatusConfirmed  = "confirmed"
+	SessionStatusInProgress = "in_progress"
+	SessionStatusCompleted  = "completed"
+	SessionStatusCancelled  = "cancelled"
+	SessionStatusNoShow     = "no_show"
+)
+
+type BookingRequest struct {
+	TherapistID uint      `json:"therapist_id" binding:"required"`
+	StartTime   time.Time `json:"start_time" binding:"required"`
+	Type        string    `json:"type" binding:"omitempty,oneof=individual couple group"`
+	Duration    int       `json:"duration"` // minutes, defaults to 60
+	Notes       string    `json:"notes"`
+	Provider    string    `json:"provider"`
+	ReturnURL   string    `json:"return_url"`
+	PromoCode   string    `json:"promo_code"`
+	UseBalance  bool      `json:"use_balance"` // pay what the balance covers from it
+
+	SlidingScale bool `json:"sliding_scale"` // book a reduced-fee slot
+	QuotedPrice  int  `json:"quoted_price"`  // charge from the quote, in kopecks; booking fails if it changed
+}
+
+// BookingResponse has the payment to complete, unless a package credit or
+// the client balance paid the session
+type BookingResponse struct {
+	Session       Session        `json:"session"`
+	Payment       *Payment       `json:"payment,omitempty"`
+	ClientPackage *ClientPackage `json:"client_package,omitempty"`
+}
+
+var (
+	errSlotTaken             = errors.New("slot is already taken")
+	errSessionNotCompletable = errors.New("session cannot be completed")
+)
+
+// lockTherapist locks the therapist row so that bookings of the same
+// therapist are serialized
+func lockTherapist(tx *gorm.DB, therapistID uint) (*Therapist, error) {
+	var therapist Therapist
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&therapist, therapistID).Error; err != nil {
+		return nil, err
+	}
+	return &therapist, nil
+}
+
+// checkSlotFree fails with errSlotTaken if the therapist has an active
+// session overlapping [start, end), ignoring the session excludeID
+func checkSlotFree(tx *gorm.DB, therapistID uint, start, end time.Time, excludeID uint) error {
+	var count int64
+	query := tx.Model(&Session{}).
+		Where("therapist_id = ? AND status NOT IN ?", therapistID, []string{SessionStatusCancelled, SessionStatusNoShow}).
+		Where("start_time < ? AND end_time > ?", end, start)
+	if excludeID != 0 {
+		query = query.Where("id <> ?", excludeID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errSlotTaken
+	}
+	return nil
+}
+
+func sessionReturnURL(sessionID uint) string {
+	return fmt.Sprintf("%s/sessions/%d", getEnv("FRONTEND_URL", "http://localhost:3000"), sessionID)
+}
+
+// Handlers
+func bookSession(c *gin.Context) {
+	var req BookingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	if req.Type == "" {
+		req.Type = "individual"
+	}
+	if req.Duration == 0 {
+		req.Duration = 60
+	}
+	if req.Duration < 30 || req.Duration > 180 {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Длительность сессии должна быть от 30 до 180 минут",
+		})
+		return
+	}
+	if !req.StartTime.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Нельзя записаться на прошедшее время",
+		})
+		return
+	}
+	if _, ok := paymentProvider(req.Provider); !ok {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неизвестный платёжный провайдер",
+		})
+		return
+	}
+
+	clientID := c.GetUint("user_id")
+	var session Session
+	var payment Payment
+	var clientPackage *ClientPackage
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		therapist, err := lockTherapist(tx, req.TherapistID)
+		if err != nil {
+			return err
+		}
+
+		start := req.StartTime
+		end := start.Add(time.Duration(req.Duration) * time.Minute)
+		if err := checkSlotFree(tx, therapist.ID, start, end, 0); err != nil {
+			return err
+		}
+
+		quote, err := quotePrice(tx, therapist, req.Type, req.Duration, start, req.SlidingScale)
+		if err != nil {
+			return err
+		}
+		if req.QuotedPrice != 0 && req.QuotedPrice != quote.Charge.Amount {
+			return errQuotedPriceChanged
+		}
+
+		session = Session{
+			ClientID:     clientID,
+			TherapistID:  therapist.ID,
+			StartTime:    start,
+			EndTime:      end,
+			Status:       SessionStatusScheduled,
+			Type:         req.Type,
+			Duration:     req.Duration,
+			Notes:        req.Notes,
+			Price:        quote.Charge.Amount,
+			Currency:     quote.Charge.Currency,
+			SlidingScale: req.SlidingScale,
+		}
+		if quote.Currency != settlementCurrency {
+			session.ListPrice = quote.Price
+			session.ListCurrency = quote.Currency
+		}
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		if err := recordSessionEvent(tx, EventSessionBooked, &session); err != nil {
+			return err
+		}
+
+		// Prepaid credits are drawn down before charging
+		clientPackage, err = useCredit(tx, &session)
+		if err != nil || clientPackage != nil {
+			return err
+		}
+
+		if req.PromoCode != "" {
+			if err := redeemPromoCode(tx, req.PromoCode, &session); err != nil {
+				return err
+			}
+		}
+		if req.UseBalance {
+			if err := spendBalance(tx, &session); err != nil {
+				return err
+			}
+		}
+		if session.Price-session.BalanceUsed == 0 {
+			// Fully covered by the discount and the balance
+			session.Status = SessionStatusConfirmed
+			if err := tx.Save(&session).Error; err != nil {
+				return err
+			}
+			if err := recordSessionEvent(tx, EventSessionConfirmed, &session); err != nil {
+				return err
+			}
+			return scheduleSessionReminders(tx, &session)
+		}
+
+		payment = Payment{
+			SessionID:   &session.ID,
+			UserID:      clientID,
+			Amount:      session.Price - session.BalanceUsed,
+			Currency:    session.Currency,
+			Status:      PaymentStatusPending,
+			Provider:    req.Provider,
+			Description: fmt.Sprintf("Сессия №%d, %s", session.ID, start.Format("02.01.2006 15:04")),
+		}
+		if payment.Provider == "" {
+			payment.Provider = defaultPaymentProvider
+		}
+		return tx.Create(&payment).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Therapist not found",
+		})
+		return
+	}
+	if errors.Is(err, errSlotTaken) {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Это время уже занято",
+		})
+		return
+	}
+	if errors.Is(err, errQuotedPriceChanged) {
+		message, _ := priceErrorMessage(err)
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   message,
+		})
+		return
+	}
+	if message, ok := priceErrorMessage(err); ok {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   message,
+		})
+		return
+	}
+	if message, ok := promoErrorMessage(err); ok {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   message,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при записи на сессию",
+		})
+		return
+	}
+
+	if clientPackage != nil || payment.ID == 0 {
+		notifySession(db, &session, NotificationSessionConfirmed, "client")
+		notifySession(db, &session, NotificationSessionBooked, "therapist")
+		c.JSON(http.StatusCreated, ApiResponse{
+			Success: true,
+			Data: BookingResponse{
+				Session:       session,
+				ClientPackage: clientPackage,
+			},
+		})
+		return
+	}
+
+	// The provider is called outside the transaction, a failure releases the slot
+	returnURL := req.ReturnURL
+	if returnURL == "" {
+		returnURL = sessionReturnURL(session.ID)
+	}
+	if err := startPayment(c.Request.Context(), &payment, returnURL); err != nil {
+		log.Printf("Failed to start payment %d: %v", payment.ID, err)
+		c.JSON(http.StatusBadGateway, ApiResponse{
+			Success: false,
+			Error:   "Платёжная система недоступна, попробуйте позже",
+		})
+		return
+	}
+
+	db.First(&session, session.ID)
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data: BookingResponse{
+			Session: session,
+			Payment: &payment,
+		},
+	})
+}
+
+// completeSession marks a held session as completed. The first completed
+// session of an invited client rewards the referral.
+func completeSession(c *gin.Context) {
+	var session Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Сессия не найдена",
+		})
+		return
+	}
+	if role := sessionRole(c, &session); role != "therapist" && role != "admin" {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Недостаточно прав",
+		})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, session.ID).Error; err != nil {
+			return err
+		}
+		if (session.Status != SessionStatusConfirmed && session.Status != SessionStatusInProgress) ||
+			session.StartTime.After(time.Now()) {
+			return errSessionNotCompletable
+		}
+		session.Status = SessionStatusCompleted
+		if err := tx.Save(&session).Error; err != nil {
+			return err
+		}
+		if err := recordSessionEvent(tx, EventSessionCompleted, &session); err != nil {
+			return err
+		}
+		return rewardReferral(tx, &session)
+	})
+	if err == nil {
+		notifySession(db, &session, NotificationSessionCompleted, "client")
+	}
+	if errors.Is(err, errSessionNotCompletable) {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Завершить можно только подтверждённую сессию после её начала",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при завершении сессии",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    session,
+	})
+}
+
+// Session statuses of sessions still to be held
+var sessionActiveStatuses = []string{SessionStatusScheduled, SessionStatusConfirmed, SessionStatusInProgress}
+
+// Keyset orderings of the upcoming and past sessions
+var (
+	upcomingSessionKeys = []sortKey{{Column: "sessions.start_time"}, {Column: "sessions.id"}}
+	pastSessionKeys     = []sortKey{{Column: "sessions.start_time", Desc: true}, {Column: "sessions.id", Desc: true}}
+)
+
+// userSessions restricts the query to the sessions the user takes part in,
+// as the client or as the therapist. Admins see every session.
+func userSessions(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if c.GetString("user_role") == "admin" {
+		return query
+	}
+	userID := c.GetUint("user_id")
+	return query.Where("sessions.client_id = ? OR sessions.therapist_id IN (SELECT id FROM therapists WHERE user_id = ?)",
+		userID, userID)
+}
+
+// listSessionsByStart responds with a page of sessions ordered by start time
+func listSessionsByStart(c *gin.Context, query *gorm.DB, sortName string, keys []sortKey) {
+	limit := cursorLimit(c, 20, 100)
+	if cursor := c.Query("cursor"); cursor != "" {
+		values, err := decodeCursor(cursor, sortName, len(keys))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Неверный курсор",
+			})
+			return
+		}
+		query = keysetAfter(query, keys, values)
+	}
+
+	var sessions []Session
+	if err := keysetOrder(query, keys).Limit(limit + 1).Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке сессий",
+		})
+		return
+	}
+
+	meta := CursorMeta{}
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+		last := sessions[limit-1]
+		meta = CursorMeta{
+			NextCursor: encodeCursor(sortName, []interface{}{last.StartTime, last.ID}),
+			HasMore:    true,
+		}
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    sessions,
+		Meta:    meta,
+	})
+}
+
+// getSessions lists the sessions of the user, newest booking first
+func getSessions(c *gin.Context) {
+	limit := cursorLimit(c, 20, 100)
+	query := userSessions(c, db.Model(&Session{}))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("sessions.status = ?", status)
+	}
+
+	query, err := paginateByID(query, c, "sessions", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var sessions []Session
+	if err := query.Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке сессий",
+		})
+		return
+	}
+
+	sessions, meta := pageByID(sessions, limit, func(s Session) uint { return s.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    sessions,
+		Meta:    meta,
+	})
+}
+
+// getUpcomingSessions lists the sessions still to be held, soonest first
+func getUpcomingSessions(c *gin.Context) {
+	query := userSessions(c, db.Model(&Session{})).
+		Where("sessions.status IN ? AND sessions.end_time > ?", sessionActiveStatuses, time.Now())
+	listSessionsByStart(c, query, "upcoming", upcomingSessionKeys)
+}
+
+// getSessionHistory lists the sessions that are over, latest first
+func getSessionHistory(c *gin.Context) {
+	query := userSessions(c, db.Model(&Session{})).
+		Where("sessions.status NOT IN ? OR sessions.end_time <= ?", sessionActiveStatuses, time.Now())
+	listSessionsByStart(c, query, "history", pastSessionKeys)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Taxonomy vocabularies
+const (
+	VocabularyLanguage       = "language"
+	VocabularySpecialization = "specialization"
+	VocabularyApproach       = "approach"
+	VocabularyIssue          = "issue"
+)
+
+var vocabularies = []string{VocabularyLanguage, VocabularySpecialization, VocabularyApproach, VocabularyIssue}
+
+// vocabularyParams maps vocabularies to the multi-value filter parameters of getTherapists
+var vocabularyParams = map[string]string{
+	VocabularyLanguage:       "languages",
+	VocabularySpecialization: "specializations",
+	VocabularyApproach:       "approaches",
+	VocabularyIssue:          "issues",
+}
+
+type TaxonomyTerm struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	Vocabulary string    `json:"vocabulary" gorm:"not null;uniqueIndex:idx_taxonomy_vocabulary_slug"`
+	Slug       string    `json:"slug" gorm:"not null;uniqueIndex:idx_taxonomy_vocabulary_slug"`
+	Name       string    `json:"name" gorm:"not null"`
+	SortOrder  int       `json:"sort_order"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type TaxonomyTermRequest struct {
+	Name      string `json:"name" binding:"required"`
+	Slug      string `json:"slug"`
+	SortOrder int    `json:"sort_order"`
+}
+
+// TherapistTermsRequest replaces therapist terms, values are term slugs
+type TherapistTermsRequest struct {
+	Languages       []string `json:"languages"`
+	Specializations []string `json:"specializations"`
+	Approaches      []string `json:"approaches"`
+	Issues          []string `json:"issues"`
+}
+
+type FacetCount struct {
+	Slug  string `json:"slug"`
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+func isVocabulary(v string) bool {
+	for _, vocabulary := range vocabularies {
+		if v == vocabulary {
+			return true
+		}
+	}
+	return false
+}
+
+var translit = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "h", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "sch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g",
+}
+
+// slugify transliterates Cyrillic and keeps latin letters, digits and dashes
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(s)) {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case translit[r] != "" || r == 'ъ' || r == 'ь':
+			b.WriteString(translit[r])
+			dash = false
+		default:
+			if !dash && b.Len() > 0 {
+				b.WriteByte('-')
+				dash = true
+			}
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// Seeding and backfill
+func seedTaxonomy() {
+	defaults := []TaxonomyTerm{
+		{Vocabulary: VocabularyLanguage, Slug: "ru", Name: "Русский", SortOrder: 1},
+		{Vocabulary: VocabularyLanguage, Slug: "en", Name: "Английский", SortOrder: 2},
+		{Vocabulary: VocabularyLanguage, Slug: "uk", Name: "Украинский", SortOrder: 3},
+		{Vocabulary: VocabularyIssue, Slug: "anxiety", Name: "Тревога и панические атаки"},
+		{Vocabulary: VocabularyIssue, Slug: "depression", Name: "Депрессия и выгорание"},
+		{Vocabulary: VocabularyIssue, Slug: "relationships", Name: "Отношения"},
+		{Vocabulary: VocabularyIssue, Slug: "family", Name: "Семейные конфликты"},
+		{Vocabulary: VocabularyIssue, Slug: "children", Name: "Дети и подростки"},
+		{Vocabulary: VocabularyIssue, Slug: "addiction", Name: "Зависимости"},
+		{Vocabulary: VocabularyIssue, Slug: "trauma", Name: "Травма и ПТСР"},
+		{Vocabulary: VocabularyIssue, Slug: "self_esteem", Name: "Самооценка"},
+		{Vocabulary: VocabularyIssue, Slug: "grief", Name: "Утрата и горе"},
+	}
+	for _, term := range defaults {
+		db.Where(TaxonomyTerm{Vocabulary: term.Vocabulary, Slug: term.Slug}).FirstOrCreate(&term)
+	}
+
+	backfillTherapistTerms()
+}
+
+// backfillTherapistTerms builds terms from the legacy free-text fields of
+// therapists that have no terms yet
+func backfillTherapistTerms() {
+	var therapists []Therapist
+	db.Where("NOT EXISTS (SELECT 1 FROM therapist_terms tt WHERE tt.therapist_id = therapists.id)").
+		Find(&therapists)
+
+	var issues []TaxonomyTerm
+	db.Where("vocabulary = ?", VocabularyIssue).Find(&issues)
+
+	for _, t := range therapists {
+		var terms []TaxonomyTerm
+		for _, name := range parseLanguages(t) {
+			terms = append(terms, findOrCreateTerm(VocabularyLanguage, name))
+		}
+		if t.Specialization != "" {
+			terms = append(terms, findOrCreateTerm(VocabularySpecialization, t.Specialization))
+		}
+		if t.Approach != "" {
+			terms = append(terms, findOrCreateTerm(VocabularyApproach, t.Approach))
+		}
+
+		// Infer issues treated from the specialization and bio
+		text := strings.ToLower(t.Specialization + " " + t.Bio)
+		for _, issue := range issues {
+			for _, stem := range concernKeywords[issue.Slug] {
+				if strings.Contains(text, stem) {
+					terms = append(terms, issue)
+					break
+				}
+			}
+		}
+
+		if err := db.Model(&t).Association("Terms").Replace(terms); err != nil {
+			log.Printf("Failed to backfill terms for therapist %d: %v", t.ID, err)
+		}
+	}
+}
+
+// isUniqueViolation reports whether the database rejected a duplicate key
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// uniqueStrings drops repeated values, keeping the order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := values[:0:0]
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+func findOrCreateTerm(vocabulary, name string) TaxonomyTerm {
+	var term TaxonomyTerm
+	if err := db.Where("vocabulary = ? AND lower(name) = lower(?)", vocabulary, name).First(&term).Error; err == nil {
+		return term
+	}
+	term = TaxonomyTerm{Vocabulary: vocabulary, Slug: slugify(name), Name: name}
+	db.Where(TaxonomyTerm{Vocabulary: vocabulary, Slug: term.Slug}).FirstOrCreate(&term)
+	return term
+}
+
+// syncLegacyTaxonomyFields keeps the free-text Languages, Specialization and
+// Approach columns used by older clients in line with the therapist terms
+func syncLegacyTaxonomyFields(tx *gorm.DB, therapistID uint) error {
+	var therapist Therapist
+	if err := tx.Preload("Terms", func(db *gorm.DB) *gorm.DB {
+		return db.Order("sort_order, name")
+	}).First(&therapist, therapistID).Error; err != nil {
+		return err
+	}
+
+	languages := []string{}
+	var specializations, approaches []string
+	for _, term := range therapist.Terms {
+		switch term.Vocabulary {
+		case VocabularyLanguage:
+			languages = append(languages, term.Name)
+		case VocabularySpecialization:
+			specializations = append(specializations, term.Name)
+		case VocabularyApproach:
+			approaches = append(approaches, term.Name)
+		}
+	}
+
+	languagesJSON, _ := json.Marshal(languages)
+	return tx.Model(&therapist).Updates(map[string]interface{}{
+		"languages":      string(languagesJSON),
+		"specialization": strings.Join(specializations, ", "),
+		"approach":       strings.Join(approaches, ", "),
+	}).Error
+}
+
+// Catalog helpers
+
+// queryList reads a multi-value query parameter given either as repeated
+// keys (?languages=ru&languages=en) or comma-separated (?languages=ru,en)
+func queryList(c *gin.Context, key string) []string {
+	var values []string
+	for _, raw := range append(c.QueryArray(key), c.QueryArray(key+"[]")...) {
+		for _, v := range strings.Split(raw, ",") {
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// filterByTerms keeps therapists having any of the given terms, matched by slug or name
+func filterByTerms(vocabulary string, values []string) func(*gorm.DB) *gorm.DB {
+	return func(query *gorm.DB) *gorm.DB {
+		return query.Where(`therapists.id IN (
+			SELECT tt.therapist_id FROM therapist_terms tt
+			JOIN taxonomy_terms t ON t.id = tt.taxonomy_term_id
+			WHERE t.vocabulary = ? AND (t.slug IN ? OR lower(t.name) IN ?))`,
+			vocabulary, values, values)
+	}
+}
+
+// therapistFacetCounts counts therapists per term of the vocabulary among the filtered therapists
+func therapistFacetCounts(vocabulary string, filtered *gorm.DB) []FacetCount {
+	counts := []FacetCount{}
+	db.Table("taxonomy_terms t").
+		Select("t.slug, t.name, COUNT(DISTINCT tt.therapist_id) AS count").
+		Joins("JOIN therapist_terms tt ON tt.taxonomy_term_id = t.id").
+		Where("t.vocabulary = ? AND tt.therapist_id IN (?)", vocabulary, filtered.Select("therapists.id")).
+		Group("t.id, t.slug, t.name, t.sort_order").
+		Order("t.sort_order, t.name").
+		Scan(&counts)
+	return counts
+}
+
+// Handlers
+func getTaxonomies(c *gin.Context) {
+	query := db.Order("vocabulary, sort_order, name")
+	if vocabulary := c.Param("vocabulary"); vocabulary != "" {
+		if !isVocabulary(vocabulary) {
+			c.JSON(http.StatusNotFound, ApiResponse{
+				Success: false,
+				Error:   "Справочник не найден",
+			})
+			return
+		}
+		query = query.Where("vocabulary = ?", vocabulary)
+	}
+
+	var terms []TaxonomyTerm
+	if err := query.Find(&terms).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке справочников",
+		})
+		return
+	}
+
+	grouped := map[string][]TaxonomyTerm{}
+	for _, term := range terms {
+		grouped[term.Vocabulary] = append(grouped[term.Vocabulary], term)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    grouped,
+	})
+}
+
+func createTaxonomyTerm(c *gin.Context) {
+	vocabulary := c.Param("vocabulary")
+	if !isVocabulary(vocabulary) {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Справочник не найден",
+		})
+		return
+	}
+
+	var req TaxonomyTermRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	term := TaxonomyTerm{
+		Vocabulary: vocabulary,
+		Slug:       slugify(req.Slug),
+		Name:       strings.TrimSpace(req.Name),
+		SortOrder:  req.SortOrder,
+	}
+	if term.Slug == "" {
+		term.Slug = slugify(req.Name)
+	}
+
+	var count int64
+	db.Model(&TaxonomyTerm{}).Where("vocabulary = ? AND slug = ?", vocabulary, term.Slug).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Термин с таким slug уже существует",
+		})
+		return
+	}
+
+	if err := db.Create(&term).Error; err != nil {
+		if isUniqueViolation(err) {
+			c.JSON(http.StatusConflict, ApiResponse{
+				Success: false,
+				Error:   "Термин с таким slug уже существует",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при создании термина",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Data:    term,
+	})
+}
+
+func updateTaxonomyTerm(c *gin.Context) {
+	var term TaxonomyTerm
+	if err := db.Where("vocabulary = ?", c.Param("vocabulary")).First(&term, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Термин не найден",
+		})
+		return
+	}
+
+	var req TaxonomyTermRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	term.Name = strings.TrimSpace(req.Name)
+	term.SortOrder = req.SortOrder
+	if slug := slugify(req.Slug); slug != "" {
+		term.Slug = slug
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&term).Error; err != nil {
+			return err
+		}
+		return resyncTherapistsWithTerm(tx, term.ID)
+	})
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Термин с таким slug уже существует",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при обновлении термина",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    term,
+	})
+}
+
+func deleteTaxonomyTerm(c *gin.Context) {
+	var term TaxonomyTerm
+	if err := db.Where("vocabulary = ?", c.Param("vocabulary")).First(&term, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Термин не найден",
+		})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var therapistIDs []uint
+		tx.Table("therapist_terms").Where("taxonomy_term_id = ?", term.ID).Pluck("therapist_id", &therapistIDs)
+
+		if err := tx.Exec("DELETE FROM therapist_terms WHERE taxonomy_term_id = ?", term.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&term).Error; err != nil {
+			return err
+		}
+		for _, id := range therapistIDs {
+			if err := syncLegacyTaxonomyFields(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при удалении термина",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data: gin.H{
+			"message": "Термин удалён",
+		},
+	})
+}
+
+func resyncTherapistsWithTerm(tx *gorm.DB, termID uint) error {
+	var therapistIDs []uint
+	tx.Table("therapist_terms").Where("taxonomy_term_id = ?", termID).Pluck("therapist_id", &therapistIDs)
+	for _, id := range therapistIDs {
+		if err := syncLegacyTaxonomyFields(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateTherapistTerms(c *gin.Context) {
+	var therapist Therapist
+	if err := db.First(&therapist, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Therapist not found",
+		})
+		return
+	}
+
+	// Therapists may edit only their own profile
+	if c.GetString("user_role") != "admin" && therapist.UserID != c.GetUint("user_id") {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Недостаточно прав",
+		})
+		return
+	}
+
+	var req TherapistTermsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверные данные: " + err.Error(),
+		})
+		return
+	}
+
+	requested := map[string][]string{
+		VocabularyLanguage:       req.Languages,
+		VocabularySpecialization: req.Specializations,
+		VocabularyApproach:       req.Approaches,
+		VocabularyIssue:          req.Issues,
+	}
+
+	var terms []TaxonomyTerm
+	for vocabulary, slugs := range requested {
+		slugs = uniqueStrings(slugs)
+		if len(slugs) == 0 {
+			continue
+		}
+		var found []TaxonomyTerm
+		db.Where("vocabulary = ? AND slug IN ?", vocabulary, slugs).Find(&found)
+		if len(found) != len(slugs) {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Неизвестные значения в справочнике " + vocabulary,
+			})
+			return
+		}
+		terms = append(terms, found...)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&therapist).Association("Terms").Replace(terms); err != nil {
+			return err
+		}
+		return syncLegacyTaxonomyFields(tx, therapist.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при сохранении профиля",
+		})
+		return
+	}
+
+	db.Preload("User").Preload("Terms").First(&therapist, therapist.ID)
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    therapist,
+	})
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WebhookProvider is implemented by payment providers that send callbacks
+type WebhookProvider interface {
+	VerifyWebhook(r *http.Request, clientIP string, body []byte) error
+	ParseWebhook(body []byte) (*PaymentWebhookEvent, error)
+}
+
+// PaymentWebhookEvent is a provider callback mapped onto our statuses.
+// Status is empty for events we do not act upon.
+type PaymentWebhookEvent struct {
+	EventID           string
+	Type              string
+	ProviderPaymentID string
+	Status            string
+	FailureReason     string
+}
+
+// Webhook inbox statuses
+const (
+	WebhookStatusReceived  = "received"
+	WebhookStatusProcessed = "processed"
+	WebhookStatusFailed    = "failed"
+	WebhookStatusIgnored   = "ignored"
+)
+
+// WebhookEvent is the inbox of provider callbacks. Every verified callback is
+// stored once per provider event ID, failed ones can be replayed.
+type WebhookEvent struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	Provider          string     `json:"provider" gorm:"not null;uniqueIndex:idx_webhook_provider_event"`
+	EventID           string     `json:"event_id" gorm:"not null;uniqueIndex:idx_webhook_provider_event"`
+	EventType         string     `json:"event_type"`
+	ProviderPaymentID string     `json:"provider_payment_id" gorm:"index"`
+	Payload           string     `json:"payload" gorm:"type:text"`
+	Status            string     `json:"status" gorm:"default:received;index"`
+	Attempts          int        `json:"attempts"`
+	LastError         string     `json:"last_error,omitempty"`
+	ProcessedAt       *time.Time `json:"processed_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+var errWebhookSignature = errors.New("invalid webhook signature")
+
+// YooKassa does not sign notifications, they are accepted only from its networks
+// (https://yookassa.ru/developers/using-api/webhooks#ip)
+var defaultYooKassaWebhookIPs = "185.71.76.0/27,185.71.77.0/27,77.75.153.0/25,77.75.156.11/32,77.75.156.35/32,77.75.154.128/25,2a02:5180::/32"
+
+func parseCIDRList(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, ipNet)
+		} else {
+			log.Printf("Invalid CIDR in webhook allowlist: %s", cidr)
+		}
+	}
+	return nets
+}
+
+func (p *YooKassaProvider) VerifyWebhook(r *http.Request, clientIP string, body []byte) error {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return errWebhookSignature
+	}
+	for _, ipNet := range p.WebhookIPs {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return errWebhookSignature
+}
+
+func (p *YooKassaProvider) ParseWebhook(body []byte) (*PaymentWebhookEvent, error) {
+	var notification struct {
+		Event  string          `json:"event"`
+		Object yooKassaPayment `json:"object"`
+	}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, err
+	}
+	if notification.Object.ID == "" {
+		return nil, errors.New("yookassa notification without object id")
+	}
+
+	// Notifications carry no ID of their own, an object changes status once per event
+	event := &PaymentWebhookEvent{
+		EventID:           notification.Event + ":" + notification.Object.ID,
+		Type:              notification.Event,
+		ProviderPaymentID: notification.Object.ID,
+	}
+	if strings.HasPrefix(notification.Event, "payment.") {
+		mapped := p.mapPayment(notification.Object)
+		event.Status = mapped.Status
+		event.FailureReason = mapped.FailureReason
+	}
+	return event, nil
+}
+
+// Stripe signs the payload with HMAC-SHA256 in the Stripe-Signature header
+// (https://stripe.com/docs/webhooks#verify-manually)
+const stripeSignatureTolerance = 5 * time.Minute
+
+func (p *StripeProvider) VerifyWebhook(r *http.Request, clientIP string, body []byte) error {
+	if p.WebhookSecret == "" {
+		return errWebhookSignature
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)).Abs() > stripeSignatureTolerance {
+		return errWebhookSignature
+	}
+
+	expected := hmacSHA256Hex(p.WebhookSecret, timestamp+"."+string(body))
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return errWebhookSignature
+}
+
+func (p *StripeProvider) ParseWebhook(body []byte) (*PaymentWebhookEvent, error) {
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object stripePaymentIntent `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if event.ID == "" {
+		return nil, errors.New("stripe event without id")
+	}
+
+	result := &PaymentWebhookEvent{EventID: event.ID, Type: event.Type}
+	if strings.HasPrefix(event.Type, "payment_intent.") {
+		mapped := p.mapPayment(event.Data.Object)
+		result.ProviderPaymentID = mapped.ProviderPaymentID
+		result.Status = mapped.Status
+		result.FailureReason = mapped.FailureReason
+	}
+	return result, nil
+}
+
+// The fake provider signs callbacks like Stripe does, without a timestamp:
+// X-Webhook-Signature is the hex HMAC-SHA256 of the body
+func (p *FakeProvider) VerifyWebhook(r *http.Request, clientIP string, body []byte) error {
+	if p.WebhookSecret == "" {
+		return errWebhookSignature
+	}
+	if !hmac.Equal([]byte(r.Header.Get("X-Webhook-Signature")), []byte(hmacSHA256Hex(p.WebhookSecret, string(body)))) {
+		return errWebhookSignature
+	}
+	return nil
+}
+
+func (p *FakeProvider) ParseWebhook(body []byte) (*PaymentWebhookEvent, error) {
+	var event struct {
+		ID            string `json:"id"`
+		Type          string `json:"type"`
+		PaymentID     string `json:"payment_id"`
+		Status        string `json:"status"`
+		FailureReason string `json:"failure_reason"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if event.ID == "" {
+		return nil, errors.New("fake event without id")
+	}
+	return &PaymentWebhookEvent{
+		EventID:           event.ID,
+		Type:              event.Type,
+		ProviderPaymentID: event.PaymentID,
+		Status:            event.Status,
+		FailureReason:     event.FailureReason,
+	}, nil
+}
+
+func hmacSHA256Hex(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// processWebhookEvent applies a stored event to its payment and session in
+// one transaction. Processed and ignored events are left untouched.
+func processWebhookEvent(eventID uint) error {
+	var processErr error
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var event WebhookEvent
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&event, eventID).Error; err != nil {
+			return err
+		}
+		if event.Status == WebhookStatusProcessed || event.Status == WebhookStatusIgnored {
+			return nil
+		}
+
+		provider, ok := paymentProviders[event.Provider]
+		webhookProvider, hooks := provider.(WebhookProvider)
+		if !ok || !hooks {
+			processErr = fmt.Errorf("provider %s does not accept webhooks", event.Provider)
+		}
+
+		var parsed *PaymentWebhookEvent
+		if processErr == nil {
+			parsed, processErr = webhookProvider.ParseWebhook([]byte(event.Payload))
+		}
+
+		now := time.Now()
+		event.Attempts++
+		if processErr == nil {
+			if parsed.Status == "" {
+				event.Status = WebhookStatusIgnored
+				event.ProcessedAt = &now
+				return tx.Save(&event).Error
+			}
+			processErr = tx.Transaction(func(tx *gorm.DB) error {
+				var payment Payment
+				if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+					Where("provider = ? AND provider_payment_id = ?", event.Provider, parsed.ProviderPaymentID).
+					First(&payment).Error; err != nil {
+					return fmt.Errorf("payment %s: %w", parsed.ProviderPaymentID, err)
+				}
+				return applyPaymentStatus(tx, &payment, parsed.Status, parsed.FailureReason)
+			})
+		}
+
+		// A stale status (e.g. "pending" after "completed") is not an error worth replaying
+		if errors.Is(processErr, errInvalidPaymentTransition) {
+			log.Printf("Ignoring webhook event %d: %v", event.ID, processErr)
+			processErr = nil
+		}
+
+		if processErr != nil {
+			event.Status = WebhookStatusFailed
+			event.LastError = processErr.Error()
+		} else {
+			event.Status = WebhookStatusProcessed
+			event.LastError = ""
+			event.ProcessedAt = &now
+		}
+		return tx.Save(&event).Error
+	})
+	if err != nil {
+		return err
+	}
+	return processErr
+}
+
+// Handlers
+func paymentWebhook(c *gin.Context) {
+	providerName := c.Param("provider")
+	provider, ok := paymentProviders[providerName]
+	webhookProvider, hooks := provider.(WebhookProvider)
+	if !ok || !hooks {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Unknown payment provider",
+		})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Failed to read body",
+		})
+		return
+	}
+
+	if err := webhookProvider.VerifyWebhook(c.Request, c.ClientIP(), body); err != nil {
+		log.Printf("Rejected %s webhook from %s: %v", providerName, c.ClientIP(), err)
+		c.JSON(http.StatusUnauthorized, ApiResponse{
+			Success: false,
+			Error:   "Invalid signature",
+		})
+		return
+	}
+
+	parsed, err := webhookProvider.ParseWebhook(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid payload: " + err.Error(),
+		})
+		return
+	}
+
+	// Deduplicate by provider event ID
+	event := WebhookEvent{
+		Provider:          providerName,
+		EventID:           parsed.EventID,
+		EventType:         parsed.Type,
+		ProviderPaymentID: parsed.ProviderPaymentID,
+		Payload:           string(body),
+		Status:            WebhookStatusReceived,
+	}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to store event",
+		})
+		return
+	}
+	if result.RowsAffected == 0 {
+		db.Where("provider = ? AND event_id = ?", providerName, parsed.EventID).First(&event)
+	}
+
+	// Failures stay in the inbox for replay, the provider need not retry
+	if err := processWebhookEvent(event.ID); err != nil {
+		log.Printf("Failed to process webhook event %d: %v", event.ID, err)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+	})
+}
+
+func getWebhookEvents(c *gin.Context) {
+	limit := cursorLimit(c, 50, 200)
+	query := db.Model(&WebhookEvent{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if provider := c.Query("provider"); provider != "" {
+		query = query.Where("provider = ?", provider)
+	}
+
+	query, err := paginateByID(query, c, "webhook_events", limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Неверный курсор",
+		})
+		return
+	}
+
+	var events []WebhookEvent
+	if err := query.Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Ошибка при загрузке событий",
+		})
+		return
+	}
+
+	events, meta := pageByID(events, limit, func(e WebhookEvent) uint { return e.ID })
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    events,
+		Meta:    meta,
+	})
+}
+
+func replayWebhookEvent(c *gin.Context) {
+	var event WebhookEvent
+	if err := db.First(&event, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Событие не найдено",
+		})
+		return
+	}
+
+	processErr := processWebhookEvent(event.ID)
+	db.First(&event, event.ID)
+	if processErr != nil {
+		c.JSON(http.StatusUnprocessableEntity, ApiResponse{
+			Success: false,
+			Data:    event,
+			Error:   "Не удалось обработать событие: " + processErr.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    event,
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stripeSignatureHeader(secret string, timestamp time.Time, body string) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + ts + ",v1=" + hmacSHA256Hex(secret, ts+"."+body)
+}
+
+func TestStripeVerifyWebhook(t *testing.T) {
+	provider := &StripeProvider{WebhookSecret: "whsec_test"}
+	body := `{"id":"evt_1","type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","status":"succeeded"}}}`
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		header  string
+		body    string
+		wantErr bool
+	}{
+		{"valid", stripeSignatureHeader("whsec_test", now, body), body, false},
+		{"within tolerance", stripeSignatureHeader("whsec_test", now.Add(-4*time.Minute), body), body, false},
+		{"rotated secret", stripeSignatureHeader("whsec_test", now, body) + ",v1=" + hmacSHA256Hex("whsec_old", "x"), body, false},
+		{"tampered body", stripeSignatureHeader("whsec_test", now, body), strings.Replace(body, "pi_1", "pi_2", 1), true},
+		{"wrong secret", stripeSignatureHeader("whsec_other", now, body), body, true},
+		{"stale timestamp", stripeSignatureHeader("whsec_test", now.Add(-10*time.Minute), body), body, true},
+		{"future timestamp", stripeSignatureHeader("whsec_test", now.Add(10*time.Minute), body), body, true},
+		{"signature without timestamp", "v1=" + hmacSHA256Hex("whsec_test", body), body, true},
+		{"missing header", "", body, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/webhooks/payments/stripe", strings.NewReader(tt.body))
+			if tt.header != "" {
+				r.Header.Set("Stripe-Signature", tt.header)
+			}
+			if err := provider.VerifyWebhook(r, "203.0.113.1", []byte(tt.body)); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("no secret configured", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "/webhooks/payments/stripe", strings.NewReader(body))
+		r.Header.Set("Stripe-Signature", stripeSignatureHeader("", now, body))
+		if err := (&StripeProvider{}).VerifyWebhook(r, "203.0.113.1", []byte(body)); err == nil {
+			t.Error("VerifyWebhook() accepted a callback without a configured secret")
+		}
+	})
+}
+
+func TestYooKassaVerifyWebhook(t *testing.T) {
+	provider := &YooKassaProvider{WebhookIPs: parseCIDRList(defaultYooKassaWebhookIPs)}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"185.71.76.1", true},
+		{"185.71.76.31", true},
+		{"185.71.76.32", false},
+		{"77.75.156.11", true},
+		{"77.75.156.12", false},
+		{"77.75.154.200", true},
+		{"2a02:5180::1", true},
+		{"2a02:5181::1", false},
+		{"8.8.8.8", false},
+		{"127.0.0.1", false},
+		{"", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/webhooks/payments/yookassa", nil)
+			if err := provider.VerifyWebhook(r, tt.ip, nil); (err == nil) != tt.allowed {
+				t.Errorf("VerifyWebhook(%q) error = %v, want allowed = %v", tt.ip, err, tt.allowed)
+			}
+		})
+	}
+}
+
+// Callbacks are deduplicated by the event ID the providers parse out, so a
+// redelivered callback must give the same ID and a different event another one
+func TestWebhookEventIDs(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider WebhookProvider
+		body     string
+		eventID  string
+		status   string
+	}{
+		{"yookassa succeeded", &YooKassaProvider{},
+			`{"event":"payment.succeeded","object":{"id":"2d8c","status":"succeeded"}}`, "payment.succeeded:2d8c", PaymentStatusCompleted},
+		{"yookassa canceled", &YooKassaProvider{},
+			`{"event":"payment.canceled","object":{"id":"2d8c","status":"canceled","cancellation_details":{"reason":"expired_on_confirmation"}}}`,
+			"payment.canceled:2d8c", PaymentStatusFailed},
+		{"stripe succeeded", &StripeProvider{},
+			`{"id":"evt_1","type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","status":"succeeded"}}}`, "evt_1", PaymentStatusCompleted},
+		{"stripe redelivered as a new event", &StripeProvider{},
+			`{"id":"evt_2","type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","status":"succeeded"}}}`, "evt_2", PaymentStatusCompleted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, err := tt.provider.ParseWebhook([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := tt.provider.ParseWebhook([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.EventID != tt.eventID || again.EventID != first.EventID {
+				t.Errorf("event IDs = %q, %q, want %q", first.EventID, again.EventID, tt.eventID)
+			}
+			if first.Status != tt.status {
+				t.Errorf("status = %q, want %q", first.Status, tt.status)
+			}
+		})
+	}
+
+	for _, provider := range []WebhookProvider{&YooKassaProvider{}, &StripeProvider{}, NewFakeProvider()} {
+		if _, err := provider.ParseWebhook([]byte(`{"type":"payment.succeeded"}`)); err == nil {
+			t.Errorf("%T accepted an event without an ID", provider)
+		}
+	}
+}
+
+func TestFakeProviderWebhook(t *testing.T) {
+	provider := NewFakeProvider()
+	provider.WebhookSecret = "secret"
+	body := []byte(`{"id":"evt_1","type":"payment.succeeded","payment_id":"fake_1","status":"completed"}`)
+
+	tests := []struct {
+		name      string
+		signature string
+		wantErr   bool
+	}{
+		{"valid", hmacSHA256Hex("secret", string(body)), false},
+		{"wrong secret", hmacSHA256Hex("other", string(body)), true},
+		{"missing", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/webhooks/payments/fake", strings.NewReader(string(body)))
+			r.Header.Set("X-Webhook-Signature", tt.signature)
+			if err := provider.VerifyWebhook(r, "127.0.0.1", body); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	event, err := provider.ParseWebhook(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.EventID != "evt_1" || event.ProviderPaymentID != "fake_1" || event.Status != PaymentStatusCompleted {
+		t.Errorf("ParseWebhook() = %+v", event)
+	}
+}
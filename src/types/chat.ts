@@ -2,11 +2,15 @@ import { BaseEntity } from './common';
 import { User } from './user';
 
 export interface ChatRoom extends BaseEntity {
+    client_id: number;
+    therapist_id: number;
     session_id?: number;
     participants: User[];
+    presence: ChatPresence[];
     last_message?: ChatMessage;
     unread_count: number;
     is_active: boolean;
+    last_message_at?: string;
 }
 
 export interface ChatMessage extends BaseEntity {
@@ -21,4 +25,17 @@ export interface ChatMessage extends BaseEntity {
     deleted_at?: string;
 }
 
-export type MessageType = 'text' | 'image' | 'file' | 'system';
\ No newline at end of file
+export type MessageType = 'text' | 'image' | 'file' | 'system';
+
+export interface ChatPresence {
+    user_id: number;
+    online: boolean;
+    last_seen_at?: string;
+}
+
+export interface ChatReadReceipt {
+    room_id: number;
+    user_id: number;
+    message_id: number;
+    read_at: string;
+}
@@ -8,12 +8,15 @@ export interface Notification extends BaseEntity {
     read_at?: string;
     action_url?: string;
     action_text?: string;
+    data?: Record<string, unknown>;
 }
 
 export type NotificationType =
     | 'session_reminder'
+    | 'session_booked'
     | 'session_confirmed'
     | 'session_cancelled'
+    | 'session_rescheduled'
     | 'session_completed'
     | 'payment_success'
     | 'payment_failed'
@@ -28,4 +31,7 @@ export interface NotificationPreferences {
     session_reminders: boolean;
     payment_notifications: boolean;
     marketing_emails: boolean;
+    quiet_hours_start?: string;
+    quiet_hours_end?: string;
+    timezone?: string;
 }
\ No newline at end of file
@@ -6,6 +6,7 @@ export interface User extends BaseEntity {
     phone?: string;
     role: 'client' | 'therapist' | 'admin';
     avatar?: string;
+    language?: 'ru' | 'en';
     email_verified_at?: string;
     profile?: UserProfile;
 }